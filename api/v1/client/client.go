@@ -0,0 +1,345 @@
+// Package client provides a Go client for the wurzel v1 REST API.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+const apiPrefix = "/api/v1"
+
+// AllProcesses as the limit of v1.ProcessListOptions lists every matching
+// process. A limit of 0 lists a page of the daemon's default size.
+const AllProcesses = -1
+
+// Client talks to a single wurzel daemon.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+// Error is returned when the daemon responds with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("wurzel API error (status %d): %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if err is an API error caused by a missing resource.
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// New returns a client for the daemon listening at baseURL, e.g.
+// http://localhost:8080. If httpClient is nil, http.DefaultClient is used.
+func New(baseURL string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid wurzel API URL %s", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{baseURL: u, httpClient: httpClient}, nil
+}
+
+// Subsystems returns the cgroup subsystems watched by the daemon.
+func (c *Client) Subsystems() ([]v1.Subsystem, error) {
+	var subsystems []v1.Subsystem
+	err := c.get("/cgroups", nil, &subsystems)
+	return subsystems, err
+}
+
+// Cgroup returns the cgroup at path, relative to the subsystem mount point.
+func (c *Client) Cgroup(subsystem, path string) (*v1.Cgroup, error) {
+	cg := &v1.Cgroup{}
+	err := c.get("/cgroups/"+subsystem+"/"+strings.TrimPrefix(path, "/"), nil, cg)
+	if err != nil {
+		return nil, err
+	}
+	return cg, nil
+}
+
+// Node returns info about the node's CPU, memory, etc.
+func (c *Client) Node() (*v1.Node, error) {
+	n := &v1.Node{}
+	err := c.get("/node", nil, n)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// NodeCPUInfo returns information about the CPUs on the node.
+func (c *Client) NodeCPUInfo() ([]v1.NodeCPUInfo, error) {
+	var info []v1.NodeCPUInfo
+	err := c.get("/node/cpuinfo", nil, &info)
+	return info, err
+}
+
+// NodeCPUTime returns the times each CPU of the node has been in use.
+func (c *Client) NodeCPUTime() ([]v1.CPUTime, error) {
+	var times []v1.CPUTime
+	err := c.get("/node/cputime", nil, &times)
+	return times, err
+}
+
+// NodeCPUUtilization returns the utilization of each CPU of the node since the
+// previous call by any client of the daemon.
+func (c *Client) NodeCPUUtilization() ([]v1.CPUUtilization, error) {
+	var utilization []v1.CPUUtilization
+	err := c.get("/node/cpuutilization", nil, &utilization)
+	return utilization, err
+}
+
+// NodeMemory returns info on the current state of the node's memory.
+func (c *Client) NodeMemory() (*v1.NodeMemory, error) {
+	mem := &v1.NodeMemory{}
+	err := c.get("/node/memory", nil, mem)
+	if err != nil {
+		return nil, err
+	}
+	return mem, nil
+}
+
+// NodeSwap returns info on the current state of the node's swap.
+func (c *Client) NodeSwap() (*v1.NodeSwap, error) {
+	swap := &v1.NodeSwap{}
+	err := c.get("/node/swap", nil, swap)
+	if err != nil {
+		return nil, err
+	}
+	return swap, nil
+}
+
+// Processes returns a page of the processes matching opts. If opts.Limit is 0
+// the page has the daemon's default size, and if AllProcesses every matching
+// process is returned.
+func (c *Client) Processes(opts v1.ProcessListOptions) (*v1.ProcessList, error) {
+	list := &v1.ProcessList{}
+	err := c.get("/processes", processListQuery(opts), list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// CgroupProcesses returns a page of the processes in the cgroup at path
+// matching opts, including the processes of all cgroups below it if recursive
+// is set.
+func (c *Client) CgroupProcesses(subsystem, path string, recursive bool, opts v1.ProcessListOptions) (*v1.ProcessList, error) {
+	q := processListQuery(opts)
+	if recursive {
+		q.Set("recursive", "true")
+	}
+
+	list := &v1.ProcessList{}
+	err := c.get(strings.TrimSuffix("/cgroups/"+subsystem+"/"+strings.Trim(path, "/"), "/")+"/processes", q, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func processListQuery(opts v1.ProcessListOptions) url.Values {
+	q := url.Values{}
+	if opts.Name != "" {
+		q.Set("name", opts.Name)
+	}
+	if opts.UID != nil {
+		q.Set("uid", strconv.Itoa(int(*opts.UID)))
+	}
+	if opts.Status != "" {
+		q.Set("status", opts.Status)
+	}
+	if opts.SortBy != "" {
+		q.Set("sort", opts.SortBy)
+	}
+	if opts.Offset != 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	switch {
+	case opts.Limit == AllProcesses:
+		// The daemon lists every process for a limit of 0.
+		q.Set("limit", "0")
+	case opts.Limit != 0:
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cgroups {
+		q.Set("cgroups", "true")
+	}
+	return q
+}
+
+// Process returns information about a single process.
+func (c *Client) Process(pid int32) (*v1.Process, error) {
+	p := &v1.Process{}
+	err := c.get("/processes/"+strconv.Itoa(int(pid)), nil, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ProcessCgroups returns the cgroups a process belongs to in every watched
+// subsystem.
+func (c *Client) ProcessCgroups(pid int32) ([]v1.ProcessCgroup, error) {
+	var cgroups []v1.ProcessCgroup
+	err := c.get("/processes/"+strconv.Itoa(int(pid))+"/cgroups", nil, &cgroups)
+	if err != nil {
+		return nil, err
+	}
+	return cgroups, nil
+}
+
+// Events returns the cgroup lifecycle events after the given sequence number.
+// If there are none, the daemon waits up to timeout for new events; a timeout
+// of 0 returns immediately.
+func (c *Client) Events(since uint64, timeout time.Duration) (*v1.EventList, error) {
+	q := url.Values{}
+	q.Set("since", strconv.FormatUint(since, 10))
+	q.Set("timeout", timeout.String())
+
+	list := &v1.EventList{}
+	err := c.get("/events", q, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Pods returns the cgroups of Kubernetes pods grouped by pod, optionally
+// restricted to a namespace and/or pod name.
+func (c *Client) Pods(namespace, name string) ([]v1.PodCgroups, error) {
+	q := url.Values{}
+	if namespace != "" {
+		q.Set("namespace", namespace)
+	}
+	if name != "" {
+		q.Set("pod", name)
+	}
+
+	var pods []v1.PodCgroups
+	err := c.get("/pods", q, &pods)
+	if err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+// Units returns the stats of systemd units aggregated over their cgroups,
+// optionally restricted to units of a type (e.g. service) and/or placed in a
+// slice, and sorted by name, memory or cpu.
+func (c *Client) Units(typ, slice, sortBy string) ([]v1.UnitStats, error) {
+	q := url.Values{}
+	if typ != "" {
+		q.Set("type", typ)
+	}
+	if slice != "" {
+		q.Set("slice", slice)
+	}
+	if sortBy != "" {
+		q.Set("sort", sortBy)
+	}
+
+	var units []v1.UnitStats
+	err := c.get("/units", q, &units)
+	if err != nil {
+		return nil, err
+	}
+	return units, nil
+}
+
+// QueryRange returns the recorded history of the series matching q.
+func (c *Client) QueryRange(q v1.RangeQuery) (*v1.RangeResult, error) {
+	query := url.Values{"series": q.Series}
+	if len(q.Values) > 0 {
+		query.Set("values", strings.Join(q.Values, ","))
+	}
+	if !q.Start.IsZero() {
+		query.Set("start", q.Start.Format(time.RFC3339Nano))
+	}
+	if !q.End.IsZero() {
+		query.Set("end", q.End.Format(time.RFC3339Nano))
+	}
+	if q.Step > 0 {
+		query.Set("step", q.Step.String())
+	}
+
+	result := &v1.RangeResult{}
+	err := c.get("/query_range", query, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Exited returns the most recently removed cgroups with the latest stats
+// collected for them, most recently removed first, optionally restricted to
+// cgroups of a subsystem and/or at or below a path.
+func (c *Client) Exited(subsystem, path string) ([]v1.ExitedCgroup, error) {
+	q := url.Values{}
+	if subsystem != "" {
+		q.Set("subsystem", subsystem)
+	}
+	if path != "" {
+		q.Set("path", path)
+	}
+
+	var exited []v1.ExitedCgroup
+	err := c.get("/exited", q, &exited)
+	if err != nil {
+		return nil, err
+	}
+	return exited, nil
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	u := *c.baseURL
+	u.Path = u.Path + apiPrefix + path
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (c *Client) get(path string, query url.Values, into interface{}) error {
+	resp, err := c.httpClient.Get(c.url(path, query))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	apiErr := &v1.Error{}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: apiErr.Message}
+}
@@ -0,0 +1,285 @@
+package client
+
+import (
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/daemon"
+)
+
+// fakeWatcher implements the parts of cgroup.Watcher used by the API; other
+// methods panic.
+type fakeWatcher struct {
+	cgroup.Watcher
+	stats  chan *v1.StatsUpdate
+	events []v1.Event
+}
+
+func (f *fakeWatcher) Subsystems() []v1.Subsystem {
+	return []v1.Subsystem{{Name: "memory", Mountpoint: "/sys/fs/cgroup/memory"}}
+}
+
+func (f *fakeWatcher) Lookup(subsystem, path string) (*v1.Cgroup, bool) {
+	if subsystem != "memory" || path != "docker/abc" {
+		return nil, false
+	}
+	return testCgroup, true
+}
+
+func (f *fakeWatcher) SubscribeStats() (<-chan *v1.StatsUpdate, func()) {
+	return f.stats, func() {}
+}
+
+func (f *fakeWatcher) Events(since uint64) *v1.EventList {
+	list := &v1.EventList{Events: []v1.Event{}}
+	for _, e := range f.events {
+		if e.Sequence > since {
+			list.Events = append(list.Events, e)
+		}
+		list.LastSequence = e.Sequence
+	}
+	return list
+}
+
+func (f *fakeWatcher) SubscribeEvents(since uint64) (<-chan *v1.Event, func()) {
+	ch := make(chan *v1.Event, len(f.events))
+	for i := range f.events {
+		if f.events[i].Sequence > since {
+			ch <- &f.events[i]
+		}
+	}
+	return ch, func() {}
+}
+
+var testCgroup = &v1.Cgroup{
+	Name:      "abc",
+	Subsystem: "memory",
+	Path:      "/docker/abc",
+	Stats:     &v1.Stats{MemoryStats: &v1.MemoryStats{Cache: 42}},
+	Pids:      []int32{100},
+	Children:  []string{},
+}
+
+func newTestClient(t *testing.T) (*Client, func()) {
+	c, _, done := newTestClientWithWatcher(t)
+	return c, done
+}
+
+func newTestClientWithWatcher(t *testing.T) (*Client, *fakeWatcher, func()) {
+	w := &fakeWatcher{stats: make(chan *v1.StatsUpdate, 1)}
+	srv := httptest.NewServer(daemon.NewAPIHandler(w, nil, nil))
+	c, err := New(srv.URL+"/", nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return c, w, srv.Close
+}
+
+func TestNew(t *testing.T) {
+	for _, u := range []string{"", "localhost:8080", "://"} {
+		_, err := New(u, nil)
+		if err == nil {
+			t.Errorf("expected error for URL %q", u)
+		}
+	}
+}
+
+func TestCgroups(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	subsystems, err := c.Subsystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subsystems) != 1 || subsystems[0].Name != "memory" {
+		t.Errorf("unexpected subsystems: %#v", subsystems)
+	}
+
+	cg, err := c.Cgroup("memory", "/docker/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cg, testCgroup) {
+		t.Errorf("expected %#v, got %#v", testCgroup, cg)
+	}
+
+	_, err = c.Cgroup("memory", "/docker/missing")
+	if !IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestNode(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	n, err := c.Node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Memory == nil || n.Memory.Total == 0 {
+		t.Errorf("could not get Node stats: %#v", n)
+	}
+
+	info, err := c.NodeCPUInfo()
+	if err != nil || len(info) == 0 {
+		t.Errorf("could not get CPU info: %v", err)
+	}
+
+	times, err := c.NodeCPUTime()
+	if err != nil || len(times) == 0 {
+		t.Errorf("could not get CPU time: %v", err)
+	}
+
+	utilization, err := c.NodeCPUUtilization()
+	if err != nil || len(utilization) == 0 {
+		t.Errorf("could not get CPU utilization: %v", err)
+	}
+
+	mem, err := c.NodeMemory()
+	if err != nil || mem.Total == 0 {
+		t.Errorf("could not get Memory stats: %v", err)
+	}
+
+	_, err = c.NodeSwap()
+	if err != nil {
+		t.Errorf("could not get Swap stats: %v", err)
+	}
+}
+
+func TestProcesses(t *testing.T) {
+	c, done := newTestClient(t)
+	defer done()
+
+	pid := int32(os.Getpid())
+	self, err := c.Process(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.Pid != pid {
+		t.Errorf("unexpected process: %#v", self)
+	}
+
+	uid := int32(os.Getuid())
+	list, err := c.Processes(v1.ProcessListOptions{Name: self.Name, UID: &uid, SortBy: v1.SortByCPU, Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total == 0 || len(list.Processes) == 0 || len(list.Processes) > 5 {
+		t.Errorf("unexpected process list: %#v", list)
+	}
+	for _, p := range list.Processes {
+		if p.Name != self.Name {
+			t.Errorf("unexpected process: %#v", p)
+		}
+	}
+
+	// A limit of 0 leaves the page size to the daemon, AllProcesses lists
+	// every matching process.
+	if q := processListQuery(v1.ProcessListOptions{}); q["limit"] != nil {
+		t.Errorf("expected no limit to be sent, got %q", q.Get("limit"))
+	}
+	if got := processListQuery(v1.ProcessListOptions{Limit: AllProcesses}).Get("limit"); got != "0" {
+		t.Errorf("expected limit 0 to be sent, got %q", got)
+	}
+
+	_, err = c.Processes(v1.ProcessListOptions{SortBy: "bogus"})
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != 400 || apiErr.Message == "" {
+		t.Errorf("expected bad request error, got %v", err)
+	}
+
+	_, err = c.Process(-1)
+	if !IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	list, err = c.CgroupProcesses("memory", "/docker/abc", true, v1.ProcessListOptions{Name: "no-such-process"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 0 || len(list.Processes) != 0 {
+		t.Errorf("unexpected cgroup process list: %#v", list)
+	}
+
+	_, err = c.CgroupProcesses("memory", "/docker/missing", false, v1.ProcessListOptions{})
+	if !IsNotFound(err) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	cgroups, err := c.ProcessCgroups(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cgroups) != 1 || cgroups[0].Subsystem != "memory" || cgroups[0].Path == "" {
+		t.Errorf("unexpected process cgroups: %#v", cgroups)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	c, w, done := newTestClientWithWatcher(t)
+	defer done()
+
+	s, err := c.StreamStats("memory", "/docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.stats <- &v1.StatsUpdate{Cgroups: []v1.Cgroup{*testCgroup, {Subsystem: "memory", Path: "/other"}}}
+
+	update, ok := <-s.Updates
+	if !ok {
+		t.Fatalf("stream ended: %v", s.Err())
+	}
+	if len(update.Cgroups) != 1 || !reflect.DeepEqual(&update.Cgroups[0], testCgroup) {
+		t.Errorf("unexpected update %#v", update)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range s.Updates {
+	}
+	if s.Err() != nil {
+		t.Errorf("unexpected stream error %v", s.Err())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c, w, done := newTestClientWithWatcher(t)
+	defer done()
+	w.events = []v1.Event{
+		{Sequence: 1, Type: v1.EventCgroupCreated, Subsystems: []string{"memory"}, Path: "/docker/abc"},
+		{Sequence: 2, Type: v1.EventCgroupRemoved, Subsystems: []string{"memory"}, Path: "/docker/abc"},
+	}
+
+	list, err := c.Events(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Events) != 1 || !reflect.DeepEqual(list.Events[0], w.events[1]) || list.LastSequence != 2 {
+		t.Errorf("unexpected event list %#v", list)
+	}
+
+	s, err := c.StreamEvents(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, want := range w.events {
+		e, ok := <-s.Events
+		if !ok {
+			t.Fatalf("stream ended: %v", s.Err())
+		}
+		if !reflect.DeepEqual(*e, want) {
+			t.Errorf("expected %#v, got %#v", want, *e)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// stream reads Server-Sent Events from a streaming API response.
+type stream struct {
+	body    io.ReadCloser
+	errMu   sync.Mutex
+	err     error
+	closing chan struct{}
+	once    sync.Once
+}
+
+// Close ends the stream.
+func (s *stream) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closing)
+		err = s.body.Close()
+	})
+	return err
+}
+
+// Err returns the error that ended the stream, if any.
+func (s *stream) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+func (s *stream) setErr(err error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	select {
+	case <-s.closing:
+		// Errors caused by closing the stream are expected.
+	default:
+		s.err = err
+	}
+}
+
+// read decodes the data of each event into a value returned by newValue and
+// passes it to send until send returns false or the stream ends.
+func (s *stream) read(newValue func() interface{}, send func(v interface{}) bool) {
+	err := readEvents(s.body, func(data []byte) bool {
+		v := newValue()
+		if err := json.Unmarshal(data, v); err != nil {
+			s.setErr(err)
+			return false
+		}
+		return send(v)
+	})
+	if err != nil {
+		s.setErr(err)
+	}
+}
+
+func (c *Client) openStream(path string, query url.Values, header http.Header) (*stream, error) {
+	req, err := http.NewRequest("GET", c.url(path, query), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return &stream{body: resp.Body, closing: make(chan struct{})}, nil
+}
+
+// StatsStream receives the cgroup stats updates pushed by the daemon after
+// each collection round.
+type StatsStream struct {
+	*stream
+	// Updates is closed when the stream ends; Err then reports why.
+	Updates <-chan *v1.StatsUpdate
+}
+
+// StreamStats subscribes to stats updates, optionally restricted to a single
+// subsystem and/or cgroup subtree. Empty values match everything.
+func (c *Client) StreamStats(subsystem, path string) (*StatsStream, error) {
+	q := url.Values{}
+	if subsystem != "" {
+		q.Set("subsystem", subsystem)
+	}
+	if path != "" {
+		q.Set("path", path)
+	}
+
+	s, err := c.openStream("/stream", q, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(chan *v1.StatsUpdate)
+	go func() {
+		defer close(updates)
+		s.read(func() interface{} { return &v1.StatsUpdate{} }, func(v interface{}) bool {
+			select {
+			case updates <- v.(*v1.StatsUpdate):
+				return true
+			case <-s.closing:
+				return false
+			}
+		})
+	}()
+
+	return &StatsStream{stream: s, Updates: updates}, nil
+}
+
+// EventStream receives cgroup lifecycle events pushed by the daemon.
+type EventStream struct {
+	*stream
+	// Events is closed when the stream ends; Err then reports why. To resume,
+	// call StreamEvents with the sequence number of the last event received.
+	Events <-chan *v1.Event
+}
+
+// StreamEvents subscribes to cgroup lifecycle events, starting with any
+// events buffered by the daemon after the given sequence number.
+func (c *Client) StreamEvents(since uint64) (*EventStream, error) {
+	header := http.Header{}
+	if since > 0 {
+		header.Set("Last-Event-ID", strconv.FormatUint(since, 10))
+	}
+
+	s, err := c.openStream("/events/stream", nil, header)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan *v1.Event)
+	go func() {
+		defer close(events)
+		s.read(func() interface{} { return &v1.Event{} }, func(v interface{}) bool {
+			select {
+			case events <- v.(*v1.Event):
+				return true
+			case <-s.closing:
+				return false
+			}
+		})
+	}()
+
+	return &EventStream{stream: s, Events: events}, nil
+}
+
+// readEvents parses Server-Sent Events from r, calling handle with the data of
+// each event until handle returns false or r is exhausted.
+func readEvents(r io.Reader, handle func(data []byte) bool) error {
+	br := bufio.NewReader(r)
+	var data []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if len(data) > 0 && !handle(data) {
+				return nil
+			}
+			data = nil
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" "))...)
+		}
+	}
+}
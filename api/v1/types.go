@@ -1,11 +1,13 @@
 package v1
 
+import "time"
+
 // Node holds the overall node information.
 type Node struct {
 	CPUInfo []NodeCPUInfo `json:"cpuinfo"`
 	CPUTime []CPUTime     `json:"cputime"`
 	Memory  *NodeMemory   `json:"memory"`
-	Swap    *NodeSwap     `json:"memory"`
+	Swap    *NodeSwap     `json:"swap"`
 }
 
 // NodeCPUInfo holds info about the node's CPUs.
@@ -55,6 +57,22 @@ type NodeMemory struct {
 	Shared      uint64  `json:"shared"`
 }
 
+// CPUUtilization holds the percentage of time a CPU of the node spent in each
+// state since the previous sample.
+type CPUUtilization struct {
+	CPU string `json:"cpu"`
+	// time spent neither idle nor waiting for IO
+	Busy    float64 `json:"busy"`
+	User    float64 `json:"user"`
+	System  float64 `json:"system"`
+	Nice    float64 `json:"nice"`
+	Iowait  float64 `json:"iowait"`
+	Irq     float64 `json:"irq"`
+	Softirq float64 `json:"softirq"`
+	Steal   float64 `json:"steal"`
+	Idle    float64 `json:"idle"`
+}
+
 // NodeSwap holds info on the current state of the node's swap.
 type NodeSwap struct {
 	Total       uint64  `json:"total"`
@@ -77,6 +95,58 @@ type Process struct {
 	Memory   *ProcessMemory   `json:"memory"`
 	MemoryEx *ProcessMemoryEx `json:"memoryex,omitempty"`
 	CPUTime  *CPUTime         `json:"cputime"`
+	// CPU used between the daemon's two latest samples of the process, as a
+	// percentage of a single core
+	CPUPercent float64 `json:"cpu_percent,omitempty"`
+	// cgroups the process belongs to, only if requested
+	Cgroups []ProcessCgroup `json:"cgroups,omitempty"`
+}
+
+// ProcessCgroup is a cgroup a process belongs to, with any metadata known
+// about the cgroup.
+type ProcessCgroup struct {
+	Subsystem string     `json:"subsystem"`
+	Path      string     `json:"path"`
+	Container *Container `json:"container,omitempty"`
+	Pod       *Pod       `json:"pod,omitempty"`
+	Unit      *Unit      `json:"unit,omitempty"`
+}
+
+// Process list sort orders.
+const (
+	SortByPID = "pid"
+	SortByCPU = "cpu"
+	SortByRSS = "rss"
+)
+
+// ProcessListOptions filters, sorts and paginates a process listing.
+type ProcessListOptions struct {
+	// only return processes with this name
+	Name string
+	// only return processes with this real or effective uid
+	UID *int32
+	// only return processes in this status, e.g. running or sleeping
+	Status string
+	// one of SortByPID (default), SortByCPU or SortByRSS
+	SortBy string
+	// number of matching processes to skip
+	Offset int
+	// maximum number of processes to return, 0 for all
+	Limit int
+	// include the cgroups of each process, as listed in /proc/<pid>/cgroup
+	// with the unified hierarchy's subsystem empty. The API lists the
+	// watched subsystems instead, with the metadata of their cgroups.
+	Cgroups bool
+}
+
+// ProcessList holds a single page of a process listing.
+type ProcessList struct {
+	// total number of processes matching the filters. Unless sorted by CPU
+	// or memory, processes exiting while being listed are only left out if
+	// they were to be on the returned page.
+	Total     int       `json:"total"`
+	Offset    int       `json:"offset"`
+	Processes []Process `json:"processes"`
 }
 
 // ProcessMemory holds memory info related to a single process.
@@ -180,6 +250,150 @@ type HugetlbStats struct {
 	Failcnt uint64 `json:"failcnt"`
 }
 
+// PidsStats holds stats on the number of processes.
+type PidsStats struct {
+	// number of pids in the cgroup
+	Current uint64 `json:"current,omitempty"`
+	// maximum number of pids allowed, 0 if unlimited
+	Limit uint64 `json:"limit,omitempty"`
+}
+
+// PressureData holds pressure stall information for one class of stall.
+type PressureData struct {
+	// percentage of time stalled, averaged over 10, 60 and 300 seconds
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	// total stall time.
+	// Units: microseconds.
+	Total uint64 `json:"total"`
+}
+
+// PressureStats holds pressure stall information for a resource, only
+// available on the unified hierarchy.
+type PressureStats struct {
+	// time some tasks were stalled on the resource
+	Some PressureData `json:"some"`
+	// time all tasks were stalled on the resource, not reported for CPU on
+	// older kernels
+	Full *PressureData `json:"full,omitempty"`
+}
+
+// MemoryLimits holds the configured memory limits in bytes, 0 if unlimited.
+type MemoryLimits struct {
+	Limit     uint64 `json:"limit"`
+	SoftLimit uint64 `json:"soft_limit"`
+	// limit of memory + swap
+	SwapLimit uint64 `json:"swap_limit"`
+}
+
+// CPULimits holds the configured CPU bandwidth and shares.
+type CPULimits struct {
+	// CFS quota per period in microseconds, -1 if unlimited
+	Quota  int64  `json:"quota"`
+	Period uint64 `json:"period"`
+	Shares uint64 `json:"shares"`
+	// number of CPUs the quota allows, 0 if unlimited
+	Cores float64 `json:"cores"`
+}
+
+// BlkioDeviceValue holds a per-device blkio setting.
+type BlkioDeviceValue struct {
+	Major uint64 `json:"major"`
+	Minor uint64 `json:"minor"`
+	Value uint64 `json:"value"`
+}
+
+// BlkioLimits holds the configured blkio weights and throttling.
+type BlkioLimits struct {
+	Weight          uint64             `json:"weight"`
+	WeightDevice    []BlkioDeviceValue `json:"weight_device,omitempty"`
+	ReadBpsDevice   []BlkioDeviceValue `json:"read_bps_device,omitempty"`
+	WriteBpsDevice  []BlkioDeviceValue `json:"write_bps_device,omitempty"`
+	ReadIOPSDevice  []BlkioDeviceValue `json:"read_iops_device,omitempty"`
+	WriteIOPSDevice []BlkioDeviceValue `json:"write_iops_device,omitempty"`
+}
+
+// Limits holds the limits a cgroup is configured with.
+type Limits struct {
+	Memory *MemoryLimits `json:"memory,omitempty"`
+	CPU    *CPULimits    `json:"cpu,omitempty"`
+	Blkio  *BlkioLimits  `json:"blkio,omitempty"`
+	// the map is in the format "size of hugepage: limit in bytes", 0 if
+	// unlimited
+	Hugetlb map[string]uint64 `json:"hugetlb,omitempty"`
+}
+
+// Saturation holds usage as a ratio of the configured limits, omitted if
+// unlimited.
+type Saturation struct {
+	Memory     float64            `json:"memory,omitempty"`
+	MemorySwap float64            `json:"memory_swap,omitempty"`
+	Pids       float64            `json:"pids,omitempty"`
+	Hugetlb    map[string]float64 `json:"hugetlb,omitempty"`
+}
+
+// Rates holds rates derived from the difference between the latest and the
+// previous stats of a cgroup, per second unless stated otherwise. Rates of
+// counters that were reset, e.g. as the cgroup was recreated, are nil and
+// omitted, as are devices any of whose counters were reset.
+type Rates struct {
+	// seconds between the stats the rates are derived from
+	Interval float64 `json:"interval_seconds"`
+	// CPU cores used, in total and in user and kernel mode
+	CPUCores       *float64 `json:"cpu_cores,omitempty"`
+	CPUUserCores   *float64 `json:"cpu_user_cores,omitempty"`
+	CPUSystemCores *float64 `json:"cpu_system_cores,omitempty"`
+	// CPU used as a percentage of the CFS quota, omitted if unlimited
+	CPUQuotaPercent *float64 `json:"cpu_quota_percent,omitempty"`
+	// ratio of CFS periods in which the cgroup was throttled
+	CPUThrottledRatio *float64           `json:"cpu_throttled_ratio,omitempty"`
+	PageFaults        *float64           `json:"page_faults,omitempty"`
+	MajorPageFaults   *float64           `json:"major_page_faults,omitempty"`
+	Blkio             []BlkioDeviceRates `json:"blkio,omitempty"`
+}
+
+// BlkioDeviceRates holds the IO throughput and operations per second of a
+// single device.
+type BlkioDeviceRates struct {
+	Major      uint64  `json:"major"`
+	Minor      uint64  `json:"minor"`
+	ReadBytes  float64 `json:"read_bytes"`
+	WriteBytes float64 `json:"write_bytes"`
+	ReadOps    float64 `json:"read_ops"`
+	WriteOps   float64 `json:"write_ops"`
+}
+
+// CPUSetStats holds the CPU and memory node assignment.
+type CPUSetStats struct {
+	// CPUs and memory nodes the cgroup may use, in list format, e.g. "0-3,8"
+	CPUs string `json:"cpus"`
+	Mems string `json:"mems"`
+}
+
+// DevicesStats holds the device access allow list.
+type DevicesStats struct {
+	// device allow list entries, e.g. "c 1:3 rwm"
+	Allow []string `json:"allow"`
+}
+
+// FreezerStats holds the freezer state.
+type FreezerStats struct {
+	// one of THAWED, FREEZING or FROZEN
+	State string `json:"state"`
+}
+
+// NetClsStats holds the network class identifier.
+type NetClsStats struct {
+	ClassID uint32 `json:"classid"`
+}
+
+// NetPrioStats holds network interface priorities.
+type NetPrioStats struct {
+	// the map is in the format "interface name: priority"
+	IfPrioMap map[string]uint32 `json:"ifpriomap"`
+}
+
 // Stats holds cgroup stats.
 type Stats struct {
 	CPUStats    *CPUStats    `json:"cpu_stats,omitempty"`
@@ -187,4 +401,247 @@ type Stats struct {
 	BlkioStats  *BlkioStats  `json:"blkio_stats,omitempty"`
 	// the map is in the format "size of hugepage: stats of the hugepage"
 	HugetlbStats map[string]HugetlbStats `json:"hugetlb_stats,omitempty"`
+	PidsStats    *PidsStats              `json:"pids_stats,omitempty"`
+	CPUSetStats  *CPUSetStats            `json:"cpuset_stats,omitempty"`
+	DevicesStats *DevicesStats           `json:"devices_stats,omitempty"`
+	FreezerStats *FreezerStats           `json:"freezer_stats,omitempty"`
+	NetClsStats  *NetClsStats            `json:"net_cls_stats,omitempty"`
+	NetPrioStats *NetPrioStats           `json:"net_prio_stats,omitempty"`
+	// pressure stall information, only on the unified hierarchy
+	CPUPressure    *PressureStats `json:"cpu_pressure,omitempty"`
+	MemoryPressure *PressureStats `json:"memory_pressure,omitempty"`
+	IOPressure     *PressureStats `json:"io_pressure,omitempty"`
+	// configured limits and usage relative to them
+	Limits     *Limits     `json:"limits,omitempty"`
+	Saturation *Saturation `json:"saturation,omitempty"`
+	// rates derived from the previous stats, omitted on the first collection
+	Rates *Rates `json:"rates,omitempty"`
+}
+
+// Subsystem holds info about a watched cgroup subsystem.
+type Subsystem struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+}
+
+// Cgroup holds the latest collected stats and processes of a single cgroup.
+type Cgroup struct {
+	Name      string `json:"name"`
+	Subsystem string `json:"subsystem"`
+	// path relative to the subsystem mount point, e.g. /docker/<id>
+	Path     string   `json:"path"`
+	Stats    *Stats   `json:"stats,omitempty"`
+	Pids     []int32  `json:"pids"`
+	Children []string `json:"children"`
+	// container running in the cgroup, if known
+	Container *Container `json:"container,omitempty"`
+	// Kubernetes pod the cgroup belongs to, if any
+	Pod *Pod `json:"pod,omitempty"`
+	// systemd unit the cgroup belongs to, if any
+	Unit *Unit `json:"unit,omitempty"`
+}
+
+// Unit describes a systemd unit, decoded from the cgroup path. Description and
+// ActiveState are only known if the unit was confirmed over D-Bus.
+type Unit struct {
+	Name string `json:"name"`
+	// unit type, e.g. service, scope or slice
+	Type string `json:"type"`
+	// slice the unit is placed in, -.slice for top level units
+	Slice string `json:"slice,omitempty"`
+	// template and unescaped instance name of instantiated units, e.g.
+	// getty and tty1 for getty@tty1.service
+	Template    string `json:"template,omitempty"`
+	Instance    string `json:"instance,omitempty"`
+	Confirmed   bool   `json:"confirmed"`
+	Description string `json:"description,omitempty"`
+	ActiveState string `json:"active_state,omitempty"`
+}
+
+// UnitStats holds the stats of a systemd unit, aggregated over its cgroup and
+// all cgroups below it.
+type UnitStats struct {
+	Unit Unit `json:"unit"`
+	// path of the unit's cgroup
+	Path string `json:"path"`
+	// units placed directly in a slice
+	Units            []string `json:"units,omitempty"`
+	Processes        int      `json:"processes"`
+	Tasks            uint64   `json:"tasks,omitempty"`
+	MemoryUsage      uint64   `json:"memory_usage_bytes"`
+	MemoryWorkingSet uint64   `json:"memory_working_set_bytes"`
+	CPUUsage         uint64   `json:"cpu_usage_nanoseconds"`
+	IOServiceBytes   uint64   `json:"io_service_bytes"`
+}
+
+// Kubernetes pod QoS classes.
+const (
+	QOSGuaranteed = "Guaranteed"
+	QOSBurstable  = "Burstable"
+	QOSBestEffort = "BestEffort"
+)
+
+// Pod describes a Kubernetes pod. Only the UID and QoS class are known if pod
+// metadata is not available from the kubelet.
+type Pod struct {
+	UID       string            `json:"uid"`
+	Name      string            `json:"name,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	QOSClass  string            `json:"qos_class"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// PodCgroups holds the cgroups of a single pod, including the cgroups of its
+// containers.
+type PodCgroups struct {
+	Pod     Pod      `json:"pod"`
+	Cgroups []Cgroup `json:"cgroups"`
+}
+
+// Container runtimes.
+const (
+	RuntimeDocker     = "docker"
+	RuntimeContainerd = "containerd"
+	RuntimeCRIO       = "cri-o"
+	RuntimeLXC        = "lxc"
+	RuntimeRkt        = "rkt"
+	RuntimeMesos      = "mesos"
+)
+
+// Container describes the container running in a cgroup.
+type Container struct {
+	Runtime   string            `json:"runtime"`
+	ID        string            `json:"id"`
+	Name      string            `json:"name,omitempty"`
+	Image     string            `json:"image,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	StartedAt time.Time         `json:"started_at"`
+}
+
+// StatsUpdate holds the cgroups whose stats changed in a single collection
+// round.
+type StatsUpdate struct {
+	Timestamp time.Time `json:"timestamp"`
+	Cgroups   []Cgroup  `json:"cgroups"`
+}
+
+// Cgroup event types.
+const (
+	EventCgroupCreated    = "CgroupCreated"
+	EventCgroupRemoved    = "CgroupRemoved"
+	EventCgroupRenamed    = "CgroupRenamed"
+	EventProcessesChanged = "ProcessesChanged"
+	EventOOM              = "OOM"
+	EventMemoryPressure   = "MemoryPressure"
+)
+
+// Memory pressure levels, from the memory.pressure_level notifications.
+const (
+	MemoryPressureLow      = "low"
+	MemoryPressureMedium   = "medium"
+	MemoryPressureCritical = "critical"
+)
+
+// Event describes a change to the watched cgroup tree.
+type Event struct {
+	// increases by one for every event published by a daemon
+	Sequence  uint64    `json:"sequence"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	// subsystems mounted at the hierarchy containing the cgroup
+	Subsystems []string `json:"subsystems"`
+	// path relative to the subsystem mount point, e.g. /docker/<id>
+	Path        string  `json:"path"`
+	AddedPids   []int32 `json:"added_pids,omitempty"`
+	RemovedPids []int32 `json:"removed_pids,omitempty"`
+	// memory pressure level of MemoryPressure events
+	Level string `json:"level,omitempty"`
+	// previous path of CgroupRenamed events
+	OldPath string `json:"old_path,omitempty"`
+}
+
+// EventList holds the events after a requested sequence number.
+type EventList struct {
+	Events []Event `json:"events"`
+	// sequence number of the latest event published, to resume from
+	LastSequence uint64 `json:"last_sequence"`
+	// true if some events after the requested sequence number are no longer
+	// buffered
+	Truncated bool `json:"truncated"`
+}
+
+// Series is the recorded history of a node, cgroup or process series, e.g.
+// node, cgroup:memory:/docker/<id> or process:1234. Subsystems mounted
+// together share the series of a cgroup, e.g. cgroup:cpu,cpuacct:/docker/<id>.
+type Series struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Points []Point           `json:"points"`
+}
+
+// Point holds the values of a series at a single step of a range query.
+type Point struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// RangeQuery selects the series and time range of a range query.
+type RangeQuery struct {
+	// series IDs to return, which may contain glob patterns matching any
+	// characters except /, e.g. cgroup:memory:/docker/*
+	Series []string
+	// only return these values of each point, all values if empty
+	Values []string
+	// time range, defaulting to the retained history
+	Start, End time.Time
+	// interval between points, defaulting to the recording resolution
+	Step time.Duration
+}
+
+// RangeResult holds the points of the series matching a range query.
+type RangeResult struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Step   float64   `json:"step_seconds"`
+	Series []Series  `json:"series"`
+}
+
+// ExitedCgroup holds the latest stats collected for a removed cgroup. Stats
+// are collected once the cgroup is seen to become empty, and then include all
+// the resources its processes consumed, see CompleteStats. Otherwise they are
+// those of the latest collection before the cgroup was removed, missing what
+// was consumed since.
+type ExitedCgroup struct {
+	// subsystems of every hierarchy the cgroup was removed from
+	Subsystems []string `json:"subsystems"`
+	// path relative to the subsystem mount point, e.g. /docker/<id>
+	Path string `json:"path"`
+	// zero if the cgroup existed when the daemon started
+	Created time.Time `json:"created"`
+	Removed time.Time `json:"removed"`
+	// seconds between creation and removal, omitted if the creation time is
+	// not known
+	Lifetime float64 `json:"lifetime_seconds,omitempty"`
+	// highest memory usage collected, in bytes
+	PeakMemory uint64 `json:"peak_memory,omitempty"`
+	// total CPU time consumed, in nanoseconds
+	CPUUsage uint64 `json:"cpu_usage,omitempty"`
+	// latest stats of each subsystem, keyed by subsystem
+	Stats map[string]*Stats `json:"stats,omitempty"`
+	// subsystems whose stats were collected after the cgroup's last process
+	// left
+	CompleteStats []string   `json:"complete_stats,omitempty"`
+	Container     *Container `json:"container,omitempty"`
+	Pod           *Pod       `json:"pod,omitempty"`
+	Unit          *Unit      `json:"unit,omitempty"`
+}
+
+// Error is returned by the API when a request fails.
+type Error struct {
+	Message string `json:"error"`
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Message
 }
@@ -0,0 +1,180 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// Classifier identifies the container running in a cgroup from the cgroup's
+// path.
+type Classifier interface {
+	// Classify returns the runtime, ID and, if known, name of the container
+	// running in the cgroup at path, or false if path is not a container
+	// cgroup.
+	Classify(path string) (*v1.Container, bool)
+}
+
+// Rule classifies the cgroups whose path matches Pattern as containers of
+// Runtime. The container ID and name are taken from the named capture groups
+// id and name; the ID defaults to the name if the pattern has no id group.
+// Dashes escaped by systemd (\x2d) are unescaped.
+type Rule struct {
+	Runtime string
+	Pattern *regexp.Regexp
+}
+
+// NewRule returns a rule for runtime, compiling pattern.
+func NewRule(runtime, pattern string) (*Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern for runtime %s: %v", runtime, err)
+	}
+	r := &Rule{Runtime: runtime, Pattern: re}
+	if r.group("id") < 0 && r.group("name") < 0 {
+		return nil, fmt.Errorf("pattern %s for runtime %s has neither an id nor a name group", pattern, runtime)
+	}
+	return r, nil
+}
+
+func mustNewRule(runtime, pattern string) *Rule {
+	r, err := NewRule(runtime, pattern)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r *Rule) group(name string) int {
+	for i, n := range r.Pattern.SubexpNames() {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Classify implements Classifier.
+func (r *Rule) Classify(path string) (*v1.Container, bool) {
+	m := r.Pattern.FindStringSubmatch(path)
+	if m == nil {
+		return nil, false
+	}
+
+	c := &v1.Container{Runtime: r.Runtime}
+	if i := r.group("name"); i >= 0 {
+		c.Name = unescapeDashes(m[i])
+	}
+	if i := r.group("id"); i >= 0 {
+		c.ID = unescapeDashes(m[i])
+	} else {
+		c.ID = c.Name
+	}
+	if c.ID == "" {
+		return nil, false
+	}
+	return c, true
+}
+
+func unescapeDashes(s string) string {
+	return strings.Replace(s, `\x2d`, "-", -1)
+}
+
+// Rules is a Classifier trying each rule in turn.
+type Rules []*Rule
+
+// Classify implements Classifier, returning the classification of the first
+// matching rule.
+func (rs Rules) Classify(path string) (*v1.Container, bool) {
+	for _, r := range rs {
+		if c, ok := r.Classify(path); ok {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// containerIDPattern matches the IDs of Docker, containerd and CRI-O
+// containers.
+const containerIDPattern = `[0-9a-f]{64}`
+
+var (
+	// containerName matches the cgroup names Docker, containerd and CRI-O
+	// give containers, the bare ID with the cgroupfs driver and
+	// <prefix>-<id>.scope with the systemd driver.
+	containerName = regexp.MustCompile(`^(?:(docker|cri-containerd|crio)-)?(` + containerIDPattern + `)(?:\.scope)?$`)
+
+	containerNamePrefixes = map[string]string{
+		"docker":         v1.RuntimeDocker,
+		"cri-containerd": v1.RuntimeContainerd,
+		"crio":           v1.RuntimeCRIO,
+	}
+)
+
+// ParseContainerName returns the runtime and ID of the container whose cgroup
+// is named name, the last element of the cgroup's path. The runtime is empty
+// if name is a bare container ID, as any of the runtimes may have created it.
+func ParseContainerName(name string) (runtime, id string, ok bool) {
+	m := containerName.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", false
+	}
+	return containerNamePrefixes[m[1]], m[2], true
+}
+
+// DefaultRules classify the cgroups created by common container runtimes.
+var DefaultRules = Rules{
+	// /docker/<id> (cgroupfs driver) and /system.slice/docker-<id>.scope
+	// (systemd driver)
+	mustNewRule(v1.RuntimeDocker, `^/docker/(?P<id>`+containerIDPattern+`)$`),
+	mustNewRule(v1.RuntimeDocker, `/docker-(?P<id>`+containerIDPattern+`)\.scope$`),
+	// /lxc/<name>, and /lxc.payload.<name> since LXC 4
+	mustNewRule(v1.RuntimeLXC, `^/lxc/(?P<name>[^/]+)$`),
+	mustNewRule(v1.RuntimeLXC, `^/lxc\.payload\.(?P<name>[^/]+)$`),
+	// /machine.slice/machine-rkt\x2d<uuid>.scope
+	mustNewRule(v1.RuntimeRkt, `^/machine\.slice/machine-rkt\\x2d(?P<id>[0-9a-f]{8}(?:\\x2d[0-9a-f]{4}){3}\\x2d[0-9a-f]{12})\.scope$`),
+	// cri-containerd-<id>.scope and crio-<id>.scope, usually within a
+	// Kubernetes pod slice
+	mustNewRule(v1.RuntimeContainerd, `/cri-containerd-(?P<id>`+containerIDPattern+`)\.scope$`),
+	mustNewRule(v1.RuntimeCRIO, `/crio-(?P<id>`+containerIDPattern+`)\.scope$`),
+	// /mesos/<container uuid>
+	mustNewRule(v1.RuntimeMesos, `^/mesos/(?P<id>[0-9a-f]{8}(?:-[0-9a-f]{4}){3}-[0-9a-f]{12})$`),
+}
+
+// ParseRules reads classification rules, one per line in the form
+// "<runtime> <pattern>". Blank lines and lines starting with # are ignored.
+func ParseRules(r io.Reader) (Rules, error) {
+	var rules Rules
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected <runtime> <pattern>", line)
+		}
+		rule, err := NewRule(fields[0], strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// LoadRules reads classification rules from the file at path, see ParseRules.
+func LoadRules(path string) (Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
@@ -0,0 +1,102 @@
+package cgroup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+const (
+	testContainerID = "3f9a6c2b1e8d4f7a9c0b5e2d1a8f4c7b3e6d9a2c5f8b1e4d7a0c3f6b9e2d5a8c"
+	testUUID        = "2c7d4b1e-8f3a-11e6-9d2b-42010a800002"
+)
+
+func TestDefaultRules(t *testing.T) {
+	tests := []struct {
+		path string
+		want *v1.Container
+	}{
+		{"/docker/" + testContainerID, &v1.Container{Runtime: v1.RuntimeDocker, ID: testContainerID}},
+		{"/system.slice/docker-" + testContainerID + ".scope", &v1.Container{Runtime: v1.RuntimeDocker, ID: testContainerID}},
+		{"/lxc/web", &v1.Container{Runtime: v1.RuntimeLXC, ID: "web", Name: "web"}},
+		{"/lxc.payload.web", &v1.Container{Runtime: v1.RuntimeLXC, ID: "web", Name: "web"}},
+		{`/machine.slice/machine-rkt\x2d` + strings.Replace(testUUID, "-", `\x2d`, -1) + ".scope", &v1.Container{Runtime: v1.RuntimeRkt, ID: testUUID}},
+		{"/kubepods.slice/kubepods-pod1.slice/cri-containerd-" + testContainerID + ".scope", &v1.Container{Runtime: v1.RuntimeContainerd, ID: testContainerID}},
+		{"/kubepods.slice/kubepods-pod1.slice/crio-" + testContainerID + ".scope", &v1.Container{Runtime: v1.RuntimeCRIO, ID: testContainerID}},
+		{"/mesos/" + testUUID, &v1.Container{Runtime: v1.RuntimeMesos, ID: testUUID}},
+		{"/", nil},
+		{"/lxc", nil},
+		{"/lxc/web/nested", nil},
+		{"/system.slice/sshd.service", nil},
+		{"/mesos/not-a-uuid", nil},
+	}
+
+	for _, test := range tests {
+		got, ok := DefaultRules.Classify(test.path)
+		if ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v, got %#v (%v)", test.path, test.want, got, ok)
+		}
+	}
+}
+
+func TestParseContainerName(t *testing.T) {
+	tests := []struct {
+		name    string
+		runtime string
+		id      string
+	}{
+		{testContainerID, "", testContainerID},
+		{"docker-" + testContainerID + ".scope", v1.RuntimeDocker, testContainerID},
+		{"cri-containerd-" + testContainerID + ".scope", v1.RuntimeContainerd, testContainerID},
+		{"crio-" + testContainerID + ".scope", v1.RuntimeCRIO, testContainerID},
+		{"docker.service", "", ""},
+		{testContainerID[:12], "", ""},
+		{"rkt-" + testContainerID + ".scope", "", ""},
+	}
+
+	for _, test := range tests {
+		runtime, id, ok := ParseContainerName(test.name)
+		if runtime != test.runtime || id != test.id || ok != (test.id != "") {
+			t.Errorf("%s: expected %q %q, got %q %q (%v)", test.name, test.runtime, test.id, runtime, id, ok)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# Garden containers
+garden ^/garden/(?P<id>[0-9a-f-]+)$
+
+jail   ^/jails/(?P<name>[a-z]+)$
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+
+	for path, want := range map[string]*v1.Container{
+		"/garden/ab-12": {Runtime: "garden", ID: "ab-12"},
+		"/jails/web":    {Runtime: "jail", ID: "web", Name: "web"},
+		"/jails/WEB":    nil,
+	} {
+		got, ok := rules.Classify(path)
+		if ok != (want != nil) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %#v, got %#v (%v)", path, want, got, ok)
+		}
+	}
+
+	for _, invalid := range []string{
+		"garden",
+		"garden ^/garden/(",
+		"garden ^/garden/[0-9]+$",
+	} {
+		_, err := ParseRules(strings.NewReader(invalid))
+		if err == nil {
+			t.Errorf("%q: expected error", invalid)
+		}
+	}
+}
@@ -2,45 +2,68 @@ package cgroup
 
 import (
 	"os"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/opencontainers/runc/libcontainer/cgroups"
 	"github.com/opencontainers/runc/libcontainer/cgroups/fs"
-	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/jimmidyson/wurzel/api/v1"
-	"github.com/jimmidyson/wurzel/metrics"
-)
-
-var (
-	statsCollectionSummary = prometheus.NewSummary(
-		prometheus.SummaryOpts{
-			Namespace: metrics.Namespace,
-			Subsystem: MetricsSubsystem,
-			Name:      "stats_collection_duration_microseconds",
-			Help:      "The time taken to collect cgroup stats.",
-		},
-	)
-
-	subsystemStatsCollectionSummary = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Namespace: metrics.Namespace,
-			Subsystem: MetricsSubsystem,
-			Name:      "subsystem_stats_collection_duration_microseconds",
-			Help:      "The time taken to collect cgroup stats, labeled by subsystem.",
-		},
-		[]string{"subsystem"},
-	)
 )
 
+// collector collects the stats of a single subsystem for a cgroup.
 type collector interface {
+	Collect(path string) (*v1.Stats, error)
+}
+
+// fsGroup is implemented by runc's cgroup v1 subsystem stats readers.
+type fsGroup interface {
 	GetStats(path string, stats *cgroups.Stats) error
 	Name() string
 }
 
+// fsCollector collects stats from a cgroup v1 hierarchy.
+type fsCollector struct {
+	group fsGroup
+}
+
+func (c *fsCollector) Collect(path string) (*v1.Stats, error) {
+	stats := cgroups.NewStats()
+	err := c.group.GetStats(path, stats)
+	v1Stats := convertStats(c.group.Name(), stats)
+	if err != nil {
+		return v1Stats, err
+	}
+
+	v1Stats.Limits, err = readLimits(c.group.Name(), path)
+	return v1Stats, err
+}
+
+// stateCollector reads the state of v1 subsystems that runc does not report
+// stats for, such as cpuset assignment or freezer state.
+type stateCollector struct {
+	subsystem string
+}
+
+func (c *stateCollector) Collect(path string) (*v1.Stats, error) {
+	return convertState(c.subsystem, path)
+}
+
 func subsystemCollector(subsystem string) collector {
+	switch subsystem {
+	case "cpuset", "devices", "freezer", "net_cls", "net_prio", "pids":
+		return &stateCollector{subsystem: subsystem}
+	}
+
+	group := subsystemGroup(subsystem)
+	if group == nil {
+		return nil
+	}
+	return &fsCollector{group: group}
+}
+
+func subsystemGroup(subsystem string) fsGroup {
 	switch subsystem {
 	case "blkio":
 		return &fs.BlkioGroup{}
@@ -48,20 +71,10 @@ func subsystemCollector(subsystem string) collector {
 		return &fs.CpuGroup{}
 	case "cpuacct":
 		return &fs.CpuacctGroup{}
-	case "cpuset":
-		return &fs.CpusetGroup{}
-	case "devices":
-		return &fs.DevicesGroup{}
-	case "freezer":
-		return &fs.FreezerGroup{}
 	case "hugetlb":
 		return &fs.HugetlbGroup{}
 	case "memory":
 		return &fs.MemoryGroup{}
-	case "net_cls":
-		return &fs.NetClsGroup{}
-	case "net_prio":
-		return &fs.NetPrioGroup{}
 	case "perf_event":
 		return &fs.PerfEventGroup{}
 	default:
@@ -69,88 +82,271 @@ func subsystemCollector(subsystem string) collector {
 	}
 }
 
-func (w *watcher) startCollection() {
-	ticker := time.NewTicker(w.collectionInterval).C
-	go w.collectStats(time.Now())
-	for {
-		select {
-		case t := <-ticker:
-			go w.collectStats(t)
-		case <-w.done:
-			log.Debug("Stopping stats collection")
+// defaultCollectionWorkers is the number of stats collections run
+// concurrently for each subsystem. Reading stats is dominated by cgroupfs
+// reads, so more workers than CPUs pay off.
+const defaultCollectionWorkers = 16
+
+// collectStats collects the stats of every cgroup of subsystem in three
+// phases, so watching cgroups is not blocked while stats are read: the cgroups
+// to collect are snapshotted under a read lock, their stats are read without
+// holding any lock by a bounded pool of workers, and the results are then
+// published in a single short write lock. Idle cgroups are skipped unless the
+// schedule collects them in round.
+func (w *watcher) collectStats(subsystem string, startTime time.Time, round int) {
+	w.log.WithField("subsystem", subsystem).Debug("Collecting cgroup stats")
+
+	tasks := w.collectTasks(subsystem, round)
+	runTasks(tasks, w.subsystems[subsystem], w.collectionWorkers)
+
+	w.cgroupMu.Lock()
+	for _, t := range tasks {
+		t.previous, t.applied = t.cg.apply(t)
+		// Cgroups seen empty are collected again straight away, as their
+		// stats may have been read before their last process left.
+		if t.readPIDs && t.pidsErr == nil && t.cg.procsWatched && t.cg.removed.IsZero() {
+			w.setPIDs(t.path, t.cg, t.pids, t.pidsRead)
+		}
+	}
+	w.cgroupMu.Unlock()
+	for _, t := range tasks {
+		w.logCollectError(t)
+	}
+
+	elapsed := float64(time.Since(startTime)) / float64(time.Microsecond)
+	w.metrics.statsCollection.Observe(elapsed)
+	w.metrics.subsystemStatsCollection.WithLabelValues(subsystem).Observe(elapsed)
+
+	w.log.WithFields(log.Fields{"subsystem": subsystem, "cgroups": len(tasks), "duration": time.Duration(elapsed) * time.Microsecond}).Debug("Finished collecting cgroup stats")
+
+	if w.hasStatsSubscribers() {
+		w.publishStats(&v1.StatsUpdate{Timestamp: startTime, Cgroups: w.changedCgroups(tasks)})
+	}
+}
+
+// collectTask is the collection of the stats of a cgroup for a subsystem.
+type collectTask struct {
+	cg        *cgroup
+	subsystem string
+	relPath   string
+	path      string
+	// readPIDs reads the processes of the cgroup before its stats, polling
+	// whether it has become empty.
+	readPIDs bool
+
+	// Set once run.
+	stats     *v1.Stats
+	err       error
+	gone      bool
+	collected time.Time
+	pids      []int32
+	pidsErr   error
+	pidsRead  time.Time
+
+	// Set once applied.
+	previous, applied *v1.Stats
+}
+
+// collectTasks returns the collection tasks for the cgroups of subsystem,
+// skipping idle cgroups unless they are collected in round.
+func (w *watcher) collectTasks(subsystem string, round int) []*collectTask {
+	w.cgroupMu.RLock()
+	defer w.cgroupMu.RUnlock()
+
+	root := w.cgroups[subsystem]
+	if root == nil {
+		return nil
+	}
+	collectIdle := w.collectionSchedule.collectsIdle(round)
+	readPIDs := w.readsPIDs(subsystem)
+	var tasks []*collectTask
+	skipped := 0
+	walkTree(root, "/", func(cg *cgroup, relPath string) {
+		if !collectIdle && cg.idle[subsystem] >= idleAfter {
+			skipped++
 			return
 		}
+		tasks = append(tasks, &collectTask{cg: cg, subsystem: subsystem, relPath: relPath, path: cg.path, readPIDs: readPIDs})
+	})
+	if skipped > 0 {
+		w.metrics.idleSkipped.WithLabelValues(subsystem).Add(float64(skipped))
 	}
+	return tasks
 }
 
-var collecting uint32
+// runTasks runs tasks with c using at most workers concurrent collections.
+func runTasks(tasks []*collectTask, c collector, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(tasks) {
+		workers = len(tasks)
+	}
 
-func (w *watcher) collectStats(startTime time.Time) {
-	if !atomic.CompareAndSwapUint32(&collecting, 0, 1) {
-		log.Error("Time taken for collection is greater than the configured collection interval - skipping collection this time. You need to increase collection interval.")
-		return
+	ch := make(chan *collectTask)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				t.run(c)
+			}
+		}()
+	}
+	for _, t := range tasks {
+		ch <- t
 	}
-	defer atomic.StoreUint32(&collecting, 0)
+	close(ch)
+	wg.Wait()
+}
 
-	w.cgroupMu.Lock()
-	defer w.cgroupMu.Unlock()
+// run reads the stats of the task's cgroup. It only reads the task, so must
+// not be called with cgroupMu held.
+func (t *collectTask) run(c collector) {
+	if t.readPIDs {
+		t.pidsRead = time.Now()
+		t.pids, t.pidsErr = getPIDs(t.path)
+	}
+	t.collected = time.Now()
+	t.stats, t.err = cgroupStats(t.path, c)
+	if t.err != nil {
+		_, err := os.Stat(t.path)
+		t.gone = os.IsNotExist(err)
+	}
+}
 
-	log.Debug("Collecting all cgroup stats")
+// changedCgroups returns the cgroups whose stats differ from the previous
+// collection, in the order collected.
+func (w *watcher) changedCgroups(tasks []*collectTask) []v1.Cgroup {
+	w.cgroupMu.RLock()
+	defer w.cgroupMu.RUnlock()
 
-	allStart := startTime
+	changed := []v1.Cgroup{}
+	for _, t := range tasks {
+		if t.applied != nil && statsChanged(t.previous, t.applied) {
+			cg := t.cg.toV1(t.subsystem, t.relPath)
+			cg.Stats = t.applied
+			changed = append(changed, *cg)
+		}
+	}
+	return changed
+}
 
-	for name, rootCgroup := range w.cgroups {
-		c := w.subsystems[name]
-		if c == nil {
-			log.WithField("subsystem", name).Debug("No collector for subsystem")
-			continue
+// apply stores the stats read by t, deriving rates from the previous stats,
+// and returns both. The stats and collection times are copied on write, so
+// earlier stats handed out are never modified. Stats older than those stored,
+// e.g. by a collection of a newly created cgroup while t was run, are
+// dropped, as are failed collections of removed cgroups which keep their
+// latest stats. Callers must hold cgroupMu.
+func (cg *cgroup) apply(t *collectTask) (previous, stats *v1.Stats) {
+	previous = cg.stats[t.subsystem]
+	if previous != nil {
+		if !t.collected.After(cg.collected[t.subsystem]) {
+			return previous, nil
+		}
+		if t.err != nil && t.gone {
+			// Removed but not yet unwatched: keep the latest stats read
+			// while it still existed.
+			return previous, previous
 		}
-		log.WithField("subsystem", name).Debug("Collecting cgroup stats")
-		subsystemStart := time.Now()
-		walkCgroup(rootCgroup, c)
-		subsystemElapsed := float64(time.Since(subsystemStart)) / float64(time.Microsecond)
-		subsystemStatsCollectionSummary.WithLabelValues(name).Observe(subsystemElapsed)
+	}
 
-		log.WithFields(log.Fields{"subsystem": name, "duration": time.Duration(subsystemElapsed) * time.Microsecond}).Debug("Finished collecting cgroup stats")
+	stats = t.stats
+	if previous != nil {
+		stats.Rates = rates(previous, stats, t.collected.Sub(cg.collected[t.subsystem]).Seconds(), sharedCPULimits(cg, stats))
 	}
 
-	allElapsed := float64(time.Since(allStart)) / float64(time.Microsecond)
-	statsCollectionSummary.Observe(allElapsed)
+	statsCopy := make(map[string]*v1.Stats, len(cg.stats)+1)
+	collectedCopy := make(map[string]time.Time, len(cg.collected)+1)
+	for subsystem, s := range cg.stats {
+		statsCopy[subsystem] = s
+		collectedCopy[subsystem] = cg.collected[subsystem]
+	}
+	statsCopy[t.subsystem] = stats
+	collectedCopy[t.subsystem] = t.collected
+	cg.stats, cg.collected = statsCopy, collectedCopy
 
-	log.WithField("duration", time.Duration(allElapsed)*time.Microsecond).Debug("Finished collecting all cgroup stats")
-}
+	if cg.idle == nil {
+		cg.idle = make(map[string]int)
+	}
+	if previous != nil && idle(previous, stats) {
+		cg.idle[t.subsystem]++
+	} else {
+		cg.idle[t.subsystem] = 0
+	}
 
-func walkCgroup(cg *cgroup, c collector) {
-	cg.stats = cgroupStats(cg.path, c)
+	if m := stats.MemoryStats; m != nil {
+		for _, usage := range []uint64{m.Usage.Usage, m.Usage.MaxUsage} {
+			if usage > cg.peakMemory {
+				cg.peakMemory = usage
+			}
+		}
+	}
+	return previous, stats
+}
 
-	for _, subCg := range cg.subcgroups {
-		walkCgroup(subCg, c)
+// collectNow collects the stats of cg for each of subsystems outside the
+// regular collection rounds. The stats are read in the background, as callers
+// must hold cgroupMu.
+func (w *watcher) collectNow(cg *cgroup, subsystems map[string]string) {
+	var tasks []*collectTask
+	for subsystem := range subsystems {
+		if w.subsystems[subsystem] != nil {
+			tasks = append(tasks, &collectTask{cg: cg, subsystem: subsystem, path: cg.path})
+		}
+	}
+	if len(tasks) > 0 {
+		go w.runNow(tasks)
 	}
 }
 
-func cgroupStats(path string, c collector) *v1.Stats {
-	stats := cgroups.NewStats()
+// runNow reads and applies the stats of tasks queued by collectNow. If the
+// cgroup was removed meanwhile, its exited entry is updated with the stats
+// read. It must not be called with cgroupMu held.
+func (w *watcher) runNow(tasks []*collectTask) {
+	for _, t := range tasks {
+		t.run(w.subsystems[t.subsystem])
+	}
 
-	err := c.GetStats(path, stats)
-	if err != nil && !os.IsNotExist(err) {
-		log.Error(err)
+	w.cgroupMu.Lock()
+	for _, t := range tasks {
+		t.previous, t.applied = t.cg.apply(t)
+		if t.applied != nil && !t.cg.removed.IsZero() {
+			w.exited.update(t.cg, t.subsystem)
+		}
 	}
+	w.cgroupMu.Unlock()
 
-	v1Stats := &v1.Stats{}
-	switch c.Name() {
-	case "blkio":
-		v1Stats.BlkioStats = convertBlkio(stats.BlkioStats)
-	case "cpu":
-		v1Stats.CPUStats = &v1.CPUStats{ThrottlingData: convertCPUThrottlingData(stats.CpuStats.ThrottlingData)}
-	case "cpuacct":
-		v1Stats.CPUStats = &v1.CPUStats{CPUUsage: convertCPUUsage(stats.CpuStats.CpuUsage)}
-	case "hugetlb":
-		v1Stats.HugetlbStats = convertHugetlbStats(stats.HugetlbStats)
-	case "memory":
-		v1Stats.MemoryStats = convertMemory(stats.MemoryStats)
+	for _, t := range tasks {
+		w.logCollectError(t)
+	}
+}
+
+// logCollectError logs the error collecting t, if any. Missing stats files
+// are expected, e.g. as cgroups are removed while collecting. The root cgroup
+// of the unified hierarchy lacks most controller interface files, such as
+// memory.current, so failures collecting it are only logged at debug level.
+func (w *watcher) logCollectError(t *collectTask) {
+	if t.err == nil || os.IsNotExist(t.err) {
+		return
+	}
+	entry := w.log.WithFields(log.Fields{"subsystem": t.subsystem, "target": t.path, "error": t.err})
+	if c, ok := w.subsystems[t.subsystem].(*unifiedCollector); ok && t.path == c.mountpoint {
+		entry.Debug("Failed to collect root cgroup stats")
+		return
+	}
+	entry.Error("Failed to collect cgroup stats")
+}
+
+func cgroupStats(path string, c collector) (*v1.Stats, error) {
+	stats, err := c.Collect(path)
+	if stats == nil {
+		stats = &v1.Stats{}
 	}
+	stats.Saturation = saturation(stats)
 
-	return v1Stats
+	return stats, err
 }
 
 func getPIDs(path string) ([]int32, error) {
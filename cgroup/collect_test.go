@@ -0,0 +1,239 @@
+package cgroup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+type fakeCollector struct {
+	cache map[string]uint64
+}
+
+func (c *fakeCollector) Collect(path string) (*v1.Stats, error) {
+	return &v1.Stats{MemoryStats: &v1.MemoryStats{Cache: c.cache[path]}}, nil
+}
+
+func testTree() *cgroup {
+	return &cgroup{
+		name: "memory",
+		path: "/cg",
+		subcgroups: map[string]*cgroup{
+			"a": {
+				name: "a",
+				path: "/cg/a",
+				subcgroups: map[string]*cgroup{
+					"b": {name: "b", path: "/cg/a/b", subcgroups: map[string]*cgroup{}},
+				},
+			},
+		},
+	}
+}
+
+func newCollectWatcher(root *cgroup, c collector) *watcher {
+	return &watcher{
+		cgroups:           map[string]*cgroup{"memory": root},
+		subsystems:        map[string]collector{"memory": c},
+		collectionWorkers: 2,
+		statsSubs:         make(map[chan *v1.StatsUpdate]struct{}),
+		metrics:           newWatcherMetrics(nil),
+		log:               testLog,
+	}
+}
+
+func TestCollectStatsChanges(t *testing.T) {
+	root := testTree()
+	c := &fakeCollector{cache: map[string]uint64{"/cg": 1, "/cg/a": 2, "/cg/a/b": 3}}
+	w := newCollectWatcher(root, c)
+	updates, cancel := w.SubscribeStats()
+	defer cancel()
+
+	w.collectStats("memory", time.Now(), 0)
+	if changed := (<-updates).Cgroups; len(changed) != 3 {
+		t.Fatalf("expected all cgroups to change on first collection, got %#v", changed)
+	}
+
+	w.collectStats("memory", time.Now(), 0)
+	if changed := (<-updates).Cgroups; len(changed) != 0 {
+		t.Errorf("expected no changes, got %#v", changed)
+	}
+
+	c.cache["/cg/a/b"] = 4
+	w.collectStats("memory", time.Now(), 0)
+	if changed := (<-updates).Cgroups; len(changed) != 1 || changed[0].Path != "/a/b" || changed[0].Stats.MemoryStats.Cache != 4 {
+		t.Errorf("expected only /a/b to change, got %#v", changed)
+	}
+
+	if root.subcgroups["a"].stats["memory"].MemoryStats.Cache != 2 {
+		t.Errorf("unexpected stats %#v", root.subcgroups["a"].stats)
+	}
+}
+
+// blockingCollector blocks every collection until released.
+type blockingCollector struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCollector) Collect(path string) (*v1.Stats, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return &v1.Stats{MemoryStats: &v1.MemoryStats{}}, nil
+}
+
+func TestCollectStatsUnlocked(t *testing.T) {
+	c := &blockingCollector{started: make(chan struct{}, 3), release: make(chan struct{})}
+	w := newCollectWatcher(testTree(), c)
+
+	done := make(chan struct{})
+	go func() {
+		w.collectStats("memory", time.Now(), 0)
+		close(done)
+	}()
+	<-c.started
+
+	// Cgroups can be looked up, and the tree modified, while stats are read.
+	if cg, ok := w.Lookup("memory", "/a"); !ok || cg.Stats != nil {
+		t.Errorf("expected /a without stats during collection, got %#v", cg)
+	}
+	w.cgroupMu.Lock()
+	w.cgroups["memory"].subcgroups["c"] = &cgroup{name: "c", path: "/cg/c", subcgroups: map[string]*cgroup{}}
+	w.cgroupMu.Unlock()
+
+	close(c.release)
+	<-done
+	for _, path := range []string{"/", "/a", "/a/b"} {
+		if cg, ok := w.Lookup("memory", path); !ok || cg.Stats == nil {
+			t.Errorf("expected stats of %s to be published, got %#v", path, cg)
+		}
+	}
+}
+
+func TestSubscribeStats(t *testing.T) {
+	w := &watcher{statsSubs: make(map[chan *v1.StatsUpdate]struct{}), log: testLog}
+
+	if w.hasStatsSubscribers() {
+		t.Fatalf("expected no subscribers")
+	}
+
+	updates, cancel := w.SubscribeStats()
+	if !w.hasStatsSubscribers() {
+		t.Fatalf("expected subscriber")
+	}
+
+	sent := &v1.StatsUpdate{}
+	w.publishStats(sent)
+	if got := <-updates; got != sent {
+		t.Errorf("expected %#v, got %#v", sent, got)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-updates; ok {
+		t.Errorf("expected closed channel")
+	}
+	if w.hasStatsSubscribers() {
+		t.Errorf("expected no subscribers")
+	}
+}
+
+// sleepingCollector emulates the latency of reading stats from cgroupfs.
+type sleepingCollector struct {
+	latency time.Duration
+}
+
+func (c *sleepingCollector) Collect(path string) (*v1.Stats, error) {
+	time.Sleep(c.latency)
+	return &v1.Stats{MemoryStats: &v1.MemoryStats{}}, nil
+}
+
+// syntheticTree returns a tree of n cgroups below a root, in groups of 100.
+func syntheticTree(n int) *cgroup {
+	root := &cgroup{name: "memory", path: "/cg", subcgroups: map[string]*cgroup{}}
+	for i := 0; i < n; i += 100 {
+		group := &cgroup{name: fmt.Sprint(i), path: fmt.Sprintf("/cg/%d", i), subcgroups: map[string]*cgroup{}}
+		root.subcgroups[group.name] = group
+		for j := i; j < i+100 && j < n; j++ {
+			name := fmt.Sprint(j)
+			group.subcgroups[name] = &cgroup{name: name, path: group.path + "/" + name, subcgroups: map[string]*cgroup{}}
+		}
+	}
+	return root
+}
+
+// BenchmarkCollectStats collects the stats of 5000 cgroups, serially and
+// with the default number of workers.
+func BenchmarkCollectStats(b *testing.B) {
+	for _, workers := range []int{1, defaultCollectionWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			w := newCollectWatcher(syntheticTree(5000), &sleepingCollector{latency: 20 * time.Microsecond})
+			w.collectionWorkers = workers
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.collectStats("memory", time.Now(), 0)
+			}
+		})
+	}
+}
+
+// BenchmarkLookupDuringCollection looks up a cgroup while the stats of 5000
+// cgroups are collected continuously, as the API and event handling do.
+func BenchmarkLookupDuringCollection(b *testing.B) {
+	w := newCollectWatcher(syntheticTree(5000), &sleepingCollector{latency: 20 * time.Microsecond})
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				w.collectStats("memory", time.Now(), 0)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := w.Lookup("memory", "/100/150"); !ok {
+			b.Fatal("expected cgroup")
+		}
+	}
+	b.StopTimer()
+	close(done)
+	<-stopped
+}
+
+func TestCollectNowUnlocked(t *testing.T) {
+	c := &blockingCollector{started: make(chan struct{}, 1), release: make(chan struct{})}
+	w := newCollectWatcher(testTree(), c)
+
+	w.cgroupMu.Lock()
+	cg := w.cgroups["memory"].subcgroups["a"]
+	w.collectNow(cg, map[string]string{"memory": "/cg"})
+	w.cgroupMu.Unlock()
+	<-c.started
+
+	// The tree is not locked while the stats are read, and the cgroup can be
+	// removed meanwhile.
+	w.cgroupMu.Lock()
+	w.recordExited(cg, map[string]string{"memory": "/cg"}, "/a")
+	w.cgroupMu.Unlock()
+
+	close(c.release)
+	timeout := time.After(5 * time.Second)
+	for {
+		exited := w.Exited()
+		if len(exited) == 1 && exited[0].Stats["memory"] != nil {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("expected the exited cgroup to be updated with the stats read, got %#v", exited)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -1,10 +1,116 @@
 package cgroup
 
 import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/jimmidyson/wurzel/api/v1"
 	"github.com/opencontainers/runc/libcontainer/cgroups"
 )
 
+// convertStats converts the stats collected for a v1 subsystem.
+func convertStats(subsystem string, stats *cgroups.Stats) *v1.Stats {
+	v1Stats := &v1.Stats{}
+	switch subsystem {
+	case "blkio":
+		v1Stats.BlkioStats = convertBlkio(stats.BlkioStats)
+	case "cpu":
+		v1Stats.CPUStats = &v1.CPUStats{ThrottlingData: convertCPUThrottlingData(stats.CpuStats.ThrottlingData)}
+	case "cpuacct":
+		v1Stats.CPUStats = &v1.CPUStats{CPUUsage: convertCPUUsage(stats.CpuStats.CpuUsage)}
+	case "hugetlb":
+		v1Stats.HugetlbStats = convertHugetlbStats(stats.HugetlbStats)
+	case "memory":
+		v1Stats.MemoryStats = convertMemory(stats.MemoryStats)
+	}
+	return v1Stats
+}
+
+// convertState reads the state of the v1 subsystems not covered by runc's
+// stats from the cgroup at path.
+func convertState(subsystem, path string) (*v1.Stats, error) {
+	v1Stats := &v1.Stats{}
+	switch subsystem {
+	case "cpuset":
+		cpus, err := readString(filepath.Join(path, "cpuset.cpus"))
+		if err != nil {
+			return v1Stats, err
+		}
+		mems, err := readString(filepath.Join(path, "cpuset.mems"))
+		if err != nil {
+			return v1Stats, err
+		}
+		v1Stats.CPUSetStats = &v1.CPUSetStats{CPUs: cpus, Mems: mems}
+	case "devices":
+		allow, err := readLines(filepath.Join(path, "devices.list"))
+		if err != nil {
+			return v1Stats, err
+		}
+		v1Stats.DevicesStats = &v1.DevicesStats{Allow: allow}
+	case "freezer":
+		state, err := readString(filepath.Join(path, "freezer.state"))
+		if err != nil {
+			return v1Stats, err
+		}
+		v1Stats.FreezerStats = &v1.FreezerStats{State: state}
+	case "net_cls":
+		classID, err := readUint(filepath.Join(path, "net_cls.classid"))
+		if err != nil {
+			return v1Stats, err
+		}
+		v1Stats.NetClsStats = &v1.NetClsStats{ClassID: uint32(classID)}
+	case "net_prio":
+		priorities, err := readKeyValues(filepath.Join(path, "net_prio.ifpriomap"))
+		if err != nil {
+			return v1Stats, err
+		}
+		ifPrioMap := make(map[string]uint32, len(priorities))
+		for k, v := range priorities {
+			ifPrioMap[k] = uint32(v)
+		}
+		v1Stats.NetPrioStats = &v1.NetPrioStats{IfPrioMap: ifPrioMap}
+	case "pids":
+		current, err := readUint(filepath.Join(path, "pids.current"))
+		if err != nil {
+			return v1Stats, err
+		}
+		limit, err := readUint(filepath.Join(path, "pids.max"))
+		if err != nil {
+			return v1Stats, err
+		}
+		v1Stats.PidsStats = &v1.PidsStats{Current: current, Limit: limit}
+	}
+	return v1Stats, nil
+}
+
+func readString(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
 func convertBlkio(from cgroups.BlkioStats) *v1.BlkioStats {
 	to := &v1.BlkioStats{
 		IoServiceBytesRecursive: convertBlkioStatEntries(from.IoServiceBytesRecursive),
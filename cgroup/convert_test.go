@@ -0,0 +1,52 @@
+package cgroup
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func TestConvertState(t *testing.T) {
+	dir := writeFixtures(t, map[string]string{
+		"cpuset.cpus":        "0-3,8\n",
+		"cpuset.mems":        "0\n",
+		"devices.list":       "c 1:3 rwm\nb 8:* r\n",
+		"freezer.state":      "FROZEN\n",
+		"net_cls.classid":    "1048577\n",
+		"net_prio.ifpriomap": "lo 0\neth0 5\n",
+		"pids.current":       "7\n",
+		"pids.max":           "max\n",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		subsystem string
+		want      *v1.Stats
+	}{
+		{"cpuset", &v1.Stats{CPUSetStats: &v1.CPUSetStats{CPUs: "0-3,8", Mems: "0"}}},
+		{"devices", &v1.Stats{DevicesStats: &v1.DevicesStats{Allow: []string{"c 1:3 rwm", "b 8:* r"}}}},
+		{"freezer", &v1.Stats{FreezerStats: &v1.FreezerStats{State: "FROZEN"}}},
+		{"net_cls", &v1.Stats{NetClsStats: &v1.NetClsStats{ClassID: 0x100001}}},
+		{"net_prio", &v1.Stats{NetPrioStats: &v1.NetPrioStats{IfPrioMap: map[string]uint32{"lo": 0, "eth0": 5}}}},
+		{"pids", &v1.Stats{PidsStats: &v1.PidsStats{Current: 7}}},
+		{"perf_event", &v1.Stats{}},
+	}
+
+	for _, test := range tests {
+		got, err := convertState(test.subsystem, dir)
+		if err != nil {
+			t.Errorf("%s: %v", test.subsystem, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v, got %#v", test.subsystem, test.want, got)
+		}
+	}
+
+	_, err := convertState("freezer", "/nonexistent")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package cgroup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// direntLayout locates the fields of the dirents returned by getdents64.
+var direntLayout syscall.Dirent
+
+// readSubdirs returns the inode numbers of the subdirectories of the dir at
+// path, keyed by name. Types and inode numbers are taken from the dir entries
+// themselves, so the control files of a cgroup are not stat'ed.
+func readSubdirs(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	subdirs := map[string]uint64{}
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.ReadDirent(int(f.Fd()), buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("getdents64", err)
+		}
+		if n <= 0 {
+			return subdirs, nil
+		}
+		parseSubdirs(path, buf[:n], subdirs)
+	}
+}
+
+// parseSubdirs adds the subdirectories among the dirents in buf to subdirs.
+// Entries of unknown type are stat'ed.
+func parseSubdirs(path string, buf []byte, subdirs map[string]uint64) {
+	for len(buf) > 0 {
+		if len(buf) < int(unsafe.Offsetof(direntLayout.Name)) {
+			return
+		}
+		reclen := int(*(*uint16)(unsafe.Pointer(&buf[unsafe.Offsetof(direntLayout.Reclen)])))
+		if reclen == 0 || reclen > len(buf) {
+			return
+		}
+		rec := buf[:reclen]
+		buf = buf[reclen:]
+
+		ino := *(*uint64)(unsafe.Pointer(&rec[unsafe.Offsetof(direntLayout.Ino)]))
+		if ino == 0 {
+			continue
+		}
+		name := rec[unsafe.Offsetof(direntLayout.Name):]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		if string(name) == "." || string(name) == ".." {
+			continue
+		}
+
+		switch rec[unsafe.Offsetof(direntLayout.Type)] {
+		case syscall.DT_DIR:
+		case syscall.DT_UNKNOWN:
+			fi, err := os.Lstat(filepath.Join(path, string(name)))
+			if err != nil || !fi.IsDir() {
+				continue
+			}
+		default:
+			continue
+		}
+		subdirs[string(name)] = ino
+	}
+}
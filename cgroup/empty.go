@@ -0,0 +1,200 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups/fs"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// cgroupEvents is the file of unified hierarchy cgroups whose populated field
+// tells whether the cgroup or its descendants have any processes. Changes
+// raise inotify modify events, unlike cgroup.procs, which only raises them
+// when written to.
+const cgroupEvents = "cgroup.events"
+
+// newCgroupPollInterval is how often the processes of new cgroups are read
+// until their stats are collected in the regular rounds, to see short-lived
+// cgroups empty.
+const newCgroupPollInterval = 100 * time.Millisecond
+
+// isControlFile returns true if name is a cgroup control file watched for
+// changes.
+func isControlFile(name string) bool {
+	return name == fs.CgroupProcesses || name == cgroupEvents
+}
+
+// fileWatched returns whether the control file name of cg is watched.
+func (cg *cgroup) fileWatched(name string) bool {
+	if name == cgroupEvents {
+		return cg.eventsWatched
+	}
+	return cg.procsWatched
+}
+
+// updateFile reads the changed control file name in the dir of cg at path.
+// Callers must hold cgroupMu.
+func (w *watcher) updateFile(path string, cg *cgroup, name string, changed bool) error {
+	if name == cgroupEvents {
+		return w.updatePopulated(path, cg, changed)
+	}
+	return w.updatePIDs(path, cg)
+}
+
+// updatePopulated reads whether the unified hierarchy cgroup cg, with its dir
+// at path, has any processes. It was emptied if changed, i.e. on a modify
+// event, and found without processes: the event of it being populated may
+// have been merged with that of it being emptied. Callers must hold cgroupMu.
+func (w *watcher) updatePopulated(path string, cg *cgroup, changed bool) error {
+	events, err := readKeyValues(filepath.Join(path, cgroupEvents))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	populated := events["populated"] != 0
+	if populated {
+		cg.emptied = time.Time{}
+	} else if cg.populated || changed {
+		w.emptied(cg, path)
+	}
+	cg.populated = populated
+	return nil
+}
+
+// setPIDs stores the processes of cg read at the given time from the
+// cgroup.procs file in the dir at path, publishing the processes added and
+// removed. Readings older than the stored processes are dropped. Callers must
+// hold cgroupMu.
+func (w *watcher) setPIDs(path string, cg *cgroup, pids []int32, read time.Time) error {
+	if read.Before(cg.pidsRead) {
+		return nil
+	}
+	cg.pidsRead = read
+
+	added, removed := diffPIDs(cg.pids, pids)
+	if len(pids) > 0 {
+		cg.emptied = time.Time{}
+	} else if len(cg.pids) > 0 {
+		w.emptied(cg, path)
+	}
+	cg.pids = pids
+	if len(added) > 0 || len(removed) > 0 {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		w.publishEvent(v1.EventProcessesChanged, absPath, added, removed)
+	}
+	return nil
+}
+
+// emptied collects the stats of cg, with its dir at path, as its last process
+// has left. The cgroup can be removed once empty, after which its stats can no
+// longer be read, while the stats read now include all the resources its
+// processes consumed. Callers must hold cgroupMu.
+func (w *watcher) emptied(cg *cgroup, path string) {
+	cg.emptied = time.Now()
+	if absPath, err := filepath.Abs(path); err == nil {
+		w.collectNow(cg, w.findCgroupMountpoints(absPath))
+	}
+}
+
+// completeStats returns whether the stats of subsystem were collected after
+// the last process left cg.
+func (cg *cgroup) completeStats(subsystem string) bool {
+	return !cg.emptied.IsZero() && cg.stats[subsystem] != nil && !cg.collected[subsystem].Before(cg.emptied)
+}
+
+// readsPIDs returns true if the collections of subsystem read the processes
+// of its cgroups, which a single collected subsystem of each hierarchy does.
+func (w *watcher) readsPIDs(subsystem string) bool {
+	root := w.cgroups[subsystem]
+	if root == nil {
+		return false
+	}
+	for other, cg := range w.cgroups {
+		if cg.path == root.path && other < subsystem && w.subsystems[other] != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// startNewCgroupPolling reads the processes of new cgroups every
+// newCgroupPollInterval until the watcher is stopped.
+func (w *watcher) startNewCgroupPolling() {
+	var polled time.Duration
+	for subsystem := range w.subsystems {
+		if interval := w.collectionSchedule.interval(subsystem); interval > polled {
+			polled = interval
+		}
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		ticker := time.NewTicker(newCgroupPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.pollNewCgroups(polled)
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// pidsReading holds the processes of a cgroup read outside cgroupMu.
+type pidsReading struct {
+	cg   *cgroup
+	path string
+	pids []int32
+	err  error
+	read time.Time
+}
+
+// pollNewCgroups reads the processes of the cgroups created within the last
+// polled period, so cgroups emptied before their stats are collected in a
+// regular round still have their stats collected once empty. Cgroups of the
+// unified hierarchy report becoming empty in cgroup.events instead. The
+// processes are read without holding cgroupMu.
+func (w *watcher) pollNewCgroups(polled time.Duration) {
+	w.cgroupMu.Lock()
+	var readings []*pidsReading
+	for cg := range w.newCgroups {
+		if !cg.removed.IsZero() || time.Since(cg.created) > polled {
+			delete(w.newCgroups, cg)
+			continue
+		}
+		if cg.procsWatched && !cg.eventsWatched {
+			readings = append(readings, &pidsReading{cg: cg, path: cg.path})
+		}
+	}
+	w.cgroupMu.Unlock()
+	if len(readings) == 0 {
+		return
+	}
+
+	for _, r := range readings {
+		r.read = time.Now()
+		r.pids, r.err = getPIDs(r.path)
+	}
+
+	w.cgroupMu.Lock()
+	defer w.cgroupMu.Unlock()
+	for _, r := range readings {
+		// Skip cgroups removed or renamed meanwhile.
+		if r.err == nil && r.cg.removed.IsZero() && r.cg.path == r.path {
+			w.setPIDs(r.path, r.cg, r.pids, r.read)
+		}
+	}
+}
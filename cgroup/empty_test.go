@@ -0,0 +1,166 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// usageCollector counts the collections of the cgroup at path, reporting
+// the count times 100 as its memory usage. Other cgroups have no stats.
+type usageCollector struct {
+	path string
+	mu   sync.Mutex
+	n    uint64
+}
+
+func (c *usageCollector) Collect(path string) (*v1.Stats, error) {
+	if path != c.path {
+		return &v1.Stats{}, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return &v1.Stats{MemoryStats: &v1.MemoryStats{Usage: v1.MemoryData{Usage: c.n * 100}}}, nil
+}
+
+// emptyingWatcher returns a watcher of a memory hierarchy at a temp dir with
+// a single cgroup /abc running process 1, see usageCollector.
+func emptyingWatcher(t *testing.T) (*watcher, *cgroup) {
+	root, err := ioutil.TempDir("", "wurzel-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cg := &cgroup{name: "abc", path: filepath.Join(root, "abc"), subcgroups: map[string]*cgroup{}, created: time.Now(), procsWatched: true}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	w := &watcher{
+		subsystems: map[string]collector{"memory": &usageCollector{path: cg.path}},
+		cgroups:    map[string]*cgroup{"memory": {name: "memory", path: root, subcgroups: map[string]*cgroup{"abc": cg}}},
+		newCgroups: map[*cgroup]struct{}{cg: {}},
+		metrics:    newWatcherMetrics(nil),
+		log:        testLog,
+	}
+	writeProcs(t, cg.path, "1\n")
+	return w, cg
+}
+
+func writeProcs(t *testing.T, dir, procs string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(procs), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exitedAfterStats removes cg once its stats of the given memory usage have
+// been collected, and returns its exited entry.
+func exitedAfterStats(t *testing.T, w *watcher, cg *cgroup, usage uint64) *v1.ExitedCgroup {
+	waitFor(t, "expected stats to be collected once empty", func() bool {
+		w.cgroupMu.RLock()
+		defer w.cgroupMu.RUnlock()
+		stats := cg.stats["memory"]
+		return stats != nil && stats.MemoryStats != nil && stats.MemoryStats.Usage.Usage == usage
+	})
+	w.cgroupMu.Lock()
+	w.recordExited(cg, map[string]string{"memory": w.cgroups["memory"].path}, "/abc")
+	w.cgroupMu.Unlock()
+	e := w.Exited()[0]
+	return &e
+}
+
+func TestPollNewCgroupsEmptied(t *testing.T) {
+	w, cg := emptyingWatcher(t)
+	defer os.RemoveAll(w.cgroups["memory"].path)
+
+	w.runNow([]*collectTask{{cg: cg, subsystem: "memory", path: cg.path}})
+	w.pollNewCgroups(time.Minute)
+	if !reflect.DeepEqual(cg.pids, []int32{1}) {
+		t.Fatalf("expected process 1, got %v", cg.pids)
+	}
+
+	// The process exits before a regular collection.
+	writeProcs(t, cg.path, "")
+	w.pollNewCgroups(time.Minute)
+
+	e := exitedAfterStats(t, w, cg, 200)
+	if !reflect.DeepEqual(e.CompleteStats, []string{"memory"}) {
+		t.Errorf("expected complete memory stats, got %v", e.CompleteStats)
+	}
+
+	// Cgroups are no longer polled once removed.
+	w.pollNewCgroups(time.Minute)
+	if len(w.newCgroups) != 0 {
+		t.Errorf("expected removed cgroup not to be polled, got %v", w.newCgroups)
+	}
+}
+
+func TestCollectStatsEmptied(t *testing.T) {
+	w, cg := emptyingWatcher(t)
+	defer os.RemoveAll(w.cgroups["memory"].path)
+
+	w.collectStats("memory", time.Now(), 0)
+	if !reflect.DeepEqual(cg.pids, []int32{1}) {
+		t.Fatalf("expected process 1, got %v", cg.pids)
+	}
+
+	// The stats of a collection seeing the cgroup empty may have been read
+	// before the process exited, so are collected again.
+	writeProcs(t, cg.path, "")
+	w.collectStats("memory", time.Now(), 1)
+
+	e := exitedAfterStats(t, w, cg, 300)
+	if !reflect.DeepEqual(e.CompleteStats, []string{"memory"}) {
+		t.Errorf("expected complete memory stats, got %v", e.CompleteStats)
+	}
+}
+
+func TestExitedIncompleteStats(t *testing.T) {
+	w, cg := emptyingWatcher(t)
+	defer os.RemoveAll(w.cgroups["memory"].path)
+
+	// Removed while running, without being seen empty.
+	w.collectStats("memory", time.Now(), 0)
+	e := exitedAfterStats(t, w, cg, 100)
+	if len(e.CompleteStats) != 0 {
+		t.Errorf("expected incomplete stats, got %v", e.CompleteStats)
+	}
+}
+
+func TestUpdatePopulated(t *testing.T) {
+	w, cg := emptyingWatcher(t)
+	defer os.RemoveAll(w.cgroups["memory"].path)
+	events := filepath.Join(cg.path, cgroupEvents)
+
+	if err := ioutil.WriteFile(events, []byte("populated 0\nfrozen 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.cgroupMu.Lock()
+	err := w.updatePopulated(cg.path, cg, false)
+	w.cgroupMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cg.emptied.IsZero() {
+		t.Error("expected a cgroup empty when watched not to be emptied")
+	}
+
+	// A modify event of a cgroup found empty was raised as it was populated
+	// and emptied.
+	w.cgroupMu.Lock()
+	err = w.updatePopulated(cg.path, cg, true)
+	w.cgroupMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := exitedAfterStats(t, w, cg, 100)
+	if !reflect.DeepEqual(e.CompleteStats, []string{"memory"}) {
+		t.Errorf("expected complete memory stats, got %v", e.CompleteStats)
+	}
+}
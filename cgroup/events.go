@@ -0,0 +1,191 @@
+package cgroup
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+const (
+	// eventBufferSize is the number of past events kept for replay to
+	// subscribers resuming from a sequence number.
+	eventBufferSize = 1024
+
+	// eventSubscriptionBuffer is the number of live events buffered for an
+	// event subscriber before it is considered too slow and disconnected.
+	eventSubscriptionBuffer = 256
+)
+
+// eventLog holds the most recent events in a ring buffer.
+type eventLog struct {
+	events []v1.Event
+	next   int
+	seq    uint64
+}
+
+func (l *eventLog) append(e v1.Event) v1.Event {
+	l.seq++
+	e.Sequence = l.seq
+	if len(l.events) < eventBufferSize {
+		l.events = append(l.events, e)
+	} else {
+		l.events[l.next] = e
+		l.next = (l.next + 1) % eventBufferSize
+	}
+	return e
+}
+
+// since returns the buffered events with a sequence number greater than seq
+// in order, and whether some events after seq have already been discarded. A
+// seq ahead of the latest event, e.g. from before a restart, replays all
+// buffered events and is reported as truncated.
+func (l *eventLog) since(seq uint64) ([]v1.Event, bool) {
+	reset := seq > l.seq
+	if reset {
+		seq = 0
+	}
+
+	ordered := make([]v1.Event, 0, len(l.events))
+	ordered = append(ordered, l.events[l.next:]...)
+	ordered = append(ordered, l.events[:l.next]...)
+
+	oldest := l.seq - uint64(len(l.events)) + 1
+	i := sort.Search(len(ordered), func(i int) bool { return ordered[i].Sequence > seq })
+	return ordered[i:], reset || seq+1 < oldest
+}
+
+func (w *watcher) Events(since uint64) *v1.EventList {
+	w.eventsMu.Lock()
+	defer w.eventsMu.Unlock()
+
+	events, truncated := w.events.since(since)
+	return &v1.EventList{
+		Events:       events,
+		LastSequence: w.events.seq,
+		Truncated:    truncated,
+	}
+}
+
+func (w *watcher) SubscribeEvents(since uint64) (<-chan *v1.Event, func()) {
+	w.eventsMu.Lock()
+	defer w.eventsMu.Unlock()
+
+	replay, _ := w.events.since(since)
+	ch := make(chan *v1.Event, len(replay)+eventSubscriptionBuffer)
+	for i := range replay {
+		ch <- &replay[i]
+	}
+	w.eventSubs[ch] = struct{}{}
+
+	cancel := func() {
+		w.eventsMu.Lock()
+		defer w.eventsMu.Unlock()
+		if _, ok := w.eventSubs[ch]; ok {
+			delete(w.eventSubs, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+// publishEvent publishes a lifecycle event for the cgroup at absPath.
+func (w *watcher) publishEvent(eventType, absPath string, added, removed []int32) {
+	w.publish(absPath, v1.Event{
+		Type:        eventType,
+		AddedPids:   added,
+		RemovedPids: removed,
+	})
+}
+
+// publish records e against the cgroup at absPath and sends it to all
+// subscribers. Events are not published until the initial walk of the cgroup
+// tree in Start has completed. Callers must hold cgroupMu.
+func (w *watcher) publish(absPath string, e v1.Event) {
+	if !w.publishEvents {
+		return
+	}
+
+	subsystems, relPath := w.eventTarget(absPath)
+	if len(subsystems) == 0 {
+		return
+	}
+
+	w.eventsMu.Lock()
+	defer w.eventsMu.Unlock()
+
+	e.Timestamp = time.Now()
+	e.Subsystems = subsystems
+	e.Path = relPath
+	e = w.events.append(e)
+	w.log.WithFields(log.Fields{"type": e.Type, "target": absPath, "sequence": e.Sequence}).Debug("Published event")
+
+	for ch := range w.eventSubs {
+		select {
+		case ch <- &e:
+		default:
+			w.log.Warn("Event subscriber is too slow - disconnecting")
+			delete(w.eventSubs, ch)
+			close(ch)
+		}
+	}
+}
+
+// eventTarget returns the subsystems mounted at the mount point containing
+// absPath, and absPath relative to that mount point.
+func (w *watcher) eventTarget(absPath string) ([]string, string) {
+	subsystems := []string{}
+	relPath := ""
+	for subsystem, mountPoint := range w.findCgroupMountpoints(absPath) {
+		rel, err := filepath.Rel(mountPoint, absPath)
+		if err != nil {
+			continue
+		}
+		subsystems = append(subsystems, subsystem)
+		relPath = filepath.Join("/", rel)
+	}
+	sort.Strings(subsystems)
+	return subsystems, relPath
+}
+
+// closeEventSubscriptions closes all subscriber channels when the watcher is
+// stopped.
+func (w *watcher) closeEventSubscriptions() {
+	w.eventsMu.Lock()
+	defer w.eventsMu.Unlock()
+
+	for ch := range w.eventSubs {
+		delete(w.eventSubs, ch)
+		close(ch)
+	}
+}
+
+// diffPIDs returns the pids in to but not in from, and the pids in from but
+// not in to.
+func diffPIDs(from, to []int32) ([]int32, []int32) {
+	fromSet := make(map[int32]struct{}, len(from))
+	for _, pid := range from {
+		fromSet[pid] = struct{}{}
+	}
+	toSet := make(map[int32]struct{}, len(to))
+	for _, pid := range to {
+		toSet[pid] = struct{}{}
+	}
+
+	var added, removed []int32
+	for _, pid := range to {
+		if _, ok := fromSet[pid]; !ok {
+			added = append(added, pid)
+		}
+	}
+	for _, pid := range from {
+		if _, ok := toSet[pid]; !ok {
+			removed = append(removed, pid)
+		}
+	}
+	return added, removed
+}
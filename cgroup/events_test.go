@@ -0,0 +1,102 @@
+package cgroup
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func sequences(events []v1.Event) []uint64 {
+	seqs := []uint64{}
+	for _, e := range events {
+		seqs = append(seqs, e.Sequence)
+	}
+	return seqs
+}
+
+func TestEventLog(t *testing.T) {
+	l := &eventLog{}
+
+	events, truncated := l.since(0)
+	if len(events) != 0 || truncated {
+		t.Errorf("expected no events, got %v (truncated %v)", events, truncated)
+	}
+
+	for i := 0; i < eventBufferSize+10; i++ {
+		l.append(v1.Event{Type: v1.EventCgroupCreated})
+	}
+
+	tests := []struct {
+		since     uint64
+		first     uint64
+		count     int
+		truncated bool
+	}{
+		{0, 11, eventBufferSize, true},
+		{10, 11, eventBufferSize, false},
+		{eventBufferSize, eventBufferSize + 1, 10, false},
+		{eventBufferSize + 10, 0, 0, false},
+		{eventBufferSize + 100, 11, eventBufferSize, true},
+	}
+	for _, test := range tests {
+		events, truncated := l.since(test.since)
+		if len(events) != test.count || truncated != test.truncated {
+			t.Errorf("since %d: expected %d events (truncated %v), got %d (truncated %v)", test.since, test.count, test.truncated, len(events), truncated)
+			continue
+		}
+		seqs := sequences(events)
+		for i, seq := range seqs {
+			if seq != test.first+uint64(i) {
+				t.Errorf("since %d: events out of order: %v", test.since, seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	w := &watcher{
+		cgroups:       map[string]*cgroup{"memory": {name: "memory", path: "/cg/memory"}},
+		eventSubs:     make(map[chan *v1.Event]struct{}),
+		publishEvents: true,
+		log:           testLog,
+	}
+
+	w.publishEvent(v1.EventCgroupCreated, "/cg/memory/a", nil, nil)
+	w.publishEvent(v1.EventCgroupCreated, "/cg/other", nil, nil)
+
+	events, cancel := w.SubscribeEvents(0)
+	defer cancel()
+
+	w.publishEvent(v1.EventProcessesChanged, "/cg/memory/a", []int32{1}, nil)
+
+	want := []v1.Event{
+		{Sequence: 1, Type: v1.EventCgroupCreated, Subsystems: []string{"memory"}, Path: "/a"},
+		{Sequence: 2, Type: v1.EventProcessesChanged, Subsystems: []string{"memory"}, Path: "/a", AddedPids: []int32{1}},
+	}
+	for _, expected := range want {
+		e := <-events
+		e.Timestamp = expected.Timestamp
+		if !reflect.DeepEqual(*e, expected) {
+			t.Errorf("expected %#v, got %#v", expected, *e)
+		}
+	}
+
+	list := w.Events(1)
+	if !reflect.DeepEqual(sequences(list.Events), []uint64{2}) || list.LastSequence != 2 || list.Truncated {
+		t.Errorf("unexpected event list %#v", list)
+	}
+}
+
+func TestDiffPIDs(t *testing.T) {
+	added, removed := diffPIDs([]int32{1, 2, 3}, []int32{2, 3, 4, 5})
+	if !reflect.DeepEqual(added, []int32{4, 5}) || !reflect.DeepEqual(removed, []int32{1}) {
+		t.Errorf("unexpected diff: added %v, removed %v", added, removed)
+	}
+
+	added, removed = diffPIDs(nil, nil)
+	if added != nil || removed != nil {
+		t.Errorf("unexpected diff: added %v, removed %v", added, removed)
+	}
+}
@@ -0,0 +1,182 @@
+package cgroup
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// exitedBufferSize is the number of removed cgroups kept.
+const exitedBufferSize = 256
+
+// exitedLog holds the most recently removed cgroups in a ring buffer.
+type exitedLog struct {
+	exited []v1.ExitedCgroup
+	next   int
+}
+
+func (l *exitedLog) append(e v1.ExitedCgroup) {
+	if len(l.exited) < exitedBufferSize {
+		l.exited = append(l.exited, e)
+		return
+	}
+	l.exited[l.next] = e
+	l.next = (l.next + 1) % exitedBufferSize
+}
+
+// newestFirst returns the removed cgroups, most recently removed first.
+func (l *exitedLog) newestFirst() []v1.ExitedCgroup {
+	ret := make([]v1.ExitedCgroup, 0, len(l.exited))
+	for i := len(l.exited) - 1; i >= 0; i-- {
+		ret = append(ret, l.exited[(l.next+i)%len(l.exited)])
+	}
+	return ret
+}
+
+func (w *watcher) Exited() []v1.ExitedCgroup {
+	w.cgroupMu.RLock()
+	defer w.cgroupMu.RUnlock()
+	return w.exited.newestFirst()
+}
+
+// exitedMergeWindow is how long after a cgroup is removed from one hierarchy
+// its removal from others is merged into the same entry.
+const exitedMergeWindow = time.Minute
+
+// record adds e, merging it into the entry of the same cgroup recently
+// removed from other hierarchies, so each cgroup is listed once.
+func (l *exitedLog) record(e v1.ExitedCgroup) {
+	if prev := l.mergeable(e); prev != nil {
+		mergeExited(prev, e)
+		return
+	}
+	l.append(e)
+}
+
+// mergeable returns the most recent entry with the path of e removed within
+// the merge window from none of the hierarchies of e, or nil.
+func (l *exitedLog) mergeable(e v1.ExitedCgroup) *v1.ExitedCgroup {
+	for i := len(l.exited) - 1; i >= 0; i-- {
+		prev := &l.exited[(l.next+i)%len(l.exited)]
+		if prev.Path != e.Path {
+			continue
+		}
+		if e.Removed.Sub(prev.Removed) > exitedMergeWindow || overlaps(prev.Subsystems, e.Subsystems) {
+			return nil
+		}
+		return prev
+	}
+	return nil
+}
+
+func overlaps(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergeExited merges the removal e of a cgroup from some hierarchies into
+// prev, replacing the stats of the subsystems of e. The subsystems and stats
+// are copied on write, as entries handed out share them.
+func mergeExited(prev *v1.ExitedCgroup, e v1.ExitedCgroup) {
+	subsystems := append([]string(nil), prev.Subsystems...)
+	for _, subsystem := range e.Subsystems {
+		if !overlaps(subsystems, []string{subsystem}) {
+			subsystems = append(subsystems, subsystem)
+		}
+	}
+	sort.Strings(subsystems)
+	prev.Subsystems = subsystems
+
+	stats := make(map[string]*v1.Stats, len(prev.Stats)+len(e.Stats))
+	for subsystem, s := range prev.Stats {
+		stats[subsystem] = s
+	}
+	for subsystem, s := range e.Stats {
+		stats[subsystem] = s
+	}
+	prev.Stats = stats
+
+	var complete []string
+	for _, subsystem := range prev.CompleteStats {
+		if !overlaps(e.Subsystems, []string{subsystem}) {
+			complete = append(complete, subsystem)
+		}
+	}
+	complete = append(complete, e.CompleteStats...)
+	sort.Strings(complete)
+	prev.CompleteStats = complete
+
+	if !e.Created.IsZero() && (prev.Created.IsZero() || e.Created.Before(prev.Created)) {
+		prev.Created = e.Created
+	}
+	if e.Removed.After(prev.Removed) {
+		prev.Removed = e.Removed
+	}
+	if !prev.Created.IsZero() {
+		prev.Lifetime = prev.Removed.Sub(prev.Created).Seconds()
+	}
+	if e.PeakMemory > prev.PeakMemory {
+		prev.PeakMemory = e.PeakMemory
+	}
+	if e.CPUUsage > prev.CPUUsage {
+		prev.CPUUsage = e.CPUUsage
+	}
+}
+
+// recordExited adds a removed cgroup, with the latest stats collected for it,
+// to the recently exited cgroups. Callers must hold cgroupMu.
+func (w *watcher) recordExited(cg *cgroup, subsystems map[string]string, relPath string) {
+	cg.removed, cg.removedPath = time.Now(), relPath
+	w.exited.record(exitedEntry(cg, subsystems, relPath, cg.removed))
+}
+
+// update replaces the stats of subsystem in the entry of the removed cgroup
+// cg, e.g. once a collection started before its removal completes.
+func (l *exitedLog) update(cg *cgroup, subsystem string) {
+	for i := len(l.exited) - 1; i >= 0; i-- {
+		e := &l.exited[(l.next+i)%len(l.exited)]
+		if e.Path == cg.removedPath && overlaps(e.Subsystems, []string{subsystem}) {
+			mergeExited(e, exitedEntry(cg, map[string]string{subsystem: ""}, cg.removedPath, cg.removed))
+			return
+		}
+	}
+}
+
+// exitedEntry returns the entry of cg removed from the hierarchy of
+// subsystems at removed.
+func exitedEntry(cg *cgroup, subsystems map[string]string, relPath string, removed time.Time) v1.ExitedCgroup {
+	e := v1.ExitedCgroup{
+		Path:       relPath,
+		Created:    cg.created,
+		Removed:    removed,
+		PeakMemory: cg.peakMemory,
+		Stats:      map[string]*v1.Stats{},
+	}
+	for subsystem := range subsystems {
+		e.Subsystems = append(e.Subsystems, subsystem)
+		stats := cg.stats[subsystem]
+		if stats == nil {
+			continue
+		}
+		e.Stats[subsystem] = stats
+		if cg.completeStats(subsystem) {
+			e.CompleteStats = append(e.CompleteStats, subsystem)
+		}
+		if stats.CPUStats != nil && stats.CPUStats.CPUUsage != nil && stats.CPUStats.CPUUsage.TotalUsage > e.CPUUsage {
+			e.CPUUsage = stats.CPUStats.CPUUsage.TotalUsage
+		}
+	}
+	sort.Strings(e.Subsystems)
+	sort.Strings(e.CompleteStats)
+	if !cg.created.IsZero() {
+		e.Lifetime = removed.Sub(cg.created).Seconds()
+	}
+	return e
+}
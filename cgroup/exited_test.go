@@ -0,0 +1,112 @@
+package cgroup
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func TestExitedLog(t *testing.T) {
+	var l exitedLog
+	for i := 0; i < exitedBufferSize+2; i++ {
+		l.append(v1.ExitedCgroup{PeakMemory: uint64(i)})
+	}
+	exited := l.newestFirst()
+	if len(exited) != exitedBufferSize {
+		t.Fatalf("expected %d exited cgroups, got %d", exitedBufferSize, len(exited))
+	}
+	if exited[0].PeakMemory != exitedBufferSize+1 || exited[len(exited)-1].PeakMemory != 2 {
+		t.Errorf("expected newest first, got %d to %d", exited[0].PeakMemory, exited[len(exited)-1].PeakMemory)
+	}
+}
+
+// sequenceCollector returns the memory usage of each collection in turn,
+// failing once they run out.
+type sequenceCollector struct {
+	usage []uint64
+}
+
+func (c *sequenceCollector) Collect(path string) (*v1.Stats, error) {
+	if len(c.usage) == 0 {
+		return nil, errors.New("no such cgroup")
+	}
+	usage := c.usage[0]
+	c.usage = c.usage[1:]
+	return &v1.Stats{
+		MemoryStats: &v1.MemoryStats{Usage: v1.MemoryData{Usage: usage}},
+		CPUStats:    &v1.CPUStats{CPUUsage: &v1.CPUUsage{TotalUsage: usage * 10}},
+	}, nil
+}
+
+func TestRecordExited(t *testing.T) {
+	c := &sequenceCollector{usage: []uint64{100, 300, 200}}
+	w := &watcher{subsystems: map[string]collector{"memory": c}, log: testLog}
+	cg := &cgroup{name: "abc", path: "/nonexistent/wurzel/abc", created: time.Now().Add(-time.Minute)}
+
+	subsystems := map[string]string{"memory": "/nonexistent/wurzel"}
+	for i := 0; i < 4; i++ {
+		w.runNow([]*collectTask{{cg: cg, subsystem: "memory", path: cg.path}})
+	}
+	w.recordExited(cg, subsystems, "/abc")
+
+	exited := w.Exited()
+	if len(exited) != 1 {
+		t.Fatalf("expected a single exited cgroup, got %#v", exited)
+	}
+	e := exited[0]
+	if e.Path != "/abc" || !reflect.DeepEqual(e.Subsystems, []string{"memory"}) {
+		t.Errorf("unexpected exited cgroup %#v", e)
+	}
+	if e.PeakMemory != 300 {
+		t.Errorf("expected peak memory 300, got %d", e.PeakMemory)
+	}
+	// The collection after removal failed, so the stats are those read
+	// before.
+	if e.CPUUsage != 2000 || e.Stats["memory"].MemoryStats.Usage.Usage != 200 {
+		t.Errorf("expected the stats of the last collection, got %#v", e.Stats["memory"])
+	}
+	if e.Lifetime < 60 || e.Removed.Before(e.Created) {
+		t.Errorf("unexpected lifetime %v from %v to %v", e.Lifetime, e.Created, e.Removed)
+	}
+}
+
+func TestRecordExitedMerged(t *testing.T) {
+	w := &watcher{log: testLog}
+	created := time.Now().Add(-time.Minute)
+	memory := &cgroup{created: created, peakMemory: 300, stats: map[string]*v1.Stats{
+		"memory": {MemoryStats: &v1.MemoryStats{Usage: v1.MemoryData{Usage: 200}}},
+	}}
+	cpu := &cgroup{created: created.Add(time.Millisecond), stats: map[string]*v1.Stats{
+		"cpu":     {CPUStats: &v1.CPUStats{CPUUsage: &v1.CPUUsage{TotalUsage: 2000}}},
+		"cpuacct": {CPUStats: &v1.CPUStats{CPUUsage: &v1.CPUUsage{TotalUsage: 2000}}},
+	}}
+
+	w.recordExited(memory, map[string]string{"memory": "/sys/fs/cgroup/memory"}, "/docker/abc")
+	w.recordExited(cpu, map[string]string{"cpu": "/sys/fs/cgroup/cpu,cpuacct", "cpuacct": "/sys/fs/cgroup/cpu,cpuacct"}, "/docker/abc")
+	w.recordExited(cpu, map[string]string{"cpu": "/sys/fs/cgroup/cpu,cpuacct"}, "/docker/def")
+
+	exited := w.Exited()
+	if len(exited) != 2 {
+		t.Fatalf("expected the removals from each hierarchy to be merged, got %#v", exited)
+	}
+	e := exited[1]
+	if e.Path != "/docker/abc" || !reflect.DeepEqual(e.Subsystems, []string{"cpu", "cpuacct", "memory"}) {
+		t.Errorf("unexpected merged cgroup %#v", e)
+	}
+	if e.PeakMemory != 300 || e.CPUUsage != 2000 || len(e.Stats) != 3 {
+		t.Errorf("expected the stats of every hierarchy, got %#v", e)
+	}
+	if !e.Created.Equal(created) {
+		t.Errorf("expected earliest creation %v, got %v", created, e.Created)
+	}
+
+	// The cgroup created again and removed from the same hierarchy is listed
+	// separately.
+	w.recordExited(memory, map[string]string{"memory": "/sys/fs/cgroup/memory"}, "/docker/abc")
+	if exited := w.Exited(); len(exited) != 3 || exited[0].Path != "/docker/abc" || len(exited[0].Subsystems) != 1 {
+		t.Errorf("expected a new entry for a later removal, got %#v", exited)
+	}
+}
@@ -0,0 +1,295 @@
+package cgroup
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// unlimitedMemory is the smallest value treated as an unlimited v1 memory
+// limit. The kernel reports unlimited as the maximum int64 rounded down to the
+// page size, which differs between architectures.
+const unlimitedMemory = 1 << 62
+
+// readLimits reads the configured limits of a v1 subsystem, returning nil for
+// subsystems without limits.
+func readLimits(subsystem, path string) (*v1.Limits, error) {
+	switch subsystem {
+	case "memory":
+		limit, err := readUint(filepath.Join(path, "memory.limit_in_bytes"))
+		if err != nil {
+			return nil, err
+		}
+		softLimit, err := readUint(filepath.Join(path, "memory.soft_limit_in_bytes"))
+		if err != nil {
+			return nil, err
+		}
+		// Only present with swap accounting enabled.
+		swapLimit, _ := readUint(filepath.Join(path, "memory.memsw.limit_in_bytes"))
+		return &v1.Limits{Memory: &v1.MemoryLimits{
+			Limit:     memoryLimit(limit),
+			SoftLimit: memoryLimit(softLimit),
+			SwapLimit: memoryLimit(swapLimit),
+		}}, nil
+	case "cpu":
+		shares, err := readUint(filepath.Join(path, "cpu.shares"))
+		if err != nil {
+			return nil, err
+		}
+		// Only present with CFS bandwidth control enabled.
+		quota := int64(-1)
+		if s, err := readString(filepath.Join(path, "cpu.cfs_quota_us")); err == nil {
+			quota, _ = strconv.ParseInt(s, 10, 64)
+		}
+		period, _ := readUint(filepath.Join(path, "cpu.cfs_period_us"))
+		return &v1.Limits{CPU: cpuLimits(quota, period, shares)}, nil
+	case "blkio":
+		// The weight files depend on the IO scheduler, so are all optional.
+		weight, err := readUint(filepath.Join(path, "blkio.weight"))
+		if os.IsNotExist(err) {
+			weight, _ = readUint(filepath.Join(path, "blkio.bfq.weight"))
+		}
+		limits := &v1.BlkioLimits{Weight: weight}
+		limits.WeightDevice, _ = readDeviceValues(filepath.Join(path, "blkio.weight_device"))
+		limits.ReadBpsDevice, _ = readDeviceValues(filepath.Join(path, "blkio.throttle.read_bps_device"))
+		limits.WriteBpsDevice, _ = readDeviceValues(filepath.Join(path, "blkio.throttle.write_bps_device"))
+		limits.ReadIOPSDevice, _ = readDeviceValues(filepath.Join(path, "blkio.throttle.read_iops_device"))
+		limits.WriteIOPSDevice, _ = readDeviceValues(filepath.Join(path, "blkio.throttle.write_iops_device"))
+		return &v1.Limits{Blkio: limits}, nil
+	case "hugetlb":
+		hugetlb, err := readHugetlbLimits(path, "limit_in_bytes")
+		if err != nil {
+			return nil, err
+		}
+		for size, limit := range hugetlb {
+			hugetlb[size] = memoryLimit(limit)
+		}
+		return &v1.Limits{Hugetlb: hugetlb}, nil
+	}
+	return nil, nil
+}
+
+// readUnifiedLimits reads the configured limits from the unified hierarchy,
+// converted to their v1 equivalents.
+func readUnifiedLimits(subsystem, path string) (*v1.Limits, error) {
+	// The root cgroup has no limits.
+	switch subsystem {
+	case "memory":
+		limit, err := readUint(filepath.Join(path, "memory.max"))
+		if err != nil {
+			return nil, nil
+		}
+		softLimit, _ := readUint(filepath.Join(path, "memory.low"))
+		// The v1 swap limit includes memory, so is only limited if both are.
+		var swapLimit uint64
+		if swap, err := readUint(filepath.Join(path, "memory.swap.max")); err == nil && swap > 0 && limit > 0 {
+			swapLimit = limit + swap
+		}
+		return &v1.Limits{Memory: &v1.MemoryLimits{Limit: limit, SoftLimit: softLimit, SwapLimit: swapLimit}}, nil
+	case "cpu":
+		max, err := readString(filepath.Join(path, "cpu.max"))
+		if err != nil {
+			return nil, nil
+		}
+		quota := int64(-1)
+		var period uint64
+		fields := strings.Fields(max)
+		if len(fields) == 2 {
+			if fields[0] != "max" {
+				quota, _ = strconv.ParseInt(fields[0], 10, 64)
+			}
+			period, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+		var shares uint64
+		if weight, err := readUint(filepath.Join(path, "cpu.weight")); err == nil && weight > 0 {
+			// Inverse of the conversion from shares [2-262144] to weight
+			// [1-10000] used by container runtimes.
+			shares = 2 + ((weight-1)*262142)/9999
+		}
+		return &v1.Limits{CPU: cpuLimits(quota, period, shares)}, nil
+	case "blkio":
+		weights, err := readKeyValues(filepath.Join(path, "io.weight"))
+		if err != nil {
+			return nil, nil
+		}
+		limits := &v1.BlkioLimits{Weight: weights["default"]}
+		err = readIOMax(filepath.Join(path, "io.max"), limits)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return &v1.Limits{Blkio: limits}, nil
+	case "hugetlb":
+		hugetlb, err := readHugetlbLimits(path, "max")
+		if err != nil || len(hugetlb) == 0 {
+			return nil, err
+		}
+		return &v1.Limits{Hugetlb: hugetlb}, nil
+	}
+	return nil, nil
+}
+
+func memoryLimit(limit uint64) uint64 {
+	if limit >= unlimitedMemory {
+		return 0
+	}
+	return limit
+}
+
+func cpuLimits(quota int64, period, shares uint64) *v1.CPULimits {
+	limits := &v1.CPULimits{Quota: quota, Period: period, Shares: shares}
+	if quota > 0 && period > 0 {
+		limits.Cores = float64(quota) / float64(period)
+	}
+	return limits
+}
+
+// readHugetlbLimits reads the hugetlb.<size>.<suffix> files, keyed by size.
+func readHugetlbLimits(path, suffix string) (map[string]uint64, error) {
+	files, err := filepath.Glob(filepath.Join(path, "hugetlb.*."+suffix))
+	if err != nil {
+		return nil, err
+	}
+
+	limits := make(map[string]uint64, len(files))
+	for _, file := range files {
+		limit, err := readUint(file)
+		if err != nil {
+			return nil, err
+		}
+		size := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "hugetlb."), "."+suffix)
+		limits[size] = limit
+	}
+	return limits, nil
+}
+
+// readDeviceValues parses blkio device files of "major:minor value" lines.
+func readDeviceValues(path string) ([]v1.BlkioDeviceValue, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values []v1.BlkioDeviceValue
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		major, minor, ok := parseDevice(fields[0])
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values = append(values, v1.BlkioDeviceValue{Major: major, Minor: minor, Value: v})
+	}
+	return values, scanner.Err()
+}
+
+// readIOMax parses io.max lines such as
+// "8:0 rbps=1048576 wbps=max riops=max wiops=100".
+func readIOMax(path string, limits *v1.BlkioLimits) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		major, minor, ok := parseDevice(fields[0])
+		if !ok {
+			continue
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[1] == "max" {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			value := v1.BlkioDeviceValue{Major: major, Minor: minor, Value: v}
+			switch kv[0] {
+			case "rbps":
+				limits.ReadBpsDevice = append(limits.ReadBpsDevice, value)
+			case "wbps":
+				limits.WriteBpsDevice = append(limits.WriteBpsDevice, value)
+			case "riops":
+				limits.ReadIOPSDevice = append(limits.ReadIOPSDevice, value)
+			case "wiops":
+				limits.WriteIOPSDevice = append(limits.WriteIOPSDevice, value)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseDevice parses a "major:minor" device number.
+func parseDevice(s string) (uint64, uint64, bool) {
+	dev := strings.SplitN(s, ":", 2)
+	if len(dev) != 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.ParseUint(dev[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.ParseUint(dev[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// saturation returns usage as a ratio of the configured limits, or nil if
+// nothing is limited.
+func saturation(stats *v1.Stats) *v1.Saturation {
+	s := &v1.Saturation{}
+	limits := stats.Limits
+	if limits == nil {
+		limits = &v1.Limits{}
+	}
+
+	if stats.MemoryStats != nil && limits.Memory != nil {
+		if limits.Memory.Limit > 0 {
+			s.Memory = float64(stats.MemoryStats.Usage.Usage) / float64(limits.Memory.Limit)
+		}
+		if limits.Memory.SwapLimit > 0 {
+			s.MemorySwap = float64(stats.MemoryStats.SwapUsage.Usage) / float64(limits.Memory.SwapLimit)
+		}
+	}
+
+	if stats.PidsStats != nil && stats.PidsStats.Limit > 0 {
+		s.Pids = float64(stats.PidsStats.Current) / float64(stats.PidsStats.Limit)
+	}
+
+	for size, limit := range limits.Hugetlb {
+		usage, ok := stats.HugetlbStats[size]
+		if !ok || limit == 0 {
+			continue
+		}
+		if s.Hugetlb == nil {
+			s.Hugetlb = map[string]float64{}
+		}
+		s.Hugetlb[size] = float64(usage.Usage) / float64(limit)
+	}
+
+	if s.Memory == 0 && s.MemorySwap == 0 && s.Pids == 0 && s.Hugetlb == nil {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,98 @@
+package cgroup
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func TestReadLimits(t *testing.T) {
+	dir := writeFixtures(t, map[string]string{
+		"memory.limit_in_bytes":          "1073741824\n",
+		"memory.soft_limit_in_bytes":     "9223372036854771712\n",
+		"cpu.shares":                     "512\n",
+		"cpu.cfs_quota_us":               "150000\n",
+		"cpu.cfs_period_us":              "100000\n",
+		"blkio.weight":                   "500\n",
+		"blkio.throttle.read_bps_device": "8:0 1048576\n",
+		"hugetlb.2MB.limit_in_bytes":     "4194304\n",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		subsystem string
+		want      *v1.Limits
+	}{
+		{"memory", &v1.Limits{Memory: &v1.MemoryLimits{Limit: 1 << 30}}},
+		{"cpu", &v1.Limits{CPU: &v1.CPULimits{Quota: 150000, Period: 100000, Shares: 512, Cores: 1.5}}},
+		{"blkio", &v1.Limits{Blkio: &v1.BlkioLimits{Weight: 500, ReadBpsDevice: []v1.BlkioDeviceValue{{Major: 8, Minor: 0, Value: 1048576}}}}},
+		{"hugetlb", &v1.Limits{Hugetlb: map[string]uint64{"2MB": 4194304}}},
+		{"cpuacct", nil},
+	}
+
+	for _, test := range tests {
+		got, err := readLimits(test.subsystem, dir)
+		if err != nil {
+			t.Errorf("%s: %v", test.subsystem, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v, got %#v", test.subsystem, test.want, got)
+		}
+	}
+}
+
+func TestReadUnifiedLimits(t *testing.T) {
+	dir := writeFixtures(t, map[string]string{
+		"memory.max":      "1073741824\n",
+		"memory.low":      "0\n",
+		"memory.swap.max": "max\n",
+		"cpu.max":         "max 100000\n",
+		"cpu.weight":      "100\n",
+		"io.weight":       "default 100\n",
+		"io.max":          "8:0 rbps=max wbps=1024 riops=max wiops=10\n",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		subsystem string
+		want      *v1.Limits
+	}{
+		{"memory", &v1.Limits{Memory: &v1.MemoryLimits{Limit: 1 << 30}}},
+		{"cpu", &v1.Limits{CPU: &v1.CPULimits{Quota: -1, Period: 100000, Shares: 2597}}},
+		{"blkio", &v1.Limits{Blkio: &v1.BlkioLimits{
+			Weight:          100,
+			WriteBpsDevice:  []v1.BlkioDeviceValue{{Major: 8, Minor: 0, Value: 1024}},
+			WriteIOPSDevice: []v1.BlkioDeviceValue{{Major: 8, Minor: 0, Value: 10}},
+		}}},
+		{"pids", nil},
+	}
+
+	for _, test := range tests {
+		got, err := readUnifiedLimits(test.subsystem, dir)
+		if err != nil {
+			t.Errorf("%s: %v", test.subsystem, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v, got %#v", test.subsystem, test.want, got)
+		}
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	stats := &v1.Stats{
+		MemoryStats: &v1.MemoryStats{Usage: v1.MemoryData{Usage: 256}},
+		Limits:      &v1.Limits{Memory: &v1.MemoryLimits{Limit: 1024}},
+	}
+	if got := saturation(stats); !reflect.DeepEqual(got, &v1.Saturation{Memory: 0.25}) {
+		t.Errorf("unexpected saturation: %#v", got)
+	}
+
+	stats = &v1.Stats{PidsStats: &v1.PidsStats{Current: 10}}
+	if got := saturation(stats); got != nil {
+		t.Errorf("expected no saturation without limits, got %#v", got)
+	}
+}
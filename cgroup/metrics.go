@@ -0,0 +1,213 @@
+package cgroup
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jimmidyson/wurzel/metrics"
+)
+
+// Registerer registers the metrics of a watcher on creating it, and
+// unregisters them on stopping it.
+type Registerer interface {
+	Register(c prometheus.Collector) error
+	Unregister(c prometheus.Collector) bool
+}
+
+// DefaultRegisterer registers metrics with the default Prometheus registry.
+var DefaultRegisterer Registerer = defaultRegisterer{}
+
+type defaultRegisterer struct{}
+
+func (defaultRegisterer) Register(c prometheus.Collector) error  { return prometheus.Register(c) }
+func (defaultRegisterer) Unregister(c prometheus.Collector) bool { return prometheus.Unregister(c) }
+
+// watcherMetrics holds the metrics of a single watcher.
+type watcherMetrics struct {
+	inotifyCount             prometheus.Gauge
+	cgroupCount              *prometheus.GaugeVec
+	subsystemEnabled         *prometheus.GaugeVec
+	statsCollection          prometheus.Summary
+	subsystemStatsCollection *prometheus.SummaryVec
+	collectionInterval       *prometheus.GaugeVec
+	droppedRounds            *prometheus.CounterVec
+	idleSkipped              *prometheus.CounterVec
+	oomEvents                *prometheus.CounterVec
+	allOOMEvents             prometheus.Counter
+	memoryPressureEvents     *prometheus.CounterVec
+	reconciliations          *prometheus.CounterVec
+	reconciledDrift          *prometheus.CounterVec
+}
+
+// newWatcherMetrics returns the metrics of a watcher, with labels added to
+// every metric.
+func newWatcherMetrics(labels prometheus.Labels) *watcherMetrics {
+	return &watcherMetrics{
+		inotifyCount: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "fsnotify_count_current",
+				Help:        "The current number of fs notifies labeled by subsystem.",
+				ConstLabels: labels,
+			},
+		),
+		cgroupCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "cgroup_count_current",
+				Help:        "The current number of cgroups in each subsystem.",
+				ConstLabels: labels,
+			},
+			[]string{"subsystem"},
+		),
+		subsystemEnabled: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "subsystem_enabled",
+				Help:        "A metric with a constant '0' for disabled or '1' for enabled labeled by subsystem.",
+				ConstLabels: labels,
+			},
+			[]string{"subsystem"},
+		),
+		statsCollection: prometheus.NewSummary(
+			prometheus.SummaryOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "stats_collection_duration_microseconds",
+				Help:        "The time taken to collect cgroup stats.",
+				ConstLabels: labels,
+			},
+		),
+		subsystemStatsCollection: prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "subsystem_stats_collection_duration_microseconds",
+				Help:        "The time taken to collect cgroup stats, labeled by subsystem.",
+				ConstLabels: labels,
+			},
+			[]string{"subsystem"},
+		),
+		collectionInterval: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "stats_collection_interval_seconds",
+				Help:        "The effective interval between cgroup stats collections, labeled by subsystem.",
+				ConstLabels: labels,
+			},
+			[]string{"subsystem"},
+		),
+		droppedRounds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "stats_collection_dropped_rounds_total",
+				Help:        "The number of cgroup stats collection rounds missed as a round took longer than the interval, labeled by subsystem.",
+				ConstLabels: labels,
+			},
+			[]string{"subsystem"},
+		),
+		idleSkipped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "stats_collection_idle_skipped_total",
+				Help:        "The number of collections of idle cgroups skipped, labeled by subsystem.",
+				ConstLabels: labels,
+			},
+			[]string{"subsystem"},
+		),
+		oomEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "oom_events_total",
+				Help:        "The number of OOM events labeled by cgroup.",
+				ConstLabels: labels,
+			},
+			[]string{"cgroup"},
+		),
+		allOOMEvents: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "oom_events_all_cgroups_total",
+				Help:        "The number of OOM events of all cgroups, including those removed or renamed since.",
+				ConstLabels: labels,
+			},
+		),
+		memoryPressureEvents: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "memory_pressure_events_total",
+				Help:        "The number of memory pressure events labeled by cgroup and level.",
+				ConstLabels: labels,
+			},
+			[]string{"cgroup", "level"},
+		),
+		reconciliations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "reconciliations_total",
+				Help:        "The number of reconciliations of the watched cgroups against cgroupfs, labeled by reason.",
+				ConstLabels: labels,
+			},
+			[]string{"reason"},
+		),
+		reconciledDrift: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   metrics.Namespace,
+				Subsystem:   MetricsSubsystem,
+				Name:        "reconciled_cgroups_total",
+				Help:        "The number of cgroups missed by watch events and repaired by reconciliation, labeled by action.",
+				ConstLabels: labels,
+			},
+			[]string{"action"},
+		),
+	}
+}
+
+func (m *watcherMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.inotifyCount,
+		m.cgroupCount,
+		m.subsystemEnabled,
+		m.statsCollection,
+		m.subsystemStatsCollection,
+		m.collectionInterval,
+		m.droppedRounds,
+		m.idleSkipped,
+		m.oomEvents,
+		m.allOOMEvents,
+		m.memoryPressureEvents,
+		m.reconciliations,
+		m.reconciledDrift,
+	}
+}
+
+// register registers every metric with r, unregistering those already
+// registered if any fails.
+func (m *watcherMetrics) register(r Registerer) error {
+	var registered []prometheus.Collector
+	for _, c := range m.collectors() {
+		if err := r.Register(c); err != nil {
+			for _, c := range registered {
+				r.Unregister(c)
+			}
+			return err
+		}
+		registered = append(registered, c)
+	}
+	return nil
+}
+
+func (m *watcherMetrics) unregister(r Registerer) {
+	for _, c := range m.collectors() {
+		r.Unregister(c)
+	}
+}
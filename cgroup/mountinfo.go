@@ -0,0 +1,118 @@
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+
+	"github.com/jimmidyson/wurzel/host"
+)
+
+// findHostMounts returns the cgroup hierarchies mounted on the host, as listed
+// in the mountinfo of the host's init process, with their mount points
+// translated to where the host's /proc and /sys are mounted.
+func findHostMounts() ([]cgroups.Mount, string, error) {
+	f, err := os.Open(host.Proc("1", "mountinfo"))
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	mounts, unifiedMount, err := parseMountInfo(f)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range mounts {
+		mounts[i].Mountpoint = host.Translate(mounts[i].Mountpoint)
+	}
+	if unifiedMount != "" {
+		unifiedMount = host.Translate(unifiedMount)
+	}
+	return mounts, unifiedMount, nil
+}
+
+// parseMountInfo parses a /proc/<pid>/mountinfo file, returning the mounted v1
+// hierarchies and the mount point of the unified hierarchy, empty if not
+// mounted. Lines are formatted as
+//
+//	36 35 0:30 / /sys/fs/cgroup/memory rw,nosuid shared:16 - cgroup cgroup rw,memory
+//
+// with a variable number of optional fields before the separator, and the
+// subsystems of v1 hierarchies listed in the super block options.
+func parseMountInfo(r io.Reader) ([]cgroups.Mount, string, error) {
+	known := map[string]bool{}
+	for _, subsystem := range allSubsystems {
+		known[subsystem] = true
+	}
+
+	var (
+		mounts       []cgroups.Mount
+		unifiedMount string
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+4 {
+			return nil, "", fmt.Errorf("invalid mountinfo line %q", line)
+		}
+
+		root, mountpoint, fstype := unescapeMountPath(fields[3]), unescapeMountPath(fields[4]), fields[sep+1]
+		switch fstype {
+		case "cgroup2":
+			if unifiedMount == "" {
+				unifiedMount = mountpoint
+			}
+		case "cgroup":
+			m := cgroups.Mount{Mountpoint: mountpoint, Root: root}
+			for _, opt := range strings.Split(fields[sep+3], ",") {
+				if known[opt] || strings.HasPrefix(opt, "name=") {
+					m.Subsystems = append(m.Subsystems, opt)
+				}
+			}
+			if len(m.Subsystems) > 0 {
+				mounts = append(mounts, m)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	return mounts, unifiedMount, nil
+}
+
+// unescapeMountPath replaces the octal escapes the kernel uses for spaces,
+// tabs, newlines and backslashes in mountinfo paths.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+
+	"github.com/jimmidyson/wurzel/host"
+)
+
+const testMountInfo = `22 27 0:20 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+25 22 0:23 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755
+26 25 0:24 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup rw
+27 25 0:25 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,xattr,name=systemd
+30 25 0:28 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:14 - cgroup cgroup rw,cpu,cpuacct
+31 25 0:29 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:15 - cgroup cgroup rw,memory
+40 27 0:35 /docker /var/lib/my\040cgroups rw,relatime - cgroup cgroup rw,pids
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, unifiedMount, err := parseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cgroups.Mount{
+		{Mountpoint: "/sys/fs/cgroup/systemd", Root: "/", Subsystems: []string{"name=systemd"}},
+		{Mountpoint: "/sys/fs/cgroup/cpu,cpuacct", Root: "/", Subsystems: []string{"cpu", "cpuacct"}},
+		{Mountpoint: "/sys/fs/cgroup/memory", Root: "/", Subsystems: []string{"memory"}},
+		{Mountpoint: "/var/lib/my cgroups", Root: "/docker", Subsystems: []string{"pids"}},
+	}
+	if !reflect.DeepEqual(mounts, want) {
+		t.Errorf("expected mounts %+v, got %+v", want, mounts)
+	}
+	if unifiedMount != "/sys/fs/cgroup/unified" {
+		t.Errorf("expected unified mount /sys/fs/cgroup/unified, got %s", unifiedMount)
+	}
+
+	if _, _, err := parseMountInfo(strings.NewReader("1 2 0:3 / /sys rw\n")); err == nil {
+		t.Error("expected error for line without separator")
+	}
+}
+
+func TestFindHostMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "proc", "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "proc", "1", "mountinfo"), []byte(testMountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer host.SetProc("/proc")
+	defer host.SetSys("/sys")
+	if err := host.SetProc(filepath.Join(dir, "proc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.SetSys(filepath.Join(dir, "sys")); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, unifiedMount, err := findMounts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 4 || mounts[2].Mountpoint != filepath.Join(dir, "sys/fs/cgroup/memory") {
+		t.Errorf("expected mounts translated below %s, got %+v", dir, mounts)
+	}
+	if mounts[3].Mountpoint != "/var/lib/my cgroups" {
+		t.Errorf("expected mount outside /sys to be unchanged, got %s", mounts[3].Mountpoint)
+	}
+	if want := filepath.Join(dir, "sys/fs/cgroup/unified"); unifiedMount != want {
+		t.Errorf("expected unified mount %s, got %s", want, unifiedMount)
+	}
+}
@@ -0,0 +1,62 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/cgroups/fs"
+
+	"github.com/jimmidyson/wurzel/host"
+)
+
+// findMounts returns the mounted v1 hierarchies and the mount point of the
+// unified hierarchy, empty if not mounted. If root is empty they are found in
+// the mount table, or the host's if its /proc is mounted elsewhere, otherwise
+// below root.
+func findMounts(root string) ([]cgroups.Mount, string, error) {
+	if root == "" && host.Relocated() {
+		return findHostMounts()
+	}
+	if root == "" {
+		mounts, err := cgroups.GetCgroupMounts()
+		if err != nil {
+			return nil, "", err
+		}
+		unifiedMount, err := findUnifiedMount()
+		if err != nil {
+			return nil, "", err
+		}
+		return mounts, unifiedMount, nil
+	}
+
+	if isUnified(root) {
+		return nil, root, nil
+	}
+
+	var mounts []cgroups.Mount
+	for _, subsystem := range allSubsystems {
+		// Hierarchies of subsystems mounted together are usually linked
+		// to, e.g. cpu -> cpu,cpuacct, so resolve links to find them.
+		mountpoint, err := filepath.EvalSymlinks(filepath.Join(root, subsystem))
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(mountpoint, fs.CgroupProcesses)); err != nil {
+			continue
+		}
+		mounts = append(mounts, cgroups.Mount{Mountpoint: mountpoint, Subsystems: []string{subsystem}})
+	}
+
+	unifiedMount := filepath.Join(root, "unified")
+	if !isUnified(unifiedMount) {
+		unifiedMount = ""
+	}
+	return mounts, unifiedMount, nil
+}
+
+// isUnified returns true if the unified hierarchy is mounted at path.
+func isUnified(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "cgroup.controllers"))
+	return err == nil
+}
@@ -0,0 +1,154 @@
+package cgroup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+const eventControlFile = "cgroup.event_control"
+
+var memoryPressureLevels = []string{v1.MemoryPressureLow, v1.MemoryPressureMedium, v1.MemoryPressureCritical}
+
+// memoryNotifier holds the eventfds registered for OOM and memory pressure
+// notifications of a v1 memory cgroup.
+type memoryNotifier struct {
+	eventfds []*os.File
+	// relPath labels the notification metrics of the cgroup.
+	relPath string
+	metrics *watcherMetrics
+	// closed is set once the metrics of the cgroup are deleted, after which
+	// notifications still read only count in the aggregate metrics.
+	closed bool
+}
+
+// registerMemoryEvents registers for OOM and memory pressure notifications of
+// the memory cgroup at absPath, publishing an event for each notification.
+// Returns nil if the cgroup does not support notifications, e.g. on the
+// unified hierarchy.
+func (w *watcher) registerMemoryEvents(absPath string) *memoryNotifier {
+	if _, err := os.Stat(filepath.Join(absPath, eventControlFile)); err != nil {
+		return nil
+	}
+
+	_, relPath := w.eventTarget(absPath)
+	n := &memoryNotifier{relPath: relPath, metrics: w.metrics}
+	register := func(file, arg string, publish func(count uint64)) {
+		eventfd, err := registerEventfd(absPath, file, arg)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				w.log.WithFields(log.Fields{"target": absPath, "file": file, "error": err}).Error("Failed to register for notifications")
+			}
+			return
+		}
+		n.eventfds = append(n.eventfds, eventfd)
+		go w.readEventfd(absPath, eventfd, publish)
+	}
+
+	register("memory.oom_control", "", func(count uint64) {
+		w.metrics.allOOMEvents.Add(float64(count))
+		if !n.closed {
+			w.metrics.oomEvents.WithLabelValues(relPath).Add(float64(count))
+		}
+		w.publish(absPath, v1.Event{Type: v1.EventOOM})
+	})
+	for _, level := range memoryPressureLevels {
+		level := level
+		register("memory.pressure_level", level, func(count uint64) {
+			if !n.closed {
+				w.metrics.memoryPressureEvents.WithLabelValues(relPath, level).Add(float64(count))
+			}
+			w.publish(absPath, v1.Event{Type: v1.EventMemoryPressure, Level: level})
+		})
+	}
+
+	return n
+}
+
+// close unregisters the notifications and deletes their metrics labeled by
+// the cgroup. The OOM events of the cgroup remain counted in allOOMEvents.
+// Callers must hold cgroupMu.
+func (n *memoryNotifier) close() {
+	if n == nil {
+		return
+	}
+	for _, eventfd := range n.eventfds {
+		eventfd.Close()
+	}
+	n.eventfds = nil
+	n.closed = true
+
+	n.metrics.oomEvents.DeleteLabelValues(n.relPath)
+	for _, level := range memoryPressureLevels {
+		n.metrics.memoryPressureEvents.DeleteLabelValues(n.relPath, level)
+	}
+}
+
+// registerEventfd returns a non-blocking eventfd registered via
+// cgroup.event_control for notifications on file. The kernel drops the
+// registration when the eventfd is closed.
+func registerEventfd(cgroupPath, file, arg string) (*os.File, error) {
+	evFile, err := os.Open(filepath.Join(cgroupPath, file))
+	if err != nil {
+		return nil, err
+	}
+	defer evFile.Close()
+
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	eventfd := os.NewFile(fd, "eventfd")
+
+	// Use the raw fd as eventfd.Fd() would switch it to blocking mode, and
+	// closing it would no longer interrupt reads.
+	data := fmt.Sprintf("%d %d %s", fd, evFile.Fd(), arg)
+	err = ioutil.WriteFile(filepath.Join(cgroupPath, eventControlFile), []byte(data), 0700)
+	if err != nil {
+		eventfd.Close()
+		return nil, err
+	}
+
+	return eventfd, nil
+}
+
+// readEventfd calls publish with the number of notifications on eventfd
+// since the last call until it is closed or the cgroup is removed.
+// Notifications raised in quick succession, e.g. memory pressure while
+// reclaiming, are thereby published as a single event.
+func (w *watcher) readEventfd(absPath string, eventfd *os.File, publish func(count uint64)) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := eventfd.Read(buf); err != nil {
+			return
+		}
+
+		// Reads return the number of signals since the last read. The
+		// eventfd is also signalled once when the cgroup is removed, so
+		// notifications raised just before, e.g. an OOM kill followed by
+		// the runtime removing the cgroup, are read along with it.
+		count := *(*uint64)(unsafe.Pointer(&buf[0]))
+		_, err := os.Lstat(filepath.Join(absPath, eventControlFile))
+		removed := os.IsNotExist(err)
+		if removed {
+			count--
+		}
+
+		if count > 0 {
+			w.cgroupMu.Lock()
+			publish(count)
+			w.cgroupMu.Unlock()
+		}
+
+		if removed {
+			return
+		}
+	}
+}
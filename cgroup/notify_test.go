@@ -0,0 +1,100 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func countMetrics(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestMemoryNotifierClose(t *testing.T) {
+	m := newWatcherMetrics(nil)
+	for _, relPath := range []string{"/a", "/b"} {
+		m.oomEvents.WithLabelValues(relPath).Inc()
+		m.memoryPressureEvents.WithLabelValues(relPath, v1.MemoryPressureLow).Inc()
+	}
+
+	m.allOOMEvents.Add(2)
+
+	n := &memoryNotifier{relPath: "/a", metrics: m}
+	n.close()
+
+	if got := countMetrics(m.oomEvents); got != 1 {
+		t.Errorf("expected only the OOM events of /b to be kept, got %d series", got)
+	}
+	if got := countMetrics(m.memoryPressureEvents); got != 1 {
+		t.Errorf("expected only the memory pressure events of /b to be kept, got %d series", got)
+	}
+	if got := counterValue(t, m.allOOMEvents); got != 2 {
+		t.Errorf("expected the OOM events of all cgroups to be kept, got %v", got)
+	}
+}
+
+// signalEventfd returns an eventfd signalled count times.
+func signalEventfd(t *testing.T, count uint64) *os.File {
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	eventfd := os.NewFile(fd, "eventfd")
+	if _, err := eventfd.Write((*[8]byte)(unsafe.Pointer(&count))[:]); err != nil {
+		t.Fatal(err)
+	}
+	return eventfd
+}
+
+func TestReadEventfd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, eventControlFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &watcher{}
+	published := uint64(0)
+	publish := func(count uint64) { published += count }
+	readPublished := func() uint64 {
+		w.cgroupMu.Lock()
+		defer w.cgroupMu.Unlock()
+		return published
+	}
+
+	// Every notification since the last read is published.
+	eventfd := signalEventfd(t, 2)
+	done := make(chan struct{})
+	go func() {
+		w.readEventfd(dir, eventfd, publish)
+		close(done)
+	}()
+	waitFor(t, "expected 2 notifications", func() bool { return readPublished() == 2 })
+	eventfd.Close()
+	<-done
+
+	// A notification read along with the removal of the cgroup is still
+	// published.
+	if err := os.Remove(filepath.Join(dir, eventControlFile)); err != nil {
+		t.Fatal(err)
+	}
+	eventfd = signalEventfd(t, 2)
+	defer eventfd.Close()
+	w.readEventfd(dir, eventfd, publish)
+	if got := readPublished(); got != 3 {
+		t.Errorf("expected the notification before the removal to be published, got %d notifications", got-2)
+	}
+}
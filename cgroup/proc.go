@@ -0,0 +1,51 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jimmidyson/wurzel/host"
+)
+
+// ProcessCgroupPaths returns the paths of the cgroups the process with the
+// given pid belongs to, keyed by subsystem, as listed in /proc/<pid>/cgroup
+// below the host's /proc. See ParseProcessCgroups.
+func ProcessCgroupPaths(pid int32) (map[string]string, error) {
+	f, err := os.Open(host.Proc(strconv.Itoa(int(pid)), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseProcessCgroups(f)
+}
+
+// ParseProcessCgroups parses the hierarchy-ID:controller-list:path lines of a
+// /proc/<pid>/cgroup file, returning the cgroup paths keyed by subsystem.
+// Named hierarchies are keyed by their name, e.g. name=systemd, and the
+// cgroup v2 unified hierarchy by the empty string.
+func ParseProcessCgroups(r io.Reader) (map[string]string, error) {
+	paths := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid cgroup line %q", line)
+		}
+		if fields[1] == "" {
+			paths[""] = fields[2]
+			continue
+		}
+		for _, subsystem := range strings.Split(fields[1], ",") {
+			paths[subsystem] = fields[2]
+		}
+	}
+	return paths, scanner.Err()
+}
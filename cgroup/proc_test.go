@@ -0,0 +1,51 @@
+package cgroup
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProcessCgroups(t *testing.T) {
+	paths, err := ParseProcessCgroups(strings.NewReader(`12:pids:/system.slice/sshd.service
+4:cpu,cpuacct:/system.slice/sshd.service
+3:memory:/docker/abc
+1:name=systemd:/system.slice/sshd.service
+0::/system.slice/sshd.service
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"pids":         "/system.slice/sshd.service",
+		"cpu":          "/system.slice/sshd.service",
+		"cpuacct":      "/system.slice/sshd.service",
+		"memory":       "/docker/abc",
+		"name=systemd": "/system.slice/sshd.service",
+		"":             "/system.slice/sshd.service",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected %v, got %v", want, paths)
+	}
+
+	_, err = ParseProcessCgroups(strings.NewReader("invalid\n"))
+	if err == nil {
+		t.Error("expected error for invalid line")
+	}
+}
+
+func TestProcessCgroupPaths(t *testing.T) {
+	paths, err := ProcessCgroupPaths(int32(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Error("expected cgroups for own process")
+	}
+
+	_, err = ProcessCgroupPaths(-1)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
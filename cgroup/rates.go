@@ -0,0 +1,190 @@
+package cgroup
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+const nanosecondsPerSecond = 1e9
+
+// rates derives the rates between prev and cur, collected seconds apart.
+// limits are used for the CPU quota percentage and may be nil.
+func rates(prev, cur *v1.Stats, seconds float64, limits *v1.CPULimits) *v1.Rates {
+	if prev == nil || seconds <= 0 {
+		return nil
+	}
+	r := &v1.Rates{Interval: seconds}
+
+	if prev.CPUStats != nil && cur.CPUStats != nil {
+		if p, c := prev.CPUStats.CPUUsage, cur.CPUStats.CPUUsage; p != nil && c != nil {
+			r.CPUCores = perSecond(p.TotalUsage, c.TotalUsage, seconds*nanosecondsPerSecond)
+			r.CPUUserCores = perSecond(p.UsageInUsermode, c.UsageInUsermode, seconds*nanosecondsPerSecond)
+			r.CPUSystemCores = perSecond(p.UsageInKernelmode, c.UsageInKernelmode, seconds*nanosecondsPerSecond)
+			if r.CPUCores != nil && limits != nil && limits.Cores > 0 {
+				percent := *r.CPUCores / limits.Cores * 100
+				r.CPUQuotaPercent = &percent
+			}
+		}
+		if p, c := prev.CPUStats.ThrottlingData, cur.CPUStats.ThrottlingData; p != nil && c != nil {
+			if c.Periods >= p.Periods && c.ThrottledPeriods >= p.ThrottledPeriods {
+				var ratio float64
+				if c.Periods > p.Periods {
+					ratio = float64(c.ThrottledPeriods-p.ThrottledPeriods) / float64(c.Periods-p.Periods)
+				}
+				r.CPUThrottledRatio = &ratio
+			}
+		}
+	}
+
+	if prev.MemoryStats != nil && cur.MemoryStats != nil {
+		r.PageFaults = memoryStatRate(prev.MemoryStats, cur.MemoryStats, seconds, "total_pgfault", "pgfault")
+		r.MajorPageFaults = memoryStatRate(prev.MemoryStats, cur.MemoryStats, seconds, "total_pgmajfault", "pgmajfault")
+	}
+
+	if prev.BlkioStats != nil && cur.BlkioStats != nil {
+		r.Blkio = blkioRates(prev.BlkioStats, cur.BlkioStats, seconds)
+	}
+
+	return r
+}
+
+// perSecond returns the rate of a counter, or nil if it was reset.
+func perSecond(prev, cur uint64, seconds float64) *float64 {
+	if cur < prev {
+		return nil
+	}
+	rate := float64(cur-prev) / seconds
+	return &rate
+}
+
+// memoryStatRate returns the rate of the first of names found in both
+// memory.stat samples, or nil if none is or its counter was reset.
+func memoryStatRate(prev, cur *v1.MemoryStats, seconds float64, names ...string) *float64 {
+	for _, name := range names {
+		p, ok := prev.Stats[name]
+		if !ok {
+			continue
+		}
+		c, ok := cur.Stats[name]
+		if !ok {
+			continue
+		}
+		return perSecond(p, c, seconds)
+	}
+	return nil
+}
+
+type blkioDevice struct {
+	major, minor uint64
+}
+
+// blkioCounters are the cumulative bytes and operations of a single device.
+type blkioCounters struct {
+	readBytes, writeBytes, readOps, writeOps uint64
+}
+
+func blkioDeviceCounters(stats *v1.BlkioStats) map[blkioDevice]*blkioCounters {
+	devices := map[blkioDevice]*blkioCounters{}
+	device := func(e v1.BlkioStatEntry) *blkioCounters {
+		d := blkioDevice{e.Major, e.Minor}
+		c, ok := devices[d]
+		if !ok {
+			c = &blkioCounters{}
+			devices[d] = c
+		}
+		return c
+	}
+
+	for _, e := range stats.IoServiceBytesRecursive {
+		switch e.Op {
+		case "Read":
+			device(e).readBytes = e.Value
+		case "Write":
+			device(e).writeBytes = e.Value
+		}
+	}
+	for _, e := range stats.IoServicedRecursive {
+		switch e.Op {
+		case "Read":
+			device(e).readOps = e.Value
+		case "Write":
+			device(e).writeOps = e.Value
+		}
+	}
+	return devices
+}
+
+// blkioRates returns the per-device rates of the devices in both samples,
+// except those any of whose counters were reset.
+func blkioRates(prev, cur *v1.BlkioStats, seconds float64) []v1.BlkioDeviceRates {
+	prevDevices := blkioDeviceCounters(prev)
+
+	var ret []v1.BlkioDeviceRates
+	for d, c := range blkioDeviceCounters(cur) {
+		p, ok := prevDevices[d]
+		if !ok {
+			continue
+		}
+		readBytes := perSecond(p.readBytes, c.readBytes, seconds)
+		writeBytes := perSecond(p.writeBytes, c.writeBytes, seconds)
+		readOps := perSecond(p.readOps, c.readOps, seconds)
+		writeOps := perSecond(p.writeOps, c.writeOps, seconds)
+		if readBytes == nil || writeBytes == nil || readOps == nil || writeOps == nil {
+			continue
+		}
+		ret = append(ret, v1.BlkioDeviceRates{
+			Major:      d.major,
+			Minor:      d.minor,
+			ReadBytes:  *readBytes,
+			WriteBytes: *writeBytes,
+			ReadOps:    *readOps,
+			WriteOps:   *writeOps,
+		})
+	}
+	sort.Sort(byDevice(ret))
+	return ret
+}
+
+type byDevice []v1.BlkioDeviceRates
+
+func (s byDevice) Len() int      { return len(s) }
+func (s byDevice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byDevice) Less(i, j int) bool {
+	if s[i].Major != s[j].Major {
+		return s[i].Major < s[j].Major
+	}
+	return s[i].Minor < s[j].Minor
+}
+
+// sharedCPULimits returns the CPU limits from stats or, as the cpu and cpuacct
+// subsystems are usually mounted together, the cpu stats of the same cgroup.
+func sharedCPULimits(cg *cgroup, stats *v1.Stats) *v1.CPULimits {
+	for _, s := range []*v1.Stats{stats, cg.stats["cpu"]} {
+		if s != nil && s.Limits != nil && s.Limits.CPU != nil {
+			return s.Limits.CPU
+		}
+	}
+	return nil
+}
+
+// statsChanged returns true if the stats differ, ignoring the interval the
+// rates were derived over. Missing rates equal rates of zero.
+func statsChanged(prev, cur *v1.Stats) bool {
+	if prev == nil || cur == nil {
+		return prev != cur
+	}
+	p, c := *prev, *cur
+	p.Rates, c.Rates = withoutInterval(p.Rates), withoutInterval(c.Rates)
+	return !reflect.DeepEqual(&p, &c)
+}
+
+func withoutInterval(r *v1.Rates) *v1.Rates {
+	if r == nil {
+		return &v1.Rates{}
+	}
+	ret := *r
+	ret.Interval = 0
+	return &ret
+}
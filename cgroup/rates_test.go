@@ -0,0 +1,88 @@
+package cgroup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func testRatesStats(cpu, user, periods, throttled, pgfault, readBytes, reads uint64) *v1.Stats {
+	return &v1.Stats{
+		CPUStats: &v1.CPUStats{
+			CPUUsage:       &v1.CPUUsage{TotalUsage: cpu, UsageInUsermode: user, UsageInKernelmode: cpu - user},
+			ThrottlingData: &v1.ThrottlingData{Periods: periods, ThrottledPeriods: throttled},
+		},
+		MemoryStats: &v1.MemoryStats{Stats: map[string]uint64{"total_pgfault": pgfault, "total_pgmajfault": 1}},
+		BlkioStats: &v1.BlkioStats{
+			IoServiceBytesRecursive: []v1.BlkioStatEntry{
+				{Major: 8, Minor: 0, Op: "Read", Value: readBytes},
+				{Major: 8, Minor: 0, Op: "Total", Value: readBytes},
+				{Major: 7, Minor: 1, Op: "Write", Value: 10},
+			},
+			IoServicedRecursive: []v1.BlkioStatEntry{
+				{Major: 8, Minor: 0, Op: "Read", Value: reads},
+			},
+		},
+	}
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestRates(t *testing.T) {
+	prev := testRatesStats(1e9, 5e8, 100, 10, 1000, 4096, 1)
+	cur := testRatesStats(4e9, 2e9, 120, 15, 1400, 4096+2*8192, 5)
+
+	got := rates(prev, cur, 2, &v1.CPULimits{Cores: 2})
+	want := &v1.Rates{
+		Interval:          2,
+		CPUCores:          float(1.5),
+		CPUUserCores:      float(0.75),
+		CPUSystemCores:    float(0.75),
+		CPUQuotaPercent:   float(75),
+		CPUThrottledRatio: float(0.25),
+		PageFaults:        float(200),
+		MajorPageFaults:   float(0),
+		Blkio: []v1.BlkioDeviceRates{
+			{Major: 7, Minor: 1},
+			{Major: 8, Minor: 0, ReadBytes: 8192, ReadOps: 2},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %#v, got %#v", want, got)
+	}
+
+	// Counters that were reset, e.g. as the cgroup was recreated, are omitted
+	// rather than reported as a rate of zero.
+	got = rates(cur, prev, 2, nil)
+	want = &v1.Rates{
+		Interval:        2,
+		MajorPageFaults: float(0),
+		Blkio:           []v1.BlkioDeviceRates{{Major: 7, Minor: 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %#v after reset, got %#v", want, got)
+	}
+
+	if got := rates(nil, cur, 2, nil); got != nil {
+		t.Errorf("expected no rates without previous stats, got %#v", got)
+	}
+}
+
+func TestCollectStatsRates(t *testing.T) {
+	root := testTree()
+	w := newCollectWatcher(root, &fakeCollector{cache: map[string]uint64{}})
+
+	w.collectStats("memory", time.Now(), 0)
+	if root.stats["memory"].Rates != nil {
+		t.Errorf("expected no rates on first collection, got %#v", root.stats["memory"].Rates)
+	}
+
+	w.collectStats("memory", time.Now(), 0)
+	if r := root.stats["memory"].Rates; r == nil || r.Interval <= 0 {
+		t.Errorf("expected rates on second collection, got %#v", r)
+	}
+}
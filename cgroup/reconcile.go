@@ -0,0 +1,311 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opencontainers/runc/libcontainer/cgroups/fs"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// Reasons for reconciling the watched tree, used as metric labels.
+const (
+	reconcilePeriodic = "periodic"
+	reconcileError    = "error"
+	reconcileCreate   = "create"
+	reconcileRename   = "rename"
+)
+
+// fileID identifies a file by device and inode number, to recognise cgroup
+// dirs once renamed.
+type fileID struct {
+	dev, ino uint64
+}
+
+func statID(path string) (fileID, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileID{}, err
+	}
+	return infoID(fi)
+}
+
+func infoID(fi os.FileInfo) (fileID, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, fmt.Errorf("cannot get inode of %s", fi.Name())
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, nil
+}
+
+// drift counts the cgroups repaired by a reconciliation.
+type drift struct {
+	added, removed, renamed int
+}
+
+// startReconciliation reconciles the watched tree against cgroupfs every
+// reconcile interval, if set, and whenever triggered by reconcileSoon.
+func (w *watcher) startReconciliation() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		var tick <-chan time.Time
+		if w.reconcileInterval > 0 {
+			ticker := time.NewTicker(w.reconcileInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-tick:
+				w.reconcileAll(reconcilePeriodic)
+			case <-w.reconcileNow:
+				w.reconcileAll(reconcileError)
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+// reconcileSoon triggers a reconciliation unless one is already pending.
+func (w *watcher) reconcileSoon() {
+	select {
+	case w.reconcileNow <- struct{}{}:
+	default:
+	}
+}
+
+// reconcileAll reconciles every hierarchy. The hierarchies are scanned
+// without holding cgroupMu, so lookups and collections are only blocked while
+// repairing.
+func (w *watcher) reconcileAll(reason string) {
+	mountpoints := map[string]struct{}{}
+	for _, cg := range w.cgroups {
+		mountpoints[cg.path] = struct{}{}
+	}
+
+	var d drift
+	for mountpoint := range mountpoints {
+		dirs := w.scanDirs(mountpoint)
+
+		w.cgroupMu.Lock()
+		md := w.repair(mountpoint, dirs)
+		w.cgroupMu.Unlock()
+
+		d.added += md.added
+		d.removed += md.removed
+		d.renamed += md.renamed
+	}
+	w.reconciled(reason, "", d)
+}
+
+// reconcile reconciles the tree below the cgroup dir at root. Callers must
+// hold cgroupMu.
+func (w *watcher) reconcile(root, reason string) {
+	w.reconciled(reason, root, w.repair(root, w.scanDirs(root)))
+}
+
+func (w *watcher) reconciled(reason, root string, d drift) {
+	w.metrics.reconciliations.WithLabelValues(reason).Inc()
+	w.metrics.reconciledDrift.WithLabelValues("added").Add(float64(d.added))
+	w.metrics.reconciledDrift.WithLabelValues("removed").Add(float64(d.removed))
+	w.metrics.reconciledDrift.WithLabelValues("renamed").Add(float64(d.renamed))
+	if d == (drift{}) {
+		return
+	}
+
+	entry := w.log.WithFields(log.Fields{
+		"reason":  reason,
+		"added":   d.added,
+		"removed": d.removed,
+		"renamed": d.renamed,
+	})
+	if root != "" {
+		entry = entry.WithField("target", root)
+	}
+	// Subdirs created before the watch on a new cgroup was added are
+	// expected, e.g. from mkdir -p.
+	if reason == reconcileCreate {
+		entry.Debug("Reconciled cgroups")
+	} else {
+		entry.Info("Reconciled cgroups missed by watch events")
+	}
+}
+
+// scanDirs returns the cgroup dirs below root passing the filter, keyed by
+// path. Only dirs are read, leaving the control files of each cgroup alone.
+func (w *watcher) scanDirs(root string) map[string]fileID {
+	dirs := map[string]fileID{}
+	rootID, err := statID(root)
+	if err != nil {
+		return dirs
+	}
+
+	var scan func(dir string)
+	scan = func(dir string) {
+		subdirs, err := readSubdirs(dir)
+		if err != nil {
+			return
+		}
+		for name, ino := range subdirs {
+			path := filepath.Join(dir, name)
+			if !w.filtered(path) {
+				continue
+			}
+			// A cgroup hierarchy is a single filesystem.
+			dirs[path] = fileID{dev: rootID.dev, ino: ino}
+			scan(path)
+		}
+	}
+	scan(root)
+	return dirs
+}
+
+// repair adds the cgroups found in dirs but missing below the cgroup at root,
+// moves renamed cgroups and removes those no longer found. Callers must hold
+// cgroupMu.
+func (w *watcher) repair(root string, dirs map[string]fileID) drift {
+	var d drift
+	node := w.cgroupAt(root)
+	if node == nil {
+		return d
+	}
+
+	var missing []string
+	for path := range dirs {
+		if w.cgroupAt(path) == nil {
+			missing = append(missing, path)
+		}
+	}
+	// Parents sort before their children.
+	sort.Strings(missing)
+	for _, path := range missing {
+		if w.cgroupAt(path) != nil {
+			// Moved along with a renamed parent.
+			continue
+		}
+		parent := w.cgroupAt(filepath.Dir(path))
+		if parent == nil {
+			continue
+		}
+		if old := w.renamedSibling(parent, path, dirs[path]); old != nil {
+			w.move(parent, old, path)
+			d.renamed++
+			continue
+		}
+		if err := w.watchDir(path); err != nil {
+			w.log.WithFields(log.Fields{"target": path, "error": err}).Error("Failed to add watch")
+			continue
+		}
+		if w.cgroupAt(path) != nil {
+			d.added++
+		}
+	}
+
+	var stale []string
+	walkTree(node, "", func(cg *cgroup, _ string) {
+		if _, ok := dirs[cg.path]; !ok && cg != node {
+			stale = append(stale, cg.path)
+		}
+	})
+	// Remove children before their parents.
+	sort.Sort(sort.Reverse(sort.StringSlice(stale)))
+	for _, path := range stale {
+		if _, err := os.Stat(path); err == nil {
+			// Created since scanning.
+			continue
+		}
+		if err := w.unwatch(path); err != nil {
+			w.log.WithFields(log.Fields{"target": path, "error": err}).Error("Failed to remove watch")
+			continue
+		}
+		d.removed++
+	}
+
+	return d
+}
+
+// cgroupAt returns the watched cgroup with the dir at absPath, or nil.
+func (w *watcher) cgroupAt(absPath string) *cgroup {
+	for subsystem, mountpoint := range w.findCgroupMountpoints(absPath) {
+		rel, err := filepath.Rel(mountpoint, absPath)
+		if err != nil {
+			return nil
+		}
+		// Subsystems mounted together share their tree.
+		return w.findCgroup(subsystem, rel)
+	}
+	return nil
+}
+
+// renamedSibling returns the child of parent with the given file ID that is
+// no longer found at its own path, as it was renamed to path. cgroupfs only
+// allows renaming a cgroup within its parent.
+func (w *watcher) renamedSibling(parent *cgroup, path string, id fileID) *cgroup {
+	if id == (fileID{}) {
+		return nil
+	}
+	for _, cg := range parent.subcgroups {
+		if cg.id != id || cg.path == path {
+			continue
+		}
+		if current, err := statID(cg.path); err == nil && current == id {
+			continue
+		}
+		return cg
+	}
+	return nil
+}
+
+// move renames the child cg of parent to path, keeping its stats and those of
+// its descendants, and moves their watches and memory notifications to the
+// new paths. Callers must hold cgroupMu.
+func (w *watcher) move(parent, cg *cgroup, path string) {
+	oldPath := cg.path
+	_, oldRel := w.eventTarget(oldPath)
+
+	var moved []*cgroup
+	walkTree(cg, "", func(c *cgroup, _ string) {
+		moved = append(moved, c)
+	})
+
+	delete(parent.subcgroups, cg.name)
+	cg.name = filepath.Base(path)
+	parent.subcgroups[cg.name] = cg
+	for _, c := range moved {
+		c.path = path + strings.TrimPrefix(c.path, oldPath)
+		// inotify watches follow the renamed dirs, but events are reported
+		// with the paths they were added for. Adding them again under the
+		// new paths updates the reported paths.
+		targets := []string{c.path}
+		for _, name := range []string{fs.CgroupProcesses, cgroupEvents} {
+			if c.fileWatched(name) {
+				targets = append(targets, filepath.Join(c.path, name))
+			}
+		}
+		for _, target := range targets {
+			if err := w.fsnotifyWatcher.Add(target); err != nil && !os.IsNotExist(err) {
+				w.log.WithFields(log.Fields{"target": target, "error": err}).Error("Failed to add watch")
+			}
+		}
+		// Notifications are published for the path they were registered
+		// for, so register them again for the new path.
+		if c.notifier != nil {
+			c.notifier.close()
+			c.notifier = w.registerMemoryEvents(c.path)
+		}
+	}
+
+	w.log.WithFields(log.Fields{"target": path, "from": oldPath}).Debug("Moved renamed cgroup")
+	w.publish(path, v1.Event{Type: v1.EventCgroupRenamed, OldPath: oldRel})
+}
@@ -0,0 +1,253 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// startFakeWatcher starts a watcher of the memory hierarchy below a fake root.
+func startFakeWatcher(t *testing.T, root string) *watcher {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	w, err := NewWatcher(Options{
+		Subsystems: []string{"memory"},
+		Schedule:   Schedule{Interval: time.Hour},
+		Root:       root,
+		Logger:     logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return w.(*watcher)
+}
+
+func counterValue(t *testing.T, c interface {
+	Write(*dto.Metric) error
+}) float64 {
+	pb := &dto.Metric{}
+	if err := c.Write(pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetCounter().GetValue()
+}
+
+func TestReconcile(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+	w := startFakeWatcher(t, root)
+	defer w.Stop()
+
+	// Drift as if the creation of /b and the removal of /a/gone were missed.
+	w.cgroupMu.Lock()
+	mountpoint := w.cgroups["memory"].path
+	delete(w.cgroups["memory"].subcgroups, "b")
+	a := w.cgroups["memory"].subcgroups["a"]
+	a.subcgroups["gone"] = &cgroup{
+		name:       "gone",
+		path:       filepath.Join(mountpoint, "a", "gone"),
+		subcgroups: map[string]*cgroup{},
+	}
+	w.cgroupMu.Unlock()
+
+	w.reconcileAll(reconcilePeriodic)
+
+	if _, ok := w.Lookup("memory", "/b"); !ok {
+		t.Error("expected missing cgroup to be added")
+	}
+	if _, ok := w.Lookup("memory", "/a/gone"); ok {
+		t.Error("expected stale cgroup to be removed")
+	}
+	if _, ok := w.Lookup("memory", "/a/c"); !ok {
+		t.Error("expected watched cgroup to be kept")
+	}
+	if got := counterValue(t, w.metrics.reconciliations.WithLabelValues(reconcilePeriodic)); got != 1 {
+		t.Errorf("expected 1 periodic reconciliation, got %v", got)
+	}
+	for action, want := range map[string]float64{"added": 1, "removed": 1, "renamed": 0} {
+		if got := counterValue(t, w.metrics.reconciledDrift.WithLabelValues(action)); got != want {
+			t.Errorf("expected %v cgroups %s, got %v", want, action, got)
+		}
+	}
+	exited := w.Exited()
+	if len(exited) != 1 || exited[0].Path != "/a/gone" {
+		t.Errorf("expected stale cgroup to be listed as exited, got %+v", exited)
+	}
+}
+
+func TestReadSubdirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "wurzel-dirent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"a", "b.scope"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "memory.limit_in_bytes"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readSubdirs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected the 2 subdirs, got %v", got)
+	}
+	for _, dir := range []string{"a", "b.scope"} {
+		id, err := statID(filepath.Join(root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[dir] != id.ino {
+			t.Errorf("expected %s with inode %d, got %d", dir, id.ino, got[dir])
+		}
+	}
+}
+
+// waitFor polls cond until it returns true, failing the test after 5 seconds.
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	timeout := time.After(5 * time.Second)
+	for !cond() {
+		select {
+		case <-timeout:
+			t.Fatal(msg)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestWatchNestedCreate(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+	w := startFakeWatcher(t, root)
+	defer w.Stop()
+
+	if err := os.MkdirAll(filepath.Join(root, "memory", "b", "x", "y", "z"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "expected nested cgroups to be watched", func() bool {
+		_, ok := w.Lookup("memory", "/b/x/y/z")
+		return ok
+	})
+}
+
+func TestWatchRename(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+	w := startFakeWatcher(t, root)
+	defer w.Stop()
+
+	w.cgroupMu.RLock()
+	renamed := w.cgroups["memory"].subcgroups["a"].subcgroups["c"]
+	w.cgroupMu.RUnlock()
+
+	events, cancel := w.SubscribeEvents(0)
+	defer cancel()
+	if err := os.Rename(filepath.Join(root, "memory", "a", "c"), filepath.Join(root, "memory", "a", "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	e := expectEvent(t, events, v1.EventCgroupRenamed, "/a/d")
+	if e.OldPath != "/a/c" {
+		t.Errorf("expected old path /a/c, got %s", e.OldPath)
+	}
+	if _, ok := w.Lookup("memory", "/a/c"); ok {
+		t.Error("expected old path not to be watched")
+	}
+
+	w.cgroupMu.RLock()
+	moved := w.cgroups["memory"].subcgroups["a"].subcgroups["d"]
+	w.cgroupMu.RUnlock()
+	if moved != renamed {
+		t.Error("expected renamed cgroup to be moved rather than created again")
+	}
+	if len(w.Exited()) != 0 {
+		t.Errorf("expected renamed cgroup not to be listed as exited, got %+v", w.Exited())
+	}
+
+	// Subdirs of the renamed cgroup are reported under the new path.
+	if err := os.Mkdir(filepath.Join(root, "memory", "a", "d", "e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, v1.EventCgroupCreated, "/a/d/e")
+}
+
+func TestNotifyOverflow(t *testing.T) {
+	b, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_queued_events")
+	if err != nil {
+		t.Skip("cannot read the inotify queue size:", err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || max > 65536 {
+		t.Skipf("inotify queue size %q too large to overflow", b)
+	}
+
+	dir, err := ioutil.TempDir("", "wurzel-overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	if err := fw.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Raise more events than queued, while none are received. fsnotify
+	// buffers up to 4096 events read before delivering them.
+	sub := filepath.Join(dir, "sub")
+	for i := 0; i < max+4096; i++ {
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case <-fw.Events:
+		case err := <-fw.Errors:
+			if err != fsnotify.ErrEventOverflow {
+				t.Fatalf("expected overflow error, got %v", err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for overflow error")
+		}
+	}
+}
+
+func TestReconcileOnOverflow(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+	w := startFakeWatcher(t, root)
+	defer w.Stop()
+
+	w.fsnotifyWatcher.Errors <- fsnotify.ErrEventOverflow
+	waitFor(t, "expected reconciliation on overflow", func() bool {
+		return counterValue(t, w.metrics.reconciliations.WithLabelValues(reconcileError)) == 1
+	})
+}
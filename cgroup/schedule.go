@@ -0,0 +1,187 @@
+package cgroup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// idleAfter is the number of consecutive collections without activity after
+// which a cgroup is considered idle.
+const idleAfter = 2
+
+// Schedule configures how often cgroup stats are collected. Each subsystem is
+// collected in its own rounds, and the interval between rounds backs off
+// while rounds take longer than half of it.
+type Schedule struct {
+	// Interval is the interval between collections of subsystems without
+	// their own interval.
+	Interval time.Duration
+	// Subsystems holds the intervals of individual subsystems.
+	Subsystems map[string]time.Duration
+	// MinInterval and MaxInterval bound the interval of every subsystem.
+	// Zero leaves the interval unbounded.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// IdleEvery collects cgroups without CPU usage or memory changes only
+	// every IdleEvery rounds. 0 or 1 collects every cgroup in every round.
+	IdleEvery int
+}
+
+// ParseIntervals parses a comma-separated list of per-subsystem intervals,
+// e.g. memory=5s,blkio=30s.
+func ParseIntervals(s string) (map[string]time.Duration, error) {
+	intervals := map[string]time.Duration{}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid subsystem interval %s, expected <subsystem>=<interval>", spec)
+		}
+		interval, err := time.ParseDuration(parts[1])
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %s for subsystem %s", parts[1], parts[0])
+		}
+		intervals[parts[0]] = interval
+	}
+	return intervals, nil
+}
+
+// Validate returns an error if any interval is not positive, or the bounds
+// are negative or exclude each other. Collecting without an interval between
+// rounds would keep a CPU busy.
+func (s Schedule) Validate() error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("invalid collection interval %s, must be positive", s.Interval)
+	}
+	for subsystem, interval := range s.Subsystems {
+		if interval <= 0 {
+			return fmt.Errorf("invalid collection interval %s for subsystem %s, must be positive", interval, subsystem)
+		}
+	}
+	if s.MinInterval < 0 || s.MaxInterval < 0 {
+		return fmt.Errorf("invalid collection interval bounds %s and %s, must not be negative", s.MinInterval, s.MaxInterval)
+	}
+	if s.MaxInterval > 0 && s.MinInterval > s.MaxInterval {
+		return fmt.Errorf("minimum collection interval %s exceeds maximum %s", s.MinInterval, s.MaxInterval)
+	}
+	return nil
+}
+
+// interval returns the configured interval of subsystem within the bounds.
+func (s Schedule) interval(subsystem string) time.Duration {
+	interval, ok := s.Subsystems[subsystem]
+	if !ok {
+		interval = s.Interval
+	}
+	return s.bound(interval)
+}
+
+func (s Schedule) bound(interval time.Duration) time.Duration {
+	if s.MinInterval > 0 && interval < s.MinInterval {
+		interval = s.MinInterval
+	}
+	if s.MaxInterval > 0 && interval > s.MaxInterval {
+		interval = s.MaxInterval
+	}
+	return interval
+}
+
+// next returns the interval to the round following one that took elapsed,
+// backing off from the current interval so rounds take at most half of it,
+// and recovering by at most half per round towards the configured interval.
+func (s Schedule) next(configured, current, elapsed time.Duration) time.Duration {
+	next := configured
+	if backoff := 2 * elapsed; backoff > next {
+		next = backoff
+	}
+	if recovered := current / 2; next < recovered {
+		next = recovered
+	}
+	return s.bound(next)
+}
+
+// collectsIdle returns true if idle cgroups are collected in round.
+func (s Schedule) collectsIdle(round int) bool {
+	return s.IdleEvery <= 1 || round%s.IdleEvery == 0
+}
+
+// startCollection starts a collection loop for every subsystem with a
+// collector.
+func (w *watcher) startCollection() {
+	for name := range w.cgroups {
+		if w.subsystems[name] == nil {
+			w.log.WithField("subsystem", name).Debug("No collector for subsystem")
+			continue
+		}
+		w.wg.Add(1)
+		go w.scheduleCollection(name)
+	}
+}
+
+// scheduleCollection collects the stats of subsystem in rounds until the
+// watcher is stopped. Rounds never overlap: a round taking longer than the
+// interval delays the next, counting the rounds missed as dropped, and backs
+// off the interval.
+func (w *watcher) scheduleCollection(subsystem string) {
+	defer w.wg.Done()
+
+	configured := w.collectionSchedule.interval(subsystem)
+	interval := configured
+	w.metrics.collectionInterval.WithLabelValues(subsystem).Set(interval.Seconds())
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for round := 0; ; round++ {
+		select {
+		case start := <-timer.C:
+			w.collectStats(subsystem, start, round)
+			elapsed := time.Since(start)
+			if interval > 0 && elapsed > interval {
+				dropped := elapsed / interval
+				w.metrics.droppedRounds.WithLabelValues(subsystem).Add(float64(dropped))
+				w.log.WithFields(log.Fields{"subsystem": subsystem, "duration": elapsed, "interval": interval, "dropped": dropped}).Warn("Collecting cgroup stats took longer than the interval")
+			}
+
+			next := w.collectionSchedule.next(configured, interval, elapsed)
+			if next != interval {
+				w.log.WithFields(log.Fields{"subsystem": subsystem, "interval": next}).Debug("Adapted cgroup stats collection interval")
+				interval = next
+				w.metrics.collectionInterval.WithLabelValues(subsystem).Set(interval.Seconds())
+			}
+			wait := interval - elapsed
+			if wait < 0 {
+				wait = 0
+			}
+			timer.Reset(wait)
+		case <-w.done:
+			w.log.WithField("subsystem", subsystem).Debug("Stopping stats collection")
+			return
+		}
+	}
+}
+
+// idle returns true if cur shows no activity since prev: no CPU time used and
+// memory usage unchanged. Cgroups of subsystems reporting neither are idle
+// while their stats are unchanged.
+func idle(prev, cur *v1.Stats) bool {
+	cpu := prev.CPUStats != nil && prev.CPUStats.CPUUsage != nil && cur.CPUStats != nil && cur.CPUStats.CPUUsage != nil
+	memory := prev.MemoryStats != nil && cur.MemoryStats != nil
+	if !cpu && !memory {
+		return !statsChanged(prev, cur)
+	}
+	if cpu && cur.CPUStats.CPUUsage.TotalUsage != prev.CPUStats.CPUUsage.TotalUsage {
+		return false
+	}
+	if memory && cur.MemoryStats.Usage.Usage != prev.MemoryStats.Usage.Usage {
+		return false
+	}
+	return true
+}
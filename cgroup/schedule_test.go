@@ -0,0 +1,133 @@
+package cgroup
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func TestParseIntervals(t *testing.T) {
+	got, err := ParseIntervals("memory=5s, blkio=1m,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]time.Duration{"memory": 5 * time.Second, "blkio": time.Minute}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	for _, s := range []string{"memory", "=5s", "memory=5", "memory=-1s"} {
+		if _, err := ParseIntervals(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestScheduleInterval(t *testing.T) {
+	s := Schedule{
+		Interval:    10 * time.Second,
+		Subsystems:  map[string]time.Duration{"memory": time.Second, "blkio": time.Hour},
+		MinInterval: 5 * time.Second,
+		MaxInterval: time.Minute,
+	}
+	for subsystem, want := range map[string]time.Duration{"cpu": 10 * time.Second, "memory": 5 * time.Second, "blkio": time.Minute} {
+		if got := s.interval(subsystem); got != want {
+			t.Errorf("expected interval %v for %s, got %v", want, subsystem, got)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	if err := (Schedule{Interval: time.Second, Subsystems: map[string]time.Duration{"memory": time.Minute}}).Validate(); err != nil {
+		t.Errorf("expected valid schedule, got %v", err)
+	}
+	for _, s := range []Schedule{
+		{},
+		{Interval: -time.Second},
+		{Interval: time.Second, Subsystems: map[string]time.Duration{"memory": 0}},
+		{Interval: time.Second, MinInterval: -time.Second},
+		{Interval: time.Second, MinInterval: time.Minute, MaxInterval: time.Second},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("expected error for schedule %+v", s)
+		}
+	}
+
+	// Watchers never collect without an interval between rounds.
+	if _, err := NewWatcher(Options{Subsystems: []string{"memory"}}); err == nil {
+		t.Error("expected error creating watcher without collection interval")
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	s := Schedule{MaxInterval: time.Minute}
+	configured := 10 * time.Second
+
+	tests := []struct {
+		current, elapsed, want time.Duration
+	}{
+		{10 * time.Second, time.Second, 10 * time.Second},
+		// Backs off so rounds take at most half the interval.
+		{10 * time.Second, 8 * time.Second, 16 * time.Second},
+		{16 * time.Second, 45 * time.Second, time.Minute},
+		// Recovers by at most half per round.
+		{time.Minute, time.Second, 30 * time.Second},
+		{30 * time.Second, time.Second, 15 * time.Second},
+		{15 * time.Second, time.Second, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := s.next(configured, test.current, test.elapsed); got != test.want {
+			t.Errorf("expected %v after %v round at %v, got %v", test.want, test.elapsed, test.current, got)
+		}
+	}
+}
+
+func TestIdle(t *testing.T) {
+	stats := func(cpu, memory uint64) *v1.Stats {
+		return &v1.Stats{
+			CPUStats:    &v1.CPUStats{CPUUsage: &v1.CPUUsage{TotalUsage: cpu}},
+			MemoryStats: &v1.MemoryStats{Usage: v1.MemoryData{Usage: memory}},
+		}
+	}
+	if !idle(stats(1, 1), stats(1, 1)) {
+		t.Error("expected unchanged stats to be idle")
+	}
+	if idle(stats(1, 1), stats(2, 1)) || idle(stats(1, 1), stats(1, 2)) {
+		t.Error("expected CPU usage or memory changes not to be idle")
+	}
+	pids := func(current uint64) *v1.Stats { return &v1.Stats{PidsStats: &v1.PidsStats{Current: current}} }
+	if !idle(pids(1), pids(1)) || idle(pids(1), pids(2)) {
+		t.Error("expected other subsystems to be idle while unchanged")
+	}
+}
+
+// countingCollector counts the collections of each cgroup.
+type countingCollector struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *countingCollector) Collect(path string) (*v1.Stats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[path]++
+	return &v1.Stats{MemoryStats: &v1.MemoryStats{}}, nil
+}
+
+func TestCollectStatsIdle(t *testing.T) {
+	c := &countingCollector{counts: map[string]int{}}
+	w := newCollectWatcher(testTree(), c)
+	w.collectionSchedule = Schedule{IdleEvery: 3}
+
+	for round := 0; round < 6; round++ {
+		w.collectStats("memory", time.Now(), round)
+	}
+	// Collected in rounds 0 to 2 until idle, then only in round 3.
+	want := map[string]int{"/cg": 4, "/cg/a": 4, "/cg/a/b": 4}
+	if !reflect.DeepEqual(c.counts, want) {
+		t.Errorf("expected collections %v, got %v", want, c.counts)
+	}
+}
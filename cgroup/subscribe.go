@@ -0,0 +1,57 @@
+package cgroup
+
+import "github.com/jimmidyson/wurzel/api/v1"
+
+// statsSubscriptionBuffer is the number of collection rounds buffered for a
+// stats subscriber before further rounds are dropped.
+const statsSubscriptionBuffer = 8
+
+func (w *watcher) SubscribeStats() (<-chan *v1.StatsUpdate, func()) {
+	ch := make(chan *v1.StatsUpdate, statsSubscriptionBuffer)
+
+	w.subsMu.Lock()
+	w.statsSubs[ch] = struct{}{}
+	w.subsMu.Unlock()
+
+	cancel := func() {
+		w.subsMu.Lock()
+		defer w.subsMu.Unlock()
+		if _, ok := w.statsSubs[ch]; ok {
+			delete(w.statsSubs, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+func (w *watcher) hasStatsSubscribers() bool {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+	return len(w.statsSubs) > 0
+}
+
+func (w *watcher) publishStats(update *v1.StatsUpdate) {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	for ch := range w.statsSubs {
+		select {
+		case ch <- update:
+		default:
+			w.log.Warn("Stats subscriber is too slow - dropping collection round")
+		}
+	}
+}
+
+// closeStatsSubscriptions closes all subscriber channels when the watcher is
+// stopped.
+func (w *watcher) closeStatsSubscriptions() {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	for ch := range w.statsSubs {
+		delete(w.statsSubs, ch)
+		close(ch)
+	}
+}
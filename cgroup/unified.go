@@ -0,0 +1,387 @@
+package cgroup
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/mount"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// unifiedControllers maps subsystem names to the unified hierarchy controller
+// providing their stats.
+var unifiedControllers = map[string]string{
+	"blkio":      "io",
+	"cpu":        "cpu",
+	"cpuacct":    "cpu",
+	"cpuset":     "cpuset",
+	"hugetlb":    "hugetlb",
+	"memory":     "memory",
+	"perf_event": "perf_event",
+	"pids":       "pids",
+}
+
+// findUnifiedMount returns the mount point of the unified (cgroup2) hierarchy,
+// or an empty string if it is not mounted. In hybrid mode the unified
+// hierarchy is mounted alongside the v1 hierarchies, usually at
+// /sys/fs/cgroup/unified.
+func findUnifiedMount() (string, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return "", err
+	}
+
+	for _, m := range mounts {
+		if m.Fstype == "cgroup2" {
+			return m.Mountpoint, nil
+		}
+	}
+
+	return "", nil
+}
+
+// unifiedControllerEnabled returns true if the stats for subsystem can be read
+// from the unified hierarchy mounted at mountpoint: the controller is
+// available and enabled for the cgroups below the root.
+func unifiedControllerEnabled(mountpoint, subsystem string) bool {
+	controller, ok := unifiedControllers[subsystem]
+	if !ok {
+		return false
+	}
+
+	// CPU usage in cpu.stat is always available, even without the cpu
+	// controller.
+	if subsystem == "cpuacct" {
+		return true
+	}
+
+	for _, file := range []string{"cgroup.controllers", "cgroup.subtree_control"} {
+		if listed, err := controllerListed(filepath.Join(mountpoint, file), controller); err != nil || !listed {
+			return false
+		}
+	}
+	return true
+}
+
+// controllerListed returns whether the controller file, e.g. cgroup.controllers
+// or cgroup.subtree_control, lists controller.
+func controllerListed(file, controller string) (bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range strings.Fields(string(b)) {
+		if c == controller {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// controllerDisabled returns true if the cgroup at path lacks the interface
+// files of the controller of subsystem as its parent does not enable it in
+// cgroup.subtree_control, unlike a cgroup lacking them as it was removed.
+func controllerDisabled(path, subsystem string) bool {
+	controller, ok := unifiedControllers[subsystem]
+	if !ok {
+		return false
+	}
+	listed, err := controllerListed(filepath.Join(filepath.Dir(path), "cgroup.subtree_control"), controller)
+	return err == nil && !listed
+}
+
+// unifiedCollector collects stats from the unified hierarchy, mapping them to
+// the same v1.Stats fields as their v1 equivalents.
+type unifiedCollector struct {
+	subsystem string
+	// mountpoint is the path of the root cgroup of the unified hierarchy.
+	mountpoint string
+}
+
+func (c *unifiedCollector) Collect(path string) (*v1.Stats, error) {
+	stats, err := c.collect(path)
+	if os.IsNotExist(err) && path != c.mountpoint && controllerDisabled(path, c.subsystem) {
+		// The controller is not enabled for every subtree, so there are
+		// no stats to collect.
+		return &v1.Stats{}, nil
+	}
+	return stats, err
+}
+
+func (c *unifiedCollector) collect(path string) (*v1.Stats, error) {
+	stats := &v1.Stats{}
+
+	switch c.subsystem {
+	case "cpu":
+		cpuStat, err := readKeyValues(filepath.Join(path, "cpu.stat"))
+		if err != nil {
+			return stats, err
+		}
+		stats.CPUStats = &v1.CPUStats{ThrottlingData: &v1.ThrottlingData{
+			Periods:          cpuStat["nr_periods"],
+			ThrottledPeriods: cpuStat["nr_throttled"],
+			ThrottledTime:    cpuStat["throttled_usec"] * 1000,
+		}}
+		stats.CPUPressure = readPressure(filepath.Join(path, "cpu.pressure"))
+	case "cpuacct":
+		cpuStat, err := readKeyValues(filepath.Join(path, "cpu.stat"))
+		if err != nil {
+			return stats, err
+		}
+		stats.CPUStats = &v1.CPUStats{CPUUsage: &v1.CPUUsage{
+			TotalUsage:        cpuStat["usage_usec"] * 1000,
+			UsageInKernelmode: cpuStat["system_usec"] * 1000,
+			UsageInUsermode:   cpuStat["user_usec"] * 1000,
+		}}
+	case "memory":
+		memoryStats, err := readUnifiedMemory(path)
+		if err != nil {
+			return stats, err
+		}
+		stats.MemoryStats = memoryStats
+		stats.MemoryPressure = readPressure(filepath.Join(path, "memory.pressure"))
+	case "blkio":
+		blkioStats, err := readIOStat(filepath.Join(path, "io.stat"))
+		if err != nil {
+			return stats, err
+		}
+		stats.BlkioStats = blkioStats
+		stats.IOPressure = readPressure(filepath.Join(path, "io.pressure"))
+	case "pids":
+		current, err := readUint(filepath.Join(path, "pids.current"))
+		if err != nil {
+			return stats, err
+		}
+		limit, _ := readUint(filepath.Join(path, "pids.max"))
+		stats.PidsStats = &v1.PidsStats{Current: current, Limit: limit}
+	case "cpuset":
+		cpus, err := readString(filepath.Join(path, "cpuset.cpus.effective"))
+		if err != nil {
+			return stats, err
+		}
+		mems, err := readString(filepath.Join(path, "cpuset.mems.effective"))
+		if err != nil {
+			return stats, err
+		}
+		stats.CPUSetStats = &v1.CPUSetStats{CPUs: cpus, Mems: mems}
+	case "hugetlb":
+		hugetlbStats, err := readUnifiedHugetlb(path)
+		if err != nil {
+			return stats, err
+		}
+		stats.HugetlbStats = hugetlbStats
+	}
+
+	limits, err := readUnifiedLimits(c.subsystem, path)
+	stats.Limits = limits
+	return stats, err
+}
+
+func readUnifiedMemory(path string) (*v1.MemoryStats, error) {
+	usage, err := readUint(filepath.Join(path, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+
+	memoryStat, err := readKeyValues(filepath.Join(path, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional files, depending on kernel version and swap accounting.
+	maxUsage, _ := readUint(filepath.Join(path, "memory.peak"))
+	swap, _ := readUint(filepath.Join(path, "memory.swap.current"))
+	events, _ := readKeyValues(filepath.Join(path, "memory.events"))
+
+	return &v1.MemoryStats{
+		Cache: memoryStat["file"],
+		Usage: v1.MemoryData{
+			Usage:    usage,
+			MaxUsage: maxUsage,
+			Failcnt:  events["max"],
+		},
+		// The v1 swap usage includes memory usage.
+		SwapUsage: v1.MemoryData{
+			Usage: usage + swap,
+		},
+		KernelUsage: v1.MemoryData{
+			Usage: memoryStat["kernel"],
+		},
+		Stats: memoryStat,
+	}, nil
+}
+
+// readIOStat parses io.stat lines such as
+// "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=5 dios=6".
+func readIOStat(path string) (*v1.BlkioStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := &v1.BlkioStats{
+		IoServiceBytesRecursive: []v1.BlkioStatEntry{},
+		IoServicedRecursive:     []v1.BlkioStatEntry{},
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		major, minor, ok := parseDevice(fields[0])
+		if !ok {
+			continue
+		}
+
+		values := map[string]uint64{}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			values[kv[0]] = v
+		}
+
+		entries := func(read, write, discard string) []v1.BlkioStatEntry {
+			return []v1.BlkioStatEntry{
+				{Major: major, Minor: minor, Op: "Read", Value: values[read]},
+				{Major: major, Minor: minor, Op: "Write", Value: values[write]},
+				{Major: major, Minor: minor, Op: "Discard", Value: values[discard]},
+				{Major: major, Minor: minor, Op: "Total", Value: values[read] + values[write] + values[discard]},
+			}
+		}
+		stats.IoServiceBytesRecursive = append(stats.IoServiceBytesRecursive, entries("rbytes", "wbytes", "dbytes")...)
+		stats.IoServicedRecursive = append(stats.IoServicedRecursive, entries("rios", "wios", "dios")...)
+	}
+
+	return stats, scanner.Err()
+}
+
+// readUnifiedHugetlb reads the hugetlb.<size>.current files, e.g.
+// hugetlb.2MB.current.
+func readUnifiedHugetlb(path string) (map[string]v1.HugetlbStats, error) {
+	files, err := filepath.Glob(filepath.Join(path, "hugetlb.*.current"))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]v1.HugetlbStats, len(files))
+	for _, file := range files {
+		usage, err := readUint(file)
+		if err != nil {
+			return nil, err
+		}
+		prefix := strings.TrimSuffix(file, ".current")
+		maxUsage, _ := readUint(prefix + ".max_usage")
+		events, _ := readKeyValues(prefix + ".events")
+		stats[strings.TrimPrefix(filepath.Base(prefix), "hugetlb.")] = v1.HugetlbStats{
+			Usage:    usage,
+			MaxUsage: maxUsage,
+			Failcnt:  events["max"],
+		}
+	}
+
+	return stats, nil
+}
+
+// readPressure parses a pressure stall information file such as cpu.pressure,
+// returning nil if it cannot be read.
+func readPressure(path string) *v1.PressureStats {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	stats := &v1.PressureStats{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		data := v1.PressureData{}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "avg10":
+				data.Avg10, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg60":
+				data.Avg60, _ = strconv.ParseFloat(kv[1], 64)
+			case "avg300":
+				data.Avg300, _ = strconv.ParseFloat(kv[1], 64)
+			case "total":
+				data.Total, _ = strconv.ParseUint(kv[1], 10, 64)
+			}
+		}
+
+		switch fields[0] {
+		case "some":
+			stats.Some = data
+		case "full":
+			stats.Full = &data
+		}
+	}
+	if scanner.Err() != nil {
+		return nil
+	}
+
+	return stats
+}
+
+// readKeyValues parses files of "key value" lines such as cpu.stat.
+func readKeyValues(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = v
+	}
+
+	return values, scanner.Err()
+}
+
+// readUint reads a file holding a single value, where "max" means unlimited
+// and is returned as 0.
+func readUint(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	s := strings.TrimSpace(string(b))
+	if s == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
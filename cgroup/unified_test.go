@@ -0,0 +1,156 @@
+package cgroup
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func writeFixtures(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "wurzel-unified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestUnifiedCollector(t *testing.T) {
+	dir := writeFixtures(t, map[string]string{
+		"cgroup.controllers":     "cpu io memory pids\n",
+		"cgroup.subtree_control": "cpu io memory\n",
+		"cpu.stat":               "usage_usec 300\nuser_usec 200\nsystem_usec 100\nnr_periods 5\nnr_throttled 2\nthrottled_usec 7\n",
+		"cpu.pressure":           "some avg10=1.50 avg60=0.25 avg300=0.00 total=1234\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=56\n",
+		"memory.current":         "4096\n",
+		"memory.swap.current":    "1024\n",
+		"memory.stat":            "anon 1000\nfile 2000\nkernel 300\ninactive_file 500\n",
+		"memory.events":          "low 0\nhigh 0\nmax 3\noom 0\noom_kill 0\n",
+		"io.stat":                "8:0 rbytes=10 wbytes=20 rios=1 wios=2 dbytes=0 dios=0\n",
+		"pids.current":           "12\n",
+		"pids.max":               "max\n",
+		"hugetlb.2MB.current":    "0\n",
+		"hugetlb.2MB.events":     "max 1\n",
+	})
+	defer os.RemoveAll(dir)
+
+	collect := func(subsystem string) *v1.Stats {
+		stats, err := (&unifiedCollector{subsystem: subsystem}).Collect(dir)
+		if err != nil {
+			t.Fatalf("%s: %v", subsystem, err)
+		}
+		return stats
+	}
+
+	if stats := collect("cpuacct"); !reflect.DeepEqual(stats.CPUStats.CPUUsage, &v1.CPUUsage{TotalUsage: 300000, UsageInUsermode: 200000, UsageInKernelmode: 100000}) {
+		t.Errorf("unexpected cpu usage: %#v", stats.CPUStats.CPUUsage)
+	}
+
+	stats := collect("cpu")
+	if !reflect.DeepEqual(stats.CPUStats.ThrottlingData, &v1.ThrottlingData{Periods: 5, ThrottledPeriods: 2, ThrottledTime: 7000}) {
+		t.Errorf("unexpected throttling data: %#v", stats.CPUStats.ThrottlingData)
+	}
+	wantPressure := &v1.PressureStats{
+		Some: v1.PressureData{Avg10: 1.5, Avg60: 0.25, Total: 1234},
+		Full: &v1.PressureData{Total: 56},
+	}
+	if !reflect.DeepEqual(stats.CPUPressure, wantPressure) {
+		t.Errorf("expected cpu pressure %#v, got %#v", wantPressure, stats.CPUPressure)
+	}
+
+	memory := collect("memory").MemoryStats
+	if memory.Usage.Usage != 4096 || memory.Usage.Failcnt != 3 || memory.SwapUsage.Usage != 5120 || memory.Cache != 2000 || memory.KernelUsage.Usage != 300 {
+		t.Errorf("unexpected memory stats: %#v", memory)
+	}
+
+	blkio := collect("blkio").BlkioStats
+	wantBytes := []v1.BlkioStatEntry{
+		{Major: 8, Minor: 0, Op: "Read", Value: 10},
+		{Major: 8, Minor: 0, Op: "Write", Value: 20},
+		{Major: 8, Minor: 0, Op: "Discard", Value: 0},
+		{Major: 8, Minor: 0, Op: "Total", Value: 30},
+	}
+	if !reflect.DeepEqual(blkio.IoServiceBytesRecursive, wantBytes) {
+		t.Errorf("expected io bytes %#v, got %#v", wantBytes, blkio.IoServiceBytesRecursive)
+	}
+
+	if pids := collect("pids").PidsStats; !reflect.DeepEqual(pids, &v1.PidsStats{Current: 12}) {
+		t.Errorf("unexpected pids stats: %#v", pids)
+	}
+
+	if hugetlb := collect("hugetlb").HugetlbStats; !reflect.DeepEqual(hugetlb, map[string]v1.HugetlbStats{"2MB": {Failcnt: 1}}) {
+		t.Errorf("unexpected hugetlb stats: %#v", hugetlb)
+	}
+
+	for subsystem, want := range map[string]bool{"cpu": true, "cpuacct": true, "blkio": true, "pids": false, "hugetlb": false, "devices": false} {
+		if got := unifiedControllerEnabled(dir, subsystem); got != want {
+			t.Errorf("%s: expected enabled %v, got %v", subsystem, want, got)
+		}
+	}
+}
+
+func TestUnifiedCollectorRemoved(t *testing.T) {
+	_, err := (&unifiedCollector{subsystem: "memory"}).Collect("/nonexistent")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestUnifiedCollectorDisabled(t *testing.T) {
+	dir := writeFixtures(t, map[string]string{"cgroup.subtree_control": "cpu io\n"})
+	defer os.RemoveAll(dir)
+	child := filepath.Join(dir, "a")
+	if err := os.Mkdir(child, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &unifiedCollector{subsystem: "memory", mountpoint: dir}
+	stats, err := c.Collect(child)
+	if err != nil {
+		t.Fatalf("expected no error for a cgroup without the memory controller, got %v", err)
+	}
+	if stats.MemoryStats != nil {
+		t.Errorf("expected no memory stats, got %#v", stats.MemoryStats)
+	}
+
+	c.subsystem = "blkio"
+	if _, err := c.Collect(child); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error for a cgroup lacking enabled controller files, got %v", err)
+	}
+}
+
+func TestLogCollectErrorUnifiedRoot(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	logger.Level = log.InfoLevel
+	w := &watcher{
+		subsystems: map[string]collector{"memory": &unifiedCollector{subsystem: "memory", mountpoint: "/sys/fs/cgroup"}},
+		log:        log.NewEntry(logger),
+	}
+	err := errors.New("invalid argument")
+
+	w.logCollectError(&collectTask{subsystem: "memory", path: "/sys/fs/cgroup", err: err})
+	if buf.Len() != 0 {
+		t.Errorf("expected no error logged for the root cgroup, got %s", buf.String())
+	}
+
+	w.logCollectError(&collectTask{subsystem: "memory", path: "/sys/fs/cgroup/system.slice", err: err})
+	if !strings.Contains(buf.String(), "Failed to collect cgroup stats") {
+		t.Errorf("expected error logged for a child cgroup, got %q", buf.String())
+	}
+}
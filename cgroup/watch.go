@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -15,7 +17,6 @@ import (
 	"gopkg.in/fsnotify.v1"
 
 	"github.com/jimmidyson/wurzel/api/v1"
-	"github.com/jimmidyson/wurzel/metrics"
 )
 
 const (
@@ -23,40 +24,38 @@ const (
 	MetricsSubsystem = "cgroups"
 )
 
-var (
-	allSubsystems = []string{"blkio", "cpu", "cpuacct", "cpuset", "devices", "freezer", "hugetlb", "memory", "net_cls", "net_prio", "perf_event"}
-
-	inotifyCount = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Namespace: metrics.Namespace,
-			Subsystem: MetricsSubsystem,
-			Name:      "fsnotify_count_current",
-			Help:      "The current number of fs notifies labeled by subsystem.",
-		},
-	)
-
-	cgroupCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: metrics.Namespace,
-			Subsystem: MetricsSubsystem,
-			Name:      "cgroup_count_current",
-			Help:      "The current number of cgroups in each subsystem.",
-		},
-		[]string{"subsystem"},
-	)
-)
-
-func init() {
-	prometheus.MustRegister(inotifyCount)
-	prometheus.MustRegister(cgroupCount)
-	prometheus.MustRegister(statsCollectionSummary)
-	prometheus.MustRegister(subsystemStatsCollectionSummary)
-}
+var allSubsystems = []string{"blkio", "cpu", "cpuacct", "cpuset", "devices", "freezer", "hugetlb", "memory", "net_cls", "net_prio", "perf_event", "pids"}
 
 // Watcher interface is implemented by anything watching cgroups.
 type Watcher interface {
 	Start() error
 	Stop() error
+	// Subsystems returns the watched subsystems, sorted by name.
+	Subsystems() []v1.Subsystem
+	// Lookup returns the cgroup at the given path, relative to the subsystem
+	// mount point, or false if it is not being watched.
+	Lookup(subsystem, path string) (*v1.Cgroup, bool)
+	// Walk calls fn with every watched cgroup in every subsystem. fn must not
+	// call back into the watcher.
+	Walk(fn func(cg *v1.Cgroup))
+	// Snapshot returns every watched cgroup in every subsystem, sorted by
+	// subsystem and path.
+	Snapshot() []*v1.Cgroup
+	// SubscribeStats returns a channel receiving the cgroups whose stats
+	// changed in each collection round, and a function to cancel the
+	// subscription.
+	SubscribeStats() (<-chan *v1.StatsUpdate, func())
+	// Events returns the buffered cgroup lifecycle events after the given
+	// sequence number.
+	Events(since uint64) *v1.EventList
+	// SubscribeEvents returns a channel receiving cgroup lifecycle events,
+	// starting with any buffered events after the given sequence number, and
+	// a function to cancel the subscription. The channel is closed if the
+	// subscriber falls too far behind.
+	SubscribeEvents(since uint64) (<-chan *v1.Event, func())
+	// Exited returns the most recently removed cgroups with the latest stats
+	// collected for them, most recently removed first.
+	Exited() []v1.ExitedCgroup
 }
 
 type watcher struct {
@@ -64,21 +63,134 @@ type watcher struct {
 	subsystems         map[string]collector
 	fsnotifyWatcher    *fsnotify.Watcher
 	done               chan struct{}
-	collectionInterval time.Duration
+	collectionSchedule Schedule
+	collectionWorkers  int
 	wg                 sync.WaitGroup
 	cgroupMu           sync.RWMutex
+	statsSubs          map[chan *v1.StatsUpdate]struct{}
+	subsMu             sync.Mutex
+	events             eventLog
+	eventSubs          map[chan *v1.Event]struct{}
+	eventsMu           sync.Mutex
+	// publishEvents is false during the initial walk of the cgroup tree.
+	// Guarded by cgroupMu.
+	publishEvents bool
+	// exited holds the recently removed cgroups. Guarded by cgroupMu.
+	exited exitedLog
+	// newCgroups holds the cgroups created since starting whose processes
+	// are polled, see pollNewCgroups. Guarded by cgroupMu.
+	newCgroups map[*cgroup]struct{}
+	filter     func(path string) bool
+	registerer Registerer
+	metrics    *watcherMetrics
+	log        *log.Entry
+	// reconcileInterval is the interval between periodic reconciliations,
+	// zero to only reconcile on notify errors signalled on reconcileNow.
+	reconcileInterval time.Duration
+	reconcileNow      chan struct{}
 }
 
 type cgroup struct {
-	name       string
-	path       string
-	stats      *v1.Stats
+	name string
+	path string
+	// Keyed by subsystem as cgroups are shared between subsystems mounted
+	// together, e.g. cpu,cpuacct. Replaced rather than modified on
+	// collection.
+	stats map[string]*v1.Stats
+	// collected holds when the stats of each subsystem were collected, to
+	// derive rates.
+	collected  map[string]time.Time
 	subcgroups map[string]*cgroup
 	pids       []int32
+	// pidsRead is when pids were read.
+	pidsRead time.Time
+	// procsWatched is true while the cgroup.procs file is watched, and
+	// eventsWatched while the cgroup.events file of a unified hierarchy
+	// cgroup is.
+	procsWatched  bool
+	eventsWatched bool
+	// populated is whether cgroup.events last reported processes in the
+	// cgroup or its descendants.
+	populated bool
+	// emptied is when the cgroup was last seen to become empty, zero if it
+	// has processes again since. Stats collected since include all the
+	// resources its processes consumed.
+	emptied time.Time
+	// notifier is set for v1 memory cgroups.
+	notifier *memoryNotifier
+	// created is when the cgroup was created, zero if it existed before the
+	// watcher started.
+	created time.Time
+	// peakMemory is the highest memory usage collected.
+	peakMemory uint64
+	// idle holds the number of consecutive collections of each subsystem
+	// without activity.
+	idle map[string]int
+	// id identifies the cgroup dir, to recognise it once renamed. Zero for
+	// the roots of hierarchies.
+	id fileID
+	// removed is when the cgroup was unwatched, with its path relative to
+	// the mount point, zero while watched.
+	removed     time.Time
+	removedPath string
+}
+
+// Options configures a watcher.
+type Options struct {
+	// Subsystems are the subsystems to watch.
+	Subsystems []string
+	// SkipUnmounted skips the subsystems that are not mounted with a
+	// warning, rather than failing.
+	SkipUnmounted bool
+	// Schedule configures when the stats of each subsystem are collected. It
+	// must be valid, see Schedule.Validate.
+	Schedule Schedule
+	// CollectionWorkers is the number of stats collections run concurrently
+	// for each subsystem, 16 if zero.
+	CollectionWorkers int
+	// Root is the directory the cgroup hierarchies are mounted below, e.g.
+	// /sys/fs/cgroup, each v1 hierarchy in a directory named after its
+	// subsystem. Empty finds the hierarchies in the mount table.
+	Root string
+	// Filter returns whether the cgroup at path, relative to the mount point
+	// of its hierarchy, is watched. The cgroups below a cgroup not watched
+	// are not watched either. Nil watches every cgroup.
+	Filter func(path string) bool
+	// Registerer registers the watcher's metrics, which are unregistered
+	// again on stopping the watcher. Nil leaves them unregistered.
+	Registerer Registerer
+	// MetricLabels are constant labels added to the watcher's metrics, to
+	// tell apart the metrics of watchers sharing a registry.
+	MetricLabels prometheus.Labels
+	// Logger logs the watcher's messages, the logrus standard logger if nil.
+	Logger *log.Logger
+	// ReconcileInterval is the interval between reconciliations of the
+	// watched tree against cgroupfs, repairing cgroups missed by watch
+	// events. Zero only reconciles on notify errors, e.g. queue overflows.
+	ReconcileInterval time.Duration
 }
 
 // NewWatcher is a factory method for a new watcher for a number of cgroups.
-func NewWatcher(statsInterval time.Duration, subsystems ...string) (Watcher, error) {
+// Watchers are independent of each other, so several can be created in the
+// same process.
+func NewWatcher(opts Options) (Watcher, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	workers := opts.CollectionWorkers
+	if workers <= 0 {
+		workers = defaultCollectionWorkers
+	}
+	if err := opts.Schedule.Validate(); err != nil {
+		return nil, err
+	}
+
+	mounts, unifiedMount, err := findMounts(opts.Root)
+	if err != nil {
+		return nil, err
+	}
+
 	fsWatcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
@@ -88,52 +200,54 @@ func NewWatcher(statsInterval time.Duration, subsystems ...string) (Watcher, err
 		subsystems:         make(map[string]collector),
 		fsnotifyWatcher:    fsWatcher,
 		done:               make(chan struct{}),
-		cgroups:            make(map[string]*cgroup, len(subsystems)),
-		collectionInterval: statsInterval,
+		cgroups:            make(map[string]*cgroup, len(opts.Subsystems)),
+		collectionSchedule: opts.Schedule,
+		collectionWorkers:  workers,
+		statsSubs:          make(map[chan *v1.StatsUpdate]struct{}),
+		eventSubs:          make(map[chan *v1.Event]struct{}),
+		filter:             opts.Filter,
+		registerer:         opts.Registerer,
+		metrics:            newWatcherMetrics(opts.MetricLabels),
+		log:                log.NewEntry(logger),
+		reconcileInterval:  opts.ReconcileInterval,
+		reconcileNow:       make(chan struct{}, 1),
+		newCgroups:         make(map[*cgroup]struct{}),
 	}
 
-	mounts, err := cgroups.GetCgroupMounts()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, subsystem := range subsystems {
-		err := w.watchSubsystem(subsystem, mounts)
+	for _, subsystem := range opts.Subsystems {
+		err := w.watchSubsystem(subsystem, mounts, unifiedMount)
+		if _, ok := err.(*notMountedError); ok && opts.SkipUnmounted {
+			w.log.WithField("subsystem", subsystem).Warn("Skipping subsystem that is not mounted")
+			continue
+		}
 		if err != nil {
+			fsWatcher.Close()
 			return nil, err
 		}
 	}
 
 	for _, subsystem := range allSubsystems {
-		_, ok := w.subsystems[subsystem]
-		registerSubsystemMetrics(subsystem, ok)
+		value := 0.0
+		if _, ok := w.subsystems[subsystem]; ok {
+			value = 1.0
+		}
+		w.metrics.subsystemEnabled.WithLabelValues(subsystem).Set(value)
+	}
+	if w.registerer != nil {
+		if err := w.metrics.register(w.registerer); err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("cannot register cgroup metrics: %v", err)
+		}
 	}
 
 	return w, nil
 }
 
-func registerSubsystemMetrics(subsystem string, enabled bool) {
-	value := 0.0
-	if enabled {
-		value = 1.0
-	}
-	m := prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Namespace:   metrics.Namespace,
-			Subsystem:   MetricsSubsystem,
-			Name:        "subsystem_enabled",
-			Help:        "A metric with a constant '0' for disabled or '1' for enabled labeled by subsystem.",
-			ConstLabels: prometheus.Labels{"subsystem": subsystem},
-		},
-	)
-	m.Set(value)
-	prometheus.MustRegister(m)
-}
-
 func (w *watcher) Start() error {
 	w.cgroupMu.Lock()
 	defer w.cgroupMu.Unlock()
 
+	w.wg.Add(1)
 	go w.handleEvents()
 
 	watched := map[string]struct{}{}
@@ -144,12 +258,15 @@ func (w *watcher) Start() error {
 			}
 
 			if info.IsDir() {
+				if !w.filtered(path) {
+					return filepath.SkipDir
+				}
 				err := w.watch(path)
 				if err != nil {
 					return err
 				}
 				watched[path] = struct{}{}
-			} else if filepath.Base(path) == fs.CgroupProcesses {
+			} else if isControlFile(filepath.Base(path)) {
 				err := w.watch(path)
 				if err != nil {
 					return err
@@ -162,34 +279,55 @@ func (w *watcher) Start() error {
 		}
 	}
 
-	go w.startCollection()
+	w.publishEvents = true
+
+	w.startCollection()
+	w.startReconciliation()
+	w.startNewCgroupPolling()
 
 	return nil
 }
 
-func (w *watcher) watchSubsystem(subsystem string, mounts []cgroups.Mount) error {
+func (w *watcher) watchSubsystem(subsystem string, mounts []cgroups.Mount, unifiedMount string) error {
 	for _, mount := range mounts {
 		for _, mountedSubsystem := range mount.Subsystems {
 			if mountedSubsystem == subsystem {
-				w.initializeSubsystem(subsystem, mount)
+				w.initializeSubsystem(subsystem, mount.Mountpoint, subsystemCollector(subsystem))
 				return nil
 			}
 		}
 	}
-	return fmt.Errorf("cannot find subsystem mount for %s. Discovered subsystem mounts: %#v", subsystem, mounts)
+
+	// Fall back to the unified hierarchy, which also covers hybrid mode where
+	// only some controllers have been moved to cgroup v2.
+	if unifiedMount != "" && unifiedControllerEnabled(unifiedMount, subsystem) {
+		w.initializeSubsystem(subsystem, unifiedMount, &unifiedCollector{subsystem: subsystem, mountpoint: unifiedMount})
+		return nil
+	}
+	return &notMountedError{subsystem: subsystem, mounts: mounts}
+}
+
+// notMountedError is returned by watchSubsystem for subsystems without a
+// mount.
+type notMountedError struct {
+	subsystem string
+	mounts    []cgroups.Mount
+}
+
+// Error implements the error interface.
+func (e *notMountedError) Error() string {
+	return fmt.Sprintf("cannot find subsystem mount for %s. Discovered subsystem mounts: %#v", e.subsystem, e.mounts)
 }
 
-func (w *watcher) initializeSubsystem(subsystem string, mount cgroups.Mount) {
+func (w *watcher) initializeSubsystem(subsystem, mountpoint string, sys collector) {
 	// Sometimes cgroups share mount points, e.g. cpu,cpuacct.
 	var subcgroups map[string]*cgroup
 	for _, existingCg := range w.cgroups {
-		if existingCg.path == mount.Mountpoint {
+		if existingCg.path == mountpoint {
 			subcgroups = existingCg.subcgroups
 		}
 	}
 
-	sys := subsystemCollector(subsystem)
-
 	if sys != nil {
 		w.subsystems[subsystem] = sys
 	}
@@ -200,17 +338,17 @@ func (w *watcher) initializeSubsystem(subsystem string, mount cgroups.Mount) {
 
 	w.cgroups[subsystem] = &cgroup{
 		name:       subsystem,
-		path:       mount.Mountpoint,
+		path:       mountpoint,
 		subcgroups: subcgroups,
 	}
 
-	log.WithFields(log.Fields{"subsystem": subsystem, "path": mount.Mountpoint}).Info("Initialized subsystem")
+	w.log.WithFields(log.Fields{"subsystem": subsystem, "path": mountpoint}).Info("Initialized subsystem")
 }
 
 func (w *watcher) findCgroupMountpoints(path string) map[string]string {
 	subsystemMap := map[string]string{}
 	for _, cg := range w.cgroups {
-		if strings.HasPrefix(path, cg.path) {
+		if path == cg.path || strings.HasPrefix(path, cg.path+string(os.PathSeparator)) {
 			subsystemMap[cg.name] = cg.path
 		}
 	}
@@ -218,12 +356,35 @@ func (w *watcher) findCgroupMountpoints(path string) map[string]string {
 	return subsystemMap
 }
 
+// filtered returns true if the cgroup dir at path passes the filter. The root
+// of a hierarchy always passes.
+func (w *watcher) filtered(path string) bool {
+	if w.filter == nil {
+		return true
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+	for _, mountpoint := range w.findCgroupMountpoints(absPath) {
+		rel, err := filepath.Rel(mountpoint, absPath)
+		if err != nil || rel == "." {
+			return true
+		}
+		return w.filter("/" + filepath.ToSlash(rel))
+	}
+	return true
+}
+
 func (w *watcher) findCgroup(subsystem, relPath string) *cgroup {
 	cg := w.cgroups[subsystem]
 
 	spl := strings.Split(relPath, string(os.PathSeparator))
 	for _, s := range spl {
-		if s != "." {
+		if cg == nil {
+			return nil
+		}
+		if s != "." && s != "" {
 			cg = cg.subcgroups[s]
 		}
 	}
@@ -231,8 +392,100 @@ func (w *watcher) findCgroup(subsystem, relPath string) *cgroup {
 	return cg
 }
 
+func (w *watcher) Subsystems() []v1.Subsystem {
+	w.cgroupMu.RLock()
+	defer w.cgroupMu.RUnlock()
+
+	subsystems := make([]v1.Subsystem, 0, len(w.cgroups))
+	for name, cg := range w.cgroups {
+		subsystems = append(subsystems, v1.Subsystem{Name: name, Mountpoint: cg.path})
+	}
+	sort.Sort(bySubsystemName(subsystems))
+
+	return subsystems
+}
+
+func (w *watcher) Lookup(subsystem, path string) (*v1.Cgroup, bool) {
+	w.cgroupMu.RLock()
+	defer w.cgroupMu.RUnlock()
+
+	rel := strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	cg := w.findCgroup(subsystem, rel)
+	if cg == nil {
+		return nil, false
+	}
+
+	return cg.toV1(subsystem, "/"+rel), true
+}
+
+func (w *watcher) Walk(fn func(cg *v1.Cgroup)) {
+	w.cgroupMu.RLock()
+	defer w.cgroupMu.RUnlock()
+
+	for subsystem, root := range w.cgroups {
+		walkTree(root, "/", func(cg *cgroup, relPath string) {
+			fn(cg.toV1(subsystem, relPath))
+		})
+	}
+}
+
+func (w *watcher) Snapshot() []*v1.Cgroup {
+	var cgroups []*v1.Cgroup
+	w.Walk(func(cg *v1.Cgroup) {
+		cgroups = append(cgroups, cg)
+	})
+	sort.Sort(byCgroupPath(cgroups))
+	return cgroups
+}
+
+// walkTree calls fn with cg and all its descendants, along with their paths
+// relative to the subsystem mount point.
+func walkTree(cg *cgroup, relPath string, fn func(cg *cgroup, relPath string)) {
+	fn(cg, relPath)
+	for name, subCg := range cg.subcgroups {
+		walkTree(subCg, filepath.Join(relPath, name), fn)
+	}
+}
+
+func (cg *cgroup) toV1(subsystem, path string) *v1.Cgroup {
+	children := make([]string, 0, len(cg.subcgroups))
+	for name := range cg.subcgroups {
+		children = append(children, name)
+	}
+	sort.Strings(children)
+
+	pids := make([]int32, len(cg.pids))
+	copy(pids, cg.pids)
+
+	return &v1.Cgroup{
+		Name:      cg.name,
+		Subsystem: subsystem,
+		Path:      path,
+		Stats:     cg.stats[subsystem],
+		Pids:      pids,
+		Children:  children,
+	}
+}
+
+type byCgroupPath []*v1.Cgroup
+
+func (s byCgroupPath) Len() int      { return len(s) }
+func (s byCgroupPath) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCgroupPath) Less(i, j int) bool {
+	if s[i].Subsystem != s[j].Subsystem {
+		return s[i].Subsystem < s[j].Subsystem
+	}
+	return s[i].Path < s[j].Path
+}
+
+type bySubsystemName []v1.Subsystem
+
+func (s bySubsystemName) Len() int           { return len(s) }
+func (s bySubsystemName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySubsystemName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
 func (w *watcher) watch(path string) error {
-	log.WithField("target", path).Debug("Adding watch")
+	w.log.WithField("target", path).Debug("Adding watch")
 
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -244,55 +497,132 @@ func (w *watcher) watch(path string) error {
 		return fmt.Errorf("Cannot find cgroup mount point(s) for %s", absPath)
 	}
 
+	parentCgroup, _, err := w.parentCgroup(absPath, subsystemMountPoints)
+	if err != nil {
+		return err
+	}
+	if parentCgroup == nil {
+		// The parent's own create event has not been handled yet, or was
+		// missed, in which case reconciliation adds both.
+		return fmt.Errorf("Cannot find parent cgroup of %s", absPath)
+	}
+
+	name := filepath.Base(absPath)
+	isDir := !isControlFile(name)
+	var id fileID
+	if isDir && absPath != parentCgroup.path {
+		id, err = statID(absPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				w.log.WithField("target", path).Debug("Target no longer exists - ignoring")
+				return nil
+			}
+			return err
+		}
+		if existing, ok := parentCgroup.subcgroups[name]; ok {
+			if existing.id == id {
+				// Already watched, e.g. by a reconciliation racing the
+				// create event.
+				return nil
+			}
+			// Removed and created again without seeing the removal.
+			if err := w.unwatch(absPath); err != nil {
+				return err
+			}
+		}
+		if old := w.renamedSibling(parentCgroup, absPath, id); old != nil {
+			w.move(parentCgroup, old, absPath)
+			return nil
+		}
+	}
+
+	if !isDir && parentCgroup.fileWatched(name) {
+		return w.updateFile(filepath.Dir(absPath), parentCgroup, name, false)
+	}
+
 	err = w.fsnotifyWatcher.Add(absPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.WithField("target", path).Debug("Target no longer exists - ignoring")
+			w.log.WithField("target", path).Debug("Target no longer exists - ignoring")
 			return nil
 		}
 		return err
 	}
-	inotifyCount.Inc()
+	w.metrics.inotifyCount.Inc()
 
-	firstLoop := true
-	for subsystem, cgroupMountPoint := range subsystemMountPoints {
-		if filepath.Base(absPath) != fs.CgroupProcesses {
-			cgroupCount.WithLabelValues(subsystem).Inc()
+	if !isDir {
+		if name == cgroupEvents {
+			parentCgroup.eventsWatched = true
+		} else {
+			parentCgroup.procsWatched = true
 		}
+		return w.updateFile(filepath.Dir(absPath), parentCgroup, name, false)
+	}
 
-		if firstLoop {
-			rel, relErr := filepath.Rel(cgroupMountPoint, absPath)
-			if relErr != nil {
-				return relErr
-			}
-
-			parentCgroup := w.findCgroup(subsystem, filepath.Dir(rel))
+	for subsystem := range subsystemMountPoints {
+		w.metrics.cgroupCount.WithLabelValues(subsystem).Inc()
+	}
 
-			name := filepath.Base(absPath)
+	cg := parentCgroup
+	if absPath != parentCgroup.path {
+		cg = &cgroup{
+			name:       name,
+			path:       absPath,
+			subcgroups: make(map[string]*cgroup),
+			id:         id,
+		}
+		parentCgroup.subcgroups[name] = cg
+		w.log.WithField("target", absPath).Debug("Started watching cgroup dir")
+		// Collect straight away, so cgroups living shorter than the
+		// collection interval are measured too.
+		if w.publishEvents {
+			cg.created = time.Now()
+			w.collectNow(cg, subsystemMountPoints)
+			w.newCgroups[cg] = struct{}{}
+		}
+		w.publishEvent(v1.EventCgroupCreated, absPath, nil, nil)
+	}
+	if _, ok := subsystemMountPoints["memory"]; ok && cg.notifier == nil {
+		cg.notifier = w.registerMemoryEvents(absPath)
+	}
 
-			if name == fs.CgroupProcesses {
-				err := w.updatePIDs(filepath.Dir(absPath), parentCgroup)
-				if err != nil {
-					return err
-				}
-			} else if absPath != parentCgroup.path {
-				parentCgroup.subcgroups[name] = &cgroup{
-					name:       name,
-					path:       absPath,
-					subcgroups: make(map[string]*cgroup),
-				}
-				log.WithField("target", absPath).Debug("Started watching cgroup dir")
-			}
+	return nil
+}
 
-			firstLoop = false
+// watchDir watches the cgroup dir at path and its control files. Callers
+// must hold cgroupMu.
+func (w *watcher) watchDir(path string) error {
+	if err := w.watch(path); err != nil {
+		return err
+	}
+	for _, name := range []string{fs.CgroupProcesses, cgroupEvents} {
+		file := filepath.Join(path, name)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		if err := w.watch(file); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
+// parentCgroup returns the cgroup containing absPath, or the root cgroup for
+// a mount point, and absPath relative to the mount point. Subsystems mounted
+// together share their tree, so any of them finds the parent.
+func (w *watcher) parentCgroup(absPath string, subsystemMountPoints map[string]string) (*cgroup, string, error) {
+	for subsystem, cgroupMountPoint := range subsystemMountPoints {
+		rel, err := filepath.Rel(cgroupMountPoint, absPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return w.findCgroup(subsystem, filepath.Dir(rel)), rel, nil
+	}
+	return nil, "", nil
+}
+
 func (w *watcher) unwatch(path string) error {
-	log.WithField("target", path).Debug("Removing watch")
+	w.log.WithField("target", path).Debug("Removing watch")
 
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -304,180 +634,274 @@ func (w *watcher) unwatch(path string) error {
 		return fmt.Errorf("Cannot find cgroup mount point(s) for %s", absPath)
 	}
 
-	log.WithField("target", absPath).Debug("Stopping watch")
-	err = w.fsnotifyWatcher.Remove(absPath)
+	parentCgroup, rel, err := w.parentCgroup(absPath, subsystemMountPoints)
 	if err != nil {
-		if !strings.HasPrefix(err.Error(), "can't remove non-existent inotify watch for") || !os.IsNotExist(err) {
-			return err
-		}
+		return err
+	}
+	name := filepath.Base(absPath)
+	isDir := !isControlFile(name)
+	if parentCgroup == nil || isDir && parentCgroup.subcgroups[name] == nil || !isDir && !parentCgroup.fileWatched(name) {
+		// Already removed, e.g. on both the parent's delete event and the
+		// dir's own.
+		w.log.WithField("target", absPath).Debug("Not watched - ignoring")
+		return nil
 	}
-	inotifyCount.Dec()
 
-	firstLoop := true
-	for subsystem, cgroupMountPoint := range subsystemMountPoints {
-		if filepath.Base(absPath) != fs.CgroupProcesses {
-			cgroupCount.WithLabelValues(subsystem).Dec()
+	w.log.WithField("target", absPath).Debug("Stopping watch")
+	err = w.fsnotifyWatcher.Remove(absPath)
+	// The kernel removes the watches of deleted files itself.
+	if err != nil && !strings.HasPrefix(err.Error(), "can't remove non-existent inotify watch for") && !os.IsNotExist(err) && err != syscall.EINVAL {
+		return err
+	}
+	w.metrics.inotifyCount.Dec()
+
+	if !isDir {
+		if name == cgroupEvents {
+			parentCgroup.eventsWatched = false
+		} else {
+			parentCgroup.pids = nil
+			parentCgroup.procsWatched = false
 		}
+		w.log.WithField("target", absPath).Debug("Stopped watch")
+		return nil
+	}
 
-		if firstLoop {
-			rel, err := filepath.Rel(cgroupMountPoint, absPath)
-			if err != nil {
-				return err
-			}
+	for subsystem := range subsystemMountPoints {
+		w.metrics.cgroupCount.WithLabelValues(subsystem).Dec()
+	}
 
-			cg := w.findCgroup(subsystem, filepath.Dir(rel))
-			if cg != nil {
-				if filepath.Base(absPath) == fs.CgroupProcesses {
-					cg.pids = nil
-				} else {
-					name := filepath.Base(rel)
-					delete(cg.subcgroups, name)
-					procsFile := filepath.Join(path, fs.CgroupProcesses)
-					err := w.unwatch(procsFile)
-					if err != nil {
-						log.WithFields(log.Fields{
-							"target": procsFile,
-							"error":  err,
-						}).Error("Failed to remove watch")
-					}
-				}
-			}
-			firstLoop = false
+	removed := parentCgroup.subcgroups[name]
+	// Children are removed first, unless their removal was missed.
+	for child := range removed.subcgroups {
+		if err := w.unwatch(filepath.Join(absPath, child)); err != nil {
+			w.log.WithFields(log.Fields{
+				"target": filepath.Join(absPath, child),
+				"error":  err,
+			}).Error("Failed to remove watch")
+		}
+	}
+	for _, file := range []string{fs.CgroupProcesses, cgroupEvents} {
+		file = filepath.Join(absPath, file)
+		if err := w.unwatch(file); err != nil {
+			w.log.WithFields(log.Fields{
+				"target": file,
+				"error":  err,
+			}).Error("Failed to remove watch")
 		}
 	}
+	removed.notifier.close()
+	delete(w.newCgroups, removed)
+	delete(parentCgroup.subcgroups, name)
+	w.recordExited(removed, subsystemMountPoints, "/"+filepath.ToSlash(rel))
+	w.publishEvent(v1.EventCgroupRemoved, absPath, nil, nil)
 
-	log.WithField("target", absPath).Debug("Stopped watch")
+	w.log.WithField("target", absPath).Debug("Stopped watch")
 
 	return nil
 }
 
+// eventQueueSize bounds the number of events received but not yet handled.
+// Events beyond it are dropped, reconciling the watched tree instead as on
+// inotify queue overflows.
+const eventQueueSize = 16384
+
+// handleEvents handles the events of the fsnotify watcher one at a time, in
+// the order they were raised, until the watcher is stopped.
 func (w *watcher) handleEvents() {
+	defer w.wg.Done()
+
+	queue := make(chan fsnotify.Event, eventQueueSize)
+	handling := make(chan struct{})
+	defer close(handling)
 	w.wg.Add(1)
+	go w.receiveEvents(queue, handling)
+
+	for {
+		select {
+		case event := <-queue:
+			w.handleEvent(event)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// receiveEvents queues the events of the fsnotify watcher until handling is
+// closed. Events must be received while one is handled, as removing a watch
+// waits for fsnotify to deliver the removal.
+func (w *watcher) receiveEvents(queue chan<- fsnotify.Event, handling <-chan struct{}) {
 	defer w.wg.Done()
 	for {
 		select {
 		case event := <-w.fsnotifyWatcher.Events:
-			switch {
-			case event.Op&fsnotify.Create == fsnotify.Create:
-				go func() {
-					log.WithField("target", event.Name).Debug("Received create event")
-					fi, err := os.Lstat(event.Name)
-					if err != nil {
-						log.WithFields(log.Fields{
-							"target": event.Name,
-							"error":  err,
-						}).Error("Failed to get lstat")
-						return
-					}
-
-					if !fi.IsDir() && fi.Name() != fs.CgroupProcesses {
-						log.WithField("target", event.Name).Error("Ignoring create event - not dir or ", fs.CgroupProcesses)
-						return
-					}
-
-					w.cgroupMu.Lock()
-					defer w.cgroupMu.Unlock()
-
-					err = w.watch(event.Name)
-					if err != nil {
-						log.WithFields(log.Fields{
-							"target": event.Name,
-							"error":  err,
-						}).Error("Failed to add watch")
-					}
-
-					if fi.IsDir() {
-						cgProcs := filepath.Join(event.Name, fs.CgroupProcesses)
-						_, err = os.Stat(cgProcs)
-						if err == nil {
-							err = w.watch(cgProcs)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"target": cgProcs,
-									"error":  err,
-								}).Error("Failed to add watch")
-							}
-						}
-					}
-				}()
-			case event.Op&fsnotify.Remove == fsnotify.Remove:
-				go func() {
-					log.WithField("target", event.Name).Debug("Received remove event")
-
-					w.cgroupMu.Lock()
-					defer w.cgroupMu.Unlock()
-
-					err := w.unwatch(event.Name)
-					if err != nil {
-						log.WithFields(log.Fields{
-							"target": event.Name,
-							"error":  err,
-						}).Error("Failed to remove watch")
-					}
-				}()
-			case event.Op&fsnotify.Write == fsnotify.Write && filepath.Base(event.Name) == fs.CgroupProcesses:
-				go func() {
-					log.WithField("target", event.Name).Debug("Received write event")
-
-					w.cgroupMu.Lock()
-					defer w.cgroupMu.Unlock()
-
-					absPath, err := filepath.Abs(event.Name)
-					if err != nil {
-						log.WithFields(log.Fields{"target": event.Name, "error": err}).Error("Cannot find absolute dir")
-						return
-					}
-
-					subsystemMountPoints := w.findCgroupMountpoints(absPath)
-					if len(subsystemMountPoints) == 0 {
-						log.WithField("target", absPath).Error("Cannot find cgroup mount point")
-						return
-					}
-
-					for subsystem, cgroupMountPoint := range subsystemMountPoints {
-						rel, relErr := filepath.Rel(cgroupMountPoint, absPath)
-						if relErr != nil {
-							log.WithFields(log.Fields{"error": err, "target": absPath}).Error("Cannot find relative path")
-							return
-						}
-						err = w.updatePIDs(filepath.Dir(event.Name), w.findCgroup(subsystem, filepath.Dir(rel)))
-
-						if err != nil {
-							log.WithFields(log.Fields{
-								"target": event.Name,
-								"error":  err,
-							}).Error("Failed to update pids")
-						}
-					}
-				}()
+			select {
+			case queue <- event:
+			default:
+				w.log.WithField("target", event.Name).Warn("Event queue is full - dropping event")
+				w.reconcileSoon()
 			}
 		case err := <-w.fsnotifyWatcher.Errors:
-			log.WithField("error", err).Error("Received notify error")
-		case <-w.done:
+			// Events have been lost, reconcile to repair the cgroups missed.
+			if err == fsnotify.ErrEventOverflow {
+				w.log.Warn("Notify queue overflowed")
+			} else {
+				w.log.WithField("error", err).Error("Received notify error")
+			}
+			w.reconcileSoon()
+		case <-handling:
 			return
 		}
 	}
 }
 
+func (w *watcher) handleEvent(event fsnotify.Event) {
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		w.handleCreate(event)
+	case event.Op&fsnotify.Remove == fsnotify.Remove:
+		w.log.WithField("target", event.Name).Debug("Received remove event")
+
+		w.cgroupMu.Lock()
+		defer w.cgroupMu.Unlock()
+
+		err := w.unwatch(event.Name)
+		if err != nil {
+			w.log.WithFields(log.Fields{
+				"target": event.Name,
+				"error":  err,
+			}).Error("Failed to remove watch")
+		}
+	case event.Op&fsnotify.Rename == fsnotify.Rename:
+		w.log.WithField("target", event.Name).Debug("Received rename event")
+
+		w.cgroupMu.Lock()
+		defer w.cgroupMu.Unlock()
+
+		// The new name is reported by a create event, unless filtered.
+		// Reconciling the parent moves the renamed cgroup in either order,
+		// or removes it if filtered.
+		w.reconcile(filepath.Dir(event.Name), reconcileRename)
+	case event.Op&fsnotify.Write == fsnotify.Write && isControlFile(filepath.Base(event.Name)):
+		w.handleWrite(event)
+	}
+}
+
+func (w *watcher) handleCreate(event fsnotify.Event) {
+	w.log.WithField("target", event.Name).Debug("Received create event")
+	fi, err := os.Lstat(event.Name)
+	if err != nil {
+		w.log.WithFields(log.Fields{
+			"target": event.Name,
+			"error":  err,
+		}).Error("Failed to get lstat")
+		return
+	}
+
+	if !fi.IsDir() && !isControlFile(fi.Name()) {
+		w.log.WithField("target", event.Name).Error("Ignoring create event - not dir or control file")
+		return
+	}
+	if fi.IsDir() && !w.filtered(event.Name) {
+		w.log.WithField("target", event.Name).Debug("Ignoring create event - filtered")
+		return
+	}
+
+	w.cgroupMu.Lock()
+	defer w.cgroupMu.Unlock()
+
+	if !fi.IsDir() {
+		err = w.watch(event.Name)
+	} else {
+		err = w.watchDir(event.Name)
+	}
+	if err != nil {
+		w.log.WithFields(log.Fields{
+			"target": event.Name,
+			"error":  err,
+		}).Error("Failed to add watch")
+		return
+	}
+
+	if fi.IsDir() {
+		// Subdirs created before the watch was added, e.g. by mkdir -p,
+		// raise no events.
+		w.reconcile(event.Name, reconcileCreate)
+	}
+}
+
+func (w *watcher) handleWrite(event fsnotify.Event) {
+	w.log.WithField("target", event.Name).Debug("Received write event")
+
+	w.cgroupMu.Lock()
+	defer w.cgroupMu.Unlock()
+
+	absPath, err := filepath.Abs(event.Name)
+	if err != nil {
+		w.log.WithFields(log.Fields{"target": event.Name, "error": err}).Error("Cannot find absolute dir")
+		return
+	}
+
+	subsystemMountPoints := w.findCgroupMountpoints(absPath)
+	if len(subsystemMountPoints) == 0 {
+		w.log.WithField("target", absPath).Error("Cannot find cgroup mount point")
+		return
+	}
+
+	for subsystem, cgroupMountPoint := range subsystemMountPoints {
+		rel, relErr := filepath.Rel(cgroupMountPoint, absPath)
+		if relErr != nil {
+			w.log.WithFields(log.Fields{"error": err, "target": absPath}).Error("Cannot find relative path")
+			return
+		}
+		cg := w.findCgroup(subsystem, filepath.Dir(rel))
+		if cg == nil {
+			// Removed since the write.
+			continue
+		}
+		err = w.updateFile(filepath.Dir(event.Name), cg, filepath.Base(event.Name), true)
+
+		if err != nil {
+			w.log.WithFields(log.Fields{
+				"target": event.Name,
+				"error":  err,
+			}).Error("Failed to update cgroup processes")
+		}
+	}
+}
+
 func (w *watcher) updatePIDs(path string, cg *cgroup) error {
+	read := time.Now()
 	pids, err := getPIDs(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.WithField("target", path).Debug("Target cgroup.procs no longer exists - ignoring")
+			w.log.WithField("target", path).Debug("Target cgroup.procs no longer exists - ignoring")
 			cg.pids = pids
 			return nil
 		}
-		log.WithFields(log.Fields{"target": path, "error": err}).Debug("Cannot get cgroup PIDS")
+		w.log.WithFields(log.Fields{"target": path, "error": err}).Debug("Cannot get cgroup PIDS")
 		cg.pids = pids
 		return err
 	}
-	cg.pids = pids
-	return nil
+
+	return w.setPIDs(path, cg, pids, read)
 }
 
 func (w *watcher) Stop() error {
-	log.Debug("Stopping cgroup watcher")
+	w.log.Debug("Stopping cgroup watcher")
 	close(w.done)
 	w.wg.Wait()
+	w.cgroupMu.Lock()
+	for _, cg := range w.cgroups {
+		walkTree(cg, "/", func(cg *cgroup, _ string) {
+			cg.notifier.close()
+			cg.notifier = nil
+		})
+	}
+	w.cgroupMu.Unlock()
+	w.closeStatsSubscriptions()
+	w.closeEventSubscriptions()
+	if w.registerer != nil {
+		w.metrics.unregister(w.registerer)
+	}
 	return w.fsnotifyWatcher.Close()
 }
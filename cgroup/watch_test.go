@@ -1,22 +1,349 @@
 package cgroup
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
 )
 
+// testLog is the logger of watchers created by tests.
+var testLog = log.NewEntry(log.StandardLogger())
+
+var (
+	testWatcher     Watcher
+	testWatcherErr  error
+	testWatcherOnce sync.Once
+)
+
+// startTestWatcher starts a single watcher shared by the tests watching the
+// host's cgroups.
+func startTestWatcher(t *testing.T) Watcher {
+	testWatcherOnce.Do(func() {
+		testWatcher, testWatcherErr = NewWatcher(Options{Subsystems: []string{"cpu", "memory"}, Schedule: Schedule{Interval: time.Second}})
+		if testWatcherErr == nil {
+			testWatcherErr = testWatcher.Start()
+		}
+	})
+	if testWatcherErr != nil {
+		t.Fatalf("%v", testWatcherErr)
+	}
+	return testWatcher
+}
+
 func TestWatch(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping cgroup watch test")
 	}
 
-	w, err := NewWatcher(1*time.Second, "cpu")
+	w := startTestWatcher(t)
+	time.Sleep(10 * time.Second)
+
+	cg, ok := w.Lookup("cpu", "/")
+	if !ok {
+		t.Fatalf("could not find root cpu cgroup")
+	}
+	if cg.Stats == nil || cg.Stats.CPUStats == nil {
+		t.Errorf("could not get root cpu cgroup stats: %#v", cg)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cgroup watch events test")
+	}
+
+	w := startTestWatcher(t)
+
+	events, cancel := w.SubscribeEvents(0)
+	defer cancel()
+
+	mount := w.Subsystems()[0].Mountpoint
+	name := fmt.Sprintf("wurzel-test-%d", os.Getpid())
+	dir := filepath.Join(mount, name)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Skipf("cannot create cgroup: %v", err)
+	}
+	defer os.Remove(dir)
+
+	expectEvent(t, events, v1.EventCgroupCreated, "/"+name)
+
+	cmd := exec.Command("sleep", "60")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cmd.Process.Kill()
+	err = ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	e := expectEvent(t, events, v1.EventProcessesChanged, "/"+name)
+	if len(e.AddedPids) != 1 || e.AddedPids[0] != int32(cmd.Process.Pid) {
+		t.Errorf("unexpected added pids: %#v", e)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	err = os.Remove(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	expectEvent(t, events, v1.EventCgroupRemoved, "/"+name)
+}
+
+func TestWatchOOM(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cgroup OOM test")
+	}
+
+	w := startTestWatcher(t)
+
+	events, cancel := w.SubscribeEvents(0)
+	defer cancel()
+
+	var mount string
+	for _, s := range w.Subsystems() {
+		if s.Name == "memory" {
+			mount = s.Mountpoint
+		}
+	}
+	name := fmt.Sprintf("wurzel-test-oom-%d", os.Getpid())
+	dir := filepath.Join(mount, name)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Skipf("cannot create cgroup: %v", err)
+	}
+	defer os.Remove(dir)
+
+	expectEvent(t, events, v1.EventCgroupCreated, "/"+name)
+	if _, err := os.Stat(filepath.Join(dir, eventControlFile)); err != nil {
+		t.Skipf("memory notifications not supported: %v", err)
+	}
+
+	limit := []byte(strconv.Itoa(16 << 20))
+	err = ioutil.WriteFile(filepath.Join(dir, "memory.limit_in_bytes"), limit, 0644)
 	if err != nil {
-		t.Errorf("%v", err)
+		t.Fatalf("%v", err)
+	}
+	// Only present with swap accounting enabled.
+	ioutil.WriteFile(filepath.Join(dir, "memory.memsw.limit_in_bytes"), limit, 0644)
+
+	// Doubles a string until the shell is killed.
+	cmd := exec.Command("sh", "-c", `echo $$ > `+filepath.Join(dir, "cgroup.procs")+`; x=x; while :; do x=$x$x; done`)
+	err = cmd.Run()
+	if err == nil {
+		t.Fatalf("expected process to be OOM killed")
+	}
+
+	expectEvent(t, events, v1.EventOOM, "/"+name)
+}
+
+// fakeRoot creates a memory hierarchy below a temporary root, with cgroups
+// /a, /a/c and /b.
+func fakeRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "wurzel-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"memory", "memory/a", "memory/a/c", "memory/b"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(root, dir, "cgroup.procs"), nil, 0644)
+		}
+		if err != nil {
+			os.RemoveAll(root)
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// fakeRegisterer records the registered metrics.
+type fakeRegisterer struct {
+	mu         sync.Mutex
+	registered map[prometheus.Collector]bool
+}
+
+func (r *fakeRegisterer) Register(c prometheus.Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registered[c] = true
+	return nil
+}
+
+func (r *fakeRegisterer) Unregister(c prometheus.Collector) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ok := r.registered[c]
+	delete(r.registered, c)
+	return ok
+}
+
+func TestWatcherOptions(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	r := &fakeRegisterer{registered: map[prometheus.Collector]bool{}}
+	w, err := NewWatcher(Options{
+		Subsystems: []string{"memory"},
+		Schedule:   Schedule{Interval: time.Hour},
+		Root:       root,
+		Filter:     func(path string) bool { return path != "/b" },
+		Registerer: r,
+		Logger:     logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.registered) == 0 {
+		t.Error("expected metrics to be registered")
 	}
 	err = w.Start()
 	if err != nil {
-		t.Errorf("%v", err)
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, cg := range w.Snapshot() {
+		paths = append(paths, cg.Subsystem+":"+cg.Path)
+	}
+	if want := []string{"memory:/", "memory:/a", "memory:/a/c"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected cgroups %v, got %v", want, paths)
+	}
+	if _, ok := w.Lookup("memory", "/b"); ok {
+		t.Error("expected filtered cgroup not to be watched")
+	}
+
+	err = w.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.registered) != 0 {
+		t.Errorf("expected metrics to be unregistered, got %d", len(r.registered))
+	}
+}
+
+func TestMultipleWatchers(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+
+	var watchers []Watcher
+	for _, instance := range []string{"a", "b"} {
+		w, err := NewWatcher(Options{
+			Subsystems:   []string{"memory"},
+			Schedule:     Schedule{Interval: time.Hour},
+			Root:         root,
+			Registerer:   DefaultRegisterer,
+			MetricLabels: prometheus.Labels{"instance": instance},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		watchers = append(watchers, w)
+	}
+	if _, err := NewWatcher(Options{Subsystems: []string{"memory"}, Schedule: Schedule{Interval: time.Hour}, Root: root, Registerer: DefaultRegisterer, MetricLabels: prometheus.Labels{"instance": "a"}}); err == nil {
+		t.Error("expected registering the metrics of an instance twice to fail")
+	}
+
+	for _, w := range watchers {
+		if err := w.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := w.Lookup("memory", "/a/c"); !ok {
+			t.Error("expected each watcher to watch the cgroups")
+		}
+	}
+	for _, w := range watchers {
+		if err := w.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Stopped watchers unregister their metrics.
+	w, err := NewWatcher(Options{Subsystems: []string{"memory"}, Schedule: Schedule{Interval: time.Hour}, Root: root, Registerer: DefaultRegisterer, MetricLabels: prometheus.Labels{"instance": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	w.Stop()
+}
+
+func expectEvent(t *testing.T, events <-chan *v1.Event, eventType, path string) *v1.Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == eventType && e.Path == path {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event for %s", eventType, path)
+		}
+	}
+}
+
+func TestNewWatcherSkipUnmounted(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+
+	opts := Options{Subsystems: []string{"memory", "pids"}, Schedule: Schedule{Interval: time.Hour}, Root: root}
+	if _, err := NewWatcher(opts); err == nil {
+		t.Error("expected error watching a subsystem that is not mounted")
+	}
+
+	opts.SkipUnmounted = true
+	w, err := NewWatcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsystems := w.Subsystems()
+	if len(subsystems) != 1 || subsystems[0].Name != "memory" {
+		t.Errorf("expected only the memory subsystem to be watched, got %+v", subsystems)
+	}
+}
+
+func TestWatchEventOrder(t *testing.T) {
+	root := fakeRoot(t)
+	defer os.RemoveAll(root)
+	w := startFakeWatcher(t, root)
+	defer w.Stop()
+
+	dir := filepath.Join(root, "memory", "b", "x")
+	for i := 0; i < 50; i++ {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Events are handled in order, so once the last is handled, those
+	// before have been.
+	if err := os.Mkdir(filepath.Join(root, "memory", "b", "y"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "expected the last cgroup created to be watched", func() bool {
+		_, ok := w.Lookup("memory", "/b/y")
+		return ok
+	})
+	if _, ok := w.Lookup("memory", "/b/x"); ok {
+		t.Error("expected removed cgroup not to be watched")
 	}
-	time.Sleep(10 * time.Second)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -15,11 +16,62 @@ var (
 		Short: "Start a daemon with REST API to monitor your server remotely",
 		Long:  `Start a daemon with REST API to monitor your server remotely.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			daemon.Run(strings.Split(viper.GetString("cgroups"), ","), viper.GetDuration("cgroups-stats-interval"))
+			daemon.Run(mux, daemon.Options{
+				Cgroups:                 strings.Split(viper.GetString("cgroups"), ","),
+				SkipUnmountedCgroups:    !flagSet(cmd, "cgroups"),
+				StatsInterval:           viper.GetDuration("cgroups-stats-interval"),
+				StatsSubsystemIntervals: viper.GetString("cgroups-stats-intervals"),
+				StatsMinInterval:        viper.GetDuration("cgroups-stats-min-interval"),
+				StatsMaxInterval:        viper.GetDuration("cgroups-stats-max-interval"),
+				StatsIdleEvery:          viper.GetInt("cgroups-stats-idle-every"),
+				CgroupRoot:              viper.GetString("cgroup-root"),
+				ReconcileInterval:       viper.GetDuration("cgroups-reconcile-interval"),
+				CAdvisorMetricNames:     viper.GetBool("cadvisor-metric-names"),
+				ContainerLabels:         splitList(viper.GetString("container-labels")),
+				MetricsNamespaces:       splitList(viper.GetString("metrics-namespaces")),
+				DockerEndpoint:          viper.GetString("docker-endpoint"),
+				KubeletPods:             viper.GetString("kubelet-pods"),
+				SystemdDBus:             viper.GetBool("systemd-dbus"),
+				ClassifierRules:         viper.GetString("classifier-rules"),
+				HistoryRetention:        viper.GetDuration("history-retention"),
+				HistoryResolution:       viper.GetDuration("history-resolution"),
+				HistoryProcesses:        splitList(viper.GetString("history-processes")),
+				HistoryMaxSeries:        viper.GetInt("history-max-series"),
+				HistoryMaxQuerySeries:   viper.GetInt("history-max-query-series"),
+				HistoryDir:              viper.GetString("history-dir"),
+				HistoryDiskRetention:    viper.GetDuration("history-disk-retention"),
+				HistoryRollups:          viper.GetString("history-rollups"),
+				HistoryDiskMaxBytes:     int64(viper.GetInt("history-disk-max-mb")) << 20,
+			})
 		},
 	}
 )
 
+// splitList splits a comma-separated flag value, returning nil if empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 func init() {
+	addBoolFlag(daemonCmd.Flags(), "cadvisor-metric-names", false, "export per-cgroup metrics using cAdvisor compatible names")
+	addStringFlag(daemonCmd.Flags(), "container-labels", "", "container labels to export as metric labels (comma-separated)")
+	addStringFlag(daemonCmd.Flags(), "metrics-namespaces", "", "only export metrics for Kubernetes pods in these namespaces (comma-separated)")
+	addStringFlag(daemonCmd.Flags(), "kubelet-pods", "", "kubelet /pods endpoint or file for pod metadata, e.g. http://localhost:10255/pods")
+	addBoolFlag(daemonCmd.Flags(), "systemd-dbus", false, "confirm systemd units and look up their state over D-Bus")
+	addStringFlag(daemonCmd.Flags(), "classifier-rules", "", "file of \"<runtime> <regex>\" rules identifying containers from cgroup paths")
+	addDurationFlag(daemonCmd.Flags(), "history-retention", time.Hour, "how long to keep the in-memory stats history, 0 to disable")
+	addDurationFlag(daemonCmd.Flags(), "history-resolution", 10*time.Second, "interval between samples in the stats history")
+	addStringFlag(daemonCmd.Flags(), "history-processes", "", "names of processes to record in the stats history (comma-separated)")
+	addIntFlag(daemonCmd.Flags(), "history-max-series", 20000, "maximum number of series recorded in the stats history, 0 for no limit")
+	addIntFlag(daemonCmd.Flags(), "history-max-query-series", 1000, "maximum number of series a history range query may select, 0 for no limit")
+	addStringFlag(daemonCmd.Flags(), "history-dir", "", "directory to persist the stats history in, empty to keep it in memory only")
+	addDurationFlag(daemonCmd.Flags(), "history-disk-retention", 24*time.Hour, "how long to keep persisted samples at the history resolution")
+	addStringFlag(daemonCmd.Flags(), "history-rollups", "1m:168h,10m:720h", "downsampled tiers of the persisted history as <resolution>:<retention> (comma-separated)")
+	addIntFlag(daemonCmd.Flags(), "history-disk-max-mb", 1024, "maximum size of the persisted history in MiB, 0 for no limit")
+	addStringFlag(daemonCmd.Flags(), "docker-endpoint", "unix:///var/run/docker.sock", "Docker Engine API endpoint for container metadata, empty to disable")
+
 	RootCmd.AddCommand(daemonCmd)
 }
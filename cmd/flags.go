@@ -1,9 +1,12 @@
 package main
 
 import (
+	"os"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -33,8 +36,24 @@ func addBoolPFlag(flags *pflag.FlagSet, name, shorthand string, def bool, desc s
 	viper.SetDefault(name, def)
 }
 
+func addIntFlag(flags *pflag.FlagSet, name string, def int, desc string) {
+	flags.Int(name, def, desc)
+	bindPFlag(flags, name)
+	viper.SetDefault(name, def)
+}
+
 func addDurationFlag(flags *pflag.FlagSet, name string, def time.Duration, desc string) {
 	flags.Duration(name, def, desc)
 	bindPFlag(flags, name)
 	viper.SetDefault(name, def)
 }
+
+// flagSet returns true if the flag name of cmd was set on the command line or
+// in the environment, rather than left at its default.
+func flagSet(cmd *cobra.Command, name string) bool {
+	if f := cmd.Flags().Lookup(name); f != nil && f.Changed {
+		return true
+	}
+	// Mirrors how viper.AutomaticEnv looks up the flag.
+	return os.Getenv(strings.ToUpper("wurzel_"+name)) != ""
+}
@@ -24,8 +24,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/jimmidyson/wurzel/host"
 )
 
+// defaultCgroups are the cgroups enabled by default. Those not supported by
+// the kernel are skipped.
+const defaultCgroups = "blkio,cpu,cpuacct,cpuset,devices,freezer,hugetlb,memory,net_cls,net_prio,perf_event,pids"
+
 var (
 	// RootCmd is the root command for the whole program.
 	RootCmd = &cobra.Command{
@@ -43,6 +49,13 @@ var (
 				})
 			}
 
+			if err := host.SetProc(viper.GetString("host-proc")); err != nil {
+				log.Fatal(err)
+			}
+			if err := host.SetSys(viper.GetString("host-sys")); err != nil {
+				log.Fatal(err)
+			}
+
 			if viper.GetBool("debug") {
 				go func() {
 					log.WithFields(log.Fields{"endpoint": "debug", "address": viper.GetString("debug-address")}).Info("Listening")
@@ -51,7 +64,6 @@ var (
 			}
 
 			go func() {
-				mux := http.NewServeMux()
 				mux.Handle("/metrics", prometheus.Handler())
 				log.WithFields(log.Fields{"endpoint": "api", "address": viper.GetString("listen-address")}).Info("Listening")
 				srv := http.Server{Addr: viper.GetString("listen-address"), Handler: mux}
@@ -59,6 +71,10 @@ var (
 			}()
 		},
 	}
+
+	// mux serves the metrics endpoint plus any API endpoints registered by
+	// subcommands.
+	mux = http.NewServeMux()
 )
 
 func init() {
@@ -66,8 +82,16 @@ func init() {
 	viper.AutomaticEnv()
 
 	addStringFlag(RootCmd.PersistentFlags(), "listen-address", ":8080", "the address to listen on for API requests")
-	addStringFlag(RootCmd.PersistentFlags(), "cgroups", "blkio,cpu,cpuacct,cpuset,devices,freezer,hugetlb,memory,net_cls,net_prio,perf_event", "enabled cgroups (comma-separated)")
+	addStringFlag(RootCmd.PersistentFlags(), "cgroups", defaultCgroups, "enabled cgroups (comma-separated), of which those not mounted are skipped if left at the default")
 	addDurationFlag(RootCmd.PersistentFlags(), "cgroups-stats-interval", 10*time.Second, "cgroup stats collection interval")
+	addStringFlag(RootCmd.PersistentFlags(), "cgroups-stats-intervals", "", "cgroup stats collection intervals of individual subsystems, e.g. memory=5s,blkio=30s")
+	addDurationFlag(RootCmd.PersistentFlags(), "cgroups-stats-min-interval", 0, "minimum cgroup stats collection interval, 0 for no minimum")
+	addDurationFlag(RootCmd.PersistentFlags(), "cgroups-stats-max-interval", 2*time.Minute, "maximum interval the cgroup stats collection backs off to while rounds take too long, 0 for no maximum")
+	addIntFlag(RootCmd.PersistentFlags(), "cgroups-stats-idle-every", 3, "collect the stats of idle cgroups only every this many rounds")
+	addStringFlag(RootCmd.PersistentFlags(), "cgroup-root", "", "directory the cgroup hierarchies are mounted below, e.g. /host/sys/fs/cgroup, empty to find them in the mount table")
+	addStringFlag(RootCmd.PersistentFlags(), "host-proc", "/proc", "where the host's /proc is mounted, e.g. /host/proc when running in a container")
+	addStringFlag(RootCmd.PersistentFlags(), "host-sys", "/sys", "where the host's /sys is mounted, e.g. /host/sys when running in a container")
+	addDurationFlag(RootCmd.PersistentFlags(), "cgroups-reconcile-interval", time.Minute, "interval between reconciliations of the watched cgroups against cgroupfs, repairing missed events, 0 to only reconcile on notify queue overflows and errors")
 	addBoolFlag(RootCmd.PersistentFlags(), "disable-cgroups-stats", false, "disable cgroup stats collection")
 	addStringFlag(RootCmd.PersistentFlags(), "debug-address", "localhost:6060", "the address to listen on for debug/profile requests")
 
@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/history"
+	"github.com/jimmidyson/wurzel/node"
+)
+
+const (
+	// APIPrefix is the path prefix all v1 API endpoints are served under.
+	APIPrefix = "/api/v1"
+
+	cgroupsPath   = APIPrefix + "/cgroups"
+	nodePath      = APIPrefix + "/node"
+	processesPath = APIPrefix + "/processes"
+	streamPath    = APIPrefix + "/stream"
+	eventsPath    = APIPrefix + "/events"
+	podsPath      = APIPrefix + "/pods"
+	unitsPath     = APIPrefix + "/units"
+	queryPath     = APIPrefix + "/query_range"
+	exitedPath    = APIPrefix + "/exited"
+)
+
+// NewAPIHandler returns an http.Handler serving the v1 REST API backed by the
+// given watcher, and the recorded history if h is not nil. The node CPU
+// utilization is that sampled by cpu, sampled once on first use if nil.
+func NewAPIHandler(w cgroup.Watcher, h *history.Store, cpu *node.CPUSampler) http.Handler {
+	if cpu == nil {
+		cpu = node.NewCPUSampler()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cgroupsPath, cgroupsHandler(w))
+	mux.HandleFunc(cgroupsPath+"/", cgroupsHandler(w))
+	nodeAPI := nodeHandler(cpu)
+	mux.HandleFunc(nodePath, nodeAPI)
+	mux.HandleFunc(nodePath+"/", nodeAPI)
+	mux.HandleFunc(processesPath, processesHandler(w))
+	mux.HandleFunc(processesPath+"/", processesHandler(w))
+	mux.HandleFunc(streamPath, streamHandler(w))
+	mux.HandleFunc(eventsPath, eventsHandler(w))
+	mux.HandleFunc(eventsPath+"/stream", eventsStreamHandler(w))
+	mux.HandleFunc(podsPath, podsHandler(w))
+	mux.HandleFunc(unitsPath, unitsHandler(w))
+	mux.HandleFunc(queryPath, queryRangeHandler(h))
+	mux.HandleFunc(exitedPath, exitedHandler(w))
+	return mux
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	err := json.NewEncoder(rw).Encode(v)
+	if err != nil {
+		log.WithField("error", err).Error("Failed to write API response")
+	}
+}
+
+func allowGet(rw http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, &v1.Error{Message: err.Error()})
+}
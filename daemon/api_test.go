@@ -0,0 +1,367 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/process"
+)
+
+// fakeWatcher implements the parts of cgroup.Watcher used by the API; other
+// methods panic.
+type fakeWatcher struct {
+	cgroup.Watcher
+	subsystems []v1.Subsystem
+	cgroups    map[string]*v1.Cgroup
+	stats      chan *v1.StatsUpdate
+	events     []v1.Event
+	exited     []v1.ExitedCgroup
+}
+
+func (f *fakeWatcher) Subsystems() []v1.Subsystem { return f.subsystems }
+
+func (f *fakeWatcher) Exited() []v1.ExitedCgroup { return f.exited }
+
+func (f *fakeWatcher) Lookup(subsystem, path string) (*v1.Cgroup, bool) {
+	cg, ok := f.cgroups[subsystem+":/"+path]
+	return cg, ok
+}
+
+func (f *fakeWatcher) Walk(fn func(cg *v1.Cgroup)) {
+	for _, cg := range f.cgroups {
+		fn(cg)
+	}
+}
+
+func (f *fakeWatcher) SubscribeStats() (<-chan *v1.StatsUpdate, func()) {
+	return f.stats, func() {}
+}
+
+func (f *fakeWatcher) Events(since uint64) *v1.EventList {
+	list := &v1.EventList{Events: []v1.Event{}}
+	for _, e := range f.events {
+		if e.Sequence > since {
+			list.Events = append(list.Events, e)
+		}
+		list.LastSequence = e.Sequence
+	}
+	return list
+}
+
+func (f *fakeWatcher) SubscribeEvents(since uint64) (<-chan *v1.Event, func()) {
+	ch := make(chan *v1.Event, len(f.events))
+	for i := range f.events {
+		if f.events[i].Sequence > since {
+			ch <- &f.events[i]
+		}
+	}
+	return ch, func() {}
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{
+		stats:      make(chan *v1.StatsUpdate, 1),
+		subsystems: []v1.Subsystem{{Name: "memory", Mountpoint: "/sys/fs/cgroup/memory"}},
+		cgroups: map[string]*v1.Cgroup{
+			"memory:/": {
+				Name:      "memory",
+				Subsystem: "memory",
+				Path:      "/",
+				Pids:      []int32{1},
+				Children:  []string{"docker"},
+			},
+			"memory:/docker/abc": {
+				Name:      "abc",
+				Subsystem: "memory",
+				Path:      "/docker/abc",
+				Stats:     &v1.Stats{MemoryStats: &v1.MemoryStats{Cache: 42}},
+				Pids:      []int32{100, 101},
+				Children:  []string{},
+			},
+		},
+	}
+}
+
+func TestCgroupsAPI(t *testing.T) {
+	srv := httptest.NewServer(NewAPIHandler(newFakeWatcher(), nil, nil))
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		into   interface{}
+		want   interface{}
+	}{
+		{"/api/v1/cgroups", http.StatusOK, &[]v1.Subsystem{}, &[]v1.Subsystem{{Name: "memory", Mountpoint: "/sys/fs/cgroup/memory"}}},
+		{"/api/v1/cgroups/memory", http.StatusOK, &v1.Cgroup{}, newFakeWatcher().cgroups["memory:/"]},
+		{"/api/v1/cgroups/memory/docker/abc", http.StatusOK, &v1.Cgroup{}, newFakeWatcher().cgroups["memory:/docker/abc"]},
+		{"/api/v1/cgroups/memory/docker/missing", http.StatusNotFound, &v1.Error{}, &v1.Error{Message: "cgroup /docker/missing not found in subsystem memory"}},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(test.into)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		if !reflect.DeepEqual(test.into, test.want) {
+			t.Errorf("%s: expected %#v, got %#v", test.path, test.want, test.into)
+		}
+	}
+}
+
+func TestCgroupsAPIMethodNotAllowed(t *testing.T) {
+	srv := httptest.NewServer(NewAPIHandler(newFakeWatcher(), nil, nil))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/v1/cgroups", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestNodeAPI(t *testing.T) {
+	srv := httptest.NewServer(NewAPIHandler(newFakeWatcher(), nil, nil))
+	defer srv.Close()
+
+	for _, path := range []string{"/api/v1/node", "/api/v1/node/cpuinfo", "/api/v1/node/cputime", "/api/v1/node/cpuutilization", "/api/v1/node/memory", "/api/v1/node/swap"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/api/v1/node/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestProcessesAPI(t *testing.T) {
+	srv := httptest.NewServer(NewAPIHandler(newFakeWatcher(), nil, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/processes?limit=2&sort=rss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list v1.ProcessList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || list.Total == 0 || len(list.Processes) == 0 || len(list.Processes) > 2 {
+		t.Errorf("unexpected process list (status %d): %#v", resp.StatusCode, list)
+	}
+
+	pid := os.Getpid()
+	resp, err = http.Get(srv.URL + "/api/v1/processes/" + strconv.Itoa(pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p v1.Process
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || p.Pid != int32(pid) {
+		t.Errorf("unexpected process (status %d): %#v", resp.StatusCode, p)
+	}
+
+	for path, status := range map[string]int{
+		"/api/v1/processes/-1":          http.StatusNotFound,
+		"/api/v1/processes/abc":         http.StatusBadRequest,
+		"/api/v1/processes?uid=abc":     http.StatusBadRequest,
+		"/api/v1/processes?sort=bogus":  http.StatusBadRequest,
+		"/api/v1/processes?offset=-1":   http.StatusBadRequest,
+		"/api/v1/processes?status=zzzz": http.StatusOK,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+}
+
+func TestWriteQueryError(t *testing.T) {
+	for err, status := range map[error]int{
+		&process.OptionsError{Message: "invalid sort order"}: http.StatusBadRequest,
+		errors.New("cannot read /proc"):                      http.StatusInternalServerError,
+	} {
+		rec := httptest.NewRecorder()
+		writeQueryError(rec, err)
+		if rec.Code != status {
+			t.Errorf("%v: expected status %d, got %d", err, status, rec.Code)
+		}
+	}
+}
+
+func TestCgroupProcessesAPI(t *testing.T) {
+	self, parent := int32(os.Getpid()), int32(os.Getppid())
+	w := newFakeWatcher()
+	w.cgroups = map[string]*v1.Cgroup{
+		"memory:/":              {Subsystem: "memory", Path: "/", Pids: []int32{self}, Children: []string{"app"}},
+		"memory:/app":           {Subsystem: "memory", Path: "/app", Pids: []int32{parent, -1}, Children: []string{"processes"}},
+		"memory:/app/processes": {Subsystem: "memory", Path: "/app/processes", Pids: []int32{}, Children: []string{}},
+	}
+	srv := httptest.NewServer(NewAPIHandler(w, nil, nil))
+	defer srv.Close()
+
+	// Processes are sorted by pid.
+	first, second := parent, self
+	if first > second {
+		first, second = second, first
+	}
+
+	for path, want := range map[string][]int32{
+		"/api/v1/cgroups/memory/processes":                          {self},
+		"/api/v1/cgroups/memory/processes?recursive=true":           {first, second},
+		"/api/v1/cgroups/memory/processes?recursive=true&limit=1":   {first},
+		"/api/v1/cgroups/memory/app/processes/processes":            {},
+		"/api/v1/cgroups/memory/processes?recursive=true&name=none": {},
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		var list v1.ProcessList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		got := []int32{}
+		for _, p := range list.Processes {
+			got = append(got, p.Pid)
+		}
+		if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected pids %v, got %v (status %d)", path, want, got, resp.StatusCode)
+		}
+	}
+
+	// A cgroup named processes is returned rather than its parent's processes.
+	resp, err := http.Get(srv.URL + "/api/v1/cgroups/memory/app/processes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cg v1.Cgroup
+	err = json.NewDecoder(resp.Body).Decode(&cg)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cg.Path != "/app/processes" {
+		t.Errorf("expected cgroup /app/processes, got %#v", cg)
+	}
+
+	for path, status := range map[string]int{
+		"/api/v1/cgroups/memory/missing/processes":   http.StatusNotFound,
+		"/api/v1/cgroups/memory/processes?sort=size": http.StatusBadRequest,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+}
+
+func TestProcessCgroupsAPI(t *testing.T) {
+	pid := os.Getpid()
+	paths, err := cgroup.ProcessCgroupPaths(int32(pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryPath, ok := paths["memory"]
+	if !ok {
+		memoryPath = paths[""]
+	}
+
+	container := &v1.Container{Runtime: v1.RuntimeDocker, ID: "abc"}
+	w := newFakeWatcher()
+	w.cgroups = map[string]*v1.Cgroup{
+		"memory:" + memoryPath: {Subsystem: "memory", Path: memoryPath, Container: container},
+	}
+	srv := httptest.NewServer(NewAPIHandler(w, nil, nil))
+	defer srv.Close()
+
+	want := []v1.ProcessCgroup{{Subsystem: "memory", Path: memoryPath, Container: container}}
+
+	resp, err := http.Get(srv.URL + "/api/v1/processes/" + strconv.Itoa(pid) + "/cgroups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cgroups []v1.ProcessCgroup
+	err = json.NewDecoder(resp.Body).Decode(&cgroups)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cgroups, want) {
+		t.Errorf("expected %#v, got %#v", want, cgroups)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/v1/processes/" + strconv.Itoa(pid) + "?cgroups=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p v1.Process
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Cgroups, want) {
+		t.Errorf("expected inline cgroups %#v, got %#v", want, p.Cgroups)
+	}
+
+	for path, status := range map[string]int{
+		"/api/v1/processes/-1/cgroups": http.StatusNotFound,
+		"/api/v1/processes/1/unknown":  http.StatusBadRequest,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/process"
+)
+
+// cgroupsHandler serves /api/v1/cgroups, listing the watched subsystems,
+// /api/v1/cgroups/{subsystem}/{path}, returning a single cgroup, and
+// /api/v1/cgroups/{subsystem}/{path}/processes, listing the processes in a
+// cgroup. A cgroup named processes takes precedence over the listing of its
+// parent.
+func cgroupsHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		rel := strings.Trim(strings.TrimPrefix(r.URL.Path, cgroupsPath), "/")
+		if rel == "" {
+			writeJSON(rw, http.StatusOK, w.Subsystems())
+			return
+		}
+
+		spl := strings.SplitN(rel, "/", 2)
+		subsystem, cgPath := spl[0], ""
+		if len(spl) > 1 {
+			cgPath = spl[1]
+		}
+
+		cg, ok := w.Lookup(subsystem, cgPath)
+		if !ok && path.Base("/"+cgPath) == "processes" {
+			cgPath = strings.Trim(path.Dir("/"+cgPath), "/")
+			cg, ok = w.Lookup(subsystem, cgPath)
+			if ok {
+				cgroupProcesses(rw, r, w, cg)
+				return
+			}
+		}
+		if !ok {
+			writeError(rw, http.StatusNotFound, fmt.Errorf("cgroup %s not found in subsystem %s", "/"+cgPath, subsystem))
+			return
+		}
+		writeJSON(rw, http.StatusOK, cg)
+	}
+}
+
+// cgroupProcesses lists the processes in cg, and in all cgroups below it if
+// the recursive query parameter is true. The processes can be filtered,
+// sorted and paginated as for /api/v1/processes. Only the processes in the
+// cgroups are described, rather than every process on the node.
+func cgroupProcesses(rw http.ResponseWriter, r *http.Request, w cgroup.Watcher, cg *v1.Cgroup) {
+	opts, err := parseProcessListOptions(r)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	pids := cg.Pids
+	if r.URL.Query().Get("recursive") == "true" {
+		pids = descendantPids(w, cg)
+	}
+
+	// The cgroups are attached with their metadata below.
+	query := *opts
+	query.Cgroups = false
+	list, err := process.QueryPIDs(pids, query)
+	if err != nil {
+		writeQueryError(rw, err)
+		return
+	}
+	if opts.Cgroups {
+		attachCgroups(w, list.Processes)
+	}
+	writeJSON(rw, http.StatusOK, list)
+}
+
+// descendantPids returns the pids of cg and all cgroups below it.
+func descendantPids(w cgroup.Watcher, cg *v1.Cgroup) []int32 {
+	pids := append([]int32{}, cg.Pids...)
+	for _, child := range cg.Children {
+		if childCg, ok := w.Lookup(cg.Subsystem, strings.TrimPrefix(path.Join(cg.Path, child), "/")); ok {
+			pids = append(pids, descendantPids(w, childCg)...)
+		}
+	}
+	return pids
+}
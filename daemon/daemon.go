@@ -1,35 +1,228 @@
 package daemon
 
 import (
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/exporter"
+	"github.com/jimmidyson/wurzel/history"
+	"github.com/jimmidyson/wurzel/metadata"
+	"github.com/jimmidyson/wurzel/node"
+	"github.com/jimmidyson/wurzel/process"
 )
 
-// Run starts the daemon.
-func Run(cgroups []string, statsInterval time.Duration) {
-	log.WithFields(log.Fields{"cgroups": cgroups}).Debug("Enabled cgroups")
-	w, err := cgroup.NewWatcher(statsInterval, cgroups...)
+// Options configures the daemon.
+type Options struct {
+	// Cgroups are the cgroup subsystems to watch.
+	Cgroups []string
+	// SkipUnmountedCgroups skips the Cgroups that are not mounted with a
+	// warning, as not every kernel supports every subsystem, rather than
+	// failing.
+	SkipUnmountedCgroups bool
+	// StatsInterval is the interval between collections of cgroup stats.
+	StatsInterval time.Duration
+	// StatsSubsystemIntervals overrides StatsInterval for individual
+	// subsystems, see cgroup.ParseIntervals.
+	StatsSubsystemIntervals string
+	// StatsMinInterval and StatsMaxInterval bound the collection interval as
+	// it backs off from rounds taking too long. Zero leaves it unbounded.
+	StatsMinInterval time.Duration
+	StatsMaxInterval time.Duration
+	// StatsIdleEvery collects idle cgroups only every StatsIdleEvery rounds.
+	StatsIdleEvery int
+	// CgroupRoot is the directory the cgroup hierarchies are mounted below,
+	// see cgroup.Options.Root. Empty finds them in the mount table.
+	CgroupRoot string
+	// ReconcileInterval is the interval between reconciliations of the
+	// watched cgroups against cgroupfs, see cgroup.Options.
+	ReconcileInterval time.Duration
+	// CAdvisorMetricNames exports per-cgroup metrics using cAdvisor
+	// compatible names.
+	CAdvisorMetricNames bool
+	// ContainerLabels are the container labels exported as metric labels.
+	ContainerLabels []string
+	// MetricsNamespaces restricts the exported metrics to the cgroups of
+	// Kubernetes pods in the given namespaces.
+	MetricsNamespaces []string
+	// DockerEndpoint is the Docker Engine API used to look up container
+	// metadata, e.g. unix:///var/run/docker.sock. Empty disables Docker
+	// metadata.
+	DockerEndpoint string
+	// KubeletPods is the kubelet's read-only /pods endpoint, or a file holding
+	// its response, used to look up pod metadata. Empty only attributes
+	// cgroups to pods by UID.
+	KubeletPods string
+	// SystemdDBus confirms the systemd units cgroups are attributed to, and
+	// looks up their description and state, over D-Bus.
+	SystemdDBus bool
+	// ClassifierRules is a file of rules identifying containers from cgroup
+	// paths, tried before the built-in rules. See cgroup.ParseRules.
+	ClassifierRules string
+	// HistoryRetention is how long the in-memory history served by the
+	// query_range endpoint is kept. Zero disables the history.
+	HistoryRetention time.Duration
+	// HistoryResolution is the interval between recorded samples.
+	HistoryResolution time.Duration
+	// HistoryProcesses are the names of the processes recorded in the
+	// history, in addition to the node and every cgroup.
+	HistoryProcesses []string
+	// HistoryMaxSeries limits the number of series recorded in the history,
+	// 0 for no limit.
+	HistoryMaxSeries int
+	// HistoryMaxQuerySeries limits the number of series a query_range
+	// request may select, 0 for no limit.
+	HistoryMaxQuerySeries int
+	// HistoryDir persists the history in segments below this directory, so
+	// it survives restarts. Empty keeps the history in memory only.
+	HistoryDir string
+	// HistoryDiskRetention is how long persisted samples are kept at the
+	// recording resolution.
+	HistoryDiskRetention time.Duration
+	// HistoryRollups are the coarser tiers persisted samples are downsampled
+	// into, see history.ParseTiers.
+	HistoryRollups string
+	// HistoryDiskMaxBytes limits the size of the persisted history, 0 for no
+	// limit.
+	HistoryDiskMaxBytes int64
+}
+
+// Run starts the daemon, serving the REST API on the given mux and exporting
+// per-cgroup metrics.
+func Run(mux *http.ServeMux, opts Options) {
+	log.WithFields(log.Fields{"cgroups": opts.Cgroups}).Debug("Enabled cgroups")
+	intervals, err := cgroup.ParseIntervals(opts.StatsSubsystemIntervals)
+	if err != nil {
+		log.Fatal(err)
+	}
+	schedule := cgroup.Schedule{
+		Interval:    opts.StatsInterval,
+		Subsystems:  intervals,
+		MinInterval: opts.StatsMinInterval,
+		MaxInterval: opts.StatsMaxInterval,
+		IdleEvery:   opts.StatsIdleEvery,
+	}
+	if err := schedule.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	cw, err := cgroup.NewWatcher(cgroup.Options{
+		Subsystems:        opts.Cgroups,
+		SkipUnmounted:     opts.SkipUnmountedCgroups,
+		Schedule:          schedule,
+		Root:              opts.CgroupRoot,
+		Registerer:        cgroup.DefaultRegisterer,
+		ReconcileInterval: opts.ReconcileInterval,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var providers []metadata.Provider
+	if opts.DockerEndpoint != "" {
+		docker, err := metadata.NewDocker(opts.DockerEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		providers = append(providers, docker)
+	}
+	systemd, err := metadata.NewSystemd(opts.SystemdDBus)
 	if err != nil {
 		log.Fatal(err)
 	}
+	rules := cgroup.DefaultRules
+	if opts.ClassifierRules != "" {
+		custom, err := cgroup.LoadRules(opts.ClassifierRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rules = append(custom, rules...)
+	}
+	providers = append(providers, metadata.NewKubernetes(opts.KubeletPods), systemd, metadata.NewClassified(rules))
+	w := metadata.NewWatcher(cw, providers...)
+
 	err = w.Start()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	prometheus.MustRegister(exporter.NewCgroupCollector(w, exporter.Options{
+		CAdvisorNames:   opts.CAdvisorMetricNames,
+		ContainerLabels: opts.ContainerLabels,
+		Namespaces:      opts.MetricsNamespaces,
+	}))
+	// CPU rates are sampled once per collection interval, and every consumer
+	// is served the same rates rather than disturbing each other's.
+	done := make(chan struct{})
+	cpu := node.NewCPUSampler()
+	go cpu.Run(opts.StatsInterval, done)
+	go process.RunCPUSampling(opts.StatsInterval, done)
+	prometheus.MustRegister(exporter.NewNodeCollector(cpu))
+
+	var (
+		h    *history.Store
+		disk *history.Disk
+	)
+	if opts.HistoryRetention > 0 && opts.HistoryResolution > 0 {
+		if opts.HistoryDir != "" {
+			disk, err = openHistoryDisk(opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		h = history.NewStore(w, history.Options{
+			Retention:      opts.HistoryRetention,
+			Resolution:     opts.HistoryResolution,
+			Processes:      opts.HistoryProcesses,
+			MaxSeries:      opts.HistoryMaxSeries,
+			MaxQuerySeries: opts.HistoryMaxQuerySeries,
+			CPU:            cpu,
+			Disk:           disk,
+		})
+		h.Start()
+	}
+	mux.Handle(APIPrefix+"/", NewAPIHandler(w, h, cpu))
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 
 	// Block until a signal is received.
 	<-c
+	close(done)
+	if h != nil {
+		h.Stop()
+	}
+	if disk != nil {
+		err = disk.Close()
+		if err != nil {
+			log.WithField("error", err).Error("Failed to close history")
+		}
+	}
 	err = w.Stop()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// openHistoryDisk opens the on-disk history, whose first tier holds the
+// samples at the recording resolution.
+func openHistoryDisk(opts Options) (*history.Disk, error) {
+	rollups, err := history.ParseTiers(opts.HistoryRollups)
+	if err != nil {
+		return nil, err
+	}
+	tiers := append([]history.Tier{{
+		Resolution: opts.HistoryResolution,
+		Retention:  opts.HistoryDiskRetention,
+	}}, rollups...)
+	return history.OpenDisk(history.DiskOptions{
+		Dir:      opts.HistoryDir,
+		Tiers:    tiers,
+		MaxBytes: opts.HistoryDiskMaxBytes,
+	})
+}
@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+const (
+	defaultEventsTimeout = 30 * time.Second
+	maxEventsTimeout     = 5 * time.Minute
+)
+
+// eventsHandler serves /api/v1/events, a long-poll endpoint returning the
+// cgroup lifecycle events after the since query parameter. If there are none
+// it waits up to timeout (e.g. 10s, 0 to return immediately) for new events.
+func eventsHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		since, err := parseSequence(r.URL.Query().Get("since"))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+
+		timeout := defaultEventsTimeout
+		if s := r.URL.Query().Get("timeout"); s != "" {
+			timeout, err = time.ParseDuration(s)
+			if err != nil || timeout < 0 {
+				writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid timeout %s", s))
+				return
+			}
+			if timeout > maxEventsTimeout {
+				timeout = maxEventsTimeout
+			}
+		}
+
+		list := w.Events(since)
+		if len(list.Events) > 0 || list.Truncated || timeout == 0 {
+			writeJSON(rw, http.StatusOK, list)
+			return
+		}
+
+		events, cancel := w.SubscribeEvents(since)
+		defer cancel()
+
+		select {
+		case <-events:
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, w.Events(since))
+	}
+}
+
+// eventsStreamHandler serves /api/v1/events/stream, pushing cgroup lifecycle
+// events as Server-Sent Events. Clients resume after the since query
+// parameter, or the standard Last-Event-ID header when reconnecting.
+func eventsStreamHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		s := r.URL.Query().Get("since")
+		if id := r.Header.Get("Last-Event-ID"); id != "" {
+			s = id
+		}
+		since, err := parseSequence(s)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+
+		flusher, ok := startSSE(rw)
+		if !ok {
+			return
+		}
+
+		events, cancel := w.SubscribeEvents(since)
+		defer cancel()
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if err := writeSSE(rw, flusher, "event", strconv.FormatUint(e.Sequence, 10), e); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func parseSequence(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sequence number %s", s)
+	}
+	return seq, nil
+}
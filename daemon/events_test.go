@@ -0,0 +1,105 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func testEvents() []v1.Event {
+	return []v1.Event{
+		{Sequence: 1, Type: v1.EventCgroupCreated, Subsystems: []string{"memory"}, Path: "/docker/abc"},
+		{Sequence: 2, Type: v1.EventProcessesChanged, Subsystems: []string{"memory"}, Path: "/docker/abc", AddedPids: []int32{100}},
+	}
+}
+
+func TestEventsAPI(t *testing.T) {
+	w := newFakeWatcher()
+	w.events = testEvents()
+	srv := httptest.NewServer(NewAPIHandler(w, nil, nil))
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		want  []uint64
+	}{
+		{"", []uint64{1, 2}},
+		{"?since=1", []uint64{2}},
+		{"?since=2&timeout=0", []uint64{}},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + "/api/v1/events" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list v1.EventList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs := []uint64{}
+		for _, e := range list.Events {
+			seqs = append(seqs, e.Sequence)
+		}
+		if !reflect.DeepEqual(seqs, test.want) || list.LastSequence != 2 {
+			t.Errorf("%s: expected %v, got %#v", test.query, test.want, list)
+		}
+	}
+
+	for _, query := range []string{"?since=abc", "?timeout=abc", "?timeout=-1s"} {
+		resp, err := http.Get(srv.URL + "/api/v1/events" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	w := newFakeWatcher()
+	w.events = testEvents()
+	srv := httptest.NewServer(NewAPIHandler(w, nil, nil))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/api/v1/events/stream?since=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	if lines[0] != "id: 2" || lines[1] != "event: event" {
+		t.Errorf("unexpected event %v", lines)
+	}
+	var e v1.Event
+	err = json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, testEvents()[1]) {
+		t.Errorf("expected %#v, got %#v", testEvents()[1], e)
+	}
+}
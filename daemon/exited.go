@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// exitedHandler serves /api/v1/exited, listing the most recently removed
+// cgroups with the latest stats collected for them, most recently removed
+// first. The subsystem query parameter restricts the list to cgroups of a
+// subsystem, and path to the cgroups at or below a path.
+func exitedHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		q := r.URL.Query()
+		subsystem, prefix := q.Get("subsystem"), strings.TrimSuffix(q.Get("path"), "/")
+		exited := []v1.ExitedCgroup{}
+		for _, e := range w.Exited() {
+			if subsystem != "" && !hasSubsystem(e.Subsystems, subsystem) {
+				continue
+			}
+			if prefix != "" && e.Path != prefix && !strings.HasPrefix(e.Path, prefix+"/") {
+				continue
+			}
+			exited = append(exited, e)
+		}
+
+		writeJSON(rw, http.StatusOK, exited)
+	}
+}
+
+func hasSubsystem(subsystems []string, subsystem string) bool {
+	for _, s := range subsystems {
+		if s == subsystem {
+			return true
+		}
+	}
+	return false
+}
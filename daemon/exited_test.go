@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func TestExitedAPI(t *testing.T) {
+	w := newFakeWatcher()
+	w.exited = []v1.ExitedCgroup{
+		{Subsystems: []string{"cpu", "cpuacct"}, Path: "/docker/def", CPUUsage: 2000},
+		{Subsystems: []string{"memory"}, Path: "/docker/abc", PeakMemory: 1024},
+		{Subsystems: []string{"memory"}, Path: "/system.slice/cron.service"},
+	}
+	srv := httptest.NewServer(NewAPIHandler(w, nil, nil))
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"/docker/def", "/docker/abc", "/system.slice/cron.service"}},
+		{"?subsystem=memory", []string{"/docker/abc", "/system.slice/cron.service"}},
+		{"?path=/docker/", []string{"/docker/def", "/docker/abc"}},
+		{"?subsystem=cpuacct&path=/docker/def", []string{"/docker/def"}},
+		{"?subsystem=blkio", []string{}},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + "/api/v1/exited" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exited []v1.ExitedCgroup
+		err = json.NewDecoder(resp.Body).Decode(&exited)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, e := range exited {
+			got = append(got, e.Path)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.want, got)
+		}
+	}
+}
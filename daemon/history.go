@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/history"
+)
+
+// queryRangeHandler serves /api/v1/query_range, returning the recorded history
+// of the series selected by the series query parameter, which can be repeated.
+// The start and end query parameters are RFC 3339 times or Unix timestamps,
+// step is a duration such as 30s or a number of seconds, and values restricts
+// the returned values to a comma-separated list.
+func queryRangeHandler(h *history.Store) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+		if h == nil {
+			writeError(rw, http.StatusNotFound, fmt.Errorf("history is disabled"))
+			return
+		}
+
+		q, err := parseRangeQuery(r)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := h.QueryRange(*q)
+		if _, ok := err.(*history.QueryError); ok {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, result)
+	}
+}
+
+func parseRangeQuery(r *http.Request) (*v1.RangeQuery, error) {
+	q := r.URL.Query()
+
+	rq := &v1.RangeQuery{Series: q["series"]}
+	if s := q.Get("values"); s != "" {
+		rq.Values = strings.Split(s, ",")
+	}
+
+	var err error
+	rq.Start, err = parseTime(q.Get("start"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid start %s", q.Get("start"))
+	}
+	rq.End, err = parseTime(q.Get("end"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid end %s", q.Get("end"))
+	}
+
+	if s := q.Get("step"); s != "" {
+		rq.Step, err = time.ParseDuration(s)
+		if err != nil {
+			seconds, perr := strconv.ParseFloat(s, 64)
+			if perr != nil || seconds <= 0 {
+				return nil, fmt.Errorf("invalid step %s", s)
+			}
+			rq.Step = time.Duration(seconds * float64(time.Second))
+		}
+		if rq.Step <= 0 {
+			return nil, fmt.Errorf("invalid step %s", s)
+		}
+	}
+
+	return rq, nil
+}
+
+// parseTime parses an RFC 3339 time or a Unix timestamp in seconds, returning
+// the zero time if s is empty.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/history"
+)
+
+func TestQueryRangeAPI(t *testing.T) {
+	w := newFakeWatcher()
+	h := history.NewStore(w, history.Options{Retention: time.Hour, Resolution: time.Minute})
+	// Starting records a first sample, which stopping waits for.
+	h.Start()
+	h.Stop()
+
+	srv := httptest.NewServer(NewAPIHandler(w, h, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/query_range?series=cgroup:memory:/docker/*&values=memory_usage&step=30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result v1.RangeResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if result.Step != 30 {
+		t.Errorf("expected step of 30 seconds, got %v", result.Step)
+	}
+	if len(result.Series) != 1 || result.Series[0].ID != "cgroup:memory:/docker/abc" {
+		t.Fatalf("expected the /docker/abc series, got %+v", result.Series)
+	}
+	if points := result.Series[0].Points; len(points) == 0 || len(points[len(points)-1].Values) != 1 {
+		t.Errorf("expected points with only memory_usage, got %+v", points)
+	}
+
+	for _, query := range []string{"", "series=node&step=x", "series=node&start=yesterday", "series=node&start=2&end=1"} {
+		resp, err = http.Get(srv.URL + "/api/v1/query_range?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+func TestQueryRangeAPIDisabled(t *testing.T) {
+	srv := httptest.NewServer(NewAPIHandler(newFakeWatcher(), nil, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/query_range?series=node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,48 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jimmidyson/wurzel/node"
+)
+
+// nodeHandler serves /api/v1/node and its cpuinfo, cputime, cpuutilization,
+// memory and swap sub-resources. CPU utilization is that between the two
+// latest samples of sampler.
+func nodeHandler(sampler *node.CPUSampler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		var (
+			v   interface{}
+			err error
+		)
+		switch resource := strings.Trim(strings.TrimPrefix(r.URL.Path, nodePath), "/"); resource {
+		case "":
+			v, err = node.Info()
+		case "cpuinfo":
+			v, err = node.CPUInfo()
+		case "cputime":
+			v, err = node.CPUTime()
+		case "cpuutilization":
+			v, err = sampler.Utilization()
+		case "memory":
+			v, err = node.Memory()
+		case "swap":
+			v, err = node.Swap()
+		default:
+			writeError(rw, http.StatusNotFound, fmt.Errorf("unknown node resource %s", resource))
+			return
+		}
+
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, v)
+	}
+}
@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// podsHandler serves /api/v1/pods, grouping the cgroups of Kubernetes pods by
+// pod. Pods can be filtered with the namespace and pod (name) query
+// parameters, and cgroups with the subsystem query parameter.
+func podsHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		q := r.URL.Query()
+		filter := &podFilter{namespace: q.Get("namespace"), name: q.Get("pod")}
+		subsystem := q.Get("subsystem")
+
+		byUID := map[string]*v1.PodCgroups{}
+		w.Walk(func(cg *v1.Cgroup) {
+			if cg.Pod == nil || !filter.matches(cg.Pod) || (subsystem != "" && cg.Subsystem != subsystem) {
+				return
+			}
+			pc, ok := byUID[cg.Pod.UID]
+			if !ok {
+				pc = &v1.PodCgroups{Pod: *cg.Pod, Cgroups: []v1.Cgroup{}}
+				byUID[cg.Pod.UID] = pc
+			}
+			pc.Cgroups = append(pc.Cgroups, *cg)
+		})
+
+		pods := make([]v1.PodCgroups, 0, len(byUID))
+		for _, pc := range byUID {
+			sort.Sort(byCgroupPath(pc.Cgroups))
+			pods = append(pods, *pc)
+		}
+		sort.Sort(byPodName(pods))
+
+		writeJSON(rw, http.StatusOK, pods)
+	}
+}
+
+// podFilter matches the cgroups of pods in a namespace and/or with a name.
+// Empty fields match any pod.
+type podFilter struct {
+	namespace string
+	name      string
+}
+
+func (f *podFilter) matches(pod *v1.Pod) bool {
+	if pod == nil {
+		return f.namespace == "" && f.name == ""
+	}
+	return (f.namespace == "" || pod.Namespace == f.namespace) && (f.name == "" || pod.Name == f.name)
+}
+
+type byCgroupPath []v1.Cgroup
+
+func (s byCgroupPath) Len() int      { return len(s) }
+func (s byCgroupPath) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCgroupPath) Less(i, j int) bool {
+	if s[i].Path != s[j].Path {
+		return s[i].Path < s[j].Path
+	}
+	return s[i].Subsystem < s[j].Subsystem
+}
+
+type byPodName []v1.PodCgroups
+
+func (s byPodName) Len() int      { return len(s) }
+func (s byPodName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPodName) Less(i, j int) bool {
+	a, b := s[i].Pod, s[j].Pod
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.UID < b.UID
+}
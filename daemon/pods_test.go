@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func newPodsWatcher() *fakeWatcher {
+	web := &v1.Pod{UID: "a", Name: "web", Namespace: "prod", QOSClass: v1.QOSBurstable}
+	db := &v1.Pod{UID: "b", Name: "db", Namespace: "prod", QOSClass: v1.QOSGuaranteed}
+	dev := &v1.Pod{UID: "c", Name: "web", Namespace: "dev", QOSClass: v1.QOSBestEffort}
+
+	w := newFakeWatcher()
+	for key, cg := range map[string]*v1.Cgroup{
+		"memory:/kubepods/burstable/poda":     {Subsystem: "memory", Path: "/kubepods/burstable/poda", Pod: web},
+		"memory:/kubepods/burstable/poda/123": {Subsystem: "memory", Path: "/kubepods/burstable/poda/123", Pod: web},
+		"cpu:/kubepods/burstable/poda":        {Subsystem: "cpu", Path: "/kubepods/burstable/poda", Pod: web},
+		"memory:/kubepods/podb":               {Subsystem: "memory", Path: "/kubepods/podb", Pod: db},
+		"memory:/kubepods/besteffort/podc":    {Subsystem: "memory", Path: "/kubepods/besteffort/podc", Pod: dev},
+	} {
+		w.cgroups[key] = cg
+	}
+	return w
+}
+
+func TestPodsAPI(t *testing.T) {
+	srv := httptest.NewServer(NewAPIHandler(newPodsWatcher(), nil, nil))
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		want  map[string][]string
+	}{
+		{"", map[string][]string{
+			"dev/web":  {"memory:/kubepods/besteffort/podc"},
+			"prod/db":  {"memory:/kubepods/podb"},
+			"prod/web": {"cpu:/kubepods/burstable/poda", "memory:/kubepods/burstable/poda", "memory:/kubepods/burstable/poda/123"},
+		}},
+		{"?namespace=prod&subsystem=memory", map[string][]string{
+			"prod/db":  {"memory:/kubepods/podb"},
+			"prod/web": {"memory:/kubepods/burstable/poda", "memory:/kubepods/burstable/poda/123"},
+		}},
+		{"?pod=web", map[string][]string{
+			"dev/web":  {"memory:/kubepods/besteffort/podc"},
+			"prod/web": {"cpu:/kubepods/burstable/poda", "memory:/kubepods/burstable/poda", "memory:/kubepods/burstable/poda/123"},
+		}},
+		{"?namespace=missing", map[string][]string{}},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + "/api/v1/pods" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pods []v1.PodCgroups
+		err = json.NewDecoder(resp.Body).Decode(&pods)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[string][]string{}
+		for _, pc := range pods {
+			cgroups := []string{}
+			for _, cg := range pc.Cgroups {
+				cgroups = append(cgroups, cg.Subsystem+":"+cg.Path)
+			}
+			got[pc.Pod.Namespace+"/"+pc.Pod.Name] = cgroups
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.want, got)
+		}
+	}
+}
+
+func TestStatsFilterPods(t *testing.T) {
+	update := &v1.StatsUpdate{Cgroups: []v1.Cgroup{
+		{Subsystem: "memory", Path: "/kubepods/poda", Pod: &v1.Pod{UID: "a", Name: "web", Namespace: "prod"}},
+		{Subsystem: "memory", Path: "/kubepods/podb", Pod: &v1.Pod{UID: "b", Name: "web", Namespace: "dev"}},
+		{Subsystem: "memory", Path: "/system.slice"},
+	}}
+
+	filter := newStatsFilter("", "")
+	filter.pod = podFilter{namespace: "prod"}
+	filtered := filter.apply(update)
+	if filtered == nil || len(filtered.Cgroups) != 1 || filtered.Cgroups[0].Path != "/kubepods/poda" {
+		t.Errorf("unexpected filtered update: %#v", filtered)
+	}
+
+	if filtered := newStatsFilter("", "").apply(update); filtered == nil || len(filtered.Cgroups) != 3 {
+		t.Errorf("expected all cgroups without pod filters, got %#v", filtered)
+	}
+}
@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/process"
+)
+
+// defaultProcessLimit is the page size used when a process listing request
+// does not specify a limit. A limit of 0 lists every process.
+const defaultProcessLimit = 100
+
+// processesHandler serves /api/v1/processes, listing processes filtered by the
+// name, uid and status query parameters, sorted by sort and paginated by
+// offset and limit (0 for all), /api/v1/processes/{pid}, returning a single
+// process, and /api/v1/processes/{pid}/cgroups, returning the cgroups a
+// process belongs to. The cgroups of the returned processes are included if
+// the cgroups query parameter is true.
+func processesHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		rel := strings.Trim(strings.TrimPrefix(r.URL.Path, processesPath), "/")
+		if rel == "" {
+			opts, err := parseProcessListOptions(r)
+			if err != nil {
+				writeError(rw, http.StatusBadRequest, err)
+				return
+			}
+
+			// The cgroups are attached with their metadata below.
+			query := *opts
+			query.Cgroups = false
+			list, err := process.Query(query)
+			if err != nil {
+				writeQueryError(rw, err)
+				return
+			}
+			if opts.Cgroups {
+				attachCgroups(w, list.Processes)
+			}
+			writeJSON(rw, http.StatusOK, list)
+			return
+		}
+
+		spl := strings.SplitN(rel, "/", 2)
+		pid, err := strconv.ParseInt(spl[0], 10, 32)
+		if err != nil || (len(spl) > 1 && spl[1] != "cgroups") {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("invalid pid %s", rel))
+			return
+		}
+
+		if len(spl) > 1 {
+			cgroups, err := processCgroups(w, int32(pid))
+			if err != nil {
+				writeProcessError(rw, int32(pid), err)
+				return
+			}
+			writeJSON(rw, http.StatusOK, cgroups)
+			return
+		}
+
+		p, err := process.Get(int32(pid))
+		if err != nil {
+			writeProcessError(rw, int32(pid), err)
+			return
+		}
+		if r.URL.Query().Get("cgroups") == "true" {
+			p.Cgroups, _ = processCgroups(w, p.Pid)
+		}
+		writeJSON(rw, http.StatusOK, p)
+	}
+}
+
+// writeQueryError responds with a bad request for invalid process list
+// options, and an internal server error otherwise.
+func writeQueryError(rw http.ResponseWriter, err error) {
+	if _, ok := err.(*process.OptionsError); ok {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	writeError(rw, http.StatusInternalServerError, err)
+}
+
+func writeProcessError(rw http.ResponseWriter, pid int32, err error) {
+	if os.IsNotExist(err) {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("process %d not found", pid))
+		return
+	}
+	writeError(rw, http.StatusInternalServerError, err)
+}
+
+// processCgroups returns the cgroup the process with the given pid belongs to
+// in every watched subsystem, with any metadata known about the cgroups.
+// Subsystems without a cgroup v1 hierarchy use the process' unified
+// hierarchy cgroup.
+func processCgroups(w cgroup.Watcher, pid int32) ([]v1.ProcessCgroup, error) {
+	paths, err := cgroup.ProcessCgroupPaths(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	cgroups := []v1.ProcessCgroup{}
+	for _, subsystem := range w.Subsystems() {
+		cgPath, ok := paths[subsystem.Name]
+		if !ok {
+			cgPath, ok = paths[""]
+		}
+		if !ok {
+			continue
+		}
+
+		pc := v1.ProcessCgroup{Subsystem: subsystem.Name, Path: cgPath}
+		if cg, ok := w.Lookup(subsystem.Name, strings.TrimPrefix(cgPath, "/")); ok {
+			pc.Container, pc.Pod, pc.Unit = cg.Container, cg.Pod, cg.Unit
+		}
+		cgroups = append(cgroups, pc)
+	}
+	return cgroups, nil
+}
+
+// attachCgroups sets the cgroups of processes, skipping processes that have
+// exited.
+func attachCgroups(w cgroup.Watcher, processes []v1.Process) {
+	for i := range processes {
+		processes[i].Cgroups, _ = processCgroups(w, processes[i].Pid)
+	}
+}
+
+func parseProcessListOptions(r *http.Request) (*v1.ProcessListOptions, error) {
+	q := r.URL.Query()
+
+	opts := &v1.ProcessListOptions{
+		Name:    q.Get("name"),
+		Status:  q.Get("status"),
+		SortBy:  q.Get("sort"),
+		Limit:   defaultProcessLimit,
+		Cgroups: q.Get("cgroups") == "true",
+	}
+
+	if s := q.Get("uid"); s != "" {
+		uid, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %s", s)
+		}
+		uid32 := int32(uid)
+		opts.UID = &uid32
+	}
+
+	if s := q.Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %s", s)
+		}
+		opts.Offset = offset
+	}
+
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %s", s)
+		}
+		opts.Limit = limit
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,178 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/websocket"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// streamHandler serves /api/v1/stream, pushing the cgroups whose stats changed
+// in each collection round as Server-Sent Events, or as WebSocket messages if
+// the request asks for a WebSocket upgrade. Updates can be restricted to a
+// single subsystem and/or cgroup subtree with the subsystem and path query
+// parameters, and to the cgroups of Kubernetes pods with the namespace and pod
+// query parameters.
+func streamHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		q := r.URL.Query()
+		filter := newStatsFilter(q.Get("subsystem"), q.Get("path"))
+		filter.pod = podFilter{namespace: q.Get("namespace"), name: q.Get("pod")}
+
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			websocket.Server{Handler: func(ws *websocket.Conn) {
+				streamWebSocket(ws, w, filter)
+			}}.ServeHTTP(rw, r)
+			return
+		}
+
+		streamSSE(rw, r, w, filter)
+	}
+}
+
+func streamSSE(rw http.ResponseWriter, r *http.Request, w cgroup.Watcher, filter *statsFilter) {
+	flusher, ok := startSSE(rw)
+	if !ok {
+		return
+	}
+
+	updates, cancel := w.SubscribeStats()
+	defer cancel()
+
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			update = filter.apply(update)
+			if update == nil {
+				continue
+			}
+			if err := writeSSE(rw, flusher, "stats", "", update); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// startSSE writes the headers for a Server-Sent Events response.
+func startSSE(rw http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return nil, false
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return flusher, true
+}
+
+// writeSSE writes v as the JSON data of a single event, with an optional id
+// clients can resume from.
+func writeSSE(rw http.ResponseWriter, flusher http.Flusher, event, id string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.WithFields(log.Fields{"event": event, "error": err}).Error("Failed to encode event")
+		return err
+	}
+	if id != "" {
+		_, err = fmt.Fprintf(rw, "id: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, b)
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+func streamWebSocket(ws *websocket.Conn, w cgroup.Watcher, filter *statsFilter) {
+	defer ws.Close()
+
+	updates, cancel := w.SubscribeStats()
+	defer cancel()
+
+	// Reading only returns once the client goes away, as clients are not
+	// expected to send anything.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard []byte
+		for {
+			if err := websocket.Message.Receive(ws, &discard); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			update = filter.apply(update)
+			if update == nil {
+				continue
+			}
+			if err := websocket.JSON.Send(ws, update); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+type statsFilter struct {
+	subsystem string
+	path      string
+	pod       podFilter
+}
+
+func newStatsFilter(subsystem, p string) *statsFilter {
+	return &statsFilter{subsystem: subsystem, path: path.Clean("/" + p)}
+}
+
+// apply returns the update restricted to the cgroups matching the filter, or
+// nil if none match.
+func (f *statsFilter) apply(update *v1.StatsUpdate) *v1.StatsUpdate {
+	filtered := &v1.StatsUpdate{Timestamp: update.Timestamp}
+	for _, cg := range update.Cgroups {
+		if f.subsystem != "" && cg.Subsystem != f.subsystem {
+			continue
+		}
+		if f.path != "/" && cg.Path != f.path && !strings.HasPrefix(cg.Path, f.path+"/") {
+			continue
+		}
+		if !f.pod.matches(cg.Pod) {
+			continue
+		}
+		filtered.Cgroups = append(filtered.Cgroups, cg)
+	}
+	if len(filtered.Cgroups) == 0 {
+		return nil
+	}
+	return filtered
+}
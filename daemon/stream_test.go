@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func testStatsUpdate() *v1.StatsUpdate {
+	return &v1.StatsUpdate{
+		Timestamp: time.Unix(1000, 0).UTC(),
+		Cgroups: []v1.Cgroup{
+			{Name: "abc", Subsystem: "memory", Path: "/docker/abc", Pids: []int32{}, Children: []string{}},
+			{Name: "abcd", Subsystem: "memory", Path: "/docker/abcd", Pids: []int32{}, Children: []string{}},
+			{Name: "abc", Subsystem: "cpu", Path: "/docker/abc", Pids: []int32{}, Children: []string{}},
+		},
+	}
+}
+
+func TestStatsFilter(t *testing.T) {
+	tests := []struct {
+		subsystem, path string
+		want            []int
+	}{
+		{"", "", []int{0, 1, 2}},
+		{"memory", "", []int{0, 1}},
+		{"", "/docker/abc", []int{0, 2}},
+		{"cpu", "docker/abc/", []int{2}},
+		{"blkio", "", nil},
+	}
+
+	for _, test := range tests {
+		update := testStatsUpdate()
+		filtered := newStatsFilter(test.subsystem, test.path).apply(update)
+		if test.want == nil {
+			if filtered != nil {
+				t.Errorf("%s:%s: expected no update, got %#v", test.subsystem, test.path, filtered)
+			}
+			continue
+		}
+		var want []v1.Cgroup
+		for _, i := range test.want {
+			want = append(want, update.Cgroups[i])
+		}
+		if filtered == nil || !reflect.DeepEqual(filtered.Cgroups, want) {
+			t.Errorf("%s:%s: expected %#v, got %#v", test.subsystem, test.path, want, filtered)
+		}
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	w := newFakeWatcher()
+	srv := httptest.NewServer(NewAPIHandler(w, nil, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/stream?subsystem=cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+
+	w.stats <- testStatsUpdate()
+
+	r := bufio.NewReader(resp.Body)
+	event, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != "event: stats\n" {
+		t.Errorf("unexpected event line %q", event)
+	}
+	data, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var update v1.StatsUpdate
+	err = json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Cgroups) != 1 || update.Cgroups[0].Subsystem != "cpu" {
+		t.Errorf("unexpected update %#v", update)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	w := newFakeWatcher()
+	srv := httptest.NewServer(NewAPIHandler(w, nil, nil))
+	defer srv.Close()
+
+	ws, err := websocket.Dial(strings.Replace(srv.URL, "http", "ws", 1)+"/api/v1/stream?path=/docker/abcd", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	w.stats <- testStatsUpdate()
+
+	var update v1.StatsUpdate
+	err = websocket.JSON.Receive(ws, &update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Cgroups) != 1 || update.Cgroups[0].Path != "/docker/abcd" {
+		t.Errorf("unexpected update %#v", update)
+	}
+}
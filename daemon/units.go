@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// unitsHandler serves /api/v1/units, aggregating the stats of every systemd
+// unit over its cgroup and the cgroups below it. Units can be filtered with
+// the type and slice query parameters, and sorted by name (default), memory or
+// cpu usage with the sort query parameter.
+func unitsHandler(w cgroup.Watcher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !allowGet(rw, r) {
+			return
+		}
+
+		q := r.URL.Query()
+		var less func(a, b *v1.UnitStats) bool
+		switch q.Get("sort") {
+		case "", "name":
+			less = func(a, b *v1.UnitStats) bool { return a.Unit.Name < b.Unit.Name }
+		case "memory":
+			less = func(a, b *v1.UnitStats) bool { return a.MemoryUsage > b.MemoryUsage }
+		case "cpu":
+			less = func(a, b *v1.UnitStats) bool { return a.CPUUsage > b.CPUUsage }
+		default:
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("unsupported sort %s", q.Get("sort")))
+			return
+		}
+
+		typ, slice := q.Get("type"), q.Get("slice")
+		units := []v1.UnitStats{}
+		for _, u := range aggregateUnits(w) {
+			if (typ == "" || u.Unit.Type == typ) && (slice == "" || u.Unit.Slice == slice) {
+				units = append(units, *u)
+			}
+		}
+		sort.Sort(unitStatsSorter{units, less})
+
+		writeJSON(rw, http.StatusOK, units)
+	}
+}
+
+// aggregateUnits returns the stats of every unit owning a cgroup. Stats are
+// taken from the unit's own cgroup, which includes the cgroups below it, while
+// processes are counted over all cgroups below it.
+func aggregateUnits(w cgroup.Watcher) map[string]*v1.UnitStats {
+	units := map[string]*v1.UnitStats{}
+	byPath := map[string]*v1.UnitStats{}
+	var cgroups []*v1.Cgroup
+	w.Walk(func(cg *v1.Cgroup) {
+		cgroups = append(cgroups, cg)
+		if cg.Unit == nil || path.Base(cg.Path) != cg.Unit.Name {
+			return
+		}
+		u, ok := units[cg.Unit.Name]
+		if !ok {
+			u = &v1.UnitStats{Unit: *cg.Unit, Path: cg.Path}
+			units[cg.Unit.Name] = u
+			byPath[cg.Path] = u
+		}
+		addUnitStats(u, cg.Stats)
+	})
+
+	// Processes appear in every subsystem, so are only counted once.
+	pids := map[*v1.UnitStats]map[int32]bool{}
+	for _, cg := range cgroups {
+		for p := cg.Path; ; p = path.Dir(p) {
+			if u, ok := byPath[p]; ok {
+				if pids[u] == nil {
+					pids[u] = map[int32]bool{}
+				}
+				for _, pid := range cg.Pids {
+					pids[u][pid] = true
+				}
+			}
+			if p == "/" || p == "." {
+				break
+			}
+		}
+	}
+	for u, set := range pids {
+		u.Processes = len(set)
+	}
+
+	for _, u := range units {
+		if u.Unit.Type != "slice" {
+			continue
+		}
+		for _, child := range units {
+			if child.Unit.Slice == u.Unit.Name {
+				u.Units = append(u.Units, child.Unit.Name)
+			}
+		}
+		sort.Strings(u.Units)
+	}
+
+	return units
+}
+
+// addUnitStats adds the stats of a unit's cgroup in one subsystem to u.
+func addUnitStats(u *v1.UnitStats, stats *v1.Stats) {
+	if stats == nil {
+		return
+	}
+	if stats.MemoryStats != nil {
+		u.MemoryUsage = stats.MemoryStats.Usage.Usage
+		inactive, ok := stats.MemoryStats.Stats["total_inactive_file"]
+		if !ok {
+			inactive = stats.MemoryStats.Stats["inactive_file"]
+		}
+		if inactive < u.MemoryUsage {
+			u.MemoryWorkingSet = u.MemoryUsage - inactive
+		}
+	}
+	if stats.CPUStats != nil && stats.CPUStats.CPUUsage != nil && stats.CPUStats.CPUUsage.TotalUsage > u.CPUUsage {
+		u.CPUUsage = stats.CPUStats.CPUUsage.TotalUsage
+	}
+	if stats.BlkioStats != nil {
+		u.IOServiceBytes = 0
+		for _, e := range stats.BlkioStats.IoServiceBytesRecursive {
+			if e.Op == "Read" || e.Op == "Write" {
+				u.IOServiceBytes += e.Value
+			}
+		}
+	}
+	if stats.PidsStats != nil {
+		u.Tasks = stats.PidsStats.Current
+	}
+}
+
+type unitStatsSorter struct {
+	units []v1.UnitStats
+	less  func(a, b *v1.UnitStats) bool
+}
+
+func (s unitStatsSorter) Len() int      { return len(s.units) }
+func (s unitStatsSorter) Swap(i, j int) { s.units[i], s.units[j] = s.units[j], s.units[i] }
+func (s unitStatsSorter) Less(i, j int) bool {
+	a, b := &s.units[i], &s.units[j]
+	if s.less(a, b) {
+		return true
+	}
+	if s.less(b, a) {
+		return false
+	}
+	return a.Unit.Name < b.Unit.Name
+}
@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func newUnitsWatcher() *fakeWatcher {
+	system := &v1.Unit{Name: "system.slice", Type: "slice", Slice: "-.slice"}
+	sshd := &v1.Unit{Name: "sshd.service", Type: "service", Slice: "system.slice"}
+	docker := &v1.Unit{Name: "docker.service", Type: "service", Slice: "system.slice"}
+
+	memory := func(usage, inactive uint64) *v1.Stats {
+		return &v1.Stats{MemoryStats: &v1.MemoryStats{
+			Usage: v1.MemoryData{Usage: usage},
+			Stats: map[string]uint64{"total_inactive_file": inactive},
+		}}
+	}
+	cpu := func(usage uint64) *v1.Stats {
+		return &v1.Stats{CPUStats: &v1.CPUStats{CPUUsage: &v1.CPUUsage{TotalUsage: usage}}}
+	}
+
+	w := newFakeWatcher()
+	for key, cg := range map[string]*v1.Cgroup{
+		"memory:/system.slice":                    {Subsystem: "memory", Path: "/system.slice", Unit: system, Stats: memory(300, 50), Pids: []int32{}},
+		"memory:/system.slice/sshd.service":       {Subsystem: "memory", Path: "/system.slice/sshd.service", Unit: sshd, Stats: memory(100, 10), Pids: []int32{10, 11}},
+		"memory:/system.slice/docker.service":     {Subsystem: "memory", Path: "/system.slice/docker.service", Unit: docker, Stats: memory(200, 40), Pids: []int32{20}},
+		"memory:/system.slice/docker.service/sub": {Subsystem: "memory", Path: "/system.slice/docker.service/sub", Unit: docker, Stats: memory(150, 0), Pids: []int32{21}},
+		"cpuacct:/system.slice":                   {Subsystem: "cpuacct", Path: "/system.slice", Unit: system, Stats: cpu(3000), Pids: []int32{}},
+		"cpuacct:/system.slice/sshd.service":      {Subsystem: "cpuacct", Path: "/system.slice/sshd.service", Unit: sshd, Stats: cpu(2000), Pids: []int32{10, 11}},
+		"cpuacct:/system.slice/docker.service":    {Subsystem: "cpuacct", Path: "/system.slice/docker.service", Unit: docker, Stats: cpu(1000), Pids: []int32{20, 21}},
+		"memory:/docker/abc":                      {Subsystem: "memory", Path: "/docker/abc", Pids: []int32{30}},
+	} {
+		w.cgroups[key] = cg
+	}
+	return w
+}
+
+func TestUnitsAPI(t *testing.T) {
+	srv := httptest.NewServer(NewAPIHandler(newUnitsWatcher(), nil, nil))
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		want  []v1.UnitStats
+	}{
+		{"?type=service&sort=memory", []v1.UnitStats{
+			{Unit: v1.Unit{Name: "docker.service", Type: "service", Slice: "system.slice"}, Path: "/system.slice/docker.service", Processes: 2, MemoryUsage: 200, MemoryWorkingSet: 160, CPUUsage: 1000},
+			{Unit: v1.Unit{Name: "sshd.service", Type: "service", Slice: "system.slice"}, Path: "/system.slice/sshd.service", Processes: 2, MemoryUsage: 100, MemoryWorkingSet: 90, CPUUsage: 2000},
+		}},
+		{"?slice=system.slice&sort=cpu", []v1.UnitStats{
+			{Unit: v1.Unit{Name: "sshd.service", Type: "service", Slice: "system.slice"}, Path: "/system.slice/sshd.service", Processes: 2, MemoryUsage: 100, MemoryWorkingSet: 90, CPUUsage: 2000},
+			{Unit: v1.Unit{Name: "docker.service", Type: "service", Slice: "system.slice"}, Path: "/system.slice/docker.service", Processes: 2, MemoryUsage: 200, MemoryWorkingSet: 160, CPUUsage: 1000},
+		}},
+		{"?type=slice", []v1.UnitStats{
+			{Unit: v1.Unit{Name: "system.slice", Type: "slice", Slice: "-.slice"}, Path: "/system.slice", Units: []string{"docker.service", "sshd.service"}, Processes: 4, MemoryUsage: 300, MemoryWorkingSet: 250, CPUUsage: 3000},
+		}},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + "/api/v1/units" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var units []v1.UnitStats
+		err = json.NewDecoder(resp.Body).Decode(&units)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(units, test.want) {
+			t.Errorf("%s: expected %+v, got %+v", test.query, test.want, units)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/api/v1/units?sort=size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d for unsupported sort, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
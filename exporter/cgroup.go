@@ -0,0 +1,774 @@
+// Package exporter exports the stats collected for every watched cgroup as
+// Prometheus metrics.
+package exporter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/metrics"
+)
+
+const (
+	// MetricsSubsystem is the metrics subsystem for per-cgroup stats.
+	MetricsSubsystem = "cgroup"
+
+	nanosecondsPerSecond = 1e9
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Options configures a CgroupCollector.
+type Options struct {
+	// CAdvisorNames exports metrics with the names and labels used by cAdvisor,
+	// e.g. container_memory_usage_bytes{id="/docker/<id>"}, so existing
+	// dashboards keep working.
+	CAdvisorNames bool
+	// ContainerLabels are the container labels exported as metric labels,
+	// named container_label_<label> with invalid characters replaced by
+	// underscores. Of labels with the same metric label name, only the first
+	// is exported.
+	ContainerLabels []string
+	// Namespaces restricts the exported cgroups to those of Kubernetes pods in
+	// the given namespaces. All cgroups are exported if empty.
+	Namespaces []string
+}
+
+// sample is a single value of a metric, with the values of any labels beyond
+// the cgroup labels.
+type sample struct {
+	value  float64
+	labels []string
+}
+
+// cgroupMetric describes a metric derived from the stats of a single
+// subsystem.
+type cgroupMetric struct {
+	name string
+	// cadvisorName is empty for metrics cAdvisor has no equivalent of, which
+	// are not exported with cAdvisor names.
+	cadvisorName string
+	help         string
+	valueType    prometheus.ValueType
+	subsystem    string
+	extraLabels  []string
+	samples      func(stats *v1.Stats) []sample
+}
+
+// CgroupCollector is a prometheus.Collector walking the watcher's cgroup tree
+// at scrape time.
+type CgroupCollector struct {
+	watcher cgroup.Watcher
+	opts    Options
+	metrics []cgroupMetric
+	descs   []*prometheus.Desc
+	// containerLabels are the exported container labels, with unique
+	// metric label names.
+	containerLabels []string
+}
+
+// NewCgroupCollector returns a collector exporting the latest stats of every
+// cgroup watched by w.
+func NewCgroupCollector(w cgroup.Watcher, opts Options) *CgroupCollector {
+	c := &CgroupCollector{
+		watcher:         w,
+		opts:            opts,
+		containerLabels: uniqueContainerLabels(opts.ContainerLabels),
+	}
+
+	for _, m := range cgroupMetrics {
+		if opts.CAdvisorNames && m.cadvisorName == "" {
+			continue
+		}
+		c.metrics = append(c.metrics, m)
+		c.descs = append(c.descs, c.newDesc(m))
+	}
+
+	return c
+}
+
+func (c *CgroupCollector) newDesc(m cgroupMetric) *prometheus.Desc {
+	if c.opts.CAdvisorNames {
+		labels := append([]string{"id", "name", "image", "runtime", "container_id", "namespace", "pod"}, c.containerLabelNames()...)
+		return prometheus.NewDesc(m.cadvisorName, m.help, append(labels, m.extraLabels...), nil)
+	}
+	labels := append([]string{"cgroup", "subsystem", "container_name", "image", "runtime", "container_id", "namespace", "pod"}, c.containerLabelNames()...)
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, MetricsSubsystem, m.name),
+		m.help,
+		append(labels, m.extraLabels...),
+		nil,
+	)
+}
+
+func (c *CgroupCollector) containerLabelNames() []string {
+	names := make([]string, 0, len(c.containerLabels))
+	for _, label := range c.containerLabels {
+		names = append(names, containerLabelName(label))
+	}
+	return names
+}
+
+func containerLabelName(label string) string {
+	return "container_label_" + invalidLabelChars.ReplaceAllString(label, "_")
+}
+
+// uniqueContainerLabels returns labels without those whose metric label name
+// is already taken by a previous label, e.g. app.name and app_name.
+func uniqueContainerLabels(labels []string) []string {
+	ret := make([]string, 0, len(labels))
+	names := map[string]string{}
+	for _, label := range labels {
+		name := containerLabelName(label)
+		if taken, ok := names[name]; ok {
+			if taken != label {
+				log.WithFields(log.Fields{"label": label, "conflicting": taken, "name": name}).Warn("Not exporting container label with conflicting metric label name")
+			}
+			continue
+		}
+		names[name] = label
+		ret = append(ret, label)
+	}
+	return ret
+}
+
+// exported returns true if cg is in one of the namespaces to export.
+func (c *CgroupCollector) exported(cg *v1.Cgroup) bool {
+	if len(c.opts.Namespaces) == 0 {
+		return true
+	}
+	if cg.Pod == nil {
+		return false
+	}
+	for _, ns := range c.opts.Namespaces {
+		if cg.Pod.Namespace == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupLabels returns the label values identifying cg, in the order of the
+// labels in newDesc.
+func (c *CgroupCollector) cgroupLabels(cg *v1.Cgroup) []string {
+	var labels []string
+	if c.opts.CAdvisorNames {
+		labels = []string{cg.Path}
+	} else {
+		labels = []string{cg.Path, cg.Subsystem}
+	}
+
+	container := cg.Container
+	if container == nil {
+		container = &v1.Container{}
+	}
+	pod := cg.Pod
+	if pod == nil {
+		pod = &v1.Pod{}
+	}
+	labels = append(labels, container.Name, container.Image, container.Runtime, container.ID, pod.Namespace, podName(pod))
+	for _, label := range c.containerLabels {
+		labels = append(labels, container.Labels[label])
+	}
+	return labels
+}
+
+// podName returns the name of pod, falling back to its UID if pod metadata is
+// not available from the kubelet.
+func podName(pod *v1.Pod) string {
+	if pod.Name == "" {
+		return pod.UID
+	}
+	return pod.Name
+}
+
+// Describe implements prometheus.Collector.
+func (c *CgroupCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *CgroupCollector) Collect(ch chan<- prometheus.Metric) {
+	c.watcher.Walk(func(cg *v1.Cgroup) {
+		if cg.Stats == nil || !c.exported(cg) {
+			return
+		}
+
+		cgroupLabels := c.cgroupLabels(cg)
+
+		for i, m := range c.metrics {
+			if m.subsystem != cg.Subsystem {
+				continue
+			}
+			for _, s := range m.samples(cg.Stats) {
+				labels := make([]string, 0, len(cgroupLabels)+len(s.labels))
+				labels = append(labels, cgroupLabels...)
+				labels = append(labels, s.labels...)
+				ch <- prometheus.MustNewConstMetric(c.descs[i], m.valueType, s.value, labels...)
+			}
+		}
+	})
+}
+
+var cgroupMetrics = []cgroupMetric{
+	{
+		name:         "cpu_usage_seconds_total",
+		cadvisorName: "container_cpu_usage_seconds_total",
+		help:         "Cumulative CPU time consumed, labeled by CPU.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "cpuacct",
+		extraLabels:  []string{"cpu"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.CPUStats == nil || stats.CPUStats.CPUUsage == nil {
+				return nil
+			}
+			usage := stats.CPUStats.CPUUsage
+			if len(usage.PerCPUUsage) == 0 {
+				return []sample{{float64(usage.TotalUsage) / nanosecondsPerSecond, []string{"total"}}}
+			}
+			samples := make([]sample, 0, len(usage.PerCPUUsage))
+			for i, v := range usage.PerCPUUsage {
+				samples = append(samples, sample{float64(v) / nanosecondsPerSecond, []string{fmt.Sprintf("cpu%02d", i)}})
+			}
+			return samples
+		},
+	},
+	{
+		name:         "cpu_user_seconds_total",
+		cadvisorName: "container_cpu_user_seconds_total",
+		help:         "Cumulative CPU time consumed in user mode.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "cpuacct",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.CPUStats == nil || stats.CPUStats.CPUUsage == nil {
+				return nil
+			}
+			return []sample{{float64(stats.CPUStats.CPUUsage.UsageInUsermode) / nanosecondsPerSecond, nil}}
+		},
+	},
+	{
+		name:         "cpu_system_seconds_total",
+		cadvisorName: "container_cpu_system_seconds_total",
+		help:         "Cumulative CPU time consumed in kernel mode.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "cpuacct",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.CPUStats == nil || stats.CPUStats.CPUUsage == nil {
+				return nil
+			}
+			return []sample{{float64(stats.CPUStats.CPUUsage.UsageInKernelmode) / nanosecondsPerSecond, nil}}
+		},
+	},
+	{
+		name:         "cpu_cfs_periods_total",
+		cadvisorName: "container_cpu_cfs_periods_total",
+		help:         "Number of elapsed enforcement period intervals.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.CPUStats == nil || stats.CPUStats.ThrottlingData == nil {
+				return nil
+			}
+			return []sample{{float64(stats.CPUStats.ThrottlingData.Periods), nil}}
+		},
+	},
+	{
+		name:         "cpu_cfs_throttled_periods_total",
+		cadvisorName: "container_cpu_cfs_throttled_periods_total",
+		help:         "Number of throttled period intervals.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.CPUStats == nil || stats.CPUStats.ThrottlingData == nil {
+				return nil
+			}
+			return []sample{{float64(stats.CPUStats.ThrottlingData.ThrottledPeriods), nil}}
+		},
+	},
+	{
+		name:         "cpu_cfs_throttled_seconds_total",
+		cadvisorName: "container_cpu_cfs_throttled_seconds_total",
+		help:         "Total time duration the cgroup has been throttled.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.CPUStats == nil || stats.CPUStats.ThrottlingData == nil {
+				return nil
+			}
+			return []sample{{float64(stats.CPUStats.ThrottlingData.ThrottledTime) / nanosecondsPerSecond, nil}}
+		},
+	},
+	{
+		name:         "memory_usage_bytes",
+		cadvisorName: "container_memory_usage_bytes",
+		help:         "Current memory usage, including all memory regardless of when it was accessed.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.MemoryStats == nil {
+				return nil
+			}
+			return []sample{{float64(stats.MemoryStats.Usage.Usage), nil}}
+		},
+	},
+	{
+		name:         "memory_max_usage_bytes",
+		cadvisorName: "container_memory_max_usage_bytes",
+		help:         "Maximum memory usage recorded.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.MemoryStats == nil {
+				return nil
+			}
+			return []sample{{float64(stats.MemoryStats.Usage.MaxUsage), nil}}
+		},
+	},
+	{
+		name:         "memory_failures_total",
+		cadvisorName: "container_memory_failcnt",
+		help:         "Number of times memory usage hit the limit.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.MemoryStats == nil {
+				return nil
+			}
+			return []sample{{float64(stats.MemoryStats.Usage.Failcnt), nil}}
+		},
+	},
+	{
+		name:         "memory_cache_bytes",
+		cadvisorName: "container_memory_cache",
+		help:         "Memory used for the page cache.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.MemoryStats == nil {
+				return nil
+			}
+			return []sample{{float64(stats.MemoryStats.Cache), nil}}
+		},
+	},
+	{
+		name:         "memory_rss_bytes",
+		cadvisorName: "container_memory_rss",
+		help:         "Anonymous and swap cache memory, including transparent hugepages.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			return memoryStat(stats, "total_rss", "rss", "anon")
+		},
+	},
+	{
+		name:         "memory_swap_bytes",
+		cadvisorName: "container_memory_swap",
+		help:         "Swap usage.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			return memoryStat(stats, "total_swap", "swap")
+		},
+	},
+	{
+		name:         "memory_working_set_bytes",
+		cadvisorName: "container_memory_working_set_bytes",
+		help:         "Current working set, i.e. usage minus inactive file backed memory.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.MemoryStats == nil {
+				return nil
+			}
+			workingSet := stats.MemoryStats.Usage.Usage
+			inactive, ok := stats.MemoryStats.Stats["total_inactive_file"]
+			if !ok {
+				// cgroup v2 memory.stat is always hierarchical.
+				inactive = stats.MemoryStats.Stats["inactive_file"]
+			}
+			if inactive < workingSet {
+				workingSet -= inactive
+			} else {
+				workingSet = 0
+			}
+			return []sample{{float64(workingSet), nil}}
+		},
+	},
+	{
+		name:         "memory_kernel_usage_bytes",
+		cadvisorName: "container_memory_kernel_usage_bytes",
+		help:         "Current kernel memory usage.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.MemoryStats == nil {
+				return nil
+			}
+			return []sample{{float64(stats.MemoryStats.KernelUsage.Usage), nil}}
+		},
+	},
+	{
+		name:         "blkio_service_bytes_total",
+		cadvisorName: "container_blkio_device_usage_total",
+		help:         "Bytes transferred to and from each block device, labeled by operation.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "blkio",
+		extraLabels:  []string{"device", "major", "minor", "operation"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.BlkioStats == nil {
+				return nil
+			}
+			return blkioSamples(stats.BlkioStats.IoServiceBytesRecursive)
+		},
+	},
+	{
+		name:         "blkio_serviced_total",
+		cadvisorName: "container_blkio_device_serviced_total",
+		help:         "I/O operations issued to each block device, labeled by operation.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "blkio",
+		extraLabels:  []string{"device", "major", "minor", "operation"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.BlkioStats == nil {
+				return nil
+			}
+			return blkioSamples(stats.BlkioStats.IoServicedRecursive)
+		},
+	},
+	{
+		name:         "hugetlb_usage_bytes",
+		cadvisorName: "container_hugetlb_usage_bytes",
+		help:         "Current hugetlb usage, labeled by page size.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "hugetlb",
+		extraLabels:  []string{"pagesize"},
+		samples: func(stats *v1.Stats) []sample {
+			samples := make([]sample, 0, len(stats.HugetlbStats))
+			for size, s := range stats.HugetlbStats {
+				samples = append(samples, sample{float64(s.Usage), []string{size}})
+			}
+			return samples
+		},
+	},
+	{
+		name:         "hugetlb_max_usage_bytes",
+		cadvisorName: "container_hugetlb_max_usage_bytes",
+		help:         "Maximum hugetlb usage recorded, labeled by page size.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "hugetlb",
+		extraLabels:  []string{"pagesize"},
+		samples: func(stats *v1.Stats) []sample {
+			samples := make([]sample, 0, len(stats.HugetlbStats))
+			for size, s := range stats.HugetlbStats {
+				samples = append(samples, sample{float64(s.MaxUsage), []string{size}})
+			}
+			return samples
+		},
+	},
+	{
+		name:         "hugetlb_failures_total",
+		cadvisorName: "container_hugetlb_failcnt",
+		help:         "Number of hugetlb allocation failures, labeled by page size.",
+		valueType:    prometheus.CounterValue,
+		subsystem:    "hugetlb",
+		extraLabels:  []string{"pagesize"},
+		samples: func(stats *v1.Stats) []sample {
+			samples := make([]sample, 0, len(stats.HugetlbStats))
+			for size, s := range stats.HugetlbStats {
+				samples = append(samples, sample{float64(s.Failcnt), []string{size}})
+			}
+			return samples
+		},
+	},
+	{
+		name:         "memory_limit_bytes",
+		cadvisorName: "container_spec_memory_limit_bytes",
+		help:         "Memory limit, 0 if unlimited.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.Memory == nil {
+				return nil
+			}
+			return []sample{{float64(stats.Limits.Memory.Limit), nil}}
+		},
+	},
+	{
+		name:         "memory_soft_limit_bytes",
+		cadvisorName: "container_spec_memory_reservation_limit_bytes",
+		help:         "Memory soft limit, 0 if unlimited.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.Memory == nil {
+				return nil
+			}
+			return []sample{{float64(stats.Limits.Memory.SoftLimit), nil}}
+		},
+	},
+	{
+		name:         "memory_swap_limit_bytes",
+		cadvisorName: "container_spec_memory_swap_limit_bytes",
+		help:         "Memory and swap limit, 0 if unlimited.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.Memory == nil {
+				return nil
+			}
+			return []sample{{float64(stats.Limits.Memory.SwapLimit), nil}}
+		},
+	},
+	{
+		name:      "memory_saturation_ratio",
+		help:      "Memory usage as a ratio of the memory limit.",
+		valueType: prometheus.GaugeValue,
+		subsystem: "memory",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Saturation == nil || stats.Saturation.Memory == 0 {
+				return nil
+			}
+			return []sample{{stats.Saturation.Memory, nil}}
+		},
+	},
+	{
+		name:         "cpu_cfs_quota_microseconds",
+		cadvisorName: "container_spec_cpu_quota",
+		help:         "CFS quota per period, only if limited.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.CPU == nil || stats.Limits.CPU.Quota <= 0 {
+				return nil
+			}
+			return []sample{{float64(stats.Limits.CPU.Quota), nil}}
+		},
+	},
+	{
+		name:         "cpu_cfs_period_microseconds",
+		cadvisorName: "container_spec_cpu_period",
+		help:         "CFS period.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.CPU == nil || stats.Limits.CPU.Period == 0 {
+				return nil
+			}
+			return []sample{{float64(stats.Limits.CPU.Period), nil}}
+		},
+	},
+	{
+		name:         "cpu_shares",
+		cadvisorName: "container_spec_cpu_shares",
+		help:         "CPU shares.",
+		valueType:    prometheus.GaugeValue,
+		subsystem:    "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.CPU == nil {
+				return nil
+			}
+			return []sample{{float64(stats.Limits.CPU.Shares), nil}}
+		},
+	},
+	{
+		name:      "cpu_limit_cores",
+		help:      "Number of CPUs the CFS quota allows, only if limited.",
+		valueType: prometheus.GaugeValue,
+		subsystem: "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.CPU == nil || stats.Limits.CPU.Cores == 0 {
+				return nil
+			}
+			return []sample{{stats.Limits.CPU.Cores, nil}}
+		},
+	},
+	{
+		name:      "blkio_weight",
+		help:      "Default blkio weight.",
+		valueType: prometheus.GaugeValue,
+		subsystem: "blkio",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil || stats.Limits.Blkio == nil || stats.Limits.Blkio.Weight == 0 {
+				return nil
+			}
+			return []sample{{float64(stats.Limits.Blkio.Weight), nil}}
+		},
+	},
+	{
+		name:        "hugetlb_limit_bytes",
+		help:        "Hugetlb limit, labeled by page size, 0 if unlimited.",
+		valueType:   prometheus.GaugeValue,
+		subsystem:   "hugetlb",
+		extraLabels: []string{"pagesize"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Limits == nil {
+				return nil
+			}
+			samples := make([]sample, 0, len(stats.Limits.Hugetlb))
+			for size, limit := range stats.Limits.Hugetlb {
+				samples = append(samples, sample{float64(limit), []string{size}})
+			}
+			return samples
+		},
+	},
+	{
+		name:      "cpu_cores",
+		help:      "CPU cores used since the previous collection.",
+		valueType: prometheus.GaugeValue,
+		subsystem: "cpuacct",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Rates == nil {
+				return nil
+			}
+			return rateSamples(rateSample{stats.Rates.CPUCores, nil})
+		},
+	},
+	{
+		name:        "cpu_mode_cores",
+		help:        "CPU cores used in user and kernel mode since the previous collection, labeled by mode.",
+		valueType:   prometheus.GaugeValue,
+		subsystem:   "cpuacct",
+		extraLabels: []string{"mode"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Rates == nil {
+				return nil
+			}
+			return rateSamples(rateSample{stats.Rates.CPUUserCores, []string{"user"}}, rateSample{stats.Rates.CPUSystemCores, []string{"system"}})
+		},
+	},
+	{
+		name:      "cpu_quota_percent",
+		help:      "CPU used since the previous collection as a percentage of the CFS quota, omitted if unlimited.",
+		valueType: prometheus.GaugeValue,
+		subsystem: "cpuacct",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Rates == nil {
+				return nil
+			}
+			return rateSamples(rateSample{stats.Rates.CPUQuotaPercent, nil})
+		},
+	},
+	{
+		name:      "cpu_throttled_ratio",
+		help:      "Ratio of CFS periods throttled since the previous collection.",
+		valueType: prometheus.GaugeValue,
+		subsystem: "cpu",
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Rates == nil {
+				return nil
+			}
+			return rateSamples(rateSample{stats.Rates.CPUThrottledRatio, nil})
+		},
+	},
+	{
+		name:        "memory_page_faults_per_second",
+		help:        "Page faults per second since the previous collection, labeled by type.",
+		valueType:   prometheus.GaugeValue,
+		subsystem:   "memory",
+		extraLabels: []string{"type"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Rates == nil {
+				return nil
+			}
+			return rateSamples(rateSample{stats.Rates.PageFaults, []string{"all"}}, rateSample{stats.Rates.MajorPageFaults, []string{"major"}})
+		},
+	},
+	{
+		name:        "blkio_bytes_per_second",
+		help:        "Bytes per second transferred to/from each block device since the previous collection, labeled by operation.",
+		valueType:   prometheus.GaugeValue,
+		subsystem:   "blkio",
+		extraLabels: []string{"device", "major", "minor", "operation"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Rates == nil {
+				return nil
+			}
+			return blkioRateSamples(stats.Rates.Blkio, func(r v1.BlkioDeviceRates) (float64, float64) {
+				return r.ReadBytes, r.WriteBytes
+			})
+		},
+	},
+	{
+		name:        "blkio_ops_per_second",
+		help:        "I/O operations per second issued to each block device since the previous collection, labeled by operation.",
+		valueType:   prometheus.GaugeValue,
+		subsystem:   "blkio",
+		extraLabels: []string{"device", "major", "minor", "operation"},
+		samples: func(stats *v1.Stats) []sample {
+			if stats.Rates == nil {
+				return nil
+			}
+			return blkioRateSamples(stats.Rates.Blkio, func(r v1.BlkioDeviceRates) (float64, float64) {
+				return r.ReadOps, r.WriteOps
+			})
+		},
+	},
+}
+
+// memoryStat returns the first of the named memory.stat entries present.
+func memoryStat(stats *v1.Stats, names ...string) []sample {
+	if stats.MemoryStats == nil {
+		return nil
+	}
+	for _, name := range names {
+		if v, ok := stats.MemoryStats.Stats[name]; ok {
+			return []sample{{float64(v), nil}}
+		}
+	}
+	return nil
+}
+
+func blkioSamples(entries []v1.BlkioStatEntry) []sample {
+	samples := make([]sample, 0, len(entries))
+	for _, e := range entries {
+		// The per-device "Total" is the sum of the other operations.
+		if e.Op == "Total" || e.Op == "" {
+			continue
+		}
+		major := strconv.FormatUint(e.Major, 10)
+		minor := strconv.FormatUint(e.Minor, 10)
+		samples = append(samples, sample{float64(e.Value), []string{deviceName(major, minor), major, minor, e.Op}})
+	}
+	return samples
+}
+
+// rateSample is a rate that is nil if its counter was reset.
+type rateSample struct {
+	value  *float64
+	labels []string
+}
+
+// rateSamples returns the samples of the rates whose counters were not reset.
+func rateSamples(rates ...rateSample) []sample {
+	var samples []sample
+	for _, r := range rates {
+		if r.value != nil {
+			samples = append(samples, sample{*r.value, r.labels})
+		}
+	}
+	return samples
+}
+
+// blkioRateSamples returns the read and write rates selected by rate for
+// each device.
+func blkioRateSamples(devices []v1.BlkioDeviceRates, rate func(r v1.BlkioDeviceRates) (read, write float64)) []sample {
+	samples := make([]sample, 0, 2*len(devices))
+	for _, d := range devices {
+		major := strconv.FormatUint(d.Major, 10)
+		minor := strconv.FormatUint(d.Minor, 10)
+		read, write := rate(d)
+		samples = append(samples,
+			sample{read, []string{deviceName(major, minor), major, minor, "Read"}},
+			sample{write, []string{deviceName(major, minor), major, minor, "Write"}},
+		)
+	}
+	return samples
+}
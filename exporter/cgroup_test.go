@@ -0,0 +1,246 @@
+package exporter
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+type fakeWatcher struct {
+	cgroup.Watcher
+	cgroups []*v1.Cgroup
+}
+
+func (f *fakeWatcher) Walk(fn func(cg *v1.Cgroup)) {
+	for _, cg := range f.cgroups {
+		fn(cg)
+	}
+}
+
+func testWatcher() *fakeWatcher {
+	return &fakeWatcher{cgroups: []*v1.Cgroup{
+		{Subsystem: "cpuacct", Path: "/docker/abc", Stats: &v1.Stats{CPUStats: &v1.CPUStats{CPUUsage: &v1.CPUUsage{
+			TotalUsage:      3e9,
+			PerCPUUsage:     []uint64{1e9, 2e9},
+			UsageInUsermode: 2e9,
+		}}}},
+		{Subsystem: "memory", Path: "/docker/abc", Stats: &v1.Stats{MemoryStats: &v1.MemoryStats{
+			Usage: v1.MemoryData{Usage: 1000},
+			Stats: map[string]uint64{"total_rss": 600, "total_inactive_file": 300},
+		},
+			Limits:     &v1.Limits{Memory: &v1.MemoryLimits{Limit: 4000}},
+			Saturation: &v1.Saturation{Memory: 0.25},
+		}},
+		{Subsystem: "cpu", Path: "/docker/abc", Stats: &v1.Stats{Limits: &v1.Limits{CPU: &v1.CPULimits{
+			Quota:  50000,
+			Period: 100000,
+			Shares: 1024,
+			Cores:  0.5,
+		}}}},
+		{Subsystem: "blkio", Path: "/", Stats: &v1.Stats{BlkioStats: &v1.BlkioStats{IoServiceBytesRecursive: []v1.BlkioStatEntry{
+			{Major: 8, Minor: 0, Op: "Read", Value: 4096},
+			{Major: 8, Minor: 0, Op: "Total", Value: 4096},
+		}}}},
+		{Subsystem: "memory", Path: "/no-stats-yet"},
+	}}
+}
+
+// collect returns the collected metrics formatted as name{labels} value.
+func collect(t *testing.T, c prometheus.Collector) []string {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var out []string
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		labels := []string{}
+		for _, l := range pb.Label {
+			labels = append(labels, l.GetName()+"="+l.GetValue())
+		}
+		var value float64
+		switch {
+		case pb.Counter != nil:
+			value = pb.Counter.GetValue()
+		case pb.Gauge != nil:
+			value = pb.Gauge.GetValue()
+		}
+		name := m.Desc().String()
+		name = name[strings.Index(name, `fqName: "`)+9:]
+		name = name[:strings.Index(name, `"`)]
+		out = append(out, name+"{"+strings.Join(labels, ",")+"} "+strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestCollect(t *testing.T) {
+	got := collect(t, NewCgroupCollector(testWatcher(), Options{}))
+	want := []string{
+		"wurzel_cgroup_blkio_service_bytes_total{cgroup=/,container_id=,container_name=,device=" + deviceName("8", "0") + ",image=,major=8,minor=0,namespace=,operation=Read,pod=,runtime=,subsystem=blkio} 4096",
+		"wurzel_cgroup_cpu_cfs_period_microseconds{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=cpu} 100000",
+		"wurzel_cgroup_cpu_cfs_quota_microseconds{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=cpu} 50000",
+		"wurzel_cgroup_cpu_limit_cores{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=cpu} 0.5",
+		"wurzel_cgroup_cpu_shares{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=cpu} 1024",
+		"wurzel_cgroup_cpu_system_seconds_total{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=cpuacct} 0",
+		"wurzel_cgroup_cpu_usage_seconds_total{cgroup=/docker/abc,container_id=,container_name=,cpu=cpu00,image=,namespace=,pod=,runtime=,subsystem=cpuacct} 1",
+		"wurzel_cgroup_cpu_usage_seconds_total{cgroup=/docker/abc,container_id=,container_name=,cpu=cpu01,image=,namespace=,pod=,runtime=,subsystem=cpuacct} 2",
+		"wurzel_cgroup_cpu_user_seconds_total{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=cpuacct} 2",
+		"wurzel_cgroup_memory_cache_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 0",
+		"wurzel_cgroup_memory_failures_total{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 0",
+		"wurzel_cgroup_memory_kernel_usage_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 0",
+		"wurzel_cgroup_memory_limit_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 4000",
+		"wurzel_cgroup_memory_max_usage_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 0",
+		"wurzel_cgroup_memory_rss_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 600",
+		"wurzel_cgroup_memory_saturation_ratio{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 0.25",
+		"wurzel_cgroup_memory_soft_limit_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 0",
+		"wurzel_cgroup_memory_swap_limit_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 0",
+		"wurzel_cgroup_memory_usage_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 1000",
+		"wurzel_cgroup_memory_working_set_bytes{cgroup=/docker/abc,container_id=,container_name=,image=,namespace=,pod=,runtime=,subsystem=memory} 700",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestCollectCAdvisorNames(t *testing.T) {
+	got := collect(t, NewCgroupCollector(testWatcher(), Options{CAdvisorNames: true}))
+	for _, want := range []string{
+		"container_cpu_usage_seconds_total{container_id=,cpu=cpu01,id=/docker/abc,image=,name=,namespace=,pod=,runtime=} 2",
+		"container_memory_usage_bytes{container_id=,id=/docker/abc,image=,name=,namespace=,pod=,runtime=} 1000",
+		"container_memory_working_set_bytes{container_id=,id=/docker/abc,image=,name=,namespace=,pod=,runtime=} 700",
+		"container_spec_cpu_quota{container_id=,id=/docker/abc,image=,name=,namespace=,pod=,runtime=} 50000",
+		"container_spec_memory_limit_bytes{container_id=,id=/docker/abc,image=,name=,namespace=,pod=,runtime=} 4000",
+	} {
+		found := false
+		for _, m := range got {
+			if m == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s in:\n%s", want, strings.Join(got, "\n"))
+		}
+	}
+	for _, m := range got {
+		if !strings.HasPrefix(m, "container_") {
+			t.Errorf("unexpected metric without a cAdvisor name: %s", m)
+		}
+	}
+}
+
+func TestCollectContainer(t *testing.T) {
+	w := &fakeWatcher{cgroups: []*v1.Cgroup{
+		{Subsystem: "memory", Path: "/docker/abc", Stats: &v1.Stats{MemoryStats: &v1.MemoryStats{}}, Container: &v1.Container{
+			Runtime: v1.RuntimeDocker,
+			ID:      "abc",
+			Name:    "web",
+			Image:   "nginx:1.9",
+			Labels:  map[string]string{"com.example.team": "frontend"},
+		}},
+	}}
+
+	// Labels whose metric label names collide are only exported once.
+	got := collect(t, NewCgroupCollector(w, Options{ContainerLabels: []string{"com.example.team", "missing", "com_example.team", "com.example.team"}}))
+	want := "wurzel_cgroup_memory_usage_bytes{cgroup=/docker/abc,container_id=abc,container_label_com_example_team=frontend,container_label_missing=,container_name=web,image=nginx:1.9,namespace=,pod=,runtime=docker,subsystem=memory} 0"
+	found := false
+	for _, m := range got {
+		if m == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected %s in:\n%s", want, strings.Join(got, "\n"))
+	}
+}
+
+func TestCollectNamespaces(t *testing.T) {
+	w := &fakeWatcher{cgroups: []*v1.Cgroup{
+		{Subsystem: "memory", Path: "/kubepods/poda", Stats: &v1.Stats{MemoryStats: &v1.MemoryStats{}}, Pod: &v1.Pod{UID: "a", Name: "web", Namespace: "prod"}},
+		{Subsystem: "memory", Path: "/kubepods/podb", Stats: &v1.Stats{MemoryStats: &v1.MemoryStats{}}, Pod: &v1.Pod{UID: "b", Name: "web", Namespace: "dev"}},
+		{Subsystem: "memory", Path: "/system.slice", Stats: &v1.Stats{MemoryStats: &v1.MemoryStats{}}},
+	}}
+
+	got := collect(t, NewCgroupCollector(w, Options{Namespaces: []string{"prod"}}))
+	for _, m := range got {
+		if !strings.Contains(m, "namespace=prod,pod=web") {
+			t.Errorf("unexpected metric outside namespace prod: %s", m)
+		}
+	}
+	if len(got) == 0 {
+		t.Error("expected metrics for namespace prod")
+	}
+}
+
+func TestCollectPodUID(t *testing.T) {
+	w := &fakeWatcher{cgroups: []*v1.Cgroup{
+		{Subsystem: "memory", Path: "/kubepods/poda", Stats: &v1.Stats{MemoryStats: &v1.MemoryStats{}}, Pod: &v1.Pod{UID: "a", QOSClass: v1.QOSGuaranteed}},
+	}}
+
+	got := collect(t, NewCgroupCollector(w, Options{}))
+	if len(got) == 0 {
+		t.Fatal("expected metrics for pod a")
+	}
+	for _, m := range got {
+		if !strings.Contains(m, "namespace=,pod=a") {
+			t.Errorf("expected the pod UID as pod label: %s", m)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	c := NewCgroupCollector(testWatcher(), Options{})
+	ch := make(chan *prometheus.Desc, len(cgroupMetrics))
+	c.Describe(ch)
+	close(ch)
+	if len(ch) != len(cgroupMetrics) {
+		t.Errorf("expected %d descs, got %d", len(cgroupMetrics), len(ch))
+	}
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestCollectRates(t *testing.T) {
+	w := &fakeWatcher{cgroups: []*v1.Cgroup{
+		{Subsystem: "cpuacct", Path: "/a", Stats: &v1.Stats{Rates: &v1.Rates{CPUCores: float(1.5), CPUUserCores: float(1), CPUSystemCores: float(0.5), CPUQuotaPercent: float(75)}}},
+		{Subsystem: "cpu", Path: "/a", Stats: &v1.Stats{Rates: &v1.Rates{CPUThrottledRatio: float(0.25)}}},
+		{Subsystem: "memory", Path: "/a", Stats: &v1.Stats{Rates: &v1.Rates{PageFaults: float(200), MajorPageFaults: float(1)}}},
+		{Subsystem: "blkio", Path: "/a", Stats: &v1.Stats{Rates: &v1.Rates{Blkio: []v1.BlkioDeviceRates{
+			{Major: 8, Minor: 0, ReadBytes: 8192, WriteBytes: 4096, ReadOps: 2, WriteOps: 1},
+		}}}},
+	}}
+
+	got := collect(t, NewCgroupCollector(w, Options{}))
+	labels := "cgroup=/a,container_id=,container_name=,image=,namespace=,pod=,runtime="
+	device := "cgroup=/a,container_id=,container_name=,device=" + deviceName("8", "0") + ",image=,major=8,minor=0,namespace="
+	want := []string{
+		"wurzel_cgroup_blkio_bytes_per_second{" + device + ",operation=Read,pod=,runtime=,subsystem=blkio} 8192",
+		"wurzel_cgroup_blkio_bytes_per_second{" + device + ",operation=Write,pod=,runtime=,subsystem=blkio} 4096",
+		"wurzel_cgroup_blkio_ops_per_second{" + device + ",operation=Read,pod=,runtime=,subsystem=blkio} 2",
+		"wurzel_cgroup_blkio_ops_per_second{" + device + ",operation=Write,pod=,runtime=,subsystem=blkio} 1",
+		"wurzel_cgroup_cpu_cores{" + labels + ",subsystem=cpuacct} 1.5",
+		"wurzel_cgroup_cpu_mode_cores{cgroup=/a,container_id=,container_name=,image=,mode=system,namespace=,pod=,runtime=,subsystem=cpuacct} 0.5",
+		"wurzel_cgroup_cpu_mode_cores{cgroup=/a,container_id=,container_name=,image=,mode=user,namespace=,pod=,runtime=,subsystem=cpuacct} 1",
+		"wurzel_cgroup_cpu_quota_percent{" + labels + ",subsystem=cpuacct} 75",
+		"wurzel_cgroup_cpu_throttled_ratio{" + labels + ",subsystem=cpu} 0.25",
+		"wurzel_cgroup_memory_page_faults_per_second{" + labels + ",subsystem=memory,type=all} 200",
+		"wurzel_cgroup_memory_page_faults_per_second{" + labels + ",subsystem=memory,type=major} 1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,44 @@
+package exporter
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jimmidyson/wurzel/host"
+)
+
+var (
+	deviceNames   = map[string]string{}
+	deviceNamesMu sync.Mutex
+)
+
+// deviceName returns the /dev path of the block device with the given major
+// and minor numbers, falling back to major:minor if it cannot be found.
+func deviceName(major, minor string) string {
+	id := major + ":" + minor
+
+	deviceNamesMu.Lock()
+	defer deviceNamesMu.Unlock()
+
+	if name, ok := deviceNames[id]; ok {
+		return name
+	}
+
+	name := id
+	f, err := os.Open(host.Sys("dev", "block", id, "uevent"))
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "DEVNAME=") {
+				name = "/dev/" + strings.TrimPrefix(scanner.Text(), "DEVNAME=")
+				break
+			}
+		}
+	}
+
+	deviceNames[id] = name
+	return name
+}
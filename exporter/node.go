@@ -0,0 +1,69 @@
+package exporter
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/metrics"
+	"github.com/jimmidyson/wurzel/node"
+)
+
+// nodeCPUUtilization is the utilization of each CPU of the node between
+// samples.
+var nodeCPUUtilization = prometheus.NewDesc(
+	prometheus.BuildFQName(metrics.Namespace, "node", "cpu_utilization_percent"),
+	"Percentage of time each CPU spent in each mode between the two latest samples.",
+	[]string{"cpu", "mode"},
+	nil,
+)
+
+// NodeCollector is a prometheus.Collector exporting node level rates.
+type NodeCollector struct {
+	cpu *node.CPUSampler
+}
+
+// NewNodeCollector returns a collector exporting the utilization of each CPU
+// of the node sampled by cpu. Scrapes do not sample, so they do not disturb
+// other consumers of the sampler.
+func NewNodeCollector(cpu *node.CPUSampler) *NodeCollector {
+	return &NodeCollector{cpu: cpu}
+}
+
+// Describe implements prometheus.Collector.
+func (c *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeCPUUtilization
+}
+
+// Collect implements prometheus.Collector.
+func (c *NodeCollector) Collect(ch chan<- prometheus.Metric) {
+	utilization, err := c.cpu.Utilization()
+	if err != nil {
+		log.WithField("error", err).Error("Failed to sample node CPU times")
+		return
+	}
+	for _, u := range utilization {
+		for _, m := range cpuModes(u) {
+			ch <- prometheus.MustNewConstMetric(nodeCPUUtilization, prometheus.GaugeValue, m.value, u.CPU, m.mode)
+		}
+	}
+}
+
+type cpuMode struct {
+	mode  string
+	value float64
+}
+
+func cpuModes(u v1.CPUUtilization) []cpuMode {
+	return []cpuMode{
+		{"busy", u.Busy},
+		{"user", u.User},
+		{"system", u.System},
+		{"nice", u.Nice},
+		{"iowait", u.Iowait},
+		{"irq", u.Irq},
+		{"softirq", u.Softirq},
+		{"steal", u.Steal},
+		{"idle", u.Idle},
+	}
+}
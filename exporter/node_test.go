@@ -0,0 +1,20 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/node"
+)
+
+func TestNodeCollector(t *testing.T) {
+	got := collect(t, NewNodeCollector(node.NewCPUSampler()))
+	if len(got) == 0 {
+		t.Fatal("expected node CPU utilization metrics")
+	}
+	for _, m := range got {
+		if !strings.HasPrefix(m, "wurzel_node_cpu_utilization_percent{cpu=") {
+			t.Errorf("unexpected metric %s", m)
+		}
+	}
+}
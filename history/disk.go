@@ -0,0 +1,459 @@
+package history
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// segmentRounds is the number of rounds at a tier's resolution a segment
+// spans before the next segment of the tier is started.
+const segmentRounds = 360
+
+// Tier is a level of the on-disk history. The first tier holds the recorded
+// samples and every further tier the averages of the samples of the tier
+// before it over its resolution.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// ParseTiers parses a comma-separated list of <resolution>:<retention> tiers,
+// e.g. 1m:168h,10m:720h.
+func ParseTiers(s string) ([]Tier, error) {
+	var tiers []Tier
+	for _, t := range strings.Split(s, ",") {
+		if t == "" {
+			continue
+		}
+		spl := strings.SplitN(t, ":", 2)
+		if len(spl) != 2 {
+			return nil, fmt.Errorf("invalid tier %s, expected <resolution>:<retention>", t)
+		}
+		resolution, err := time.ParseDuration(spl[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolution of tier %s: %v", t, err)
+		}
+		retention, err := time.ParseDuration(spl[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention of tier %s: %v", t, err)
+		}
+		tiers = append(tiers, Tier{Resolution: resolution, Retention: retention})
+	}
+	return tiers, nil
+}
+
+// DiskOptions configures the on-disk history.
+type DiskOptions struct {
+	// Dir holds a directory of segments for each tier.
+	Dir string
+	// Tiers are ordered by increasing resolution. The resolution of the first
+	// tier must be the resolution samples are recorded at.
+	Tiers []Tier
+	// MaxBytes limits the total size of the segments of all tiers, 0 for no
+	// limit. Segments of the finest tiers are removed first, as they are
+	// covered by the coarser tiers.
+	MaxBytes int64
+}
+
+// Disk persists recorded rounds in write-ahead segments, rolls complete
+// segments up into coarser tiers and removes the segments beyond the retention
+// limits. The latest segment of each tier is always kept.
+type Disk struct {
+	opts DiskOptions
+
+	mu sync.Mutex
+	// active holds the segment each tier is appended to, nil until the
+	// tier's first round after opening.
+	active []*segmentWriter
+	// rolled holds, for each tier after the first, the time up to which the
+	// tier before it was rolled up.
+	rolled []time.Time
+}
+
+// OpenDisk opens the on-disk history in opts.Dir, creating it if needed.
+// Rounds recorded before are kept, and new rounds are written to new
+// segments.
+func OpenDisk(opts DiskOptions) (*Disk, error) {
+	if len(opts.Tiers) == 0 {
+		return nil, fmt.Errorf("no history tiers configured")
+	}
+	for i, t := range opts.Tiers {
+		if t.Resolution <= 0 || t.Retention <= 0 {
+			return nil, fmt.Errorf("resolution and retention of history tier %s must be positive", t.Resolution)
+		}
+		if i > 0 && t.Resolution <= opts.Tiers[i-1].Resolution {
+			return nil, fmt.Errorf("history tier %s must be coarser than tier %s", t.Resolution, opts.Tiers[i-1].Resolution)
+		}
+	}
+
+	d := &Disk{
+		opts:   opts,
+		active: make([]*segmentWriter, len(opts.Tiers)),
+		rolled: make([]time.Time, len(opts.Tiers)),
+	}
+	for i, t := range opts.Tiers {
+		if err := os.MkdirAll(d.dir(i), 0755); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			continue
+		}
+		last, err := d.lastRound(i)
+		if err != nil {
+			return nil, err
+		}
+		if !last.IsZero() {
+			d.rolled[i] = last.Add(t.Resolution)
+		}
+	}
+	return d, nil
+}
+
+// Close closes the active segments.
+func (d *Disk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	for i, w := range d.active {
+		if w == nil {
+			continue
+		}
+		if cerr := w.close(); err == nil {
+			err = cerr
+		}
+		d.active[i] = nil
+	}
+	return err
+}
+
+func (d *Disk) dir(tier int) string {
+	return filepath.Join(d.opts.Dir, d.opts.Tiers[tier].Resolution.String())
+}
+
+// lastRound returns the time of the latest round of a tier, or the zero time
+// if the tier is empty.
+func (d *Disk) lastRound(tier int) (time.Time, error) {
+	segments, err := listSegments(d.dir(tier))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		rounds, err := readSegment(segments[i].path)
+		if err != nil && err != errCorrupt {
+			return time.Time{}, err
+		}
+		if len(rounds) > 0 {
+			return rounds[len(rounds)-1].timestamp, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// write appends a recorded round to the first tier. Whenever a new segment is
+// started, the previous segments are rolled up and expired segments removed.
+func (d *Disk) write(r round) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rotated, err := d.writeTier(0, r)
+	if rotated {
+		d.compact(r.timestamp)
+	}
+	return err
+}
+
+// writeTier appends r to the active segment of a tier, first starting a new
+// segment if there is none or the active segment is full. It returns whether
+// a new segment was started.
+func (d *Disk) writeTier(tier int, r round) (bool, error) {
+	w := d.active[tier]
+	rotated := false
+	if w == nil || r.timestamp.Sub(w.start) >= segmentRounds*d.opts.Tiers[tier].Resolution {
+		if w != nil {
+			if err := w.close(); err != nil {
+				log.WithFields(log.Fields{"tier": d.opts.Tiers[tier].Resolution, "error": err}).Warn("Failed to close history segment")
+			}
+		}
+		var err error
+		w, err = createSegment(d.dir(tier), r.timestamp)
+		d.active[tier] = w
+		if err != nil {
+			return false, err
+		}
+		rotated = true
+	}
+
+	if err := w.append(r); err != nil {
+		// The next round starts a new segment, as this one may be torn.
+		if cerr := w.close(); cerr != nil {
+			log.WithFields(log.Fields{"tier": d.opts.Tiers[tier].Resolution, "error": cerr}).Warn("Failed to close history segment")
+		}
+		d.active[tier] = nil
+		return rotated, err
+	}
+	return rotated, nil
+}
+
+// compact rolls each tier up into the next and removes the segments beyond
+// the retention limits.
+func (d *Disk) compact(now time.Time) {
+	for i := 1; i < len(d.opts.Tiers); i++ {
+		if err := d.rollup(i); err != nil {
+			log.WithFields(log.Fields{"tier": d.opts.Tiers[i].Resolution, "error": err}).Warn("Failed to roll up history")
+		}
+	}
+	d.removeExpired(now)
+}
+
+// rollup writes the averages of the samples of the tier before tier over each
+// of tier's buckets not rolled up yet. Only buckets ending before the active
+// segment of the tier before was started are complete and rolled up.
+func (d *Disk) rollup(tier int) error {
+	src := d.active[tier-1]
+	if src == nil {
+		return nil
+	}
+	resolution := d.opts.Tiers[tier].Resolution
+	limit := src.start.Truncate(resolution)
+	if !d.rolled[tier].Before(limit) {
+		return nil
+	}
+
+	segments, err := listSegments(d.dir(tier - 1))
+	if err != nil {
+		return err
+	}
+	buckets := map[time.Time]*bucket{}
+	for i, seg := range segments {
+		if !seg.start.Before(limit) {
+			break
+		}
+		if i+1 < len(segments) && !segments[i+1].start.After(d.rolled[tier]) {
+			continue
+		}
+		rounds, err := readSegment(seg.path)
+		if err != nil && err != errCorrupt {
+			return err
+		}
+		for _, r := range rounds {
+			if r.timestamp.Before(d.rolled[tier]) || !r.timestamp.Before(limit) {
+				continue
+			}
+			start := r.timestamp.Truncate(resolution)
+			b, ok := buckets[start]
+			if !ok {
+				b = &bucket{series: map[string]*aggregate{}}
+				buckets[start] = b
+			}
+			b.add(r)
+		}
+	}
+
+	starts := make([]time.Time, 0, len(buckets))
+	for start := range buckets {
+		starts = append(starts, start)
+	}
+	sort.Sort(byTime(starts))
+	for _, start := range starts {
+		if _, err := d.writeTier(tier, buckets[start].round(start)); err != nil {
+			return err
+		}
+	}
+	d.rolled[tier] = limit
+	return nil
+}
+
+// removeExpired removes the segments ending before the retention of their
+// tier, then the oldest segments of the finest tiers while the total size
+// exceeds opts.MaxBytes. Segments not rolled up yet are kept.
+func (d *Disk) removeExpired(now time.Time) {
+	var (
+		total      int64
+		candidates []segmentInfo
+	)
+	for i, tier := range d.opts.Tiers {
+		segments, err := listSegments(d.dir(i))
+		if err != nil {
+			log.WithFields(log.Fields{"tier": tier.Resolution, "error": err}).Warn("Failed to list history segments")
+			continue
+		}
+		for j, seg := range segments {
+			total += seg.size
+			// The end of the latest segment is not known.
+			if j+1 == len(segments) {
+				continue
+			}
+			end := segments[j+1].start
+			if i+1 < len(d.opts.Tiers) && end.After(d.rolled[i+1]) {
+				continue
+			}
+			if end.Before(now.Add(-tier.Retention)) {
+				if removeSegment(seg) {
+					total -= seg.size
+				}
+				continue
+			}
+			candidates = append(candidates, seg)
+		}
+	}
+
+	for _, seg := range candidates {
+		if d.opts.MaxBytes <= 0 || total <= d.opts.MaxBytes {
+			return
+		}
+		if removeSegment(seg) {
+			total -= seg.size
+		}
+	}
+}
+
+func removeSegment(seg segmentInfo) bool {
+	if err := os.Remove(seg.path); err != nil {
+		log.WithFields(log.Fields{"segment": seg.path, "error": err}).Warn("Failed to remove history segment")
+		return false
+	}
+	log.WithField("segment", seg.path).Debug("Removed history segment")
+	return true
+}
+
+// read adds the samples of the series of tier matching match, taken from
+// start up to end, to ret. It returns a tooManySeries error as soon as ret
+// would hold more than max series, unless max is 0.
+func (d *Disk) read(tier int, start, end time.Time, match func(id string) bool, ret map[string]*seriesSamples, max int) error {
+	segments, err := listSegments(d.dir(tier))
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range segments {
+		if !seg.start.Before(end) {
+			break
+		}
+		if i+1 < len(segments) && !segments[i+1].start.After(start) {
+			continue
+		}
+		rounds, err := readSegment(seg.path)
+		if os.IsNotExist(err) {
+			// Removed since listing.
+			continue
+		}
+		if err != nil && err != errCorrupt {
+			return err
+		}
+		for _, r := range rounds {
+			if r.timestamp.Before(start) || !r.timestamp.Before(end) {
+				continue
+			}
+			for _, e := range r.entries {
+				if !match(e.id) {
+					continue
+				}
+				ss, ok := ret[e.id]
+				if !ok {
+					if max > 0 && len(ret) >= max {
+						return tooManySeries(max)
+					}
+					ss = &seriesSamples{}
+					ret[e.id] = ss
+				}
+				ss.labels = e.labels
+				ss.samples = append(ss.samples, sample{timestamp: r.timestamp, values: e.values})
+			}
+		}
+	}
+	return nil
+}
+
+// rolledUp returns the time up to which the samples of tier are complete, as
+// the tier before it was rolled up to then. The first tier is complete up to
+// its latest round.
+func (d *Disk) rolledUp(tier int) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rolled[tier]
+}
+
+// tierFor returns the tier to answer a query from start with the given step:
+// the coarsest tier retaining samples from start with a resolution no longer
+// than step, else the finest tier retaining samples from start, else the
+// coarsest tier.
+func (d *Disk) tierFor(start time.Time, step time.Duration, now time.Time) int {
+	ret := -1
+	for i, t := range d.opts.Tiers {
+		if start.Before(now.Add(-t.Retention)) {
+			continue
+		}
+		if ret < 0 || t.Resolution <= step {
+			ret = i
+		}
+	}
+	if ret < 0 {
+		return len(d.opts.Tiers) - 1
+	}
+	return ret
+}
+
+// resolution returns the resolution of a tier.
+func (d *Disk) resolution(tier int) time.Duration {
+	return d.opts.Tiers[tier].Resolution
+}
+
+// bucket accumulates the samples of each series within a rolled up bucket.
+type bucket struct {
+	series map[string]*aggregate
+}
+
+type aggregate struct {
+	labels map[string]string
+	sums   map[string]float64
+	counts map[string]int
+}
+
+func (b *bucket) add(r round) {
+	for _, e := range r.entries {
+		a, ok := b.series[e.id]
+		if !ok {
+			a = &aggregate{sums: map[string]float64{}, counts: map[string]int{}}
+			b.series[e.id] = a
+		}
+		a.labels = e.labels
+		for k, v := range e.values {
+			a.sums[k] += v
+			a.counts[k]++
+		}
+	}
+}
+
+// round returns the averages of the bucket's samples as a round at start.
+func (b *bucket) round(start time.Time) round {
+	ids := make([]string, 0, len(b.series))
+	for id := range b.series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	r := round{timestamp: start}
+	for _, id := range ids {
+		a := b.series[id]
+		values := make(map[string]float64, len(a.sums))
+		for k, sum := range a.sums {
+			values[k] = sum / float64(a.counts[k])
+		}
+		r.entries = append(r.entries, entry{id: id, labels: a.labels, values: values})
+	}
+	return r
+}
+
+type byTime []time.Time
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTime) Less(i, j int) bool { return s[i].Before(s[j]) }
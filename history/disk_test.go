@@ -0,0 +1,175 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := ParseTiers("1m:168h,10m:720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Tier{{time.Minute, 168 * time.Hour}, {10 * time.Minute, 720 * time.Hour}}
+	if !reflect.DeepEqual(tiers, want) {
+		t.Errorf("expected %v, got %v", want, tiers)
+	}
+
+	for _, s := range []string{"1m", "x:1h", "1m:x"} {
+		if _, err := ParseTiers(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func openTestDisk(t *testing.T, dir string, maxBytes int64) *Disk {
+	d, err := OpenDisk(DiskOptions{
+		Dir: dir,
+		Tiers: []Tier{
+			{Resolution: 10 * time.Second, Retention: time.Hour},
+			{Resolution: time.Minute, Retention: 24 * time.Hour},
+		},
+		MaxBytes: maxBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// writeRounds writes a round every 10s from start, with value i for the i-th
+// round.
+func writeRounds(t *testing.T, d *Disk, start time.Time, from, to int) {
+	for i := from; i < to; i++ {
+		r := round{timestamp: start.Add(time.Duration(i) * 10 * time.Second), entries: []entry{
+			{id: "node", values: map[string]float64{"value": float64(i)}},
+		}}
+		if err := d.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiskRollup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openTestDisk(t, dir, 0)
+	// Two full segments and the first minute of a third.
+	writeRounds(t, d, t0, 0, 2*segmentRounds+7)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rolled := map[string]*seriesSamples{}
+	if err := d.read(1, t0, t0.Add(24*time.Hour), all, rolled, 0); err != nil {
+		t.Fatal(err)
+	}
+	samples := rolled["node"].samples
+	if len(samples) != 2*segmentRounds/6 {
+		t.Fatalf("expected %d rolled up samples, got %d", 2*segmentRounds/6, len(samples))
+	}
+	for i, smp := range samples {
+		if want := t0.Add(time.Duration(i) * time.Minute); !smp.timestamp.Equal(want) {
+			t.Errorf("sample %d: expected timestamp %v, got %v", i, want, smp.timestamp)
+		}
+		// The average of the 6 rounds in each minute.
+		if want := float64(6*i) + 2.5; smp.values["value"] != want {
+			t.Errorf("sample %d: expected value %v, got %v", i, want, smp.values["value"])
+		}
+	}
+
+	// Reopening continues rolling up where it stopped.
+	d = openTestDisk(t, dir, 0)
+	writeRounds(t, d, t0, 3*segmentRounds, 3*segmentRounds+1)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rolled = map[string]*seriesSamples{}
+	if err := d.read(1, t0, t0.Add(24*time.Hour), all, rolled, 0); err != nil {
+		t.Fatal(err)
+	}
+	samples = rolled["node"].samples
+	for i := 1; i < len(samples); i++ {
+		if !samples[i].timestamp.After(samples[i-1].timestamp) {
+			t.Fatalf("expected increasing timestamps, got %v after %v", samples[i].timestamp, samples[i-1].timestamp)
+		}
+	}
+	// The first minute of the third segment and the single round after it
+	// are rolled up once the round written after reopening starts a new
+	// segment.
+	if len(samples) != 2*segmentRounds/6+2 {
+		t.Errorf("expected %d rolled up samples, got %d", 2*segmentRounds/6+2, len(samples))
+	}
+
+	// Starting the latest segment removed the first, which ended more than
+	// an hour before.
+	segments, err := listSegments(d.dir(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 || !segments[0].start.Equal(t0.Add(time.Hour)) {
+		t.Errorf("expected the first raw segment to be removed, got %+v", segments)
+	}
+}
+
+func TestDiskMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openTestDisk(t, dir, 1)
+	writeRounds(t, d, t0, 0, segmentRounds+1)
+	defer d.Close()
+
+	segments, err := listSegments(d.dir(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || !segments[0].start.Equal(t0.Add(time.Hour)) {
+		t.Errorf("expected only the latest raw segment to be kept, got %+v", segments)
+	}
+	segments, err = listSegments(d.dir(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("expected the latest rolled up segment to be kept, got %+v", segments)
+	}
+}
+
+func TestTierFor(t *testing.T) {
+	d := &Disk{opts: DiskOptions{Tiers: []Tier{
+		{Resolution: 10 * time.Second, Retention: time.Hour},
+		{Resolution: time.Minute, Retention: 24 * time.Hour},
+		{Resolution: 10 * time.Minute, Retention: 720 * time.Hour},
+	}}}
+	now := t0
+	for _, test := range []struct {
+		start time.Time
+		step  time.Duration
+		tier  int
+	}{
+		{now.Add(-30 * time.Minute), 10 * time.Second, 0},
+		{now.Add(-30 * time.Minute), 5 * time.Second, 0},
+		{now.Add(-30 * time.Minute), 5 * time.Minute, 1},
+		{now.Add(-30 * time.Minute), time.Hour, 2},
+		{now.Add(-2 * time.Hour), 10 * time.Second, 1},
+		{now.Add(-48 * time.Hour), time.Minute, 2},
+		{now.Add(-1000 * time.Hour), time.Hour, 2},
+	} {
+		if tier := d.tierFor(test.start, test.step, now); tier != test.tier {
+			t.Errorf("start %v, step %v: expected tier %d, got %d", test.start, test.step, test.tier, tier)
+		}
+	}
+}
+
+func all(string) bool { return true }
@@ -0,0 +1,375 @@
+// Package history records a bounded history of node, cgroup and process stats
+// in memory and optionally on disk, so recent history can be queried without
+// an external time series database.
+package history
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+	"github.com/jimmidyson/wurzel/node"
+	"github.com/jimmidyson/wurzel/process"
+)
+
+// Options configures what is recorded and for how long.
+type Options struct {
+	// Retention is how long samples are kept.
+	Retention time.Duration
+	// Resolution is the interval between samples.
+	Resolution time.Duration
+	// Processes are the names of the processes to record, in addition to
+	// the node and every watched cgroup.
+	Processes []string
+	// MaxSeries limits the number of series recorded, 0 for no limit. New
+	// series are not recorded while at the limit.
+	MaxSeries int
+	// MaxQuerySeries limits the number of series a range query may select,
+	// 0 for no limit.
+	MaxQuerySeries int
+	// CPU serves the node CPU utilization recorded. If nil, the store samples
+	// a sampler of its own on recording.
+	CPU *node.CPUSampler
+	// Disk persists the recorded samples if not nil. The samples within the
+	// retention are reloaded from it on creating the store, and queries
+	// starting before the retention are answered from it.
+	Disk *Disk
+}
+
+// Store samples the node, the cgroups of a watcher and the selected processes
+// every Options.Resolution, keeping the samples of each series in a ring
+// buffer covering Options.Retention. Subsystems mounted together, e.g.
+// cpu,cpuacct, share the series of their cgroups.
+type Store struct {
+	w        cgroup.Watcher
+	opts     Options
+	capacity int
+	cpu      *node.CPUSampler
+	ownCPU   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+// NewStore returns a store recording the cgroups of w. The store records
+// nothing until started.
+func NewStore(w cgroup.Watcher, opts Options) *Store {
+	capacity := 1
+	if opts.Resolution > 0 {
+		capacity = int(opts.Retention/opts.Resolution) + 1
+	}
+	s := &Store{
+		w:        w,
+		opts:     opts,
+		capacity: capacity,
+		cpu:      opts.CPU,
+		done:     make(chan struct{}),
+		series:   map[string]*series{},
+	}
+	if s.cpu == nil {
+		s.cpu, s.ownCPU = node.NewCPUSampler(), true
+	}
+	if opts.Disk != nil {
+		s.load(time.Now())
+	}
+	return s
+}
+
+// load adds the samples persisted within the retention to the store.
+func (s *Store) load(now time.Time) {
+	loaded := map[string]*seriesSamples{}
+	err := s.opts.Disk.read(0, now.Add(-s.opts.Retention), now, func(string) bool { return true }, loaded, 0)
+	if err != nil {
+		log.WithField("error", err).Warn("Failed to load history")
+		return
+	}
+	for id, ss := range loaded {
+		for _, smp := range ss.samples {
+			s.add(id, ss.labels, smp.timestamp, smp.values)
+		}
+	}
+	log.WithField("series", len(loaded)).Debug("Loaded history")
+}
+
+// Start records a sample of every series each resolution interval until
+// stopped.
+func (s *Store) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.opts.Resolution)
+		defer ticker.Stop()
+
+		s.record(time.Now())
+		for {
+			select {
+			case now := <-ticker.C:
+				s.record(now)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops recording. Recorded series can still be queried.
+func (s *Store) Stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// record samples every series at now and drops series with no samples within
+// the retention period, e.g. those of removed cgroups or exited processes.
+func (s *Store) record(now time.Time) {
+	entries := []entry{s.sampleNode()}
+	entries = append(entries, s.sampleCgroups()...)
+	entries = append(entries, s.sampleProcesses()...)
+
+	r := round{timestamp: now}
+	for _, e := range entries {
+		if len(e.values) > 0 {
+			r.entries = append(r.entries, e)
+		}
+	}
+
+	var dropped int
+	for _, e := range r.entries {
+		if !s.add(e.id, e.labels, now, e.values) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.WithFields(log.Fields{"series": dropped, "max": s.opts.MaxSeries}).Warn("History series limit reached, not recording new series")
+	}
+	if s.opts.Disk != nil {
+		if err := s.opts.Disk.write(r); err != nil {
+			log.WithField("error", err).Warn("Failed to persist history")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ser := range s.series {
+		if ser.latest().Before(now.Add(-s.opts.Retention)) {
+			delete(s.series, id)
+		}
+	}
+}
+
+// add appends a sample to the series id, creating it if needed. It returns
+// false if the series is new and the store holds Options.MaxSeries series.
+func (s *Store) add(id string, labels map[string]string, now time.Time, values map[string]float64) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ser, ok := s.series[id]
+	if !ok {
+		if s.opts.MaxSeries > 0 && len(s.series) >= s.opts.MaxSeries {
+			return false
+		}
+		ser = newSeries(s.capacity)
+		s.series[id] = ser
+	}
+	ser.labels = labels
+	ser.add(now, values)
+	return true
+}
+
+func (s *Store) sampleNode() entry {
+	values := map[string]float64{}
+
+	if s.ownCPU {
+		if err := s.cpu.Sample(); err != nil {
+			log.WithField("error", err).Warn("Failed to sample node CPU times")
+		}
+	}
+	utilization, err := s.cpu.Utilization()
+	if err != nil {
+		log.WithField("error", err).Warn("Failed to sample node CPU times")
+	} else if len(utilization) > 0 {
+		var busy float64
+		for _, u := range utilization {
+			busy += u.Busy
+		}
+		values["cpu_busy_percent"] = busy / float64(len(utilization))
+	}
+
+	mem, err := node.Memory()
+	if err != nil {
+		log.WithField("error", err).Warn("Failed to get node memory")
+	} else {
+		values["memory_used"] = float64(mem.Used)
+		values["memory_available"] = float64(mem.Available)
+		values["memory_used_percent"] = mem.UsedPercent
+	}
+
+	swap, err := node.Swap()
+	if err != nil {
+		log.WithField("error", err).Warn("Failed to get node swap")
+	} else {
+		values["swap_used"] = float64(swap.Used)
+	}
+
+	return entry{id: "node", values: values}
+}
+
+// sampleCgroups returns an entry for each cgroup of each hierarchy, holding
+// the values of every subsystem mounted at the hierarchy.
+func (s *Store) sampleCgroups() []entry {
+	hierarchies := hierarchies(s.w.Subsystems())
+
+	var entries []entry
+	byID := map[string]int{}
+	s.w.Walk(func(cg *v1.Cgroup) {
+		hierarchy, ok := hierarchies[cg.Subsystem]
+		if !ok {
+			hierarchy = cg.Subsystem
+		}
+		id := "cgroup:" + hierarchy + ":" + cg.Path
+		i, ok := byID[id]
+		if !ok {
+			byID[id] = len(entries)
+			entries = append(entries, entry{
+				id:     id,
+				labels: cgroupLabels(cg, hierarchy),
+				values: map[string]float64{},
+			})
+			i = len(entries) - 1
+		}
+		for k, v := range cgroupValues(cg.Stats) {
+			entries[i].values[k] = v
+		}
+	})
+	return entries
+}
+
+// hierarchies maps each subsystem to the comma-separated, sorted names of the
+// subsystems mounted at the same hierarchy, e.g. cpu,cpuacct.
+func hierarchies(subsystems []v1.Subsystem) map[string]string {
+	byMountpoint := map[string][]string{}
+	for _, s := range subsystems {
+		byMountpoint[s.Mountpoint] = append(byMountpoint[s.Mountpoint], s.Name)
+	}
+	ret := map[string]string{}
+	for _, names := range byMountpoint {
+		sort.Strings(names)
+		hierarchy := strings.Join(names, ",")
+		for _, name := range names {
+			ret[name] = hierarchy
+		}
+	}
+	return ret
+}
+
+func cgroupLabels(cg *v1.Cgroup, hierarchy string) map[string]string {
+	labels := map[string]string{"subsystem": hierarchy, "path": cg.Path}
+	if cg.Container != nil {
+		labels["container_id"] = cg.Container.ID
+		labels["container_name"] = cg.Container.Name
+		labels["runtime"] = cg.Container.Runtime
+	}
+	if cg.Pod != nil {
+		labels["namespace"] = cg.Pod.Namespace
+		labels["pod"] = cg.Pod.Name
+		if cg.Pod.Name == "" {
+			// Only the pod UID is known without pod metadata from the kubelet.
+			labels["pod"] = cg.Pod.UID
+		}
+	}
+	if cg.Unit != nil {
+		labels["unit"] = cg.Unit.Name
+	}
+	return labels
+}
+
+// cgroupValues returns the values recorded for a cgroup, taken from the
+// stats of its subsystem.
+func cgroupValues(stats *v1.Stats) map[string]float64 {
+	values := map[string]float64{}
+	if stats == nil {
+		return values
+	}
+
+	if m := stats.MemoryStats; m != nil {
+		values["memory_usage"] = float64(m.Usage.Usage)
+		inactive, ok := m.Stats["total_inactive_file"]
+		if !ok {
+			inactive = m.Stats["inactive_file"]
+		}
+		if inactive < m.Usage.Usage {
+			values["memory_working_set"] = float64(m.Usage.Usage - inactive)
+		} else {
+			values["memory_working_set"] = 0
+		}
+	}
+	if c := stats.CPUStats; c != nil && c.CPUUsage != nil {
+		values["cpu_usage_seconds"] = float64(c.CPUUsage.TotalUsage) / float64(time.Second)
+	}
+	if p := stats.PidsStats; p != nil {
+		values["tasks"] = float64(p.Current)
+	}
+	if r := stats.Rates; r != nil {
+		if r.CPUCores != nil {
+			values["cpu_cores"] = *r.CPUCores
+		}
+		if r.CPUThrottledRatio != nil {
+			values["cpu_throttled_ratio"] = *r.CPUThrottledRatio
+		}
+		if r.PageFaults != nil {
+			values["page_faults_per_second"] = *r.PageFaults
+		}
+		if stats.BlkioStats != nil {
+			var read, write float64
+			for _, d := range r.Blkio {
+				read += d.ReadBytes
+				write += d.WriteBytes
+			}
+			values["io_read_bytes_per_second"] = read
+			values["io_write_bytes_per_second"] = write
+		}
+	}
+	return values
+}
+
+func (s *Store) sampleProcesses() []entry {
+	if len(s.opts.Processes) == 0 {
+		return nil
+	}
+	processes, err := process.ListNames(s.opts.Processes)
+	if err != nil {
+		log.WithField("error", err).Warn("Failed to list processes")
+		return nil
+	}
+	var entries []entry
+	for _, p := range processes {
+		values := map[string]float64{
+			"cpu_percent": p.CPUPercent,
+			"threads":     float64(p.Threads),
+		}
+		if p.CPUTime != nil {
+			values["cpu_seconds"] = p.CPUTime.User + p.CPUTime.System
+		}
+		if p.Memory != nil {
+			values["rss"] = float64(p.Memory.RSS)
+		}
+		entries = append(entries, entry{
+			id:     "process:" + strconv.Itoa(int(p.Pid)),
+			labels: map[string]string{"name": p.Name},
+			values: values,
+		})
+	}
+	return entries
+}
@@ -0,0 +1,354 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+type fakeWatcher struct {
+	cgroup.Watcher
+	subsystems []v1.Subsystem
+	cgroups    []*v1.Cgroup
+}
+
+func (f *fakeWatcher) Subsystems() []v1.Subsystem { return f.subsystems }
+
+func (f *fakeWatcher) Walk(fn func(cg *v1.Cgroup)) {
+	for _, cg := range f.cgroups {
+		fn(cg)
+	}
+}
+
+var t0 = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestSeries(t *testing.T) {
+	s := newSeries(3)
+	if !s.latest().IsZero() {
+		t.Errorf("expected no latest sample, got %v", s.latest())
+	}
+	for i := 0; i < 5; i++ {
+		values := map[string]float64{"a": float64(i)}
+		// Values missing from some samples are omitted from those only.
+		if i == 3 {
+			values = map[string]float64{"b": 1}
+		}
+		s.add(t0.Add(time.Duration(i)*time.Second), values)
+		if got, want := s.latest(), t0.Add(time.Duration(i)*time.Second); !got.Equal(want) {
+			t.Errorf("expected latest sample at %v, got %v", want, got)
+		}
+	}
+
+	var got []time.Time
+	var values []map[string]float64
+	for _, smp := range s.ordered() {
+		got = append(got, smp.timestamp)
+		values = append(values, smp.values)
+	}
+	want := []time.Time{t0.Add(2 * time.Second), t0.Add(3 * time.Second), t0.Add(4 * time.Second)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected samples at %v, got %v", want, got)
+	}
+	wantValues := []map[string]float64{{"a": 2}, {"b": 1}, {"a": 4}}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("expected values %v, got %v", wantValues, values)
+	}
+	if len(s.timestamps) != 3 || cap(s.timestamps) != 3 {
+		t.Errorf("expected columns bounded by the capacity of 3, got %d/%d", len(s.timestamps), cap(s.timestamps))
+	}
+}
+
+func newTestStore() *Store {
+	s := NewStore(&fakeWatcher{}, Options{Retention: time.Minute, Resolution: 10 * time.Second})
+	for i := 0; i < 3; i++ {
+		now := t0.Add(time.Duration(i) * 10 * time.Second)
+		s.add("cgroup:memory:/docker/abc", map[string]string{"path": "/docker/abc"}, now, map[string]float64{
+			"memory_usage": float64(100 * (i + 1)),
+			"tasks":        float64(i),
+		})
+		s.add("cgroup:memory:/docker/abc/nested", nil, now, map[string]float64{"memory_usage": 1})
+		s.add("node", nil, now, map[string]float64{"memory_used": 1})
+	}
+	return s
+}
+
+func TestQueryRange(t *testing.T) {
+	s := newTestStore()
+
+	result, err := s.QueryRange(v1.RangeQuery{
+		Series: []string{"cgroup:memory:/docker/*"},
+		Values: []string{"memory_usage"},
+		Start:  t0,
+		End:    t0.Add(30 * time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &v1.RangeResult{
+		Start: t0,
+		End:   t0.Add(30 * time.Second),
+		Step:  10,
+		Series: []v1.Series{{
+			ID:     "cgroup:memory:/docker/abc",
+			Labels: map[string]string{"path": "/docker/abc"},
+			Points: []v1.Point{
+				{Timestamp: t0, Values: map[string]float64{"memory_usage": 100}},
+				{Timestamp: t0.Add(10 * time.Second), Values: map[string]float64{"memory_usage": 200}},
+				{Timestamp: t0.Add(20 * time.Second), Values: map[string]float64{"memory_usage": 300}},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("expected %+v, got %+v", want, result)
+	}
+
+	// Steps shorter than the resolution repeat the latest sample.
+	result, err = s.QueryRange(v1.RangeQuery{
+		Series: []string{"cgroup:memory:/docker/abc", "node"},
+		Values: []string{"tasks"},
+		Start:  t0.Add(5 * time.Second),
+		End:    t0.Add(15 * time.Second),
+		Step:   5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Series) != 2 || result.Series[0].ID != "cgroup:memory:/docker/abc" || result.Series[1].ID != "node" {
+		t.Fatalf("expected the cgroup and node series, got %+v", result.Series)
+	}
+	var tasks []float64
+	for _, p := range result.Series[0].Points {
+		tasks = append(tasks, p.Values["tasks"])
+	}
+	if !reflect.DeepEqual(tasks, []float64{0, 1, 1}) {
+		t.Errorf("expected tasks [0 1 1], got %v", tasks)
+	}
+	if len(result.Series[1].Points) != 0 {
+		t.Errorf("expected no node points without tasks, got %+v", result.Series[1].Points)
+	}
+}
+
+func TestQueryRangeErrors(t *testing.T) {
+	s := newTestStore()
+	for _, q := range []v1.RangeQuery{
+		{},
+		{Series: []string{"cgroup:memory:/["}},
+		{Series: []string{"node"}, Start: t0, End: t0.Add(-time.Second)},
+		{Series: []string{"node"}, Start: t0, End: t0.Add(24 * time.Hour), Step: time.Second},
+	} {
+		if _, err := s.QueryRange(q); err == nil {
+			t.Errorf("expected error for query %+v", q)
+		}
+	}
+
+	s.opts.MaxQuerySeries = 2
+	q := v1.RangeQuery{Series: []string{"node", "cgroup:memory:/docker/*", "cgroup:memory:/docker/*/*"}, Start: t0, End: t0.Add(30 * time.Second)}
+	if _, err := s.QueryRange(q); err == nil {
+		t.Errorf("expected error for query selecting more than %d series", s.opts.MaxQuerySeries)
+	}
+	q.Series = q.Series[:2]
+	if _, err := s.QueryRange(q); err != nil {
+		t.Errorf("expected query selecting %d series to succeed, got %v", s.opts.MaxQuerySeries, err)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	s := NewStore(&fakeWatcher{}, Options{Retention: time.Minute, Resolution: 10 * time.Second, MaxSeries: 2})
+	for _, id := range []string{"a", "b", "c"} {
+		s.add(id, nil, t0, map[string]float64{"v": 1})
+	}
+	if _, ok := s.series["c"]; ok || len(s.series) != 2 {
+		t.Errorf("expected new series beyond the limit to be dropped, got %d series", len(s.series))
+	}
+	if !s.add("a", nil, t0.Add(10*time.Second), map[string]float64{"v": 2}) {
+		t.Error("expected existing series to be recorded at the limit")
+	}
+}
+
+func TestRecordComounted(t *testing.T) {
+	throttled := 0.25
+	w := &fakeWatcher{
+		subsystems: []v1.Subsystem{
+			{Name: "cpu", Mountpoint: "/sys/fs/cgroup/cpu,cpuacct"},
+			{Name: "cpuacct", Mountpoint: "/sys/fs/cgroup/cpu,cpuacct"},
+			{Name: "memory", Mountpoint: "/sys/fs/cgroup/memory"},
+		},
+		cgroups: []*v1.Cgroup{
+			{Subsystem: "cpuacct", Path: "/a", Stats: &v1.Stats{CPUStats: &v1.CPUStats{CPUUsage: &v1.CPUUsage{TotalUsage: uint64(2 * time.Second)}}}},
+			{Subsystem: "cpu", Path: "/a", Stats: &v1.Stats{Rates: &v1.Rates{CPUThrottledRatio: &throttled}}},
+			{Subsystem: "memory", Path: "/a", Stats: &v1.Stats{MemoryStats: &v1.MemoryStats{}}},
+		},
+	}
+	s := NewStore(w, Options{Retention: time.Minute, Resolution: 10 * time.Second})
+	s.record(t0)
+
+	ser, ok := s.series["cgroup:cpu,cpuacct:/a"]
+	if !ok {
+		t.Fatalf("expected a single series of the cpu,cpuacct hierarchy, got %v", s.series)
+	}
+	if _, ok := s.series["cgroup:cpu:/a"]; ok {
+		t.Error("expected no separate cpu series")
+	}
+	if _, ok := s.series["cgroup:memory:/a"]; !ok {
+		t.Error("expected memory series")
+	}
+	if got := ser.labels["subsystem"]; got != "cpu,cpuacct" {
+		t.Errorf("expected subsystem label cpu,cpuacct, got %s", got)
+	}
+	want := map[string]float64{"cpu_usage_seconds": 2, "cpu_throttled_ratio": 0.25}
+	if got := ser.ordered(); len(got) != 1 || !reflect.DeepEqual(got[0].values, want) {
+		t.Errorf("expected a single sample with values %v, got %+v", want, got)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	pageFaults := 5.0
+	w := &fakeWatcher{cgroups: []*v1.Cgroup{{
+		Subsystem: "memory",
+		Path:      "/docker/abc",
+		Container: &v1.Container{Runtime: v1.RuntimeDocker, ID: "abc", Name: "web"},
+		Stats: &v1.Stats{
+			MemoryStats: &v1.MemoryStats{
+				Usage: v1.MemoryData{Usage: 1000},
+				Stats: map[string]uint64{"total_inactive_file": 400},
+			},
+			Rates: &v1.Rates{PageFaults: &pageFaults},
+		},
+	}}}
+	s := NewStore(w, Options{Retention: time.Minute, Resolution: 10 * time.Second})
+	s.add("process:1", nil, t0, map[string]float64{"rss": 1})
+
+	now := t0.Add(2 * time.Minute)
+	s.record(now)
+
+	if _, ok := s.series["process:1"]; ok {
+		t.Error("expected series without samples within the retention to be dropped")
+	}
+	if _, ok := s.series["node"]; !ok {
+		t.Error("expected node series to be recorded")
+	}
+
+	ser, ok := s.series["cgroup:memory:/docker/abc"]
+	if !ok {
+		t.Fatal("expected cgroup series to be recorded")
+	}
+	wantLabels := map[string]string{
+		"subsystem":      "memory",
+		"path":           "/docker/abc",
+		"container_id":   "abc",
+		"container_name": "web",
+		"runtime":        v1.RuntimeDocker,
+	}
+	if !reflect.DeepEqual(ser.labels, wantLabels) {
+		t.Errorf("expected labels %v, got %v", wantLabels, ser.labels)
+	}
+	wantValues := map[string]float64{
+		"memory_usage":           1000,
+		"memory_working_set":     600,
+		"page_faults_per_second": 5,
+	}
+	if got := ser.ordered(); len(got) != 1 || !got[0].timestamp.Equal(now) || !reflect.DeepEqual(got[0].values, wantValues) {
+		t.Errorf("expected a single sample with values %v, got %+v", wantValues, got)
+	}
+}
+
+func TestStorePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := OpenDisk(DiskOptions{Dir: dir, Tiers: []Tier{{Resolution: 10 * time.Second, Retention: 24 * time.Hour}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Two hours of rounds recorded before a restart.
+	end := time.Now().Add(-5 * time.Second)
+	start := end.Add(-2 * time.Hour)
+	for ts := start; !ts.After(end); ts = ts.Add(10 * time.Second) {
+		r := round{timestamp: ts, entries: []entry{
+			{id: "node", values: map[string]float64{"memory_used": float64(ts.Sub(start) / time.Second)}},
+		}}
+		if err := d.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewStore(&fakeWatcher{}, Options{Retention: time.Minute, Resolution: 10 * time.Second, Disk: d})
+	if got := len(s.series["node"].ordered()); got != 6 {
+		t.Errorf("expected the 6 samples within the retention to be loaded, got %d", got)
+	}
+
+	result, err := s.QueryRange(v1.RangeQuery{Series: []string{"node"}, Start: start, End: end, Step: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for _, p := range result.Series[0].Points {
+		got = append(got, p.Values["memory_used"])
+	}
+	if want := []float64{0, 3600, 7200}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v from disk, got %v", want, got)
+	}
+}
+
+func TestQueryRangeTiers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openTestDisk(t, dir, 0)
+	defer d.Close()
+
+	// Three and a half hours of rounds, of which the last half hour is not
+	// rolled up yet.
+	end := time.Now().Add(-5 * time.Second)
+	start := end.Add(-210 * time.Minute)
+	for ts := start; !ts.After(end); ts = ts.Add(10 * time.Second) {
+		r := round{timestamp: ts, entries: []entry{
+			{id: "node", values: map[string]float64{"memory_used": float64(ts.Sub(start) / time.Second)}},
+			{id: "cgroup:memory:/", values: map[string]float64{"memory_used": 1}},
+		}}
+		if err := d.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rolled := d.rolledUp(1); !rolled.Before(end.Add(-29 * time.Minute)) {
+		t.Fatalf("expected the rolled up tier to lag behind, rolled up to %v", rolled)
+	}
+
+	s := NewStore(&fakeWatcher{}, Options{Retention: time.Minute, Resolution: 10 * time.Second, Disk: d})
+	q := v1.RangeQuery{Series: []string{"node"}, Start: start, End: end, Step: time.Minute}
+	result, err := s.QueryRange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := result.Series[0].Points
+	if len(points) != 211 {
+		t.Fatalf("expected a point every minute, got %d points", len(points))
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].Values["memory_used"] < points[i-1].Values["memory_used"] {
+			t.Errorf("expected increasing values, got %v after %v", points[i].Values["memory_used"], points[i-1].Values["memory_used"])
+		}
+	}
+	if got := points[len(points)-1].Values["memory_used"]; got != 210*60 {
+		t.Errorf("expected the latest sample at the end, got %v", got)
+	}
+
+	s.opts.MaxQuerySeries = 1
+	q.Series = []string{"node", "cgroup:memory:/"}
+	if _, err := s.QueryRange(q); err == nil {
+		t.Errorf("expected error for query selecting more than %d series", s.opts.MaxQuerySeries)
+	}
+}
@@ -0,0 +1,205 @@
+package history
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// maxPoints is the maximum number of points per series a range query may
+// return.
+const maxPoints = 11000
+
+// QueryError is returned for invalid range queries.
+type QueryError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+// QueryRange returns the points of the series matching q at every step from
+// q.Start to q.End. Each point holds the latest sample taken within a step, or
+// the resolution if longer, before it. Points without such a sample are
+// omitted. Queries starting before the retention are answered from the disk
+// tier best matching the start and step, if the history is persisted, up to
+// where the tier is rolled up, then from the finer tiers and from memory.
+func (s *Store) QueryRange(q v1.RangeQuery) (*v1.RangeResult, error) {
+	if len(q.Series) == 0 {
+		return nil, &QueryError{"no series selected"}
+	}
+	for _, pattern := range q.Series {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, &QueryError{fmt.Sprintf("invalid series selector %s: %v", pattern, err)}
+		}
+	}
+
+	if q.End.IsZero() {
+		q.End = time.Now()
+	}
+	if q.Start.IsZero() {
+		q.Start = q.End.Add(-s.opts.Retention)
+	}
+	if q.Step == 0 {
+		q.Step = s.opts.Resolution
+	}
+	if q.Step <= 0 {
+		return nil, &QueryError{"step must be positive"}
+	}
+	if q.End.Before(q.Start) {
+		return nil, &QueryError{fmt.Sprintf("end %s is before start %s", q.End.Format(time.RFC3339), q.Start.Format(time.RFC3339))}
+	}
+	if points := q.End.Sub(q.Start) / q.Step; points >= maxPoints {
+		return nil, &QueryError{fmt.Sprintf("range of %d steps exceeds the maximum of %d points per series", points+1, maxPoints)}
+	}
+
+	now := time.Now()
+	fromDisk := s.opts.Disk != nil && q.Start.Before(now.Add(-s.opts.Retention))
+	tier, resolution := 0, s.opts.Resolution
+	if fromDisk {
+		tier = s.opts.Disk.tierFor(q.Start, q.Step, now)
+		resolution = s.opts.Disk.resolution(tier)
+	}
+	lookback := q.Step
+	if lookback < resolution {
+		lookback = resolution
+	}
+
+	match := func(id string) bool { return matchesAny(q.Series, id) }
+	selected := map[string]*seriesSamples{}
+	from, end := q.Start.Add(-lookback), q.End.Add(time.Nanosecond)
+	if fromDisk {
+		// Each tier holds the samples up to where it is rolled up, which
+		// lags behind the finer tiers. Samples still in memory are read
+		// from memory.
+		memoryStart := now.Add(-s.opts.Retention)
+		for t := tier; t >= 0 && from.Before(end); t-- {
+			until := memoryStart
+			if t > 0 {
+				if rolled := s.opts.Disk.rolledUp(t); rolled.Before(until) {
+					until = rolled
+				}
+			}
+			if end.Before(until) {
+				until = end
+			}
+			if !from.Before(until) {
+				continue
+			}
+			if err := s.opts.Disk.read(t, from, until, match, selected, s.opts.MaxQuerySeries); err != nil {
+				return nil, err
+			}
+			from = until
+		}
+	}
+	if from.Before(end) {
+		if err := s.memorySamples(from, match, selected); err != nil {
+			return nil, err
+		}
+	}
+	var fields map[string]bool
+	if len(q.Values) > 0 {
+		fields = map[string]bool{}
+		for _, v := range q.Values {
+			fields[v] = true
+		}
+	}
+
+	result := &v1.RangeResult{
+		Start:  q.Start,
+		End:    q.End,
+		Step:   q.Step.Seconds(),
+		Series: []v1.Series{},
+	}
+	for id, ss := range selected {
+		points := []v1.Point{}
+		for t := q.Start; !t.After(q.End); t = t.Add(q.Step) {
+			smp, ok := at(ss.samples, t, lookback)
+			if !ok {
+				continue
+			}
+			values := map[string]float64{}
+			for k, v := range smp.values {
+				if fields == nil || fields[k] {
+					values[k] = v
+				}
+			}
+			if len(values) > 0 {
+				points = append(points, v1.Point{Timestamp: t, Values: values})
+			}
+		}
+		result.Series = append(result.Series, v1.Series{ID: id, Labels: ss.labels, Points: points})
+	}
+	sort.Sort(byID(result.Series))
+
+	return result, nil
+}
+
+// seriesSamples holds the samples of a series, oldest first.
+type seriesSamples struct {
+	labels  map[string]string
+	samples []sample
+}
+
+// memorySamples adds the samples of the series in memory matching match,
+// taken from start on, to ret. It returns an error if ret would then hold more
+// than Options.MaxQuerySeries series.
+func (s *Store) memorySamples(start time.Time, match func(id string) bool, ret map[string]*seriesSamples) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	added := 0
+	for id := range s.series {
+		if match(id) {
+			ids = append(ids, id)
+			if _, ok := ret[id]; !ok {
+				added++
+			}
+		}
+	}
+	if max := s.opts.MaxQuerySeries; max > 0 && len(ret)+added > max {
+		return tooManySeries(max)
+	}
+
+	for _, id := range ids {
+		ser := s.series[id]
+		ss, ok := ret[id]
+		if !ok {
+			ss = &seriesSamples{}
+			ret[id] = ss
+		}
+		ss.labels = ser.labels
+		for _, smp := range ser.ordered() {
+			if !smp.timestamp.Before(start) {
+				ss.samples = append(ss.samples, smp)
+			}
+		}
+	}
+	return nil
+}
+
+// tooManySeries returns the error of a query selecting more than max series.
+func tooManySeries(max int) error {
+	return &QueryError{fmt.Sprintf("series selectors match more than the maximum of %d series per query", max)}
+}
+
+func matchesAny(patterns []string, id string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type byID []v1.Series
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -0,0 +1,333 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segmentExt is the file extension of segments. Segments are named after the
+// Unix time in nanoseconds of their first round, zero padded so they sort by
+// name.
+const segmentExt = ".seg"
+
+// entry is the sample of a single series in a round.
+type entry struct {
+	id     string
+	labels map[string]string
+	values map[string]float64
+}
+
+// round holds the samples of every series recorded at the same time.
+type round struct {
+	timestamp time.Time
+	entries   []entry
+}
+
+// A segment is a log of rounds, each framed by its uvarint encoded length and
+// followed by its CRC-32. Strings are interned per segment: the first use of a
+// string is written as a zero followed by its length and bytes, later uses as
+// the string's index plus one. The labels of a series are only written when
+// they changed since the previous round of the segment.
+type segmentWriter struct {
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	size    int64
+	strings map[string]uint64
+	labels  map[string]map[string]string
+}
+
+func segmentPath(dir string, start time.Time) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", start.UnixNano(), segmentExt))
+}
+
+func createSegment(dir string, start time.Time) (*segmentWriter, error) {
+	f, err := os.OpenFile(segmentPath(dir, start), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentWriter{
+		f:       f,
+		w:       bufio.NewWriter(f),
+		start:   start,
+		strings: map[string]uint64{},
+		labels:  map[string]map[string]string{},
+	}, nil
+}
+
+// append writes r and syncs it to disk. The segment must not be appended to
+// after an error, as the interned strings may no longer match the file.
+func (sw *segmentWriter) append(r round) error {
+	buf := appendVarint(nil, r.timestamp.UnixNano())
+	buf = appendUvarint(buf, uint64(len(r.entries)))
+	for _, e := range r.entries {
+		buf = sw.appendString(buf, e.id)
+
+		if prev, ok := sw.labels[e.id]; ok && reflect.DeepEqual(prev, e.labels) {
+			buf = append(buf, 0)
+		} else {
+			sw.labels[e.id] = e.labels
+			buf = append(buf, 1)
+			buf = appendUvarint(buf, uint64(len(e.labels)))
+			for _, k := range sortedKeys(e.labels) {
+				buf = sw.appendString(buf, k)
+				buf = sw.appendString(buf, e.labels[k])
+			}
+		}
+
+		names := make([]string, 0, len(e.values))
+		for k := range e.values {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		buf = appendUvarint(buf, uint64(len(names)))
+		for _, k := range names {
+			buf = sw.appendString(buf, k)
+			buf = appendUint64(buf, math.Float64bits(e.values[k]))
+		}
+	}
+
+	frame := appendUvarint(nil, uint64(len(buf)))
+	frame = append(frame, buf...)
+	frame = appendUint32(frame, crc32.ChecksumIEEE(buf))
+	if _, err := sw.w.Write(frame); err != nil {
+		return err
+	}
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	sw.size += int64(len(frame))
+	return sw.f.Sync()
+}
+
+func (sw *segmentWriter) appendString(buf []byte, s string) []byte {
+	if i, ok := sw.strings[s]; ok {
+		return appendUvarint(buf, i+1)
+	}
+	sw.strings[s] = uint64(len(sw.strings))
+	buf = append(buf, 0)
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func (sw *segmentWriter) close() error {
+	err := sw.w.Flush()
+	if cerr := sw.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errCorrupt = errors.New("corrupt segment")
+
+// readSegment returns the rounds of the segment at path. Reading stops at the
+// first incomplete or corrupt round, e.g. one torn by a crash, returning the
+// rounds before it together with errCorrupt.
+func readSegment(path string) ([]round, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		rounds   []round
+		interned []string
+		labels   = map[string]map[string]string{}
+	)
+	for len(b) > 0 {
+		n, l := binary.Uvarint(b)
+		if l <= 0 || uint64(len(b)-l) < n+4 {
+			return rounds, errCorrupt
+		}
+		payload := b[l : l+int(n)]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(b[l+int(n):]) {
+			return rounds, errCorrupt
+		}
+		b = b[l+int(n)+4:]
+
+		d := &decoder{b: payload, strings: interned}
+		r := d.round(labels)
+		if d.err != nil {
+			return rounds, errCorrupt
+		}
+		interned = d.strings
+		rounds = append(rounds, r)
+	}
+	return rounds, nil
+}
+
+// decoder decodes a single round, recording the first error.
+type decoder struct {
+	b       []byte
+	strings []string
+	err     error
+}
+
+func (d *decoder) round(labels map[string]map[string]string) round {
+	r := round{timestamp: time.Unix(0, d.varint())}
+	n := d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		e := entry{id: d.string()}
+
+		if d.byte() == 1 {
+			m := map[string]string{}
+			for j, nl := uint64(0), d.uvarint(); j < nl && d.err == nil; j++ {
+				k := d.string()
+				m[k] = d.string()
+			}
+			labels[e.id] = m
+		}
+		e.labels = labels[e.id]
+
+		e.values = map[string]float64{}
+		for j, nv := uint64(0), d.uvarint(); j < nv && d.err == nil; j++ {
+			k := d.string()
+			e.values[k] = d.float()
+		}
+		r.entries = append(r.entries, e)
+	}
+	return r
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errCorrupt
+	}
+	d.b = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decoder) float() float64 {
+	if len(d.b) < 8 {
+		d.fail()
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) string() string {
+	ref := d.uvarint()
+	if ref > 0 {
+		if ref > uint64(len(d.strings)) {
+			d.fail()
+			return ""
+		}
+		return d.strings[ref-1]
+	}
+	n := d.uvarint()
+	if uint64(len(d.b)) < n {
+		d.fail()
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	d.strings = append(d.strings, s)
+	return s
+}
+
+// segmentInfo describes a segment file of a tier.
+type segmentInfo struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+// listSegments returns the segments in dir, oldest first.
+func listSegments(dir string) ([]segmentInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segmentInfo
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segmentInfo{
+			path:  filepath.Join(dir, name),
+			start: time.Unix(0, nanos),
+			size:  fi.Size(),
+		})
+	}
+	// ReadDir sorts by name, which sorts by start time.
+	return segments, nil
+}
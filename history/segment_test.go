@@ -0,0 +1,108 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testRounds() []round {
+	return []round{
+		{timestamp: t0, entries: []entry{
+			{id: "node", labels: map[string]string{}, values: map[string]float64{"memory_used": 1}},
+			{id: "cgroup:memory:/a", labels: map[string]string{"path": "/a"}, values: map[string]float64{"memory_usage": 2, "tasks": 3}},
+		}},
+		{timestamp: t0.Add(10 * time.Second), entries: []entry{
+			{id: "cgroup:memory:/a", labels: map[string]string{"path": "/a"}, values: map[string]float64{"memory_usage": 4.5}},
+		}},
+		{timestamp: t0.Add(20 * time.Second), entries: []entry{
+			{id: "cgroup:memory:/a", labels: map[string]string{"path": "/a", "pod": "web"}, values: map[string]float64{"memory_usage": 5}},
+		}},
+	}
+}
+
+func writeTestSegment(t *testing.T, dir string, rounds []round) string {
+	w, err := createSegment(dir, rounds[0].timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rounds {
+		if err := w.append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	return segmentPath(dir, rounds[0].timestamp)
+}
+
+func TestSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := testRounds()
+	path := writeTestSegment(t, dir, want)
+
+	got, err := readSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d rounds, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !got[i].timestamp.Equal(want[i].timestamp) {
+			t.Errorf("round %d: expected timestamp %v, got %v", i, want[i].timestamp, got[i].timestamp)
+		}
+		if !reflect.DeepEqual(got[i].entries, want[i].entries) {
+			t.Errorf("round %d: expected entries %+v, got %+v", i, want[i].entries, got[i].entries)
+		}
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].path != path || !segments[0].start.Equal(t0) {
+		t.Errorf("expected segment %s starting at %v, got %+v", path, t0, segments)
+	}
+}
+
+func TestSegmentTorn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wurzel-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTestSegment(t, dir, testRounds())
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A round torn by a crash.
+	if err := ioutil.WriteFile(path, b[:len(b)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	rounds, err := readSegment(path)
+	if err != errCorrupt || len(rounds) != 2 {
+		t.Errorf("expected 2 rounds and errCorrupt, got %d rounds and %v", len(rounds), err)
+	}
+
+	// A round with a bad checksum.
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rounds, err = readSegment(path)
+	if err != errCorrupt || len(rounds) != 2 {
+		t.Errorf("expected 2 rounds and errCorrupt, got %d rounds and %v", len(rounds), err)
+	}
+}
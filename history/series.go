@@ -0,0 +1,152 @@
+package history
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+type sample struct {
+	timestamp time.Time
+	values    map[string]float64
+}
+
+// series is a ring buffer of the latest samples of a single series. Samples
+// are stored column-wise, as a column of timestamps and a column per value
+// name, with NaN marking values missing from a sample. The columns grow as
+// samples are added, up to the capacity.
+type series struct {
+	labels     map[string]string
+	capacity   int
+	timestamps []int64
+	names      []string
+	columns    [][]float64
+	// next is the index the next sample is written to.
+	next int
+	full bool
+}
+
+func newSeries(capacity int) *series {
+	return &series{capacity: capacity}
+}
+
+func (s *series) add(timestamp time.Time, values map[string]float64) {
+	for name := range values {
+		if s.column(name) < 0 {
+			col := make([]float64, len(s.timestamps), cap(s.timestamps))
+			for i := range col {
+				col[i] = math.NaN()
+			}
+			s.names = append(s.names, name)
+			s.columns = append(s.columns, col)
+		}
+	}
+
+	if !s.full && s.next == len(s.timestamps) {
+		s.grow()
+		s.timestamps = s.timestamps[:s.next+1]
+		for i := range s.columns {
+			s.columns[i] = s.columns[i][:s.next+1]
+		}
+	}
+	s.timestamps[s.next] = timestamp.UnixNano()
+	for i, name := range s.names {
+		v, ok := values[name]
+		if !ok {
+			v = math.NaN()
+		}
+		s.columns[i][s.next] = v
+	}
+
+	s.next++
+	if s.next == s.capacity {
+		s.next = 0
+		s.full = true
+	}
+}
+
+// grow makes room for at least one more sample in every column, doubling
+// the columns up to the capacity.
+func (s *series) grow() {
+	if len(s.timestamps) < cap(s.timestamps) {
+		return
+	}
+	n := 2 * cap(s.timestamps)
+	if n == 0 {
+		n = 1
+	}
+	if n > s.capacity {
+		n = s.capacity
+	}
+	timestamps := make([]int64, len(s.timestamps), n)
+	copy(timestamps, s.timestamps)
+	s.timestamps = timestamps
+	for i, col := range s.columns {
+		s.columns[i] = make([]float64, len(col), n)
+		copy(s.columns[i], col)
+	}
+}
+
+// column returns the index of the column of name, or -1 if there is none.
+func (s *series) column(name string) int {
+	for i, n := range s.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// sample returns the sample at index i of the columns.
+func (s *series) sample(i int) sample {
+	smp := sample{
+		timestamp: time.Unix(0, s.timestamps[i]).UTC(),
+		values:    make(map[string]float64, len(s.names)),
+	}
+	for j, name := range s.names {
+		if v := s.columns[j][i]; !math.IsNaN(v) {
+			smp.values[name] = v
+		}
+	}
+	return smp
+}
+
+// ordered returns the samples, oldest first.
+func (s *series) ordered() []sample {
+	ret := make([]sample, 0, len(s.timestamps))
+	if s.full {
+		for i := s.next; i < len(s.timestamps); i++ {
+			ret = append(ret, s.sample(i))
+		}
+	}
+	for i := 0; i < s.next; i++ {
+		ret = append(ret, s.sample(i))
+	}
+	return ret
+}
+
+// latest returns the time of the latest sample.
+func (s *series) latest() time.Time {
+	i := s.next - 1
+	if i < 0 {
+		if !s.full {
+			return time.Time{}
+		}
+		i = len(s.timestamps) - 1
+	}
+	return time.Unix(0, s.timestamps[i]).UTC()
+}
+
+// at returns the latest of samples, ordered oldest first, taken at or before t
+// and after t-lookback.
+func at(samples []sample, t time.Time, lookback time.Duration) (sample, bool) {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].timestamp.After(t) })
+	if i == 0 {
+		return sample{}, false
+	}
+	smp := samples[i-1]
+	if !smp.timestamp.After(t.Add(-lookback)) {
+		return sample{}, false
+	}
+	return smp, true
+}
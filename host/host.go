@@ -0,0 +1,70 @@
+// Package host locates the host's proc and sys filesystems, which are mounted
+// elsewhere, e.g. below /host, when wurzel runs in a container.
+package host
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	mu   sync.RWMutex
+	proc = "/proc"
+	sys  = "/sys"
+)
+
+// SetProc sets where the host's /proc is mounted. It is also exported as
+// HOST_PROC, which the gopsutil readers used by the node and process packages
+// respect.
+func SetProc(path string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	proc = filepath.Clean(path)
+	return os.Setenv("HOST_PROC", proc)
+}
+
+// SetSys sets where the host's /sys is mounted. It is also exported as
+// HOST_SYS for gopsutil.
+func SetSys(path string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	sys = filepath.Clean(path)
+	return os.Setenv("HOST_SYS", sys)
+}
+
+// Proc returns the path of elem within the host's /proc.
+func Proc(elem ...string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return filepath.Join(append([]string{proc}, elem...)...)
+}
+
+// Sys returns the path of elem within the host's /sys.
+func Sys(elem ...string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return filepath.Join(append([]string{sys}, elem...)...)
+}
+
+// Relocated returns true if the host's /proc is mounted elsewhere, so mounts
+// listed in it are relative to the host's root rather than this process'.
+func Relocated() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return proc != "/proc"
+}
+
+// Translate returns where a path on the host, e.g. a mount point listed in
+// the host's mountinfo, is found by this process: paths below /proc and /sys
+// are moved below the host's proc and sys mounts, others are unchanged.
+func Translate(path string) string {
+	path = filepath.Clean(path)
+	for _, root := range []struct{ host, local string }{{"/proc", Proc()}, {"/sys", Sys()}} {
+		if path == root.host || strings.HasPrefix(path, root.host+"/") {
+			return root.local + strings.TrimPrefix(path, root.host)
+		}
+	}
+	return path
+}
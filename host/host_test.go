@@ -0,0 +1,43 @@
+package host
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	defer SetProc("/proc")
+	defer SetSys("/sys")
+
+	if Relocated() {
+		t.Error("expected /proc not to be relocated by default")
+	}
+	if err := SetProc("/host/proc/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSys("/host/sys"); err != nil {
+		t.Fatal(err)
+	}
+	if !Relocated() {
+		t.Error("expected /proc to be relocated")
+	}
+	if got := os.Getenv("HOST_PROC"); got != "/host/proc" {
+		t.Errorf("expected HOST_PROC /host/proc, got %s", got)
+	}
+
+	tests := map[string]string{
+		"/sys/fs/cgroup/memory": "/host/sys/fs/cgroup/memory",
+		"/sys":                  "/host/sys",
+		"/proc/1/mountinfo":     "/host/proc/1/mountinfo",
+		"/system":               "/system",
+		"/var/lib/docker":       "/var/lib/docker",
+	}
+	for path, want := range tests {
+		if got := Translate(path); got != want {
+			t.Errorf("expected %s to translate to %s, got %s", path, want, got)
+		}
+	}
+	if got := Proc("1", "cgroup"); got != "/host/proc/1/cgroup" {
+		t.Errorf("unexpected proc path %s", got)
+	}
+}
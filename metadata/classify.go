@@ -0,0 +1,32 @@
+package metadata
+
+import (
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// classified attaches the container identified by a cgroup.Classifier to
+// cgroups no other provider attached a container to.
+type classified struct {
+	classifier cgroup.Classifier
+}
+
+// NewClassified returns a provider identifying containers from cgroup paths
+// with c. It should come after providers looking up richer metadata, as it
+// only decorates cgroups without a container.
+func NewClassified(c cgroup.Classifier) Provider {
+	return &classified{classifier: c}
+}
+
+// Decorate implements Provider.
+func (p *classified) Decorate(cg *v1.Cgroup) {
+	if cg.Container != nil {
+		return
+	}
+	if c, ok := p.classifier.Classify(cg.Path); ok {
+		cg.Container = c
+	}
+}
+
+// HandleEvent implements Provider.
+func (p *classified) HandleEvent(e *v1.Event) {}
@@ -0,0 +1,32 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+func TestClassified(t *testing.T) {
+	p := NewClassified(cgroup.DefaultRules)
+
+	cg := &v1.Cgroup{Path: "/lxc/web"}
+	p.Decorate(cg)
+	if cg.Container == nil || cg.Container.Runtime != v1.RuntimeLXC || cg.Container.Name != "web" {
+		t.Errorf("expected LXC container, got %#v", cg.Container)
+	}
+
+	// Containers attached by other providers are kept.
+	docker := &v1.Container{Runtime: v1.RuntimeDocker, ID: testContainerID, Name: "web"}
+	cg = &v1.Cgroup{Path: "/docker/" + testContainerID, Container: docker}
+	p.Decorate(cg)
+	if cg.Container != docker {
+		t.Errorf("expected existing container to be kept, got %#v", cg.Container)
+	}
+
+	cg = &v1.Cgroup{Path: "/system.slice"}
+	p.Decorate(cg)
+	if cg.Container != nil {
+		t.Errorf("expected no container, got %#v", cg.Container)
+	}
+}
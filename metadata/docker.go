@@ -0,0 +1,222 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// dockerContainer is the subset of the Docker Engine API container inspect
+// response used.
+type dockerContainer struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Running   bool      `json:"Running"`
+		StartedAt time.Time `json:"StartedAt"`
+	} `json:"State"`
+}
+
+// Backoff between retries of failed or incomplete container lookups, doubling
+// with every retry.
+const (
+	dockerRetryMin = time.Second
+	dockerRetryMax = 5 * time.Minute
+)
+
+// dockerLookup is the cached result of inspecting a container.
+type dockerLookup struct {
+	// container is nil while the lookup is in progress, or if the container
+	// is not known to Docker.
+	container *v1.Container
+	fetching  bool
+	// retryAt is when a failed or incomplete lookup is retried, zero once
+	// complete.
+	retryAt  time.Time
+	failures uint
+}
+
+// Docker provides metadata for Docker containers by querying the Docker
+// Engine API.
+type Docker struct {
+	client  *http.Client
+	baseURL string
+
+	mu sync.Mutex
+	// containers is keyed by container ID.
+	containers map[string]*dockerLookup
+}
+
+// NewDocker returns a provider querying the Docker Engine API at endpoint,
+// e.g. unix:///var/run/docker.sock or tcp://localhost:2375.
+func NewDocker(endpoint string) (*Docker, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Docker{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		containers: map[string]*dockerLookup{},
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		d.client.Transport = &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.DialTimeout("unix", socket, 10*time.Second)
+			},
+		}
+		d.baseURL = "http://docker"
+	case "tcp", "http":
+		d.baseURL = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported Docker endpoint %s", endpoint)
+	}
+
+	return d, nil
+}
+
+// dockerID returns the ID of the Docker container running in the cgroup at
+// path, if any, with the cgroupfs driver (/docker/<id>) and the systemd driver
+// (/system.slice/docker-<id>.scope). Bare IDs elsewhere, e.g. of Kubernetes
+// pods with the cgroupfs driver, may belong to any runtime, so are left to
+// the other providers rather than looked up with Docker.
+func dockerID(cgroupPath string) (string, bool) {
+	runtime, id, ok := cgroup.ParseContainerName(path.Base(cgroupPath))
+	if runtime == "" && path.Dir(cgroupPath) == "/docker" {
+		runtime = v1.RuntimeDocker
+	}
+	if !ok || runtime != v1.RuntimeDocker {
+		return "", false
+	}
+	return id, true
+}
+
+// Decorate implements Provider.
+func (d *Docker) Decorate(cg *v1.Cgroup) {
+	id, ok := dockerID(cg.Path)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lookup, ok := d.containers[id]
+	if !ok {
+		lookup = &dockerLookup{}
+		d.containers[id] = lookup
+	}
+	if !lookup.fetching && (!ok || !lookup.retryAt.IsZero() && !time.Now().Before(lookup.retryAt)) {
+		lookup.fetching = true
+		go d.fetch(id, lookup)
+	}
+	if lookup.container != nil {
+		cg.Container = lookup.container
+	}
+}
+
+// HandleEvent implements Provider.
+func (d *Docker) HandleEvent(e *v1.Event) {
+	if e.Type != v1.EventCgroupCreated && e.Type != v1.EventCgroupRemoved {
+		return
+	}
+
+	id, ok := dockerID(e.Path)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	delete(d.containers, id)
+	d.mu.Unlock()
+}
+
+func (d *Docker) fetch(id string, lookup *dockerLookup) {
+	container, err := d.inspect(id)
+	if err != nil {
+		log.WithFields(log.Fields{"container": id, "error": err}).Warn("Failed to inspect Docker container")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lookup.fetching = false
+	if container != nil {
+		lookup.container = container
+	}
+	// Back off from retrying failed lookups, and those of containers that
+	// have not started yet so their start time is set, unless the container
+	// is known, or known not to exist.
+	if err != nil || (container != nil && container.StartedAt.IsZero()) {
+		lookup.retryAt = time.Now().Add(dockerRetry(lookup.failures))
+		lookup.failures++
+		return
+	}
+	lookup.retryAt = time.Time{}
+}
+
+// dockerRetry returns the backoff before retrying a lookup that failed the
+// given number of times before.
+func dockerRetry(failures uint) time.Duration {
+	if failures >= 10 {
+		return dockerRetryMax
+	}
+	backoff := dockerRetryMin << failures
+	if backoff > dockerRetryMax {
+		return dockerRetryMax
+	}
+	return backoff
+}
+
+// inspect returns the container with the given ID, or nil if Docker does not
+// know it.
+func (d *Docker) inspect(id string) (*v1.Container, error) {
+	resp, err := d.client.Get(d.baseURL + "/containers/" + id + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	var c dockerContainer
+	err = json.NewDecoder(resp.Body).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &v1.Container{
+		Runtime: v1.RuntimeDocker,
+		ID:      c.ID,
+		Name:    strings.TrimPrefix(c.Name, "/"),
+		Image:   c.Config.Image,
+		Labels:  c.Config.Labels,
+	}
+	if c.State.Running {
+		container.StartedAt = c.State.StartedAt
+	}
+	return container, nil
+}
@@ -0,0 +1,212 @@
+package metadata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+const testContainerID = "3f9a6c2b1e8d4f7a9c0b5e2d1a8f4c7b3e6d9a2c5f8b1e4d7a0c3f6b9e2d5a8c"
+
+// failingContainerID is inspected with a server error.
+var failingContainerID = strings.Repeat("f", 64)
+
+// fakeDocker serves the container inspect endpoint on a unix socket.
+type fakeDocker struct {
+	*httptest.Server
+	dir      string
+	requests int32
+}
+
+func newFakeDocker(t *testing.T) *fakeDocker {
+	dir, err := ioutil.TempDir("", "wurzel-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	f := &fakeDocker{dir: dir}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.requests, 1)
+		if r.URL.Path == "/containers/"+failingContainerID+"/json" {
+			http.Error(rw, "server error", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path != "/containers/"+testContainerID+"/json" {
+			http.NotFound(rw, r)
+			return
+		}
+		fmt.Fprintf(rw, `{
+			"Id": %q,
+			"Name": "/web",
+			"Config": {"Image": "nginx:1.9", "Labels": {"app": "web"}},
+			"State": {"Running": true, "StartedAt": "2016-03-01T10:00:00.5Z"}
+		}`, testContainerID)
+	}))
+	f.Listener = l
+	f.Start()
+	return f
+}
+
+func (f *fakeDocker) endpoint() string {
+	return "unix://" + filepath.Join(f.dir, "docker.sock")
+}
+
+func (f *fakeDocker) Close() {
+	f.Server.Close()
+	os.RemoveAll(f.dir)
+}
+
+func TestDockerID(t *testing.T) {
+	for path, want := range map[string]string{
+		"/docker/" + testContainerID:                         testContainerID,
+		"/system.slice/docker-" + testContainerID + ".scope": testContainerID,
+		"/kubepods/burstable/pod1234/" + testContainerID:     "",
+		"/docker/" + testContainerID + "/" + testContainerID: "",
+		"/docker":                      "",
+		"/system.slice/docker.service": "",
+		"/docker/" + strings.ToUpper(testContainerID):        "",
+		"/docker/" + testContainerID[:12]:                    "",
+		"/system.slice/docker-" + testContainerID + ".mount": "",
+	} {
+		id, ok := dockerID(path)
+		if id != want || ok != (want != "") {
+			t.Errorf("%s: expected %q, got %q (%v)", path, want, id, ok)
+		}
+	}
+}
+
+// decorate calls Decorate until the cgroup has container metadata, or times
+// out.
+func decorate(t *testing.T, d *Docker, cg *v1.Cgroup) {
+	timeout := time.After(5 * time.Second)
+	for {
+		d.Decorate(cg)
+		if cg.Container != nil {
+			return
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("timed out waiting for container metadata for %s", cg.Path)
+		}
+	}
+}
+
+func TestDocker(t *testing.T) {
+	f := newFakeDocker(t)
+	defer f.Close()
+
+	d, err := NewDocker(f.endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cg := &v1.Cgroup{Path: "/docker/" + testContainerID}
+	decorate(t, d, cg)
+	want := &v1.Container{
+		Runtime:   v1.RuntimeDocker,
+		ID:        testContainerID,
+		Name:      "web",
+		Image:     "nginx:1.9",
+		Labels:    map[string]string{"app": "web"},
+		StartedAt: time.Date(2016, 3, 1, 10, 0, 0, 5e8, time.UTC),
+	}
+	if cg.Container.Name != want.Name || cg.Container.Image != want.Image || cg.Container.Labels["app"] != "web" || !cg.Container.StartedAt.Equal(want.StartedAt) {
+		t.Errorf("expected %#v, got %#v", want, cg.Container)
+	}
+
+	// Cached until invalidated.
+	requests := atomic.LoadInt32(&f.requests)
+	decorate(t, d, &v1.Cgroup{Path: "/system.slice/docker-" + testContainerID + ".scope"})
+	if got := atomic.LoadInt32(&f.requests); got != requests {
+		t.Errorf("expected cached metadata, got %d requests", got-requests)
+	}
+
+	d.HandleEvent(&v1.Event{Type: v1.EventCgroupRemoved, Path: "/docker/" + testContainerID})
+	decorate(t, d, &v1.Cgroup{Path: "/docker/" + testContainerID})
+	if got := atomic.LoadInt32(&f.requests); got != requests+1 {
+		t.Errorf("expected metadata to be fetched again after removal, got %d requests", got-requests)
+	}
+
+	// Unknown containers are cached too.
+	unknown := &v1.Cgroup{Path: "/docker/" + strings.Repeat("0", 64)}
+	d.Decorate(unknown)
+	time.Sleep(100 * time.Millisecond)
+	d.Decorate(unknown)
+	if unknown.Container != nil {
+		t.Errorf("expected no metadata for unknown container, got %#v", unknown.Container)
+	}
+	if got := atomic.LoadInt32(&f.requests); got != requests+2 {
+		t.Errorf("expected a single request for unknown container, got %d requests", got-requests-1)
+	}
+}
+
+func TestDockerBackoff(t *testing.T) {
+	f := newFakeDocker(t)
+	defer f.Close()
+
+	d, err := NewDocker(f.endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := &v1.Cgroup{Path: "/docker/" + failingContainerID}
+	d.Decorate(failing)
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		d.Decorate(failing)
+	}
+	if got := atomic.LoadInt32(&f.requests); got != 1 {
+		t.Errorf("expected failed lookup to be retried after backing off, got %d requests", got)
+	}
+
+	d.mu.Lock()
+	d.containers[failingContainerID].retryAt = time.Now()
+	d.mu.Unlock()
+	d.Decorate(failing)
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&f.requests); got != 2 {
+		t.Errorf("expected failed lookup to be retried once due, got %d requests", got)
+	}
+	d.mu.Lock()
+	if got := d.containers[failingContainerID].failures; got != 2 {
+		t.Errorf("expected 2 failures, got %d", got)
+	}
+	d.mu.Unlock()
+}
+
+func TestDockerRetry(t *testing.T) {
+	for failures, want := range map[uint]time.Duration{
+		0:  time.Second,
+		1:  2 * time.Second,
+		5:  32 * time.Second,
+		9:  dockerRetryMax,
+		64: dockerRetryMax,
+	} {
+		if got := dockerRetry(failures); got != want {
+			t.Errorf("%d failures: expected %v, got %v", failures, want, got)
+		}
+	}
+}
+
+func TestNewDockerInvalidEndpoint(t *testing.T) {
+	_, err := NewDocker("ftp://localhost")
+	if err == nil {
+		t.Error("expected error for unsupported endpoint")
+	}
+}
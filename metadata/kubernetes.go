@@ -0,0 +1,282 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// minPodsRefreshInterval limits how often pods are fetched from the kubelet
+// when cgroups of unknown pods are seen.
+const minPodsRefreshInterval = 10 * time.Second
+
+var (
+	// kubePodName matches pod cgroup names with the cgroupfs driver
+	// (pod<uid>) and the systemd driver (kubepods-burstable-pod<uid>.slice,
+	// with dashes in the uid replaced by underscores).
+	kubePodName = regexp.MustCompile(`^(?:kubepods-(?:burstable-|besteffort-)?)?pod([0-9a-f_-]+)(?:\.slice)?$`)
+
+	// containerRuntimes maps the runtimes of kubelet container IDs, in the
+	// form <runtime>://<id>.
+	containerRuntimes = map[string]string{
+		"docker":     v1.RuntimeDocker,
+		"containerd": v1.RuntimeContainerd,
+		"cri-o":      v1.RuntimeCRIO,
+	}
+)
+
+// kubePath is a cgroup path parsed by parseKubepodsPath.
+type kubePath struct {
+	podUID      string
+	qosClass    string
+	runtime     string
+	containerID string
+}
+
+// parseKubepodsPath parses the cgroups the kubelet creates for pods, e.g.
+// /kubepods/burstable/pod<uid>/<container id> or
+// /kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod<uid>.slice/docker-<id>.scope.
+// The container ID is empty for pod level cgroups.
+func parseKubepodsPath(path string) (kubePath, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	i := 0
+	for i < len(segments) && segments[i] != "kubepods" && segments[i] != "kubepods.slice" {
+		i++
+	}
+	if i == len(segments) {
+		return kubePath{}, false
+	}
+
+	p := kubePath{qosClass: v1.QOSGuaranteed}
+	for i++; i < len(segments); i++ {
+		switch strings.TrimSuffix(segments[i], ".slice") {
+		case "burstable", "kubepods-burstable":
+			p.qosClass = v1.QOSBurstable
+			continue
+		case "besteffort", "kubepods-besteffort":
+			p.qosClass = v1.QOSBestEffort
+			continue
+		}
+
+		m := kubePodName.FindStringSubmatch(segments[i])
+		if m == nil {
+			return kubePath{}, false
+		}
+		p.podUID = strings.Replace(m[1], "_", "-", -1)
+
+		if i+1 < len(segments) {
+			runtime, id, ok := cgroup.ParseContainerName(segments[i+1])
+			if !ok {
+				return kubePath{}, false
+			}
+			p.runtime, p.containerID = runtime, id
+		}
+		return p, true
+	}
+
+	return kubePath{}, false
+}
+
+// kubePodList is the subset of the kubelet /pods response used.
+type kubePodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			UID       string            `json:"uid"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Status struct {
+			QOSClass          string `json:"qosClass"`
+			ContainerStatuses []struct {
+				Name        string `json:"name"`
+				Image       string `json:"image"`
+				ContainerID string `json:"containerID"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type kubePod struct {
+	pod v1.Pod
+	// containers is keyed by container ID.
+	containers map[string]*v1.Container
+}
+
+// Kubernetes attributes cgroups created by the kubelet to pods, optionally
+// enriched with pod metadata from the kubelet.
+type Kubernetes struct {
+	source string
+	client *http.Client
+
+	mu          sync.Mutex
+	pods        map[string]*kubePod
+	lastRefresh time.Time
+	refreshing  bool
+	// stale is set when new pod cgroups are created, allowing an immediate
+	// refresh.
+	stale bool
+}
+
+// NewKubernetes returns a provider attributing cgroups to pods. Pod metadata
+// is read from source, either the kubelet's read-only /pods endpoint, e.g.
+// http://localhost:10255/pods, or a file holding the same response. Only the
+// pod UID and QoS class parsed from the cgroup path are provided if source is
+// empty.
+func NewKubernetes(source string) *Kubernetes {
+	return &Kubernetes{
+		source: source,
+		client: &http.Client{Timeout: 10 * time.Second},
+		pods:   map[string]*kubePod{},
+	}
+}
+
+// Decorate implements Provider.
+func (k *Kubernetes) Decorate(cg *v1.Cgroup) {
+	p, ok := parseKubepodsPath(cg.Path)
+	if !ok {
+		return
+	}
+
+	pod := v1.Pod{UID: p.podUID, QOSClass: p.qosClass}
+	var container *v1.Container
+
+	k.mu.Lock()
+	if kp, ok := k.pods[p.podUID]; ok {
+		pod = kp.pod
+		container = kp.containers[p.containerID]
+	} else {
+		k.refresh()
+	}
+	k.mu.Unlock()
+
+	cg.Pod = &pod
+	if p.containerID == "" || cg.Container != nil {
+		return
+	}
+	if container == nil {
+		container = &v1.Container{Runtime: p.runtime, ID: p.containerID}
+	}
+	cg.Container = container
+}
+
+// HandleEvent implements Provider.
+func (k *Kubernetes) HandleEvent(e *v1.Event) {
+	if e.Type != v1.EventCgroupCreated && e.Type != v1.EventCgroupRemoved {
+		return
+	}
+
+	p, ok := parseKubepodsPath(e.Path)
+	if !ok {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if e.Type == v1.EventCgroupCreated {
+		k.stale = true
+	} else if p.containerID == "" {
+		delete(k.pods, p.podUID)
+	}
+}
+
+// refresh fetches pods in the background, unless already fetching or fetched
+// recently. Callers must hold mu.
+func (k *Kubernetes) refresh() {
+	if k.source == "" || k.refreshing {
+		return
+	}
+	if !k.stale && time.Since(k.lastRefresh) < minPodsRefreshInterval {
+		return
+	}
+	k.refreshing = true
+
+	go func() {
+		pods, err := k.fetch()
+		if err != nil {
+			log.WithFields(log.Fields{"source": k.source, "error": err}).Warn("Failed to fetch pods")
+		}
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if err == nil {
+			k.pods = pods
+		}
+		k.lastRefresh = time.Now()
+		k.refreshing = false
+		k.stale = false
+	}()
+}
+
+func (k *Kubernetes) fetch() (map[string]*kubePod, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://") {
+		b, err = k.get()
+	} else {
+		b, err = ioutil.ReadFile(k.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list kubePodList
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := make(map[string]*kubePod, len(list.Items))
+	for _, item := range list.Items {
+		kp := &kubePod{
+			pod: v1.Pod{
+				UID:       item.Metadata.UID,
+				Name:      item.Metadata.Name,
+				Namespace: item.Metadata.Namespace,
+				QOSClass:  item.Status.QOSClass,
+				Labels:    item.Metadata.Labels,
+			},
+			containers: map[string]*v1.Container{},
+		}
+		for _, status := range item.Status.ContainerStatuses {
+			// Container IDs are in the form <runtime>://<id>.
+			spl := strings.SplitN(status.ContainerID, "://", 2)
+			if len(spl) != 2 {
+				continue
+			}
+			kp.containers[spl[1]] = &v1.Container{
+				Runtime: containerRuntimes[spl[0]],
+				ID:      spl[1],
+				Name:    status.Name,
+				Image:   status.Image,
+			}
+		}
+		pods[kp.pod.UID] = kp
+	}
+	return pods, nil
+}
+
+func (k *Kubernetes) get() ([]byte, error) {
+	resp, err := k.client.Get(k.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,131 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+const testPodUID = "2c7d4b1e-8f3a-11e6-9d2b-42010a800002"
+
+func TestParseKubepodsPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want kubePath
+		ok   bool
+	}{
+		{"/kubepods/pod" + testPodUID, kubePath{podUID: testPodUID, qosClass: v1.QOSGuaranteed}, true},
+		{"/kubepods/burstable/pod" + testPodUID + "/" + testContainerID, kubePath{podUID: testPodUID, qosClass: v1.QOSBurstable, containerID: testContainerID}, true},
+		{"/kubepods/besteffort/pod" + testPodUID, kubePath{podUID: testPodUID, qosClass: v1.QOSBestEffort}, true},
+		{
+			"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod2c7d4b1e_8f3a_11e6_9d2b_42010a800002.slice/docker-" + testContainerID + ".scope",
+			kubePath{podUID: testPodUID, qosClass: v1.QOSBurstable, runtime: v1.RuntimeDocker, containerID: testContainerID},
+			true,
+		},
+		{
+			"/kubepods.slice/kubepods-pod2c7d4b1e_8f3a_11e6_9d2b_42010a800002.slice/cri-containerd-" + testContainerID + ".scope",
+			kubePath{podUID: testPodUID, qosClass: v1.QOSGuaranteed, runtime: v1.RuntimeContainerd, containerID: testContainerID},
+			true,
+		},
+		{"/kubepods", kubePath{}, false},
+		{"/kubepods/burstable", kubePath{}, false},
+		{"/docker/" + testContainerID, kubePath{}, false},
+		{"/kubepods/burstable/pod" + testPodUID + "/unknown", kubePath{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseKubepodsPath(test.path)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v (%v), got %#v (%v)", test.path, test.want, test.ok, got, ok)
+		}
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	f, err := ioutil.TempFile("", "wurzel-pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{
+		"kind": "PodList",
+		"items": [{
+			"metadata": {"name": "web-1", "namespace": "prod", "uid": "` + testPodUID + `", "labels": {"app": "web"}},
+			"status": {
+				"qosClass": "Burstable",
+				"containerStatuses": [{"name": "nginx", "image": "nginx:1.9", "containerID": "docker://` + testContainerID + `"}]
+			}
+		}]
+	}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := NewKubernetes(f.Name())
+	cg := &v1.Cgroup{Path: "/kubepods/burstable/pod" + testPodUID + "/" + testContainerID}
+
+	// Only the path is known until pods have been fetched.
+	k.Decorate(cg)
+	if cg.Pod == nil || cg.Pod.UID != testPodUID || cg.Pod.QOSClass != v1.QOSBurstable {
+		t.Errorf("unexpected pod: %#v", cg.Pod)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for cg.Pod.Name == "" {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for pod metadata")
+		}
+		cg = &v1.Cgroup{Path: cg.Path}
+		k.Decorate(cg)
+	}
+
+	want := &v1.Pod{UID: testPodUID, Name: "web-1", Namespace: "prod", QOSClass: v1.QOSBurstable, Labels: map[string]string{"app": "web"}}
+	if !reflect.DeepEqual(cg.Pod, want) {
+		t.Errorf("expected pod %#v, got %#v", want, cg.Pod)
+	}
+	wantContainer := &v1.Container{Runtime: v1.RuntimeDocker, ID: testContainerID, Name: "nginx", Image: "nginx:1.9"}
+	if !reflect.DeepEqual(cg.Container, wantContainer) {
+		t.Errorf("expected container %#v, got %#v", wantContainer, cg.Container)
+	}
+
+	// Metadata from other providers is kept.
+	docker := &v1.Container{Runtime: v1.RuntimeDocker, ID: testContainerID, Name: "k8s_nginx"}
+	cg = &v1.Cgroup{Path: cg.Path, Container: docker}
+	k.Decorate(cg)
+	if cg.Container != docker {
+		t.Errorf("expected existing container metadata to be kept, got %#v", cg.Container)
+	}
+
+	k.HandleEvent(&v1.Event{Type: v1.EventCgroupRemoved, Path: "/kubepods/burstable/pod" + testPodUID})
+	k.mu.Lock()
+	_, ok := k.pods[testPodUID]
+	k.mu.Unlock()
+	if ok {
+		t.Error("expected removed pod to be forgotten")
+	}
+}
+
+func TestKubernetesWithoutSource(t *testing.T) {
+	k := NewKubernetes("")
+	cg := &v1.Cgroup{Path: "/kubepods/besteffort/pod" + testPodUID + "/" + testContainerID}
+	k.Decorate(cg)
+	if !reflect.DeepEqual(cg.Pod, &v1.Pod{UID: testPodUID, QOSClass: v1.QOSBestEffort}) {
+		t.Errorf("unexpected pod: %#v", cg.Pod)
+	}
+	if !reflect.DeepEqual(cg.Container, &v1.Container{ID: testContainerID}) {
+		t.Errorf("unexpected container: %#v", cg.Container)
+	}
+
+	cg = &v1.Cgroup{Path: "/system.slice"}
+	k.Decorate(cg)
+	if cg.Pod != nil || cg.Container != nil {
+		t.Errorf("expected no metadata for non-pod cgroup, got %#v", cg)
+	}
+}
@@ -0,0 +1,242 @@
+// Package metadata attaches metadata about the containers running in cgroups,
+// such as container names and images, to the cgroups reported by a watcher.
+package metadata
+
+import (
+	"io"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// Provider supplies metadata for the cgroups it recognises. Providers
+// implementing io.Closer are closed when the watcher is stopped.
+type Provider interface {
+	// Decorate attaches any known metadata to cg. It must not block, so
+	// metadata not known yet is fetched in the background and attached on a
+	// later call.
+	Decorate(cg *v1.Cgroup)
+	// HandleEvent is called with every event published by the watcher, so
+	// metadata of created or removed cgroups can be invalidated.
+	HandleEvent(e *v1.Event)
+}
+
+// maxRemoved is the number of removed cgroups whose metadata is kept to
+// decorate the recently exited cgroups.
+const maxRemoved = 256
+
+// watcher decorates the cgroups returned by a cgroup.Watcher with metadata.
+type watcher struct {
+	cgroup.Watcher
+	providers []Provider
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	// removed holds the metadata of removed cgroups by path, captured before
+	// providers invalidate it, oldest first in removedOrder.
+	removedMu    sync.Mutex
+	removed      map[string]*v1.Cgroup
+	removedOrder []string
+}
+
+// NewWatcher returns a cgroup.Watcher attaching metadata from providers to
+// the cgroups returned by w.
+func NewWatcher(w cgroup.Watcher, providers ...Provider) cgroup.Watcher {
+	return &watcher{
+		Watcher:   w,
+		providers: providers,
+		done:      make(chan struct{}),
+		removed:   map[string]*v1.Cgroup{},
+	}
+}
+
+func (w *watcher) Start() error {
+	err := w.Watcher.Start()
+	if err != nil {
+		return err
+	}
+
+	w.wg.Add(1)
+	go w.handleEvents()
+
+	return nil
+}
+
+func (w *watcher) Stop() error {
+	close(w.done)
+	w.wg.Wait()
+	err := w.Watcher.Stop()
+	for _, p := range w.providers {
+		if c, ok := p.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func (w *watcher) handleEvents() {
+	defer w.wg.Done()
+
+	var since uint64
+	for {
+		events, cancel := w.Watcher.SubscribeEvents(since)
+		for open := true; open; {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					log.Warn("Metadata event subscription closed - resubscribing")
+					open = false
+					continue
+				}
+				since = e.Sequence
+				if e.Type == v1.EventCgroupRemoved {
+					w.captureRemoved(e)
+				}
+				for _, pe := range providerEvents(e) {
+					for _, p := range w.providers {
+						p.HandleEvent(pe)
+					}
+				}
+			case <-w.done:
+				cancel()
+				return
+			}
+		}
+		cancel()
+	}
+}
+
+// providerEvents returns the events handed to providers for e. Renames are
+// handed over as the removal of the old path and the creation of the new one,
+// so providers caching metadata by path only handle those.
+func providerEvents(e *v1.Event) []*v1.Event {
+	if e.Type != v1.EventCgroupRenamed {
+		return []*v1.Event{e}
+	}
+	removed, created := *e, *e
+	removed.Type, removed.Path, removed.OldPath = v1.EventCgroupRemoved, e.OldPath, ""
+	created.Type, created.OldPath = v1.EventCgroupCreated, ""
+	return []*v1.Event{&removed, &created}
+}
+
+func (w *watcher) decorate(cg *v1.Cgroup) {
+	for _, p := range w.providers {
+		p.Decorate(cg)
+	}
+}
+
+// captureRemoved keeps the metadata of a removed cgroup, which providers may
+// drop on handling the event, to decorate it once listed as exited.
+func (w *watcher) captureRemoved(e *v1.Event) {
+	cg := &v1.Cgroup{Path: e.Path}
+	if len(e.Subsystems) > 0 {
+		cg.Subsystem = e.Subsystems[0]
+	}
+	w.decorate(cg)
+	if cg.Container == nil && cg.Pod == nil && cg.Unit == nil {
+		return
+	}
+
+	w.removedMu.Lock()
+	defer w.removedMu.Unlock()
+	if _, ok := w.removed[e.Path]; !ok {
+		w.removedOrder = append(w.removedOrder, e.Path)
+	}
+	w.removed[e.Path] = cg
+	for len(w.removedOrder) > maxRemoved {
+		delete(w.removed, w.removedOrder[0])
+		w.removedOrder = w.removedOrder[1:]
+	}
+}
+
+func (w *watcher) Exited() []v1.ExitedCgroup {
+	exited := w.Watcher.Exited()
+
+	w.removedMu.Lock()
+	defer w.removedMu.Unlock()
+	for i := range exited {
+		e := &exited[i]
+		cg, ok := w.removed[e.Path]
+		if !ok {
+			// The removal event may not have been handled yet, in which
+			// case the providers still know the cgroup.
+			cg = &v1.Cgroup{Path: e.Path}
+			if len(e.Subsystems) > 0 {
+				cg.Subsystem = e.Subsystems[0]
+			}
+			w.decorate(cg)
+		}
+		e.Container, e.Pod, e.Unit = cg.Container, cg.Pod, cg.Unit
+	}
+	return exited
+}
+
+func (w *watcher) Lookup(subsystem, path string) (*v1.Cgroup, bool) {
+	cg, ok := w.Watcher.Lookup(subsystem, path)
+	if ok {
+		w.decorate(cg)
+	}
+	return cg, ok
+}
+
+func (w *watcher) Walk(fn func(cg *v1.Cgroup)) {
+	w.Watcher.Walk(func(cg *v1.Cgroup) {
+		w.decorate(cg)
+		fn(cg)
+	})
+}
+
+func (w *watcher) Snapshot() []*v1.Cgroup {
+	cgroups := w.Watcher.Snapshot()
+	for _, cg := range cgroups {
+		w.decorate(cg)
+	}
+	return cgroups
+}
+
+func (w *watcher) SubscribeStats() (<-chan *v1.StatsUpdate, func()) {
+	updates, cancel := w.Watcher.SubscribeStats()
+
+	ch := make(chan *v1.StatsUpdate, cap(updates))
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case update, ok := <-updates:
+				if !ok {
+					return
+				}
+				// Updates are shared between subscribers, so decorate a copy.
+				decorated := &v1.StatsUpdate{
+					Timestamp: update.Timestamp,
+					Cgroups:   make([]v1.Cgroup, len(update.Cgroups)),
+				}
+				copy(decorated.Cgroups, update.Cgroups)
+				for i := range decorated.Cgroups {
+					w.decorate(&decorated.Cgroups[i])
+				}
+				select {
+				case ch <- decorated:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package metadata
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
+)
+
+// fakeWatcher implements the parts of cgroup.Watcher decorated by the
+// metadata watcher; other methods panic.
+type fakeWatcher struct {
+	cgroup.Watcher
+	stats  chan *v1.StatsUpdate
+	events chan *v1.Event
+}
+
+func (f *fakeWatcher) Start() error { return nil }
+func (f *fakeWatcher) Stop() error  { return nil }
+
+func (f *fakeWatcher) Lookup(subsystem, path string) (*v1.Cgroup, bool) {
+	return &v1.Cgroup{Subsystem: subsystem, Path: path}, true
+}
+
+func (f *fakeWatcher) Walk(fn func(cg *v1.Cgroup)) {
+	fn(&v1.Cgroup{Subsystem: "memory", Path: "/a"})
+}
+
+func (f *fakeWatcher) SubscribeStats() (<-chan *v1.StatsUpdate, func()) {
+	return f.stats, func() {}
+}
+
+func (f *fakeWatcher) Exited() []v1.ExitedCgroup {
+	return []v1.ExitedCgroup{{Subsystems: []string{"memory"}, Path: "/c"}}
+}
+
+func (f *fakeWatcher) SubscribeEvents(since uint64) (<-chan *v1.Event, func()) {
+	return f.events, func() {}
+}
+
+// fakeProvider names every cgroup after its path and records events. Removed
+// cgroups are no longer decorated.
+type fakeProvider struct {
+	mu      sync.Mutex
+	events  []*v1.Event
+	removed map[string]bool
+}
+
+func (p *fakeProvider) Decorate(cg *v1.Cgroup) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.removed[cg.Path] {
+		cg.Container = &v1.Container{Name: cg.Path}
+	}
+}
+
+func (p *fakeProvider) HandleEvent(e *v1.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, e)
+	if e.Type == v1.EventCgroupRemoved {
+		p.removed[e.Path] = true
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	f := &fakeWatcher{
+		stats:  make(chan *v1.StatsUpdate, 1),
+		events: make(chan *v1.Event, 1),
+	}
+	p := &fakeProvider{removed: map[string]bool{}}
+	w := NewWatcher(f, p)
+	err := w.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	cg, ok := w.Lookup("memory", "/b")
+	if !ok || cg.Container == nil || cg.Container.Name != "/b" {
+		t.Errorf("expected decorated cgroup, got %#v", cg)
+	}
+
+	w.Walk(func(cg *v1.Cgroup) {
+		if cg.Container == nil || cg.Container.Name != "/a" {
+			t.Errorf("expected decorated cgroup, got %#v", cg)
+		}
+	})
+
+	updates, cancel := w.SubscribeStats()
+	defer cancel()
+	update := &v1.StatsUpdate{Cgroups: []v1.Cgroup{{Path: "/c"}}}
+	f.stats <- update
+	select {
+	case got := <-updates:
+		if got.Cgroups[0].Container == nil || got.Cgroups[0].Container.Name != "/c" {
+			t.Errorf("expected decorated update, got %#v", got.Cgroups[0])
+		}
+		if update.Cgroups[0].Container != nil {
+			t.Error("expected shared update not to be modified")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stats update")
+	}
+
+	f.events <- &v1.Event{Sequence: 1, Type: v1.EventCgroupRemoved, Path: "/c"}
+	timeout := time.After(5 * time.Second)
+	for {
+		p.mu.Lock()
+		n := len(p.events)
+		p.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for event to be handled")
+		}
+	}
+
+	exited := w.Exited()
+	if len(exited) != 1 || exited[0].Container == nil || exited[0].Container.Name != "/c" {
+		t.Errorf("expected exited cgroup decorated with metadata captured on removal, got %#v", exited)
+	}
+}
+
+func TestWatcherStopClosesProviders(t *testing.T) {
+	f := &fakeWatcher{
+		stats:  make(chan *v1.StatsUpdate, 1),
+		events: make(chan *v1.Event, 1),
+	}
+	conn := &fakeUnitProperties{}
+	s := &Systemd{conn: conn, units: map[string]*v1.Unit{}}
+	w := NewWatcher(f, &fakeProvider{removed: map[string]bool{}}, s)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.closed != 1 {
+		t.Errorf("expected the systemd provider to be closed on stopping, got %d closes", conn.closed)
+	}
+}
+
+func TestProviderEvents(t *testing.T) {
+	e := &v1.Event{Sequence: 3, Type: v1.EventCgroupRenamed, Subsystems: []string{"memory"}, Path: "/b", OldPath: "/a"}
+	events := providerEvents(e)
+	if len(events) != 2 {
+		t.Fatalf("expected rename to be handed over as 2 events, got %d", len(events))
+	}
+	if events[0].Type != v1.EventCgroupRemoved || events[0].Path != "/a" || events[0].OldPath != "" {
+		t.Errorf("expected removal of the old path, got %+v", events[0])
+	}
+	if events[1].Type != v1.EventCgroupCreated || events[1].Path != "/b" || events[1].OldPath != "" {
+		t.Errorf("expected creation of the new path, got %+v", events[1])
+	}
+	if e.Type != v1.EventCgroupRenamed || e.Path != "/b" {
+		t.Error("expected shared event not to be modified")
+	}
+
+	created := &v1.Event{Type: v1.EventCgroupCreated, Path: "/c"}
+	if events := providerEvents(created); len(events) != 1 || events[0] != created {
+		t.Errorf("expected other events to be handed over as is, got %+v", events)
+	}
+}
@@ -0,0 +1,196 @@
+package metadata
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	sddbus "github.com/coreos/go-systemd/dbus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// rootSlice is the slice top level units are placed in.
+const rootSlice = "-.slice"
+
+// unitTypes are the systemd unit types that have cgroups.
+var unitTypes = map[string]bool{
+	"service": true,
+	"scope":   true,
+	"slice":   true,
+	"socket":  true,
+	"mount":   true,
+	"swap":    true,
+}
+
+// unitType returns the type of the unit name, if name is a unit with a cgroup.
+func unitType(name string) (string, bool) {
+	ext := path.Ext(name)
+	if len(ext) < 2 || len(ext) == len(name) || !unitTypes[ext[1:]] {
+		return "", false
+	}
+	return ext[1:], true
+}
+
+// parseUnitPath decodes the systemd unit the cgroup at cgroupPath belongs to,
+// e.g. sshd.service for /system.slice/sshd.service, or session-3.scope for
+// /user.slice/user-1000.slice/session-3.scope. Cgroups nested below a unit's
+// cgroup belong to the innermost unit.
+func parseUnitPath(cgroupPath string) (v1.Unit, bool) {
+	var unit v1.Unit
+	slice := rootSlice
+	for _, segment := range strings.Split(strings.Trim(cgroupPath, "/"), "/") {
+		typ, ok := unitType(segment)
+		if !ok {
+			continue
+		}
+		if unit.Type == "slice" {
+			slice = unit.Name
+		}
+		unit = v1.Unit{Name: segment, Type: typ}
+	}
+	if unit.Name == "" {
+		return v1.Unit{}, false
+	}
+	unit.Slice = slice
+
+	prefix := strings.TrimSuffix(unit.Name, "."+unit.Type)
+	if i := strings.Index(prefix, "@"); i >= 0 {
+		unit.Template = prefix[:i]
+		unit.Instance = unescapeUnitName(prefix[i+1:])
+	}
+	return unit, true
+}
+
+// unescapeUnitName reverses the \xNN escaping systemd applies to characters
+// not allowed in unit names, as done by systemd-escape.
+func unescapeUnitName(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// unitProperties looks up the properties of systemd units, implemented by
+// go-systemd's dbus.Conn.
+type unitProperties interface {
+	GetUnitProperties(unit string) (map[string]interface{}, error)
+	Close()
+}
+
+// Systemd attributes cgroups to systemd units, optionally confirming the
+// units and looking up their description and state over D-Bus.
+type Systemd struct {
+	conn unitProperties
+
+	mu sync.Mutex
+	// units is keyed by unit name. A nil value means a lookup is in progress
+	// or the unit is not loaded.
+	units map[string]*v1.Unit
+	// closed is set once the D-Bus connection is closed, after which units
+	// are no longer looked up.
+	closed bool
+}
+
+// NewSystemd returns a provider attributing cgroups to systemd units. Units are
+// confirmed over the system D-Bus if useDBus is set, otherwise only the unit
+// decoded from the cgroup path is provided.
+func NewSystemd(useDBus bool) (*Systemd, error) {
+	s := &Systemd{units: map[string]*v1.Unit{}}
+	if useDBus {
+		conn, err := sddbus.New()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	return s, nil
+}
+
+// Decorate implements Provider.
+func (s *Systemd) Decorate(cg *v1.Cgroup) {
+	unit, ok := parseUnitPath(cg.Path)
+	if !ok {
+		return
+	}
+
+	if s.conn != nil {
+		s.mu.Lock()
+		confirmed, ok := s.units[unit.Name]
+		if !ok && !s.closed {
+			s.units[unit.Name] = nil
+			go s.fetch(unit)
+		}
+		s.mu.Unlock()
+		if confirmed != nil {
+			unit = *confirmed
+		}
+	}
+
+	cg.Unit = &unit
+}
+
+// Close closes the D-Bus connection, if any.
+func (s *Systemd) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.conn.Close()
+	}
+	return nil
+}
+
+// HandleEvent implements Provider.
+func (s *Systemd) HandleEvent(e *v1.Event) {
+	if e.Type != v1.EventCgroupCreated && e.Type != v1.EventCgroupRemoved {
+		return
+	}
+
+	unit, ok := parseUnitPath(e.Path)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.units, unit.Name)
+	s.mu.Unlock()
+}
+
+func (s *Systemd) fetch(unit v1.Unit) {
+	props, err := s.conn.GetUnitProperties(unit.Name)
+	if err != nil {
+		log.WithFields(log.Fields{"unit": unit.Name, "error": err}).Warn("Failed to get systemd unit properties")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		delete(s.units, unit.Name)
+		return
+	}
+	if state, _ := props["LoadState"].(string); state != "loaded" {
+		return
+	}
+	unit.Confirmed = true
+	unit.Description, _ = props["Description"].(string)
+	unit.ActiveState, _ = props["ActiveState"].(string)
+	s.units[unit.Name] = &unit
+}
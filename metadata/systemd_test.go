@@ -0,0 +1,156 @@
+package metadata
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+func TestParseUnitPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want v1.Unit
+		ok   bool
+	}{
+		{"/system.slice/sshd.service", v1.Unit{Name: "sshd.service", Type: "service", Slice: "system.slice"}, true},
+		{"/system.slice", v1.Unit{Name: "system.slice", Type: "slice", Slice: "-.slice"}, true},
+		{"/user.slice/user-1000.slice/session-3.scope", v1.Unit{Name: "session-3.scope", Type: "scope", Slice: "user-1000.slice"}, true},
+		{"/user.slice/user-1000.slice", v1.Unit{Name: "user-1000.slice", Type: "slice", Slice: "user.slice"}, true},
+		{"/system.slice/docker.service/nested", v1.Unit{Name: "docker.service", Type: "service", Slice: "system.slice"}, true},
+		{"/system.slice/system-getty.slice/getty@tty1.service", v1.Unit{Name: "getty@tty1.service", Type: "service", Slice: "system-getty.slice", Template: "getty", Instance: "tty1"}, true},
+		{
+			`/system.slice/system-systemd\x2dfsck.slice/systemd-fsck@dev-disk-by\x2duuid-1234.service`,
+			v1.Unit{Name: `systemd-fsck@dev-disk-by\x2duuid-1234.service`, Type: "service", Slice: `system-systemd\x2dfsck.slice`, Template: "systemd-fsck", Instance: "dev-disk-by-uuid-1234"},
+			true,
+		},
+		{"/init.scope", v1.Unit{Name: "init.scope", Type: "scope", Slice: "-.slice"}, true},
+		{"/", v1.Unit{}, false},
+		{"/docker/" + testContainerID, v1.Unit{}, false},
+		{"/kubepods/burstable/pod" + testPodUID, v1.Unit{}, false},
+		{"/.service", v1.Unit{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseUnitPath(test.path)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v (%v), got %#v (%v)", test.path, test.want, test.ok, got, ok)
+		}
+	}
+}
+
+func TestUnescapeUnitName(t *testing.T) {
+	for s, want := range map[string]string{
+		"tty1":           "tty1",
+		`a\x2db`:         "a-b",
+		`\x2f\x2F`:       "//",
+		`trailing\x2`:    `trailing\x2`,
+		`invalid\xzz`:    `invalid\xzz`,
+		`\x5cx41\x41end`: `\x41Aend`,
+	} {
+		if got := unescapeUnitName(s); got != want {
+			t.Errorf("%s: expected %q, got %q", s, want, got)
+		}
+	}
+}
+
+// fakeUnitProperties returns properties of loaded units ending in .service.
+type fakeUnitProperties struct {
+	calls  int32
+	fail   bool
+	closed int32
+}
+
+func (f *fakeUnitProperties) Close() {
+	atomic.AddInt32(&f.closed, 1)
+}
+
+func (f *fakeUnitProperties) GetUnitProperties(unit string) (map[string]interface{}, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if f.fail {
+		return nil, errors.New("no bus")
+	}
+	if unit != "sshd.service" {
+		return map[string]interface{}{"LoadState": "not-found"}, nil
+	}
+	return map[string]interface{}{
+		"LoadState":   "loaded",
+		"ActiveState": "active",
+		"Description": "OpenSSH server daemon",
+	}, nil
+}
+
+func TestSystemdDBus(t *testing.T) {
+	conn := &fakeUnitProperties{}
+	s := &Systemd{conn: conn, units: map[string]*v1.Unit{}}
+
+	cg := &v1.Cgroup{Path: "/system.slice/sshd.service"}
+	timeout := time.After(5 * time.Second)
+	for {
+		s.Decorate(cg)
+		if cg.Unit == nil {
+			t.Fatal("expected unit decoded from path")
+		}
+		if cg.Unit.Confirmed {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for unit to be confirmed")
+		}
+	}
+	want := &v1.Unit{Name: "sshd.service", Type: "service", Slice: "system.slice", Confirmed: true, Description: "OpenSSH server daemon", ActiveState: "active"}
+	if !reflect.DeepEqual(cg.Unit, want) {
+		t.Errorf("expected %#v, got %#v", want, cg.Unit)
+	}
+
+	// Units that are not loaded are not confirmed, and not looked up again.
+	unknown := &v1.Cgroup{Path: "/system.slice/gone.service"}
+	s.Decorate(unknown)
+	time.Sleep(100 * time.Millisecond)
+	s.Decorate(unknown)
+	if unknown.Unit == nil || unknown.Unit.Confirmed {
+		t.Errorf("expected unconfirmed unit, got %#v", unknown.Unit)
+	}
+	if calls := atomic.LoadInt32(&conn.calls); calls != 2 {
+		t.Errorf("expected 2 lookups, got %d", calls)
+	}
+
+	s.HandleEvent(&v1.Event{Type: v1.EventCgroupRemoved, Path: "/system.slice/sshd.service"})
+	s.mu.Lock()
+	_, ok := s.units["sshd.service"]
+	s.mu.Unlock()
+	if ok {
+		t.Error("expected removed unit to be forgotten")
+	}
+
+	// Units are no longer looked up once closed.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if closed := atomic.LoadInt32(&conn.closed); closed != 1 {
+		t.Errorf("expected the connection to be closed once, got %d", closed)
+	}
+	s.Decorate(cg)
+	time.Sleep(100 * time.Millisecond)
+	if calls := atomic.LoadInt32(&conn.calls); calls != 2 {
+		t.Errorf("expected no lookups once closed, got %d", calls-2)
+	}
+}
+
+func TestSystemdWithoutDBus(t *testing.T) {
+	s, err := NewSystemd(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cg := &v1.Cgroup{Path: "/system.slice/sshd.service"}
+	s.Decorate(cg)
+	if !reflect.DeepEqual(cg.Unit, &v1.Unit{Name: "sshd.service", Type: "service", Slice: "system.slice"}) {
+		t.Errorf("unexpected unit: %#v", cg.Unit)
+	}
+}
@@ -1,7 +1,14 @@
 package node
 
-import "github.com/jimmidyson/wurzel/api/v1"
-import "github.com/shirou/gopsutil/cpu"
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/shirou/gopsutil/cpu"
+)
 
 // CPUInfo returns informaiton about the CPUs on the node.
 func CPUInfo() ([]v1.NodeCPUInfo, error) {
@@ -60,3 +67,113 @@ func CPUTime() ([]v1.CPUTime, error) {
 
 	return ret, nil
 }
+
+// CPUSampler samples the CPU times of the node, serving the utilization of
+// each CPU between the two latest samples to every caller, so callers do not
+// disturb each other's measurements. It is safe for concurrent use.
+type CPUSampler struct {
+	mu          sync.Mutex
+	prev        map[string]v1.CPUTime
+	utilization []v1.CPUUtilization
+}
+
+// NewCPUSampler returns a CPUSampler. The first sample reports the
+// utilization since boot.
+func NewCPUSampler() *CPUSampler {
+	return &CPUSampler{prev: map[string]v1.CPUTime{}}
+}
+
+// Sample samples the CPU times, updating the utilization served to that since
+// the previous sample.
+func (s *CPUSampler) Sample() error {
+	times, err := CPUTime()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]v1.CPUUtilization, 0, len(times))
+	prev := make(map[string]v1.CPUTime, len(times))
+	for _, cur := range times {
+		prev[cur.CPU] = cur
+		ret = append(ret, utilization(s.prev[cur.CPU], cur))
+	}
+	s.prev, s.utilization = prev, ret
+
+	return nil
+}
+
+// Run samples the CPU times each interval until done is closed.
+func (s *CPUSampler) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sample(); err != nil {
+			log.WithField("error", err).Warn("Failed to sample node CPU times")
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Utilization returns the utilization of each CPU between the two latest
+// samples, taking the first sample if none was taken yet.
+func (s *CPUSampler) Utilization() ([]v1.CPUUtilization, error) {
+	s.mu.Lock()
+	sampled := s.utilization != nil
+	s.mu.Unlock()
+	if !sampled {
+		if err := s.Sample(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]v1.CPUUtilization(nil), s.utilization...), nil
+}
+
+// utilization returns the percentage of time spent in each state between two
+// samples. A sample with counters lower than prev, e.g. after a CPU was
+// hotplugged, is compared against zero instead.
+func utilization(prev, cur v1.CPUTime) v1.CPUUtilization {
+	if cpuTotal(cur) < cpuTotal(prev) || cur.Idle < prev.Idle {
+		prev = v1.CPUTime{}
+	}
+	u := v1.CPUUtilization{CPU: cur.CPU}
+	total := cpuTotal(cur) - cpuTotal(prev)
+	if total <= 0 {
+		return u
+	}
+
+	percent := func(prev, cur float64) float64 {
+		if cur < prev {
+			return 0
+		}
+		return (cur - prev) / total * 100
+	}
+	u.User = percent(prev.User, cur.User)
+	u.System = percent(prev.System, cur.System)
+	u.Nice = percent(prev.Nice, cur.Nice)
+	u.Iowait = percent(prev.Iowait, cur.Iowait)
+	u.Irq = percent(prev.Irq, cur.Irq)
+	u.Softirq = percent(prev.Softirq, cur.Softirq)
+	u.Steal = percent(prev.Steal, cur.Steal)
+	u.Idle = percent(prev.Idle, cur.Idle)
+	u.Busy = 100 - u.Idle - u.Iowait
+	if u.Busy < 0 {
+		u.Busy = 0
+	}
+	return u
+}
+
+// cpuTotal returns the total time of a CPU. Guest time is already included in
+// user time.
+func cpuTotal(t v1.CPUTime) float64 {
+	return t.User + t.System + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal + t.Idle
+}
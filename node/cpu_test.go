@@ -1,6 +1,11 @@
 package node
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
 
 func TestCPUInfo(t *testing.T) {
 	v, err := CPUInfo()
@@ -49,3 +54,61 @@ func BenchmarkCPUTime(b *testing.B) {
 		}
 	}
 }
+
+func TestCPUSampler(t *testing.T) {
+	s := NewCPUSampler()
+	for i := 0; i < 2; i++ {
+		v, err := s.Utilization()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) == 0 {
+			t.Fatal("could not get CPU utilization")
+		}
+		for _, u := range v {
+			if u.Busy < 0 || u.Busy > 100 || u.Idle < 0 || u.Idle > 100 {
+				t.Errorf("invalid CPU utilization: %v", u)
+			}
+		}
+	}
+}
+
+func TestCPUSamplerCached(t *testing.T) {
+	s := NewCPUSampler()
+	first, err := s.Utilization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without sampling, every consumer is served the same utilization.
+	second, err := s.Utilization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected cached utilization %v, got %v", first, second)
+	}
+	if err := s.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Utilization(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	prev := v1.CPUTime{CPU: "cpu0", User: 10, System: 5, Idle: 80, Iowait: 5}
+	cur := v1.CPUTime{CPU: "cpu0", User: 40, System: 15, Idle: 130, Iowait: 15}
+
+	got := utilization(prev, cur)
+	want := v1.CPUUtilization{CPU: "cpu0", Busy: 40, User: 30, System: 10, Idle: 50, Iowait: 10}
+	if got != want {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Reset counters are compared against zero.
+	got = utilization(cur, prev)
+	want = v1.CPUUtilization{CPU: "cpu0", Busy: 15, User: 10, System: 5, Idle: 80, Iowait: 5}
+	if got != want {
+		t.Errorf("expected %v after reset, got %v", want, got)
+	}
+}
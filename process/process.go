@@ -1,10 +1,24 @@
 package process
 
 import (
+	"fmt"
+	"sort"
+
 	"github.com/jimmidyson/wurzel/api/v1"
+	"github.com/jimmidyson/wurzel/cgroup"
 	"github.com/shirou/gopsutil/process"
 )
 
+// OptionsError is returned for invalid process list options.
+type OptionsError struct {
+	Message string
+}
+
+// Error implements the error interface.
+func (e *OptionsError) Error() string {
+	return e.Message
+}
+
 // IDs returns all the current running process IDs.
 func IDs() ([]int32, error) {
 	return process.Pids()
@@ -24,99 +38,355 @@ func List() ([]v1.Process, error) {
 			continue
 		}
 
-		name, err := p.Name()
+		proc, err := describe(p)
 		if err != nil {
 			continue
 		}
 
-		status, err := p.Status()
+		processes = append(processes, *proc)
+	}
+
+	return processes, nil
+}
+
+// ListNames returns information about the processes named any of names,
+// scanning the processes once however many names are given.
+func ListNames(names []string) ([]v1.Process, error) {
+	pids, err := IDs()
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var processes []v1.Process
+	for _, pid := range pids {
+		p, err := process.NewProcess(pid)
 		if err != nil {
 			continue
 		}
 
-		uids, err := p.Uids()
-		if err != nil && !isNotImplementedError(err) {
+		name, err := p.Name()
+		if err != nil || !wanted[name] {
 			continue
 		}
 
-		gids, err := p.Gids()
-		if err != nil && !isNotImplementedError(err) {
+		proc, err := describe(p)
+		if err != nil {
 			continue
 		}
 
-		threads, err := p.NumThreads()
-		if err != nil && !isNotImplementedError(err) {
+		processes = append(processes, *proc)
+	}
+
+	return processes, nil
+}
+
+// Get returns information about a single process.
+func Get(pid int32) (*v1.Process, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	return describe(p)
+}
+
+// Query returns the processes matching the filters in opts, sorted and
+// paginated as requested. Only the returned page of processes is fully
+// described unless sorting requires CPU or memory info for every match.
+func Query(opts v1.ProcessListOptions) (*v1.ProcessList, error) {
+	pids, err := IDs()
+	if err != nil {
+		return nil, err
+	}
+	return QueryPIDs(pids, opts)
+}
+
+// QueryPIDs is like Query, but only considers the given processes, e.g. the
+// processes of a cgroup. Processes that have exited are skipped.
+func QueryPIDs(pids []int32, opts v1.ProcessListOptions) (*v1.ProcessList, error) {
+	var less func(a, b *v1.Process) bool
+	switch opts.SortBy {
+	case "", v1.SortByPID:
+	case v1.SortByCPU:
+		less = func(a, b *v1.Process) bool { return cpuTotal(a) > cpuTotal(b) }
+	case v1.SortByRSS:
+		less = func(a, b *v1.Process) bool { return rss(a) > rss(b) }
+	default:
+		return nil, &OptionsError{fmt.Sprintf("invalid sort order %q", opts.SortBy)}
+	}
+
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, &OptionsError{"offset and limit must not be negative"}
+	}
+
+	sorted := make([]int32, len(pids))
+	copy(sorted, pids)
+	sort.Sort(byPID(sorted))
+	pids = sorted
+
+	matched := make([]*process.Process, 0, len(pids))
+	for _, pid := range pids {
+		p, err := process.NewProcess(pid)
+		if err != nil {
 			continue
 		}
 
-		memoryInfo, err := p.MemoryInfo()
-		if err != nil && !isNotImplementedError(err) {
-			continue
+		if matches(p, opts) {
+			matched = append(matched, p)
 		}
-		var memory *v1.ProcessMemory
-		if memoryInfo != nil {
-			memory = &v1.ProcessMemory{
-				RSS:  memoryInfo.RSS,
-				VMS:  memoryInfo.VMS,
-				Swap: memoryInfo.Swap,
+	}
+
+	list := &v1.ProcessList{
+		Total:     len(matched),
+		Offset:    opts.Offset,
+		Processes: []v1.Process{},
+	}
+
+	if less == nil {
+		// Only the page is described, so processes exiting before being
+		// described are replaced by the following matches and only
+		// dropped from the total if on the page.
+		start, _ := pageBounds(len(matched), opts)
+		for _, p := range matched[start:] {
+			if opts.Limit > 0 && len(list.Processes) == opts.Limit {
+				break
+			}
+			proc, err := describe(p)
+			if err != nil {
+				list.Total--
+				continue
 			}
+			list.Processes = append(list.Processes, *proc)
 		}
+		attachCgroups(list.Processes, opts)
+		return list, nil
+	}
 
-		memoryInfoEx, err := p.MemoryInfoEx()
-		if err != nil && !isNotImplementedError(err) {
+	described := make([]*v1.Process, 0, len(matched))
+	for _, p := range matched {
+		proc, err := describe(p)
+		if err != nil {
 			continue
 		}
-		var memoryEx *v1.ProcessMemoryEx
-		if memoryInfoEx != nil {
-			memoryEx = &v1.ProcessMemoryEx{
-				RSS:    memoryInfoEx.RSS,
-				VMS:    memoryInfoEx.VMS,
-				Shared: memoryInfoEx.Shared,
-				Text:   memoryInfoEx.Text,
-				Lib:    memoryInfoEx.Lib,
-				Data:   memoryInfoEx.Data,
-				Dirty:  memoryInfoEx.Dirty,
-			}
-		}
+		described = append(described, proc)
+	}
+	sort.Stable(processSorter{p: described, less: less})
+	list.Total = len(described)
 
-		cpuTime, err := p.CPUTimes()
-		if err != nil && !isNotImplementedError(err) {
+	start, end := pageBounds(len(described), opts)
+	for _, proc := range described[start:end] {
+		list.Processes = append(list.Processes, *proc)
+	}
+	attachCgroups(list.Processes, opts)
+
+	return list, nil
+}
+
+// attachCgroups sets the cgroups of processes if requested by opts, sorted by
+// subsystem. Processes that have exited are left without cgroups.
+func attachCgroups(processes []v1.Process, opts v1.ProcessListOptions) {
+	if !opts.Cgroups {
+		return
+	}
+	for i := range processes {
+		paths, err := cgroup.ProcessCgroupPaths(processes[i].Pid)
+		if err != nil {
 			continue
 		}
-		var cpu *v1.CPUTime
-		if cpuTime != nil {
-			cpu = &v1.CPUTime{
-				CPU:       cpuTime.CPU,
-				User:      cpuTime.User,
-				System:    cpuTime.System,
-				Idle:      cpuTime.Idle,
-				Nice:      cpuTime.Nice,
-				Iowait:    cpuTime.Iowait,
-				Irq:       cpuTime.Irq,
-				Softirq:   cpuTime.Softirq,
-				Steal:     cpuTime.Steal,
-				Guest:     cpuTime.Guest,
-				GuestNice: cpuTime.GuestNice,
-				Stolen:    cpuTime.Stolen,
+		subsystems := make([]string, 0, len(paths))
+		for subsystem := range paths {
+			subsystems = append(subsystems, subsystem)
+		}
+		sort.Strings(subsystems)
+
+		cgroups := make([]v1.ProcessCgroup, 0, len(paths))
+		for _, subsystem := range subsystems {
+			cgroups = append(cgroups, v1.ProcessCgroup{Subsystem: subsystem, Path: paths[subsystem]})
+		}
+		processes[i].Cgroups = cgroups
+	}
+}
+
+func matches(p *process.Process, opts v1.ProcessListOptions) bool {
+	if opts.Name != "" {
+		name, err := p.Name()
+		if err != nil || name != opts.Name {
+			return false
+		}
+	}
+
+	if opts.Status != "" {
+		status, err := p.Status()
+		if err != nil || status != opts.Status {
+			return false
+		}
+	}
+
+	if opts.UID != nil {
+		uids, err := p.Uids()
+		if err != nil {
+			return false
+		}
+		// uids are real, effective, saved & filesystem.
+		found := false
+		for i := 0; i < len(uids) && i < 2; i++ {
+			if uids[i] == *opts.UID {
+				found = true
 			}
 		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
 
-		processes = append(processes, v1.Process{
-			Pid:      p.Pid,
-			Name:     name,
-			Status:   status,
-			Uids:     uids,
-			Gids:     gids,
-			Threads:  threads,
-			Memory:   memory,
-			MemoryEx: memoryEx,
-			CPUTime:  cpu,
-		})
+func pageBounds(total int, opts v1.ProcessListOptions) (int, int) {
+	start := opts.Offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
 	}
+	return start, end
+}
 
-	return processes, nil
+func describe(p *process.Process) (*v1.Process, error) {
+	name, err := p.Name()
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := p.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	uids, err := p.Uids()
+	if err != nil && !isNotImplementedError(err) {
+		return nil, err
+	}
+
+	gids, err := p.Gids()
+	if err != nil && !isNotImplementedError(err) {
+		return nil, err
+	}
+
+	threads, err := p.NumThreads()
+	if err != nil && !isNotImplementedError(err) {
+		return nil, err
+	}
+
+	memoryInfo, err := p.MemoryInfo()
+	if err != nil && !isNotImplementedError(err) {
+		return nil, err
+	}
+	var memory *v1.ProcessMemory
+	if memoryInfo != nil {
+		memory = &v1.ProcessMemory{
+			RSS:  memoryInfo.RSS,
+			VMS:  memoryInfo.VMS,
+			Swap: memoryInfo.Swap,
+		}
+	}
+
+	memoryInfoEx, err := p.MemoryInfoEx()
+	if err != nil && !isNotImplementedError(err) {
+		return nil, err
+	}
+	var memoryEx *v1.ProcessMemoryEx
+	if memoryInfoEx != nil {
+		memoryEx = &v1.ProcessMemoryEx{
+			RSS:    memoryInfoEx.RSS,
+			VMS:    memoryInfoEx.VMS,
+			Shared: memoryInfoEx.Shared,
+			Text:   memoryInfoEx.Text,
+			Lib:    memoryInfoEx.Lib,
+			Data:   memoryInfoEx.Data,
+			Dirty:  memoryInfoEx.Dirty,
+		}
+	}
+
+	cpuTime, err := p.CPUTimes()
+	if err != nil && !isNotImplementedError(err) {
+		return nil, err
+	}
+	var cpu *v1.CPUTime
+	if cpuTime != nil {
+		cpu = &v1.CPUTime{
+			CPU:       cpuTime.CPU,
+			User:      cpuTime.User,
+			System:    cpuTime.System,
+			Idle:      cpuTime.Idle,
+			Nice:      cpuTime.Nice,
+			Iowait:    cpuTime.Iowait,
+			Irq:       cpuTime.Irq,
+			Softirq:   cpuTime.Softirq,
+			Steal:     cpuTime.Steal,
+			Guest:     cpuTime.Guest,
+			GuestNice: cpuTime.GuestNice,
+			Stolen:    cpuTime.Stolen,
+		}
+	}
+
+	created, err := p.CreateTime()
+	if err != nil && !isNotImplementedError(err) {
+		return nil, err
+	}
+
+	proc := &v1.Process{
+		Pid:      p.Pid,
+		Name:     name,
+		Status:   status,
+		Uids:     uids,
+		Gids:     gids,
+		Threads:  threads,
+		Created:  created,
+		Memory:   memory,
+		MemoryEx: memoryEx,
+		CPUTime:  cpu,
+	}
+	proc.CPUPercent = cpuPercent(proc)
+	return proc, nil
+}
+
+func cpuTotal(p *v1.Process) float64 {
+	if p.CPUTime == nil {
+		return 0
+	}
+	return p.CPUTime.User + p.CPUTime.System
 }
 
+func rss(p *v1.Process) uint64 {
+	if p.Memory == nil {
+		return 0
+	}
+	return p.Memory.RSS
+}
+
+type byPID []int32
+
+func (s byPID) Len() int           { return len(s) }
+func (s byPID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPID) Less(i, j int) bool { return s[i] < s[j] }
+
+type processSorter struct {
+	p    []*v1.Process
+	less func(a, b *v1.Process) bool
+}
+
+func (s processSorter) Len() int           { return len(s.p) }
+func (s processSorter) Swap(i, j int)      { s.p[i], s.p[j] = s.p[j], s.p[i] }
+func (s processSorter) Less(i, j int) bool { return s.less(s.p[i], s.p[j]) }
+
 func isNotImplementedError(err error) bool {
 	return err != nil && err.Error() == "not implemented yet"
 }
@@ -1,6 +1,12 @@
 package process
 
-import "testing"
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
 
 func TestIDs(t *testing.T) {
 	v, err := IDs()
@@ -47,3 +53,154 @@ func BenchmarkList(b *testing.B) {
 		}
 	}
 }
+
+func TestGet(t *testing.T) {
+	pid := int32(os.Getpid())
+	v, err := Get(pid)
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	if v.Pid != pid || v.Name == "" {
+		t.Errorf("could not get Process: %#v", v)
+	}
+
+	_, err = Get(-1)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	all, err := Query(v1.ProcessListOptions{})
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	if all.Total == 0 || len(all.Processes) != all.Total {
+		t.Fatalf("could not query Processes: %#v", all)
+	}
+	for i := 1; i < len(all.Processes); i++ {
+		if all.Processes[i-1].Pid >= all.Processes[i].Pid {
+			t.Errorf("processes not sorted by pid: %d before %d", all.Processes[i-1].Pid, all.Processes[i].Pid)
+		}
+	}
+
+	page, err := Query(v1.ProcessListOptions{Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	if len(page.Processes) > 1 || page.Offset != 1 {
+		t.Errorf("could not paginate Processes: %#v", page)
+	}
+
+	self, err := Get(int32(os.Getpid()))
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	uid := int32(os.Getuid())
+	named, err := Query(v1.ProcessListOptions{Name: self.Name, UID: &uid, SortBy: v1.SortByRSS})
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	found := false
+	for i, p := range named.Processes {
+		if p.Name != self.Name {
+			t.Errorf("unexpected Process name: %#v", p)
+		}
+		if p.Pid == self.Pid {
+			found = true
+		}
+		if i > 0 && named.Processes[i-1].Memory.RSS < p.Memory.RSS {
+			t.Errorf("processes not sorted by rss: %#v", named.Processes)
+		}
+	}
+	if !found {
+		t.Errorf("could not find own Process in %#v", named)
+	}
+
+	_, err = Query(v1.ProcessListOptions{SortBy: "invalid"})
+	if err == nil {
+		t.Errorf("expected error for invalid sort order")
+	}
+
+	withCgroups, err := QueryPIDs([]int32{self.Pid}, v1.ProcessListOptions{Cgroups: true})
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	if len(withCgroups.Processes) != 1 || len(withCgroups.Processes[0].Cgroups) == 0 {
+		t.Errorf("expected the cgroups of own Process, got %#v", withCgroups)
+	}
+	if all.Processes[0].Cgroups != nil {
+		t.Errorf("expected no cgroups unless requested, got %#v", all.Processes[0].Cgroups)
+	}
+}
+
+func TestListNames(t *testing.T) {
+	self, err := Get(int32(os.Getpid()))
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	v, err := ListNames([]string{"nonexistent-process", self.Name})
+	if err != nil {
+		t.Fatalf("error %v", err)
+	}
+	found := false
+	for _, p := range v {
+		if p.Name != self.Name {
+			t.Errorf("unexpected Process name: %#v", p)
+		}
+		if p.Pid == self.Pid {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("could not find own Process in %#v", v)
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, err := Query(v1.ProcessListOptions{Limit: 10})
+		if err != nil {
+			b.Errorf("error %v", err)
+		}
+	}
+}
+
+func TestCPUPercentBetween(t *testing.T) {
+	now := time.Now()
+	prev := cpuSample{created: 1, cpu: 2, time: now}
+	if got := cpuPercentBetween(prev, cpuSample{created: 1, cpu: 3.5, time: now.Add(2 * time.Second)}); got != 75 {
+		t.Errorf("expected 75, got %v", got)
+	}
+
+	// A new process reusing the pid starts over.
+	if got := cpuPercentBetween(prev, cpuSample{created: 2, cpu: 5, time: now.Add(4 * time.Second)}); got != 0 {
+		t.Errorf("expected 0 for reused pid, got %v", got)
+	}
+}
+
+func TestSampleCPU(t *testing.T) {
+	self := &v1.Process{Pid: int32(os.Getpid())}
+	for i := 0; i < 2; i++ {
+		if err := SampleCPU(); err != nil {
+			t.Fatal(err)
+		}
+		p, err := Get(self.Pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		self = p
+	}
+	if self.CPUPercent < 0 {
+		t.Errorf("invalid CPU usage %v", self.CPUPercent)
+	}
+
+	// Describing processes does not sample, so repeated lookups agree.
+	again, err := Get(self.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.CPUPercent != self.CPUPercent {
+		t.Errorf("expected the CPU usage of the latest sample %v, got %v", self.CPUPercent, again.CPUPercent)
+	}
+}
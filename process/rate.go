@@ -0,0 +1,104 @@
+package process
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/jimmidyson/wurzel/api/v1"
+)
+
+// cpuSample is the CPU time of a process when last sampled, with its CPU
+// usage since the sample before.
+type cpuSample struct {
+	// created distinguishes processes reusing a pid.
+	created int64
+	cpu     float64
+	time    time.Time
+	percent float64
+}
+
+var (
+	cpuSamplesMu sync.RWMutex
+	cpuSamples   = map[int32]cpuSample{}
+)
+
+// SampleCPU samples the CPU time of every process, deriving the CPU usage
+// since the previous sample reported by List, Get and Query until the next
+// sample. Describing processes never samples, so consumers do not disturb
+// each other's measurements; a single loop samples instead, see
+// RunCPUSampling.
+func SampleCPU() error {
+	pids, err := IDs()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	samples := make(map[int32]cpuSample, len(pids))
+	for _, pid := range pids {
+		p, err := process.NewProcess(pid)
+		if err != nil {
+			continue
+		}
+		times, err := p.CPUTimes()
+		if err != nil {
+			continue
+		}
+		created, _ := p.CreateTime()
+		samples[pid] = cpuSample{created: created, cpu: times.User + times.System, time: now}
+	}
+
+	cpuSamplesMu.Lock()
+	defer cpuSamplesMu.Unlock()
+	for pid, cur := range samples {
+		if prev, ok := cpuSamples[pid]; ok {
+			cur.percent = cpuPercentBetween(prev, cur)
+			samples[pid] = cur
+		}
+	}
+	// Exited processes are dropped.
+	cpuSamples = samples
+	return nil
+}
+
+// RunCPUSampling samples the CPU time of every process each interval until
+// done is closed.
+func RunCPUSampling(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := SampleCPU(); err != nil {
+			log.WithField("error", err).Warn("Failed to sample process CPU times")
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// cpuPercent returns the CPU used by p between the two latest samples, as a
+// percentage of a single core, or 0 if p has not been sampled twice.
+func cpuPercent(p *v1.Process) float64 {
+	cpuSamplesMu.RLock()
+	defer cpuSamplesMu.RUnlock()
+	s, ok := cpuSamples[p.Pid]
+	if !ok || s.created != p.Created {
+		return 0
+	}
+	return s.percent
+}
+
+// cpuPercentBetween returns the CPU used between two samples of a process as a
+// percentage of a single core, 0 if the pid was reused or the CPU time reset.
+func cpuPercentBetween(prev, cur cpuSample) float64 {
+	seconds := cur.time.Sub(prev.time).Seconds()
+	if prev.created != cur.created || cur.cpu < prev.cpu || seconds <= 0 {
+		return 0
+	}
+	return (cur.cpu - prev.cpu) / seconds * 100
+}